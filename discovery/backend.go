@@ -0,0 +1,89 @@
+package discovery
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// 服务发现后端按地址中的scheme选择，例如"etcd://127.0.0.1:2379"
+// 后端包在init中调用RegisterBackend注册，使用时需要导入对应的包，没有scheme的地址使用memsd
+
+const (
+	DefaultScheme = "memsd" // 地址中没有scheme时使用的后端
+)
+
+// BackendConfig 是创建服务发现后端的通用参数
+type BackendConfig struct {
+	Address   string      // 去掉scheme后的地址，多个地址使用逗号分隔
+	ClientID  string      // 客户端身份
+	Secret    string      // 客户端密钥
+	Namespace string      // 命名空间
+	TLS       *tls.Config // 设置后使用TLS连接
+}
+
+// BackendCreator 创建服务发现后端，需要在ctx结束前完成连接及初始数据拉取
+type BackendCreator func(ctx context.Context, config *BackendConfig) (Discovery, error)
+
+var (
+	creatorByScheme      = map[string]BackendCreator{}
+	creatorBySchemeGuard sync.RWMutex
+)
+
+// RegisterBackend 注册服务发现后端，重复注册时panic
+// 参数:
+//   - scheme: 地址中的scheme，例如"etcd"
+//   - creator: 创建函数
+func RegisterBackend(scheme string, creator BackendCreator) {
+
+	creatorBySchemeGuard.Lock()
+	defer creatorBySchemeGuard.Unlock()
+
+	if _, ok := creatorByScheme[scheme]; ok {
+		panic("duplicate discovery backend: " + scheme)
+	}
+
+	creatorByScheme[scheme] = creator
+}
+
+// ParseAddress 拆分地址中的scheme
+// 参数:
+//   - sdaddr: 服务发现地址，例如"etcd://127.0.0.1:2379"
+// 返回:
+//   - scheme: 地址中的scheme，没有时为DefaultScheme
+//   - addr: 去掉scheme后的地址
+func ParseAddress(sdaddr string) (scheme, addr string) {
+
+	if index := strings.Index(sdaddr, "://"); index >= 0 {
+		return sdaddr[:index], sdaddr[index+3:]
+	}
+
+	return DefaultScheme, sdaddr
+}
+
+// NewBackend 按地址中的scheme创建服务发现后端
+// 参数:
+//   - ctx: 控制连接的取消及截止时间
+//   - sdaddr: 服务发现地址，覆盖config.Address
+//   - config: 通用参数
+// 返回:
+//   - Discovery: 服务发现实例
+//   - error: scheme没有注册或连接失败时返回错误信息
+func NewBackend(ctx context.Context, sdaddr string, config BackendConfig) (Discovery, error) {
+
+	scheme, addr := ParseAddress(sdaddr)
+
+	creatorBySchemeGuard.RLock()
+	creator, ok := creatorByScheme[scheme]
+	creatorBySchemeGuard.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown discovery scheme '%s', forget to import the backend package?", scheme)
+	}
+
+	config.Address = addr
+
+	return creator(ctx, &config)
+}
@@ -0,0 +1,27 @@
+package discovery
+
+import "errors"
+
+const (
+	// MaxValueSize 单个配置值的最大字节数，更大的值需要使用SafeSetValue分块保存
+	MaxValueSize = 512 * 1024
+
+	// ServiceKeyPrefix 服务描述在KV存储中的键前缀，各后端使用相同的前缀
+	ServiceKeyPrefix = "_svcdesc_"
+)
+
+// 各服务发现后端共用的错误值，调用方可以不区分后端比较错误
+var (
+	ErrValueNotExists   = errors.New("value not exists")
+	ErrValueTooLarge    = errors.New("value too large")
+	ErrRevisionMismatch = errors.New("revision mismatch")
+	ErrInvalidRequest   = errors.New("invalid request")
+)
+
+// PrettyPrintOption 是带有格式化输出选项的SetValue选项，各后端的Option实现了该接口
+// 不关心后端的实现(如localsd)通过此接口读取其他后端的选项
+type PrettyPrintOption interface {
+
+	// IsPrettyPrint 是否使用格式化输出（JSON缩进）
+	IsPrettyPrint() bool
+}
@@ -1,5 +1,7 @@
 package discovery
 
+import "context"
+
 // ValueMeta 表示键值对配置的元数据信息
 // 用于在服务发现系统中存储和传递配置数据
 type ValueMeta struct {
@@ -50,6 +52,19 @@ type Discovery interface {
 	//   - c: 之前注册的通知channel
 	DeregisterNotify(mode string, c chan struct{})
 
+	// WatchService 侦听服务的变化事件
+	// 与RegisterNotify不同，每次服务新增、变化、移除都会收到一个带有服务描述的事件
+	// 参数:
+	//   - name: 服务名称，支持通配符，例如"*"表示侦听所有服务
+	// 返回:
+	//   - ret: 用于接收服务事件的channel
+	WatchService(name string) (ret chan ServiceEvent)
+
+	// UnwatchService 解除服务变化事件的侦听
+	// 参数:
+	//   - c: 之前WatchService返回的channel
+	UnwatchService(c chan ServiceEvent)
+
 	// SetValue 在服务发现系统中设置一个配置值
 	// 参数:
 	//   - key: 配置项的键名
@@ -75,6 +90,136 @@ type Discovery interface {
 	DeleteValue(key string) error
 }
 
+// DiscoveryCtx 是支持context.Context的服务发现接口
+// 所有调用都可以通过ctx取消或设置截止时间，适合需要快速失败的场景，如启动脚本、健康检查
+type DiscoveryCtx interface {
+	Discovery
+
+	// RegisterCtx 注册一个服务到服务发现系统
+	// 参数:
+	//   - ctx: 控制调用的取消及截止时间
+	//   - svc: 服务描述信息
+	// 返回:
+	//   - error: 注册失败、取消或超时时返回错误信息
+	RegisterCtx(ctx context.Context, svc *ServiceDesc) error
+
+	// DeregisterCtx 从服务发现系统中注销指定的服务
+	// 参数:
+	//   - ctx: 控制调用的取消及截止时间
+	//   - svcid: 服务的唯一标识ID
+	// 返回:
+	//   - error: 注销失败、取消或超时时返回错误信息
+	DeregisterCtx(ctx context.Context, svcid string) error
+
+	// QueryCtx 根据服务名称查询所有可用的服务实例
+	// 参数:
+	//   - ctx: 控制调用的取消及截止时间
+	//   - name: 服务名称
+	// 返回:
+	//   - ret: 匹配的服务描述列表
+	//   - err: 取消或超时时返回错误信息
+	QueryCtx(ctx context.Context, name string) (ret []*ServiceDesc, err error)
+
+	// SetValueCtx 在服务发现系统中设置一个配置值
+	// 参数:
+	//   - ctx: 控制调用的取消及截止时间
+	//   - key: 配置项的键名
+	//   - value: 配置项的值
+	//   - optList: 可选的配置选项
+	// 返回:
+	//   - error: 设置失败、取消或超时时返回错误信息
+	SetValueCtx(ctx context.Context, key string, value interface{}, optList ...interface{}) error
+
+	// GetValueCtx 从服务发现系统中获取配置值并赋值到指定变量
+	// 参数:
+	//   - ctx: 控制调用的取消及截止时间
+	//   - key: 配置项的键名
+	//   - valuePtr: 指向目标变量的指针
+	// 返回:
+	//   - error: 获取失败、取消或超时时返回错误信息
+	GetValueCtx(ctx context.Context, key string, valuePtr interface{}) error
+
+	// DeleteValueCtx 从服务发现系统中删除指定的配置项
+	// 参数:
+	//   - ctx: 控制调用的取消及截止时间
+	//   - key: 要删除的配置项的键名
+	// 返回:
+	//   - error: 删除失败、取消或超时时返回错误信息
+	DeleteValueCtx(ctx context.Context, key string) error
+}
+
+// DiscoveryCAS 是支持修订号及比较并设置的服务发现接口
+// 多个工具修改同一个键时，先读取修订号，写入时比较修订号，避免覆盖他人的修改
+type DiscoveryCAS interface {
+	Discovery
+
+	// GetValueRevision 从服务器读取配置值及其修订号
+	// 参数:
+	//   - key: 配置项的键名
+	//   - valuePtr: 指向目标变量的指针
+	// 返回:
+	//   - revision: 值最后一次修改时的修订号
+	//   - err: 获取失败时返回错误信息
+	GetValueRevision(key string, valuePtr interface{}) (revision int64, err error)
+
+	// SetValueCAS 只在键的当前修订号等于revision时设置配置值
+	// 参数:
+	//   - key: 配置项的键名
+	//   - value: 配置项的值
+	//   - revision: 期望的修订号，0表示键必须不存在
+	//   - optList: 可选的配置选项
+	// 返回:
+	//   - newRevision: 写入后的修订号，修订号不一致时为当前修订号
+	//   - err: 修订号不一致或设置失败时返回错误信息
+	SetValueCAS(key string, value interface{}, revision int64, optList ...interface{}) (newRevision int64, err error)
+
+	// DeleteValueCAS 只在键的当前修订号等于revision时删除配置项，不按前缀删除
+	// 参数:
+	//   - key: 要删除的配置项的键名
+	//   - revision: 期望的修订号
+	// 返回:
+	//   - error: 修订号不一致或删除失败时返回错误信息
+	DeleteValueCAS(key string, revision int64) error
+}
+
+// BatchOp 是批量操作中的一个设置或删除操作
+type BatchOp struct {
+	Delete        bool        // 为true时删除Key本身，不按前缀删除，否则设置Value
+	Key           string      // 配置项的键名，不能是服务描述
+	Value         interface{} // 设置的值，与SetValue的value相同
+	CheckRevision bool        // 为true时比较键的当前修订号，0表示键必须不存在
+	Revision      int64       // 期望的修订号
+}
+
+// DiscoveryBatch 是支持批量操作的服务发现接口
+// 批量操作中的所有操作一起生效，任意一个操作检查失败时都不生效，其他客户端也一起收到所有修改
+type DiscoveryBatch interface {
+	Discovery
+
+	// Batch 原子地执行一组设置及删除操作
+	// 参数:
+	//   - ops: 按顺序执行的操作列表
+	// 返回:
+	//   - revision: 执行后的修订号
+	//   - err: 任意操作检查失败时返回错误信息，此时所有操作均未执行
+	Batch(ops []BatchOp) (revision int64, err error)
+}
+
+// ReregisterHook 重新注册本实例服务之前的回调
+// 参数:
+//   - list: 断线前本实例注册的服务
+// 返回:
+//   - []*ServiceDesc: 要重新注册的服务，ID改变时原来的服务不再重新注册
+type ReregisterHook func(list []*ServiceDesc) []*ServiceDesc
+
+// DiscoveryReregister 是断线或租约丢失后自动重新注册本实例服务的服务发现接口，memsd及etcdsd实现了该接口
+type DiscoveryReregister interface {
+	Discovery
+
+	// SetReregisterHook 设置重新注册之前的回调，回调返回后才开始重新注册，为nil时按原样重新注册
+	SetReregisterHook(hook ReregisterHook)
+}
+
 var (
 	// Default 是默认的服务发现实例
 	// 应用程序应该使用此实例进行服务注册、查询和配置管理
@@ -0,0 +1,343 @@
+package election
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/bobwong89757/cellmesh/discovery"
+	memsd "github.com/bobwong89757/cellmesh/discovery/memsd/api"
+	"github.com/bobwong89757/cellnet/log"
+	"os"
+	"sync"
+	"time"
+)
+
+// 基于memsd的分布式锁及选主
+// 锁是归属于会话的临时键(memsd.Option.Ephemeral)，值为持有者ID，通过比较并设置保证只有一个持有者
+// 持有者的会话断开时，memsd与服务注册一样删除该键，等待者收到删除事件后重新竞争
+
+var (
+	// KeyPrefix 锁在memsd中的键前缀
+	KeyPrefix = "_election_/"
+
+	// RetryDuration 没有收到删除事件时，重新尝试获取锁的间隔
+	RetryDuration = time.Second * 5
+
+	// LostWaitDuration 会话断开后等待重连认证的时间，服务器在等待恢复期间保留锁，超时后以锁的当前持有者为准
+	LostWaitDuration = time.Second * 5
+
+	ErrNotHeld = errors.New("election lock not held")
+)
+
+// Client 是选举使用的服务发现接口，memsd客户端实现了该接口
+type Client interface {
+	discovery.DiscoveryCAS
+
+	// WatchValue 侦听键前缀的设置及删除事件
+	WatchValue(prefix string) chan discovery.ValueEvent
+
+	// UnwatchValue 解除侦听
+	UnwatchValue(c chan discovery.ValueEvent)
+}
+
+// LeadershipEvent 是选主状态变化的事件
+type LeadershipEvent struct {
+	Name   string // 选举名称
+	Leader bool   // true表示当选，false表示失去领导权
+}
+
+// Election 管理一个持有者的锁及选举
+type Election struct {
+	client  Client
+	ownerID string
+
+	held      map[string]int64 // 持有的锁，键为名称，值为获取时的修订号
+	heldGuard sync.Mutex
+}
+
+// New 创建选举实例
+// 参数:
+//   - client: 服务发现客户端，通常为discovery.Default
+//   - ownerID: 持有者ID，需要全局唯一，为空时使用主机名、进程ID及创建时间生成
+// 返回:
+//   - *Election: 选举实例
+func New(client Client, ownerID string) *Election {
+
+	if ownerID == "" {
+		host, _ := os.Hostname()
+		ownerID = fmt.Sprintf("%s-%d-%x", host, os.Getpid(), time.Now().UnixNano())
+	}
+
+	return &Election{
+		client:  client,
+		ownerID: ownerID,
+		held:    map[string]int64{},
+	}
+}
+
+// OwnerID 返回持有者ID
+func (self *Election) OwnerID() string {
+	return self.ownerID
+}
+
+func lockKey(name string) string {
+	return KeyPrefix + name
+}
+
+// Owner 查询锁当前的持有者
+// 返回:
+//   - owner: 持有者ID
+//   - err: 锁未被持有时返回memsd.ErrValueNotExists
+func (self *Election) Owner(name string) (owner string, err error) {
+	_, err = self.client.GetValueRevision(lockKey(name), &owner)
+	return
+}
+
+// TryLock 尝试获取锁，不等待
+// 锁按持有者ID互斥，同一个Election已持有时再次获取也返回true
+// 返回:
+//   - bool: 是否获取到锁
+//   - error: 请求失败时返回错误
+func (self *Election) TryLock(name string) (bool, error) {
+
+	key := lockKey(name)
+
+	rev, err := self.client.SetValueCAS(key, self.ownerID, 0, memsd.Option{Ephemeral: true})
+
+	switch err {
+	case nil:
+		self.setHeld(name, rev)
+		return true, nil
+	case memsd.ErrRevisionMismatch:
+
+		// 重连后锁可能仍归属于自己
+		var owner string
+		rev, err = self.client.GetValueRevision(key, &owner)
+		if err == nil && owner == self.ownerID {
+			self.setHeld(name, rev)
+			return true, nil
+		}
+
+		return false, nil
+	}
+
+	return false, err
+}
+
+// Lock 获取锁，锁被他人持有时等待其释放
+// 参数:
+//   - ctx: 结束时停止等待
+//   - name: 锁名称
+// 返回:
+//   - error: ctx结束时返回ctx.Err()，没有权限时返回memsd.ErrPermissionDenied
+func (self *Election) Lock(ctx context.Context, name string) error {
+
+	watch := self.client.WatchValue(lockKey(name))
+	defer self.client.UnwatchValue(watch)
+
+	return self.acquire(ctx, name, watch, nil)
+}
+
+// acquire 竞争锁直到获取，lost不为空时丢弃获取之前的断开通知
+func (self *Election) acquire(ctx context.Context, name string, watch chan discovery.ValueEvent, lost chan struct{}) error {
+
+	key := lockKey(name)
+
+	ready := self.client.RegisterNotify("ready")
+	defer self.client.DeregisterNotify("ready", ready)
+
+	for {
+
+		if lost != nil {
+			drainNotify(lost)
+		}
+
+		ok, err := self.TryLock(name)
+
+		switch {
+		case ok:
+			return nil
+		case err == memsd.ErrPermissionDenied:
+			return err
+		case err != nil:
+			log.GetLog().Warnf("election try lock '%s' failed, %s", name, err.Error())
+		}
+
+		// 等待锁被删除或重连后再次尝试
+		wait := true
+		for wait {
+
+			select {
+			case ev := <-watch:
+				wait = ev.Key != key || ev.Kind != discovery.ValueEventKind_Deleted
+			case <-ready:
+				wait = false
+			case <-time.After(RetryDuration):
+				wait = false
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+// Unlock 释放持有的锁
+// 返回:
+//   - error: 未持有或锁已丢失时返回ErrNotHeld
+func (self *Election) Unlock(name string) error {
+
+	rev, ok := self.clearHeld(name)
+	if !ok {
+		return ErrNotHeld
+	}
+
+	switch err := self.client.DeleteValueCAS(lockKey(name), rev); err {
+	case nil:
+		return nil
+	case memsd.ErrRevisionMismatch, memsd.ErrValueNotExists:
+		return ErrNotHeld
+	default:
+		return err
+	}
+}
+
+// IsHeld 是否认为自己持有锁
+func (self *Election) IsHeld(name string) bool {
+	self.heldGuard.Lock()
+	defer self.heldGuard.Unlock()
+	_, ok := self.held[name]
+	return ok
+}
+
+// Campaign 参与选主，当选及失去领导权时发送事件
+// 会话断开时等待重连认证或LostWaitDuration，锁仍归属于自己时不认为失去领导权
+// 失去领导权（会话断开后锁被删除或锁被删除）后会自动重新参与
+// ctx结束时释放领导权，发送最后一个事件后关闭channel
+// 参数:
+//   - ctx: 结束时退出选举
+//   - name: 选举名称
+// 返回:
+//   - <-chan LeadershipEvent: 领导权变化事件
+func (self *Election) Campaign(ctx context.Context, name string) <-chan LeadershipEvent {
+
+	ret := make(chan LeadershipEvent, 10)
+
+	key := lockKey(name)
+	watch := self.client.WatchValue(key)
+	lost := self.client.RegisterNotify("lost")
+	ready := self.client.RegisterNotify("ready")
+
+	send := func(leader bool) {
+		select {
+		case ret <- LeadershipEvent{Name: name, Leader: leader}:
+		case <-ctx.Done():
+		}
+	}
+
+	go func() {
+
+		defer func() {
+			self.client.UnwatchValue(watch)
+			self.client.DeregisterNotify("lost", lost)
+			self.client.DeregisterNotify("ready", ready)
+			close(ret)
+		}()
+
+		for {
+
+			if self.acquire(ctx, name, watch, lost) != nil {
+				return
+			}
+
+			send(true)
+
+			// 当选之前的认证完成通知与之后的断开无关
+			drainNotify(ready)
+
+			for self.stillLeader(ctx, name, watch, lost, ready) {
+			}
+
+			if ctx.Err() != nil {
+				self.Unlock(name)
+
+				select {
+				case ret <- LeadershipEvent{Name: name, Leader: false}:
+				default:
+				}
+				return
+			}
+
+			self.clearHeld(name)
+			send(false)
+		}
+	}()
+
+	return ret
+}
+
+// stillLeader 等待一个事件，返回是否仍持有领导权
+func (self *Election) stillLeader(ctx context.Context, name string, watch chan discovery.ValueEvent, lost, ready chan struct{}) bool {
+
+	select {
+	case ev := <-watch:
+
+		if ev.Key != lockKey(name) || ev.Kind != discovery.ValueEventKind_Deleted {
+			return true
+		}
+
+		// 可能是获取锁之前的删除事件，以服务器上的当前值为准
+		return self.ownLock(name)
+
+	case <-lost:
+
+		// 会话恢复时锁仍然保留，等待重连认证后确认
+		select {
+		case <-ready:
+		case <-time.After(LostWaitDuration):
+		case <-ctx.Done():
+			return false
+		}
+
+		return self.ownLock(name)
+
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// ownLock 服务器上的锁是否仍是自己获取时的那一个
+func (self *Election) ownLock(name string) bool {
+
+	var owner string
+	rev, err := self.client.GetValueRevision(lockKey(name), &owner)
+
+	self.heldGuard.Lock()
+	heldRev := self.held[name]
+	self.heldGuard.Unlock()
+
+	return err == nil && owner == self.ownerID && rev == heldRev
+}
+
+func (self *Election) setHeld(name string, rev int64) {
+	self.heldGuard.Lock()
+	self.held[name] = rev
+	self.heldGuard.Unlock()
+}
+
+func (self *Election) clearHeld(name string) (rev int64, ok bool) {
+	self.heldGuard.Lock()
+	rev, ok = self.held[name]
+	delete(self.held, name)
+	self.heldGuard.Unlock()
+	return
+}
+
+func drainNotify(c chan struct{}) {
+	for {
+		select {
+		case <-c:
+		default:
+			return
+		}
+	}
+}
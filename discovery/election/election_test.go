@@ -0,0 +1,179 @@
+package election
+
+import (
+	"context"
+	"fmt"
+	memsd "github.com/bobwong89757/cellmesh/discovery/memsd/api"
+	"github.com/bobwong89757/cellmesh/discovery/memsd/deps"
+	"github.com/bobwong89757/cellmesh/discovery/memsd/model"
+	"github.com/bobwong89757/cellnet"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	testSvcAddr string
+	testSvcOnce sync.Once
+)
+
+// newTestClient 连接进程内的memsd服务
+func newTestClient() Client {
+
+	testSvcOnce.Do(func() {
+		p := deps.ListenSvc("127.0.0.1:0")
+		testSvcAddr = fmt.Sprintf("127.0.0.1:%d", p.(cellnet.TCPAcceptor).Port())
+	})
+
+	config := memsd.DefaultConfig()
+	config.Address = testSvcAddr
+	config.ReconnectDuration = time.Millisecond * 100
+
+	return memsd.NewDiscovery(config).(Client)
+}
+
+// postWait 在memsd服务的队列中执行，并等待完成
+func postWait(f func()) {
+
+	done := make(chan struct{})
+	model.Queue.Post(func() {
+		f()
+		close(done)
+	})
+
+	<-done
+}
+
+func waitEvent(t *testing.T, c <-chan LeadershipEvent, leader bool) {
+
+	select {
+	case ev := <-c:
+		if ev.Leader != leader {
+			t.Fatalf("expect leader %v, got %v", leader, ev.Leader)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatalf("wait leader %v timeout", leader)
+	}
+}
+
+func TestLock(t *testing.T) {
+
+	a := New(newTestClient(), "a")
+	b := New(newTestClient(), "b")
+
+	if ok, err := a.TryLock("lock"); !ok || err != nil {
+		t.Fatalf("a should get lock, %v", err)
+	}
+
+	if ok, err := b.TryLock("lock"); ok || err != nil {
+		t.Fatalf("b should not get lock, %v", err)
+	}
+
+	if owner, _ := b.Owner("lock"); owner != "a" {
+		t.Fatalf("expect owner a, got '%s'", owner)
+	}
+
+	locked := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+		defer cancel()
+		locked <- b.Lock(ctx, "lock")
+	}()
+
+	time.Sleep(time.Millisecond * 100)
+
+	if err := a.Unlock("lock"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-locked; err != nil {
+		t.Fatalf("b should get lock after release, %v", err)
+	}
+
+	if err := a.Unlock("lock"); err != ErrNotHeld {
+		t.Fatalf("expect not held, got %v", err)
+	}
+
+	if err := b.Unlock("lock"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCampaign(t *testing.T) {
+
+	clientA := newTestClient()
+
+	a := New(clientA, "a")
+	b := New(newTestClient(), "b")
+
+	ctxA, cancelA := context.WithCancel(context.Background())
+	defer cancelA()
+
+	eventsA := a.Campaign(ctxA, "leader")
+	waitEvent(t, eventsA, true)
+
+	ctxB, cancelB := context.WithCancel(context.Background())
+	defer cancelB()
+
+	eventsB := b.Campaign(ctxB, "leader")
+
+	select {
+	case <-eventsB:
+		t.Fatal("b should not be leader")
+	case <-time.After(time.Millisecond * 200):
+	}
+
+	// 会话断开时，服务器删除锁，b当选
+	clientA.(interface{ Session() cellnet.Session }).Session().Close()
+
+	waitEvent(t, eventsA, false)
+	waitEvent(t, eventsB, true)
+
+	// b退出选举后，a重连并当选
+	cancelB()
+	waitEvent(t, eventsB, false)
+	waitEvent(t, eventsA, true)
+}
+
+func TestCampaignResume(t *testing.T) {
+
+	clientA := newTestClient()
+
+	a := New(clientA, "a")
+	b := New(newTestClient(), "b")
+
+	// 服务器在等待恢复期间保留锁
+	postWait(func() {
+		deps.SessionResumeGrace = time.Second * 3
+	})
+
+	defer postWait(func() {
+		deps.SessionResumeGrace = 0
+	})
+
+	ctxA, cancelA := context.WithCancel(context.Background())
+	defer cancelA()
+
+	eventsA := a.Campaign(ctxA, "resume")
+	waitEvent(t, eventsA, true)
+
+	ctxB, cancelB := context.WithCancel(context.Background())
+	defer cancelB()
+
+	eventsB := b.Campaign(ctxB, "resume")
+
+	// 会话恢复后仍持有锁，不发送失去领导权的事件
+	clientA.(interface{ Session() cellnet.Session }).Session().Close()
+
+	select {
+	case ev := <-eventsA:
+		t.Fatalf("unexpected event after resume, leader %v", ev.Leader)
+	case ev := <-eventsB:
+		t.Fatalf("b should not be leader, got %v", ev.Leader)
+	case <-time.After(time.Millisecond * 500):
+	}
+
+	if !a.IsHeld("resume") {
+		t.Fatal("lock should be held after resume")
+	}
+}
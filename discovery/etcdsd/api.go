@@ -0,0 +1,160 @@
+package etcdsd
+
+import (
+	"context"
+	"github.com/bobwong89757/cellmesh/discovery"
+	"github.com/bobwong89757/cellnet/log"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"sync"
+)
+
+// 键的布局与memsd相同，服务描述存放在discovery.ServiceKeyPrefix+服务ID下，值为JSON格式的服务描述
+// 服务描述及临时键绑定到实例的租约，进程退出或与etcd断开超过租约时长后被etcd删除
+// 启动时拉取命名空间下的所有键，之后从拉取时的修订号开始侦听，查询及读取配置使用本地缓存
+
+// notifyContext 是通知上下文的内部结构
+type notifyContext struct {
+	stack string // 注册时的调用栈信息，用于调试
+	mode  string // 通知模式
+}
+
+// etcdDiscovery 是基于etcd的服务发现实现
+type etcdDiscovery struct {
+	config *Config
+	client *clientv3.Client
+	root   string // 命名空间中所有键的前缀
+
+	kvCache      map[string][]byte // KV配置缓存，键不带root
+	kvCacheGuard sync.RWMutex      // 保护KV缓存的读写锁
+
+	svcCache      map[string][]*discovery.ServiceDesc // 服务缓存，键为服务名，修改时替换列表，不修改已返回的列表
+	svcNameByID   map[string]string                   // 服务ID对应的服务名，用于处理删除
+	svcCacheGuard sync.RWMutex                        // 保护服务缓存的读写锁
+
+	notifyMap     sync.Map // 通知通道映射，key为channel，value为notifyContext
+	watchMap      sync.Map // 服务事件侦听映射，key为channel，value为watchContext
+	valueWatchMap sync.Map // 配置值事件侦听映射，key为channel，value为watchContext
+
+	localSvc       map[string]*discovery.ServiceDesc // 本实例注册的服务，键为服务ID，租约丢失后重新注册
+	localSvcGuard  sync.Mutex                        // 保护localSvc及reregisterHook的互斥锁
+	reregisterHook discovery.ReregisterHook          // 重新注册之前的回调
+
+	leaseID    clientv3.LeaseID // 服务注册及临时键绑定的租约，为0时表示尚未申请或已丢失
+	leaseGuard sync.Mutex       // 保护leaseID的互斥锁
+
+	revision int64 // 缓存对应的修订号，只在侦听协程中访问
+
+	ctx    context.Context    // 实例关闭时取消
+	cancel context.CancelFunc // 关闭实例
+}
+
+// NewDiscovery 创建一个新的etcd服务发现实例
+// 会一直阻塞，直到连接上etcd并拉取完初始数据
+// 参数:
+//   - config: 配置对象，如果为nil则使用默认配置
+// 返回:
+//   - discovery.Discovery: 服务发现实例，失败时返回nil
+func NewDiscovery(config interface{}) discovery.Discovery {
+
+	sd, err := NewDiscoveryContext(context.Background(), config)
+	if err != nil {
+		log.GetLog().Errorf("etcd discovery init failed, %s", err.Error())
+	}
+
+	return sd
+}
+
+// NewDiscoveryContext 创建一个新的etcd服务发现实例，可通过ctx取消或设置截止时间
+// 参数:
+//   - ctx: 控制连接的取消及截止时间
+//   - config: 配置对象，如果为nil则使用默认配置
+// 返回:
+//   - discovery.Discovery: 服务发现实例，同时实现了discovery.DiscoveryCtx
+//   - error: 连接失败、取消或超时时返回错误信息
+func NewDiscoveryContext(ctx context.Context, config interface{}) (discovery.Discovery, error) {
+
+	if config == nil {
+		config = DefaultConfig()
+	}
+
+	self := &etcdDiscovery{
+		config:      config.(*Config),
+		kvCache:     make(map[string][]byte),
+		svcCache:    make(map[string][]*discovery.ServiceDesc),
+		svcNameByID: make(map[string]string),
+		localSvc:    make(map[string]*discovery.ServiceDesc),
+	}
+
+	self.root = self.config.keyRoot()
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints: self.config.endpoints(),
+		Username:  self.config.Username,
+		Password:  self.config.Password,
+		TLS:       self.config.TLS,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	self.client = client
+	self.ctx, self.cancel = context.WithCancel(context.Background())
+
+	if err = self.reload(ctx); err != nil {
+		self.Close()
+		return nil, err
+	}
+
+	go self.watchLoop()
+
+	return self, nil
+}
+
+// Close 撤销租约并断开与etcd的连接，本实例注册的服务及临时键随租约删除
+func (self *etcdDiscovery) Close() {
+
+	self.cancel()
+
+	self.leaseGuard.Lock()
+	leaseID := self.leaseID
+	self.leaseID = 0
+	self.leaseGuard.Unlock()
+
+	if leaseID != 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), self.config.Timeout)
+		self.client.Revoke(ctx, leaseID)
+		cancel()
+	}
+
+	self.client.Close()
+}
+
+// requestContext 返回单次请求使用的ctx，在parent结束、实例关闭或请求超时时结束
+func (self *etcdDiscovery) requestContext(parent context.Context) (context.Context, context.CancelFunc) {
+
+	ctx, cancel := context.WithTimeout(parent, self.config.Timeout)
+
+	stop := context.AfterFunc(self.ctx, cancel)
+
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+func init() {
+
+	discovery.RegisterBackend("etcd", func(ctx context.Context, backendConfig *discovery.BackendConfig) (discovery.Discovery, error) {
+
+		config := DefaultConfig()
+		config.Address = backendConfig.Address
+		config.Username = backendConfig.ClientID
+		config.Password = backendConfig.Secret
+		config.Namespace = backendConfig.Namespace
+		config.TLS = backendConfig.TLS
+
+		return NewDiscoveryContext(ctx, config)
+	})
+}
+
+var _ discovery.DiscoveryCtx = (*etcdDiscovery)(nil)
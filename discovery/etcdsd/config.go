@@ -0,0 +1,69 @@
+package etcdsd
+
+import (
+	"crypto/tls"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Config 是etcd服务发现的配置结构
+type Config struct {
+	Address   string        // etcd地址，格式为"host:port"，多个地址使用逗号分隔
+	Endpoints []string      // etcd地址列表，设置时优先于Address
+	Username  string        // etcd用户名，为空时不认证
+	Password  string        // etcd密码
+	TLS       *tls.Config   // 设置后使用TLS连接
+	Timeout   time.Duration // 单次请求的超时时间
+
+	Prefix    string // 所有键的前缀
+	Namespace string // 命名空间，与memsd一样为空时使用默认命名空间，与名为"default"的命名空间互不影响
+
+	LeaseTTL          time.Duration // 服务注册绑定的租约时长，进程退出后最多经过此时长服务被删除
+	ReconnectDuration time.Duration // 租约丢失或侦听中断后，再次尝试的间隔
+}
+
+// DefaultConfig 返回默认的配置
+// 默认地址为"127.0.0.1:2379"，前缀为"cellmesh/"，租约时长为10秒
+// 返回:
+//   - *Config: 默认配置实例
+func DefaultConfig() *Config {
+
+	return &Config{
+		Address:           "127.0.0.1:2379",
+		Timeout:           time.Second * 10,
+		Prefix:            "cellmesh/",
+		LeaseTTL:          time.Second * 10,
+		ReconnectDuration: time.Second * 5,
+	}
+}
+
+// endpoints 返回etcd地址列表
+func (self *Config) endpoints() (ret []string) {
+
+	if len(self.Endpoints) > 0 {
+		return self.Endpoints
+	}
+
+	for _, addr := range strings.Split(self.Address, ",") {
+
+		addr = strings.TrimSpace(addr)
+		if addr != "" {
+			ret = append(ret, addr)
+		}
+	}
+
+	return
+}
+
+// keyRoot 返回命名空间中所有键的前缀
+// 默认命名空间存放在Prefix+"default/"下，其他命名空间存放在Prefix+"ns/"+转义后的名称+"/"下
+// 各命名空间的前缀互不包含，按前缀侦听时不会收到其他命名空间的事件
+func (self *Config) keyRoot() string {
+
+	if self.Namespace == "" {
+		return self.Prefix + "default/"
+	}
+
+	return self.Prefix + "ns/" + url.PathEscape(self.Namespace) + "/"
+}
@@ -0,0 +1,13 @@
+package etcdsd
+
+import "github.com/bobwong89757/cellmesh/discovery"
+
+const (
+	MaxValueSize = discovery.MaxValueSize
+)
+
+// 与其他服务发现后端共用的错误值
+var (
+	ErrValueNotExists = discovery.ErrValueNotExists
+	ErrValueTooLarge  = discovery.ErrValueTooLarge
+)
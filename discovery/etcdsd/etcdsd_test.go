@@ -0,0 +1,235 @@
+package etcdsd
+
+import (
+	"context"
+	"github.com/bobwong89757/cellmesh/discovery"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestAddressEnv 测试使用的etcd地址的环境变量
+// 未设置时跳过测试，etcdtest模块启动进程内的etcd后设置此变量运行本包的测试，etcd服务器不是本模块的依赖
+const TestAddressEnv = "CELLMESH_ETCD_ADDR"
+
+// startEtcd 返回测试使用的etcd地址
+func startEtcd(t *testing.T) string {
+
+	addr := os.Getenv(TestAddressEnv)
+	if addr == "" {
+		t.Skipf("%s not set, run tests in discovery/etcdsd/etcdtest", TestAddressEnv)
+	}
+
+	return addr
+}
+
+// testRun 区分每次运行的命名空间，etcd中的数据在多次运行之间保留
+var testRun = strconv.FormatInt(time.Now().UnixNano(), 36)
+
+func newTestDiscovery(t *testing.T, addr string) *etcdDiscovery {
+
+	config := DefaultConfig()
+	config.Address = addr
+	config.Namespace = "test-" + testRun + "-" + t.Name()
+	config.LeaseTTL = time.Second * 2
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	sd, err := NewDiscoveryContext(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(sd.(*etcdDiscovery).Close)
+
+	return sd.(*etcdDiscovery)
+}
+
+// waitFor 等待条件成立
+func waitFor(t *testing.T, what string, cond func() bool) {
+
+	for begin := time.Now(); time.Since(begin) < time.Second*5; time.Sleep(time.Millisecond * 10) {
+		if cond() {
+			return
+		}
+	}
+
+	t.Fatalf("wait %s timeout", what)
+}
+
+func TestKeyRoot(t *testing.T) {
+
+	roots := map[string]bool{}
+
+	// 与memsd一样，空命名空间与名为default的命名空间不同，各命名空间的前缀互不包含
+	for _, ns := range []string{"", "default", "ns", "a", "a/b", "a%2Fb"} {
+
+		config := DefaultConfig()
+		config.Namespace = ns
+		root := config.keyRoot()
+
+		for other := range roots {
+			if strings.HasPrefix(root, other) || strings.HasPrefix(other, root) {
+				t.Fatalf("namespace '%s' root '%s' overlaps '%s'", ns, root, other)
+			}
+		}
+
+		roots[root] = true
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+
+	addr := startEtcd(t)
+
+	sd := newTestDiscovery(t, addr)
+	other := newTestDiscovery(t, addr)
+
+	added := other.RegisterNotify("add")
+	defer other.DeregisterNotify("add", added)
+
+	events := other.WatchService("game")
+	defer other.UnwatchService(events)
+
+	if err := sd.Register(&discovery.ServiceDesc{Name: "game", ID: "game#0@dev", Host: "127.0.0.1", Port: 9091}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-added:
+	case <-time.After(time.Second * 5):
+		t.Fatal("expect add notify")
+	}
+
+	if ev := <-events; ev.Kind != discovery.ServiceEventKind_Added || ev.Desc.ID != "game#0@dev" {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+
+	list := other.Query("game")
+	if len(list) != 1 || list[0].Port != 9091 {
+		t.Fatalf("unexpected query: %+v", list)
+	}
+
+	if err := sd.SetValue("cfg/a", 123); err != nil {
+		t.Fatal(err)
+	}
+
+	var a int
+	waitFor(t, "value", func() bool {
+		return other.GetValue("cfg/a", &a) == nil && a == 123
+	})
+
+	if err := sd.DeleteValue("cfg/"); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "delete", func() bool {
+		return other.GetValue("cfg/a", &a) == ErrValueNotExists
+	})
+
+	if err := sd.Deregister("game#0@dev"); err != nil {
+		t.Fatal(err)
+	}
+
+	if ev := <-events; ev.Kind != discovery.ServiceEventKind_Removed || ev.Desc.ID != "game#0@dev" {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+
+	// 持有的查询结果不受后续修改影响
+	if len(list) != 1 || list[0].ID != "game#0@dev" {
+		t.Fatalf("query result changed: %+v", list)
+	}
+
+	if len(other.Query("game")) != 0 {
+		t.Fatalf("expect no service")
+	}
+}
+
+func TestLeaseExpire(t *testing.T) {
+
+	addr := startEtcd(t)
+
+	sd := newTestDiscovery(t, addr)
+	other := newTestDiscovery(t, addr)
+
+	if err := sd.Register(&discovery.ServiceDesc{Name: "login", ID: "login#0@dev"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sd.SetValue("online/a", "login#0", Option{Ephemeral: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "register", func() bool {
+		return len(other.Query("login")) == 1
+	})
+
+	// 关闭时撤销租约，服务及临时键被删除
+	sd.Close()
+
+	waitFor(t, "lease revoke", func() bool {
+
+		var v string
+		return len(other.Query("login")) == 0 && other.GetValue("online/a", &v) == ErrValueNotExists
+	})
+}
+
+func TestReregister(t *testing.T) {
+
+	addr := startEtcd(t)
+
+	sd := newTestDiscovery(t, addr)
+	other := newTestDiscovery(t, addr)
+
+	reregister := sd.RegisterNotify("reregister")
+	defer sd.DeregisterNotify("reregister", reregister)
+
+	if err := sd.Register(&discovery.ServiceDesc{Name: "game", ID: "game#1@dev"}); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "register", func() bool {
+		return len(other.Query("game")) == 1
+	})
+
+	// 模拟租约到期
+	sd.leaseGuard.Lock()
+	leaseID := sd.leaseID
+	sd.leaseGuard.Unlock()
+
+	if _, err := other.client.Revoke(context.Background(), leaseID); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-reregister:
+	case <-time.After(time.Second * 10):
+		t.Fatal("expect reregister notify")
+	}
+
+	waitFor(t, "reregister", func() bool {
+		return len(other.Query("game")) == 1
+	})
+}
+
+func TestBackend(t *testing.T) {
+
+	addr := startEtcd(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	sd, err := discovery.NewBackend(ctx, "etcd://"+addr, discovery.BackendConfig{Namespace: "backend"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer sd.(*etcdDiscovery).Close()
+
+	if sd.(*etcdDiscovery).root != "cellmesh/ns/backend/" {
+		t.Fatalf("unexpected root: %s", sd.(*etcdDiscovery).root)
+	}
+}
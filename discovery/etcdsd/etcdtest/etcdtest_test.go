@@ -0,0 +1,77 @@
+package etcdtest
+
+import (
+	"fmt"
+	"go.etcd.io/etcd/server/v3/embed"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// 进程内的etcd服务器只用于测试，放在单独的模块中，cellmesh模块不依赖etcd服务器
+// 启动etcd后设置CELLMESH_ETCD_ADDR，运行etcdsd包的测试
+
+// freeURL 返回一个空闲端口的地址
+func freeURL(t *testing.T) url.URL {
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer ln.Close()
+
+	return url.URL{Scheme: "http", Host: ln.Addr().String()}
+}
+
+// startEtcd 启动进程内的etcd，返回客户端地址
+func startEtcd(t *testing.T) string {
+
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+	cfg.LogLevel = "error"
+
+	clientURL := freeURL(t)
+	peerURL := freeURL(t)
+
+	cfg.ListenClientUrls = []url.URL{clientURL}
+	cfg.AdvertiseClientUrls = []url.URL{clientURL}
+	cfg.ListenPeerUrls = []url.URL{peerURL}
+	cfg.AdvertisePeerUrls = []url.URL{peerURL}
+	cfg.InitialCluster = fmt.Sprintf("%s=%s", cfg.Name, peerURL.String())
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(e.Close)
+
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(time.Second * 10):
+		t.Fatal("etcd start timeout")
+	}
+
+	return clientURL.Host
+}
+
+func TestEtcdsd(t *testing.T) {
+
+	addr := startEtcd(t)
+
+	cmd := exec.Command("go", "test", "-count=1", ".")
+	cmd.Dir = ".."
+	cmd.Env = append(os.Environ(), "CELLMESH_ETCD_ADDR="+addr)
+
+	output, err := cmd.CombinedOutput()
+
+	t.Logf("%s", output)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,159 @@
+package etcdsd
+
+import (
+	"context"
+	"github.com/bobwong89757/cellmesh/discovery"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"strings"
+)
+
+// Option 是KV操作的选项配置
+type Option struct {
+	PrettyPrint bool // 是否使用格式化输出（JSON缩进）
+	Ephemeral   bool // 键绑定到实例的租约，与服务注册一样在实例关闭或租约到期时被删除
+}
+
+// IsPrettyPrint 是否使用格式化输出，实现discovery.PrettyPrintOption
+func (self Option) IsPrettyPrint() bool {
+	return self.PrettyPrint
+}
+
+// getOpt 从选项列表中提取Option配置
+func getOpt(optList ...interface{}) Option {
+
+	for _, opt := range optList {
+
+		switch raw := opt.(type) {
+		case Option:
+			return raw
+		}
+	}
+
+	return Option{}
+}
+
+func (self *etcdDiscovery) getKVCache(key string) (value []byte, ok bool) {
+	self.kvCacheGuard.RLock()
+	defer self.kvCacheGuard.RUnlock()
+	value, ok = self.kvCache[key]
+	return
+}
+
+func (self *etcdDiscovery) SetValue(key string, dataPtr interface{}, optList ...interface{}) error {
+	return self.SetValueCtx(context.Background(), key, dataPtr, optList...)
+}
+
+func (self *etcdDiscovery) SetValueCtx(ctx context.Context, key string, dataPtr interface{}, optList ...interface{}) error {
+
+	opt := getOpt(optList...)
+
+	raw, err := discovery.AnyToBytes(dataPtr, opt.PrettyPrint)
+	if err != nil {
+		return err
+	}
+
+	if len(raw) > MaxValueSize {
+		return ErrValueTooLarge
+	}
+
+	ctx, cancel := self.requestContext(ctx)
+	defer cancel()
+
+	var putOpts []clientv3.OpOption
+	if opt.Ephemeral {
+
+		leaseID, err := self.getLease(ctx)
+		if err != nil {
+			return err
+		}
+
+		putOpts = append(putOpts, clientv3.WithLease(leaseID))
+	}
+
+	_, err = self.client.Put(ctx, self.root+key, string(raw), putOpts...)
+
+	return err
+}
+
+func (self *etcdDiscovery) GetValue(key string, valuePtr interface{}) error {
+	return self.GetValueCtx(context.Background(), key, valuePtr)
+}
+
+// GetValueCtx 从本地缓存读取，只在调用前检查ctx是否已结束
+func (self *etcdDiscovery) GetValueCtx(ctx context.Context, key string, valuePtr interface{}) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	data, ok := self.getKVCache(key)
+
+	if !ok {
+		return ErrValueNotExists
+	}
+
+	return discovery.BytesToAny(data, valuePtr)
+}
+
+func (self *etcdDiscovery) GetValueDirect(key string, valuePtr interface{}) error {
+
+	data, err := self.GetRawValue(key)
+
+	if err != nil {
+		return err
+	}
+
+	return discovery.BytesToAny(data, valuePtr)
+}
+
+// GetRawValue 从etcd读取原始值，不使用本地缓存
+func (self *etcdDiscovery) GetRawValue(key string) ([]byte, error) {
+
+	ctx, cancel := self.requestContext(context.Background())
+	defer cancel()
+
+	resp, err := self.client.Get(ctx, self.root+key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.Kvs) == 0 {
+		return nil, ErrValueNotExists
+	}
+
+	return resp.Kvs[0].Value, nil
+}
+
+func (self *etcdDiscovery) DeleteValue(key string) error {
+	return self.DeleteValueCtx(context.Background(), key)
+}
+
+// DeleteValueCtx 与memsd相同，删除以key为前缀的所有值
+func (self *etcdDiscovery) DeleteValueCtx(ctx context.Context, key string) error {
+
+	ctx, cancel := self.requestContext(ctx)
+	defer cancel()
+
+	_, err := self.client.Delete(ctx, self.root+key, clientv3.WithPrefix())
+
+	return err
+}
+
+func (self *etcdDiscovery) GetRawValueList(prefix string) (ret []discovery.ValueMeta) {
+
+	self.kvCacheGuard.RLock()
+
+	for key, value := range self.kvCache {
+
+		if strings.HasPrefix(key, prefix) {
+			ret = append(ret, discovery.ValueMeta{
+				Key:   key,
+				Value: value,
+			})
+		}
+	}
+
+	self.kvCacheGuard.RUnlock()
+
+	return
+}
@@ -0,0 +1,402 @@
+package etcdsd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/bobwong89757/cellmesh/discovery"
+	"github.com/bobwong89757/cellnet/log"
+	"github.com/bobwong89757/cellnet/util"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"time"
+)
+
+func (self *etcdDiscovery) Register(svc *discovery.ServiceDesc) error {
+	return self.RegisterCtx(context.Background(), svc)
+}
+
+// RegisterCtx 将服务描述写入etcd并绑定到实例的租约
+func (self *etcdDiscovery) RegisterCtx(ctx context.Context, svc *discovery.ServiceDesc) error {
+
+	if svc.Name == "" {
+		return errors.New("expect svc name")
+	}
+
+	if svc.ID == "" {
+		return errors.New("expect svc id")
+	}
+
+	data, err := json.Marshal(svc)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := self.requestContext(ctx)
+	defer cancel()
+
+	leaseID, err := self.getLease(ctx)
+	if err != nil {
+		return err
+	}
+
+	if _, err = self.client.Put(ctx, self.root+discovery.ServiceKeyPrefix+svc.ID, string(data), clientv3.WithLease(leaseID)); err != nil {
+		return err
+	}
+
+	self.localSvcGuard.Lock()
+	self.localSvc[svc.ID] = svc
+	self.localSvcGuard.Unlock()
+
+	return nil
+}
+
+func (self *etcdDiscovery) Deregister(svcid string) error {
+	return self.DeregisterCtx(context.Background(), svcid)
+}
+
+func (self *etcdDiscovery) DeregisterCtx(ctx context.Context, svcid string) error {
+
+	self.localSvcGuard.Lock()
+	delete(self.localSvc, svcid)
+	self.localSvcGuard.Unlock()
+
+	ctx, cancel := self.requestContext(ctx)
+	defer cancel()
+
+	_, err := self.client.Delete(ctx, self.root+discovery.ServiceKeyPrefix+svcid)
+
+	return err
+}
+
+// getLease 返回实例的租约，没有时申请并开始续约
+func (self *etcdDiscovery) getLease(ctx context.Context) (clientv3.LeaseID, error) {
+
+	self.leaseGuard.Lock()
+	defer self.leaseGuard.Unlock()
+
+	if self.leaseID != 0 {
+		return self.leaseID, nil
+	}
+
+	resp, err := self.client.Grant(ctx, int64(self.config.LeaseTTL/time.Second))
+	if err != nil {
+		return 0, err
+	}
+
+	keepAlive, err := self.client.KeepAlive(self.ctx, resp.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	self.leaseID = resp.ID
+
+	go self.keepLease(resp.ID, keepAlive)
+
+	return resp.ID, nil
+}
+
+// keepLease 接收续约应答，租约到期或被撤销后申请新的租约并重新注册本实例的服务
+func (self *etcdDiscovery) keepLease(leaseID clientv3.LeaseID, keepAlive <-chan *clientv3.LeaseKeepAliveResponse) {
+
+	for range keepAlive {
+	}
+
+	// 实例已关闭
+	if self.ctx.Err() != nil {
+		return
+	}
+
+	self.leaseGuard.Lock()
+	if self.leaseID == leaseID {
+		self.leaseID = 0
+	}
+	self.leaseGuard.Unlock()
+
+	log.GetLog().Warnf("etcd lease %x lost", int64(leaseID))
+
+	self.triggerNotify("lost", 0)
+
+	for self.ctx.Err() == nil {
+
+		ctx, cancel := self.requestContext(context.Background())
+		_, err := self.getLease(ctx)
+		cancel()
+
+		if err == nil {
+			break
+		}
+
+		log.GetLog().Errorf("etcd grant lease failed, %s", err.Error())
+
+		select {
+		case <-time.After(self.config.ReconnectDuration):
+		case <-self.ctx.Done():
+			return
+		}
+	}
+
+	self.triggerNotify("ready", 0)
+
+	self.reregister()
+}
+
+// reregister 租约丢失后重新注册本实例注册过的服务，完成后发送"reregister"通知
+func (self *etcdDiscovery) reregister() {
+
+	self.localSvcGuard.Lock()
+	var list []*discovery.ServiceDesc
+	for _, desc := range self.localSvc {
+		list = append(list, desc)
+	}
+	hook := self.reregisterHook
+	self.localSvcGuard.Unlock()
+
+	// 没有注册服务时也调用，回调可能需要重新获取与会话绑定的锁
+	if hook != nil {
+		list = self.applyReregisterHook(hook, list)
+	}
+
+	for _, desc := range list {
+
+		// 期间已注销
+		self.localSvcGuard.Lock()
+		_, ok := self.localSvc[desc.ID]
+		self.localSvcGuard.Unlock()
+
+		if !ok {
+			continue
+		}
+
+		if err := self.Register(desc); err != nil {
+			log.GetLog().Errorf("etcd reregister service '%s' failed, %s", desc.ID, err.Error())
+		} else {
+			log.GetLog().Infof("etcd reregister service '%s'", desc.ID)
+		}
+	}
+
+	self.triggerNotify("reregister", 0)
+}
+
+// SetReregisterHook 设置重新注册本实例服务之前的回调
+func (self *etcdDiscovery) SetReregisterHook(hook discovery.ReregisterHook) {
+
+	self.localSvcGuard.Lock()
+	self.reregisterHook = hook
+	self.localSvcGuard.Unlock()
+}
+
+// applyReregisterHook 调用回调并替换ID改变的服务，原来的服务不再重新注册
+func (self *etcdDiscovery) applyReregisterHook(hook discovery.ReregisterHook, list []*discovery.ServiceDesc) []*discovery.ServiceDesc {
+
+	newList := hook(list)
+
+	kept := make(map[string]bool, len(newList))
+	for _, desc := range newList {
+		kept[desc.ID] = true
+	}
+
+	self.localSvcGuard.Lock()
+	for _, desc := range list {
+		if !kept[desc.ID] {
+			delete(self.localSvc, desc.ID)
+		}
+	}
+
+	for _, desc := range newList {
+		self.localSvc[desc.ID] = desc
+	}
+	self.localSvcGuard.Unlock()
+
+	return newList
+}
+
+// Query 从本地缓存查询，返回的列表不会被修改，可以持有
+func (self *etcdDiscovery) Query(name string) (ret []*discovery.ServiceDesc) {
+
+	self.svcCacheGuard.RLock()
+	defer self.svcCacheGuard.RUnlock()
+
+	return self.svcCache[name]
+}
+
+// QueryCtx 从本地缓存查询，只在调用前检查ctx是否已结束
+func (self *etcdDiscovery) QueryCtx(ctx context.Context, name string) (ret []*discovery.ServiceDesc, err error) {
+
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	return self.Query(name), nil
+}
+
+func (self *etcdDiscovery) QueryAll() (ret []*discovery.ServiceDesc) {
+
+	self.svcCacheGuard.RLock()
+	defer self.svcCacheGuard.RUnlock()
+
+	for _, list := range self.svcCache {
+		ret = append(ret, list...)
+	}
+
+	return
+}
+
+func (self *etcdDiscovery) triggerNotify(mode string, timeout time.Duration) {
+
+	self.notifyMap.Range(func(key, value interface{}) bool {
+
+		if value == nil {
+			return true
+		}
+
+		ctx := value.(*notifyContext)
+
+		if ctx.mode != mode {
+			return true
+		}
+
+		c := key.(chan struct{})
+
+		if timeout == 0 {
+
+			select {
+			case c <- struct{}{}:
+			default:
+			}
+
+		} else {
+			select {
+			case c <- struct{}{}:
+			case <-time.After(timeout):
+				// 接收通知阻塞太久，或者没有释放侦听的channel
+				log.GetLog().Errorf("notify(%s) timeout, not free? regstack: %s", ctx.mode, ctx.stack)
+			}
+		}
+
+		return true
+	})
+}
+
+// RegisterNotify 注册通知
+// 参数:
+//   - mode: "add"服务新增或变化，"lost"租约丢失，"ready"重新申请到租约，"reregister"重新注册完本地服务
+func (self *etcdDiscovery) RegisterNotify(mode string) (ret chan struct{}) {
+	ret = make(chan struct{}, 10)
+
+	switch mode {
+	case "add", "ready", "lost", "reregister":
+		self.notifyMap.Store(ret, &notifyContext{
+			mode:  mode,
+			stack: util.StackToString(5),
+		})
+	default:
+		panic("unknown notify mode: " + mode)
+	}
+
+	return
+}
+
+func (self *etcdDiscovery) DeregisterNotify(mode string, c chan struct{}) {
+
+	switch mode {
+	case "add", "ready", "lost", "reregister":
+		self.notifyMap.Delete(c)
+	default:
+		panic("unknown notify mode: " + mode)
+	}
+}
+
+// updateSvcCache 新增或替换服务描述，替换服务名对应的整个列表
+func (self *etcdDiscovery) updateSvcCache(desc *discovery.ServiceDesc) {
+
+	self.svcCacheGuard.Lock()
+
+	// 服务名变化时从原来的列表移除
+	var prevDesc *discovery.ServiceDesc
+	if prevName, ok := self.svcNameByID[desc.ID]; ok && prevName != desc.Name {
+		prevDesc = self.removeSvcLocked(desc.ID, prevName)
+	}
+
+	list := self.svcCache[desc.Name]
+	newList := make([]*discovery.ServiceDesc, 0, len(list)+1)
+
+	replaced := false
+	for _, svc := range list {
+		if svc.ID == desc.ID {
+			prevDesc = svc
+			replaced = true
+			newList = append(newList, desc)
+		} else {
+			newList = append(newList, svc)
+		}
+	}
+
+	if !replaced {
+		newList = append(newList, desc)
+	}
+
+	self.svcCache[desc.Name] = newList
+	self.svcNameByID[desc.ID] = desc.Name
+	self.svcCacheGuard.Unlock()
+
+	self.triggerNotify("add", time.Second*10)
+
+	switch {
+	case prevDesc == nil:
+		self.triggerServiceEvent(discovery.ServiceEvent{
+			Kind: discovery.ServiceEventKind_Added,
+			Desc: desc,
+		}, time.Second*10)
+	case !prevDesc.Equals(desc):
+		self.triggerServiceEvent(discovery.ServiceEvent{
+			Kind:     discovery.ServiceEventKind_Updated,
+			Desc:     desc,
+			PrevDesc: prevDesc,
+		}, time.Second*10)
+	}
+}
+
+// deleteSvcCache 移除服务描述
+func (self *etcdDiscovery) deleteSvcCache(svcid string) {
+
+	self.svcCacheGuard.Lock()
+
+	var removedDesc *discovery.ServiceDesc
+	if svcName, ok := self.svcNameByID[svcid]; ok {
+		removedDesc = self.removeSvcLocked(svcid, svcName)
+	}
+
+	self.svcCacheGuard.Unlock()
+
+	if removedDesc != nil {
+		self.triggerServiceEvent(discovery.ServiceEvent{
+			Kind: discovery.ServiceEventKind_Removed,
+			Desc: removedDesc,
+		}, time.Second*10)
+	}
+}
+
+// removeSvcLocked 从服务名对应的列表中移除服务，需要持有svcCacheGuard
+func (self *etcdDiscovery) removeSvcLocked(svcid, svcName string) (removedDesc *discovery.ServiceDesc) {
+
+	list := self.svcCache[svcName]
+	newList := make([]*discovery.ServiceDesc, 0, len(list))
+
+	for _, svc := range list {
+		if svc.ID == svcid {
+			removedDesc = svc
+		} else {
+			newList = append(newList, svc)
+		}
+	}
+
+	if len(newList) == 0 {
+		delete(self.svcCache, svcName)
+	} else {
+		self.svcCache[svcName] = newList
+	}
+
+	delete(self.svcNameByID, svcid)
+
+	return
+}
@@ -0,0 +1,336 @@
+package etcdsd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/bobwong89757/cellmesh/discovery"
+	"github.com/bobwong89757/cellmesh/util"
+	"github.com/bobwong89757/cellnet/log"
+	"github.com/bobwong89757/cellnet/util"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"sort"
+	"strings"
+	"time"
+)
+
+// watchContext 是服务事件侦听的内部结构
+type watchContext struct {
+	stack string // 注册时的调用栈信息，用于调试
+	name  string // 侦听的服务名，支持通配符；侦听配置值时为键前缀
+}
+
+func (self *etcdDiscovery) WatchService(name string) (ret chan discovery.ServiceEvent) {
+	ret = make(chan discovery.ServiceEvent, 100)
+
+	self.watchMap.Store(ret, &watchContext{
+		name:  name,
+		stack: util.StackToString(5),
+	})
+
+	return
+}
+
+func (self *etcdDiscovery) UnwatchService(c chan discovery.ServiceEvent) {
+	self.watchMap.Delete(c)
+}
+
+// triggerServiceEvent 将服务事件投递给所有匹配的侦听者
+func (self *etcdDiscovery) triggerServiceEvent(ev discovery.ServiceEvent, timeout time.Duration) {
+
+	self.watchMap.Range(func(key, value interface{}) bool {
+
+		ctx := value.(*watchContext)
+
+		if !meshutil.WildcardPatternMatch(ev.Desc.Name, ctx.name) {
+			return true
+		}
+
+		c := key.(chan discovery.ServiceEvent)
+
+		select {
+		case c <- ev:
+		case <-time.After(timeout):
+			// 接收事件阻塞太久，或者没有释放侦听的channel
+			log.GetLog().Errorf("service event(%s) timeout, not free? regstack: %s", ctx.name, ctx.stack)
+		}
+
+		return true
+	})
+}
+
+// WatchValue 侦听配置值的设置及删除事件
+// 参数:
+//   - prefix: 键前缀，为空时侦听所有键
+// 返回:
+//   - ret: 用于接收事件的channel
+func (self *etcdDiscovery) WatchValue(prefix string) (ret chan discovery.ValueEvent) {
+	ret = make(chan discovery.ValueEvent, 100)
+
+	self.valueWatchMap.Store(ret, &watchContext{
+		name:  prefix,
+		stack: util.StackToString(5),
+	})
+
+	return
+}
+
+func (self *etcdDiscovery) UnwatchValue(c chan discovery.ValueEvent) {
+	self.valueWatchMap.Delete(c)
+}
+
+// triggerValueEvent 将配置值事件投递给所有匹配的侦听者
+func (self *etcdDiscovery) triggerValueEvent(ev discovery.ValueEvent, timeout time.Duration) {
+
+	self.valueWatchMap.Range(func(key, value interface{}) bool {
+
+		ctx := value.(*watchContext)
+
+		if !strings.HasPrefix(ev.Key, ctx.name) {
+			return true
+		}
+
+		c := key.(chan discovery.ValueEvent)
+
+		select {
+		case c <- ev:
+		case <-time.After(timeout):
+			// 接收事件阻塞太久，或者没有释放侦听的channel
+			log.GetLog().Errorf("value event(%s) timeout, not free? regstack: %s", ctx.name, ctx.stack)
+		}
+
+		return true
+	})
+}
+
+// watchLoop 从缓存的修订号开始侦听修改，侦听中断或修订号已被压缩时重新拉取全部数据
+func (self *etcdDiscovery) watchLoop() {
+
+	for {
+
+		ctx, cancel := context.WithCancel(clientv3.WithRequireLeader(self.ctx))
+		watchChan := self.client.Watch(ctx, self.root, clientv3.WithPrefix(), clientv3.WithRev(self.revision+1))
+
+		for resp := range watchChan {
+
+			if resp.CompactRevision != 0 {
+				log.GetLog().Warnf("etcd watch revision %d compacted, reload", self.revision)
+				break
+			}
+
+			if err := resp.Err(); err != nil {
+				log.GetLog().Errorf("etcd watch failed, %s", err.Error())
+				break
+			}
+
+			for _, ev := range resp.Events {
+				self.applyEvent(ev)
+			}
+
+			self.revision = resp.Header.Revision
+		}
+
+		cancel()
+
+		for {
+
+			if self.ctx.Err() != nil {
+				return
+			}
+
+			reloadCtx, reloadCancel := self.requestContext(context.Background())
+			err := self.reload(reloadCtx)
+			reloadCancel()
+
+			if err == nil {
+				break
+			}
+
+			log.GetLog().Errorf("etcd reload failed, %s", err.Error())
+
+			select {
+			case <-time.After(self.config.ReconnectDuration):
+			case <-self.ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// applyEvent 将一个修改应用到缓存并发送事件
+func (self *etcdDiscovery) applyEvent(ev *clientv3.Event) {
+
+	key := strings.TrimPrefix(string(ev.Kv.Key), self.root)
+
+	switch {
+	case discovery.IsServiceKey(key) && ev.Type == clientv3.EventTypePut:
+
+		var desc discovery.ServiceDesc
+		if err := json.Unmarshal(ev.Kv.Value, &desc); err != nil {
+			log.GetLog().Errorf("ServiceDesc unmarshal failed, %s", err)
+			return
+		}
+
+		self.updateSvcCache(&desc)
+
+	case discovery.IsServiceKey(key):
+		self.deleteSvcCache(discovery.GetSvcIDByServiceKey(key))
+
+	case ev.Type == clientv3.EventTypePut:
+
+		self.kvCacheGuard.Lock()
+		self.kvCache[key] = ev.Kv.Value
+		self.kvCacheGuard.Unlock()
+
+		self.triggerValueEvent(discovery.ValueEvent{
+			Kind:  discovery.ValueEventKind_Set,
+			Key:   key,
+			Value: ev.Kv.Value,
+		}, time.Second*10)
+
+	default:
+
+		self.kvCacheGuard.Lock()
+		delete(self.kvCache, key)
+		self.kvCacheGuard.Unlock()
+
+		self.triggerValueEvent(discovery.ValueEvent{
+			Kind: discovery.ValueEventKind_Deleted,
+			Key:  key,
+		}, time.Second*10)
+	}
+}
+
+// reload 拉取命名空间下的所有键替换缓存，并按新旧缓存的差异发送事件
+func (self *etcdDiscovery) reload(ctx context.Context) error {
+
+	resp, err := self.client.Get(ctx, self.root, clientv3.WithPrefix())
+	if err != nil {
+		return err
+	}
+
+	newKV := map[string][]byte{}
+	newSvc := map[string][]*discovery.ServiceDesc{}
+	newNameByID := map[string]string{}
+	newDesc := map[string]*discovery.ServiceDesc{}
+
+	for _, kv := range resp.Kvs {
+
+		key := strings.TrimPrefix(string(kv.Key), self.root)
+
+		if !discovery.IsServiceKey(key) {
+			newKV[key] = kv.Value
+			continue
+		}
+
+		var desc discovery.ServiceDesc
+		if err := json.Unmarshal(kv.Value, &desc); err != nil {
+			log.GetLog().Errorf("ServiceDesc unmarshal failed, %s", err)
+			continue
+		}
+
+		newSvc[desc.Name] = append(newSvc[desc.Name], &desc)
+		newNameByID[desc.ID] = desc.Name
+		newDesc[desc.ID] = &desc
+	}
+
+	self.kvCacheGuard.Lock()
+	oldKV := self.kvCache
+	self.kvCache = newKV
+	self.kvCacheGuard.Unlock()
+
+	self.svcCacheGuard.Lock()
+	oldSvc := self.svcCache
+	self.svcCache = newSvc
+	self.svcNameByID = newNameByID
+	self.svcCacheGuard.Unlock()
+
+	self.revision = resp.Header.Revision
+
+	self.triggerReloadEvent(oldKV, newKV, oldSvc, newDesc)
+
+	return nil
+}
+
+// triggerReloadEvent 按替换前后缓存的差异发送事件
+func (self *etcdDiscovery) triggerReloadEvent(oldKV, newKV map[string][]byte, oldSvc map[string][]*discovery.ServiceDesc, newDesc map[string]*discovery.ServiceDesc) {
+
+	var keys []string
+	for key := range oldKV {
+		if _, ok := newKV[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+
+	for key, value := range newKV {
+		if oldValue, ok := oldKV[key]; !ok || !bytes.Equal(oldValue, value) {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+
+		if value, ok := newKV[key]; ok {
+			self.triggerValueEvent(discovery.ValueEvent{
+				Kind:  discovery.ValueEventKind_Set,
+				Key:   key,
+				Value: value,
+			}, time.Second*10)
+		} else {
+			self.triggerValueEvent(discovery.ValueEvent{
+				Kind: discovery.ValueEventKind_Deleted,
+				Key:  key,
+			}, time.Second*10)
+		}
+	}
+
+	oldDesc := map[string]*discovery.ServiceDesc{}
+	for _, list := range oldSvc {
+		for _, desc := range list {
+			oldDesc[desc.ID] = desc
+
+			if _, ok := newDesc[desc.ID]; !ok {
+				self.triggerServiceEvent(discovery.ServiceEvent{
+					Kind: discovery.ServiceEventKind_Removed,
+					Desc: desc,
+				}, time.Second*10)
+			}
+		}
+	}
+
+	var svcIDs []string
+	for svcid := range newDesc {
+		svcIDs = append(svcIDs, svcid)
+	}
+
+	sort.Strings(svcIDs)
+
+	svcAdded := false
+	for _, svcid := range svcIDs {
+
+		desc := newDesc[svcid]
+		prevDesc, existed := oldDesc[svcid]
+
+		switch {
+		case !existed:
+			svcAdded = true
+			self.triggerServiceEvent(discovery.ServiceEvent{
+				Kind: discovery.ServiceEventKind_Added,
+				Desc: desc,
+			}, time.Second*10)
+		case !prevDesc.Equals(desc):
+			svcAdded = true
+			self.triggerServiceEvent(discovery.ServiceEvent{
+				Kind:     discovery.ServiceEventKind_Updated,
+				Desc:     desc,
+				PrevDesc: prevDesc,
+			}, time.Second*10)
+		}
+	}
+
+	if svcAdded {
+		self.triggerNotify("add", time.Second*10)
+	}
+}
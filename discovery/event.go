@@ -0,0 +1,63 @@
+package discovery
+
+// ServiceEventKind 是服务变化事件的类型
+type ServiceEventKind int
+
+const (
+	ServiceEventKind_Added   ServiceEventKind = iota // 服务新增
+	ServiceEventKind_Updated                         // 服务描述发生变化
+	ServiceEventKind_Removed                         // 服务移除
+)
+
+// String 返回事件类型的字符串表示
+// 返回:
+//   - string: 事件类型名称
+func (self ServiceEventKind) String() string {
+	switch self {
+	case ServiceEventKind_Added:
+		return "added"
+	case ServiceEventKind_Updated:
+		return "updated"
+	case ServiceEventKind_Removed:
+		return "removed"
+	}
+
+	return "unknown"
+}
+
+// ServiceEvent 表示一次服务变化事件
+// 通过Discovery.WatchService获得
+type ServiceEvent struct {
+	Kind     ServiceEventKind // 事件类型
+	Desc     *ServiceDesc     // 变化后的服务描述，移除事件时为被移除的服务描述
+	PrevDesc *ServiceDesc     // 变化前的服务描述，仅Updated事件有效
+}
+
+// ValueEventKind 是配置值变化事件的类型
+type ValueEventKind int
+
+const (
+	ValueEventKind_Set     ValueEventKind = iota // 值被设置
+	ValueEventKind_Deleted                       // 值被删除
+)
+
+// String 返回事件类型的字符串表示
+// 返回:
+//   - string: 事件类型名称
+func (self ValueEventKind) String() string {
+	switch self {
+	case ValueEventKind_Set:
+		return "set"
+	case ValueEventKind_Deleted:
+		return "deleted"
+	}
+
+	return "unknown"
+}
+
+// ValueEvent 表示一次配置值变化事件
+type ValueEvent struct {
+	Kind  ValueEventKind // 事件类型
+	Key   string         // 键名
+	Value []byte         // 设置后的值，删除事件时为空
+}
@@ -0,0 +1,168 @@
+package filesd
+
+import (
+	"context"
+	"errors"
+	"github.com/bobwong89757/cellmesh/discovery"
+	"github.com/bobwong89757/cellmesh/discovery/localsd"
+	"github.com/bobwong89757/cellnet/log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 从YAML或JSON文件加载服务及配置，供本机开发使用，不需要启动memsd
+// 数据保存在进程内的localsd中，文件修改后按差异更新，与memsd一样发送"add"通知及服务、配置值事件
+// 进程中的Register、SetValue只在本进程内生效，不写回文件
+
+// Config 是文件服务发现的配置结构
+type Config struct {
+	FileName       string        // 服务及配置文件，按扩展名(.yaml、.yml、.json)解析
+	RejectRegister bool          // 为true时Register及Deregister返回ErrRegisterRejected，服务只能写在文件中
+	CheckDuration  time.Duration // 检查文件修改的间隔
+}
+
+// DefaultConfig 返回默认的配置
+// 默认接受Register并只在本进程内生效，每秒检查一次文件修改
+// 返回:
+//   - *Config: 默认配置实例
+func DefaultConfig() *Config {
+
+	return &Config{
+		CheckDuration: time.Second,
+	}
+}
+
+// localBackend 是localsd实现的接口
+type localBackend interface {
+	discovery.DiscoveryCtx
+	discovery.DiscoveryCAS
+	discovery.DiscoveryBatch
+
+	GetRawValue(key string) ([]byte, error)
+	GetValueDirect(key string, valuePtr interface{}) error
+	GetRawValueList(prefix string) []discovery.ValueMeta
+	WatchValue(prefix string) chan discovery.ValueEvent
+	UnwatchValue(c chan discovery.ValueEvent)
+}
+
+// fileDiscovery 是基于文件的服务发现实现
+type fileDiscovery struct {
+	localBackend
+
+	config *Config
+
+	fileSvc   map[string]*discovery.ServiceDesc // 上次从文件加载的服务，键为服务ID，只在加载时访问
+	fileValue map[string][]byte                 // 上次从文件加载的配置值，只在加载时访问
+	loadGuard sync.Mutex                        // 保证加载不并发执行
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// NewDiscovery 加载文件并开始检查文件修改
+// 参数:
+//   - config: 配置对象，FileName不能为空
+// 返回:
+//   - discovery.Discovery: 服务发现实例，同时实现了DiscoveryCtx、DiscoveryCAS及DiscoveryBatch
+//   - error: 文件读取或解析失败时返回错误信息
+func NewDiscovery(config *Config) (discovery.Discovery, error) {
+
+	self := &fileDiscovery{
+		localBackend: localsd.NewDiscovery().(localBackend),
+		config:       config,
+		fileSvc:      make(map[string]*discovery.ServiceDesc),
+		fileValue:    make(map[string][]byte),
+		closed:       make(chan struct{}),
+	}
+
+	lastModTime := self.modTime()
+
+	if err := self.load(); err != nil {
+		return nil, err
+	}
+
+	go self.checkLoop(lastModTime)
+
+	return self, nil
+}
+
+// Close 停止检查文件修改
+func (self *fileDiscovery) Close() {
+	self.closeOnce.Do(func() {
+		close(self.closed)
+	})
+}
+
+func (self *fileDiscovery) Register(svc *discovery.ServiceDesc) error {
+	return self.RegisterCtx(context.Background(), svc)
+}
+
+// RegisterCtx 设置RejectRegister时拒绝注册，否则只在本进程内注册
+func (self *fileDiscovery) RegisterCtx(ctx context.Context, svc *discovery.ServiceDesc) error {
+
+	if self.config.RejectRegister {
+		return ErrRegisterRejected
+	}
+
+	return self.localBackend.RegisterCtx(ctx, svc)
+}
+
+func (self *fileDiscovery) Deregister(svcid string) error {
+	return self.DeregisterCtx(context.Background(), svcid)
+}
+
+func (self *fileDiscovery) DeregisterCtx(ctx context.Context, svcid string) error {
+
+	if self.config.RejectRegister {
+		return ErrRegisterRejected
+	}
+
+	return self.localBackend.DeregisterCtx(ctx, svcid)
+}
+
+// parseAddress 解析file://之后的部分，例如"./sd.yaml?register=reject"
+func parseAddress(addr string) (*Config, error) {
+
+	config := DefaultConfig()
+
+	fileName, rawQuery, _ := strings.Cut(addr, "?")
+	config.FileName = fileName
+
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	switch query.Get("register") {
+	case "", "local":
+	case "reject":
+		config.RejectRegister = true
+	default:
+		return nil, errors.New("unknown register policy: " + query.Get("register"))
+	}
+
+	return config, nil
+}
+
+func init() {
+
+	discovery.RegisterBackend("file", func(ctx context.Context, backendConfig *discovery.BackendConfig) (discovery.Discovery, error) {
+
+		config, err := parseAddress(backendConfig.Address)
+		if err != nil {
+			return nil, err
+		}
+
+		sd, err := NewDiscovery(config)
+		if err != nil {
+			log.GetLog().Errorf("load discovery file '%s' failed, %s", config.FileName, err.Error())
+			return nil, err
+		}
+
+		return sd, nil
+	})
+}
+
+var _ discovery.DiscoveryCtx = (*fileDiscovery)(nil)
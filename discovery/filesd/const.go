@@ -0,0 +1,13 @@
+package filesd
+
+import (
+	"errors"
+	"github.com/bobwong89757/cellmesh/discovery"
+)
+
+var (
+	ErrRegisterRejected = errors.New("file discovery rejects register")
+
+	// 与其他服务发现后端共用的错误值
+	ErrValueNotExists = discovery.ErrValueNotExists
+)
@@ -0,0 +1,234 @@
+package filesd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/bobwong89757/cellmesh/discovery"
+	"github.com/bobwong89757/cellnet/log"
+	"github.com/bobwong89757/gnbutils/yaml"
+	"os"
+	"sort"
+	"time"
+)
+
+// fileContent 是服务发现文件的内容，与helpers.MConfig一样使用yaml.YamlUtil读取
+// YamlUtil读取时将所有map的键转为小写，区分大小写的元数据名及配置键写在列表项的key中
+// YAML示例:
+//
+//	services:
+//	  - name: game
+//	    id: game#0@dev
+//	    host: 127.0.0.1
+//	    port: 9001
+//	    meta:
+//	      - {key: SvcGroup, value: dev}
+//	values:
+//	  - key: config/game
+//	    value: {maxplayer: 100}
+type fileContent struct {
+	Services []*fileService `mapstructure:"services"` // 服务列表，字段名不区分大小写
+	Values   []*fileValue   `mapstructure:"values"`   // 配置值
+}
+
+// fileService 是文件中的服务描述
+type fileService struct {
+	Name string
+	ID   string
+	Host string
+	Port int
+	Tags []string
+	Meta []*fileValue
+}
+
+// fileValue 是文件中的键值对
+type fileValue struct {
+	Key   string
+	Value interface{} // 字符串及数值原样保存，其他类型保存为JSON，其中map的键为小写
+}
+
+// readFile 使用YamlUtil读取文件，扩展名为.json时按JSON解析，否则按扩展名对应的格式解析
+func readFile(fileName string) (content fileContent, err error) {
+
+	// YamlUtil读取失败时panic
+	defer func() {
+		if raw := recover(); raw != nil {
+			err = fmt.Errorf("%v", raw)
+		}
+	}()
+
+	var util yaml.YamlUtil
+	util.InitConfig(fileName)
+
+	err = util.GetViper().Unmarshal(&content)
+
+	return
+}
+
+// toServiceDesc 转换为服务描述
+func (self *fileService) toServiceDesc() (*discovery.ServiceDesc, error) {
+
+	if self.Name == "" || self.ID == "" {
+		return nil, errors.New("expect svc name and id")
+	}
+
+	desc := &discovery.ServiceDesc{
+		Name: self.Name,
+		ID:   self.ID,
+		Host: self.Host,
+		Port: self.Port,
+		Tags: self.Tags,
+	}
+
+	for _, meta := range self.Meta {
+
+		if meta == nil || meta.Key == "" {
+			return nil, errors.New("expect meta key: " + self.ID)
+		}
+
+		desc.SetMeta(meta.Key, fmt.Sprint(meta.Value))
+	}
+
+	return desc, nil
+}
+
+// load 读取文件，与上次加载的内容比较后更新服务及配置值
+// 文件中移除的服务及配置值会被删除，进程中通过Register、SetValue添加的不受影响
+func (self *fileDiscovery) load() error {
+
+	content, err := readFile(self.config.FileName)
+	if err != nil {
+		return err
+	}
+
+	// 修改前检查所有服务，避免只加载一部分
+	fileSvc := make(map[string]*discovery.ServiceDesc, len(content.Services))
+	svcList := make([]*discovery.ServiceDesc, 0, len(content.Services))
+	for _, raw := range content.Services {
+
+		if raw == nil {
+			return errors.New("expect svc name and id")
+		}
+
+		svc, err := raw.toServiceDesc()
+		if err != nil {
+			return err
+		}
+
+		if _, ok := fileSvc[svc.ID]; ok {
+			return errors.New("duplicate svc id: " + svc.ID)
+		}
+
+		fileSvc[svc.ID] = svc
+		svcList = append(svcList, svc)
+	}
+
+	fileValue := make(map[string][]byte, len(content.Values))
+	for _, value := range content.Values {
+
+		if value == nil || value.Key == "" {
+			return errors.New("expect value key")
+		}
+
+		raw, err := discovery.AnyToBytes(value.Value, false)
+		if err != nil {
+			return err
+		}
+
+		fileValue[value.Key] = raw
+	}
+
+	self.loadGuard.Lock()
+	defer self.loadGuard.Unlock()
+
+	// 配置值在一次批量操作中修改，出错时不修改服务
+	var ops []discovery.BatchOp
+	for _, key := range sortedKeys(fileValue) {
+		if prev, ok := self.fileValue[key]; !ok || !bytes.Equal(prev, fileValue[key]) {
+			ops = append(ops, discovery.BatchOp{Key: key, Value: string(fileValue[key])})
+		}
+	}
+
+	for _, key := range sortedKeys(self.fileValue) {
+		if _, ok := fileValue[key]; !ok {
+			ops = append(ops, discovery.BatchOp{Key: key, Delete: true})
+		}
+	}
+
+	if len(ops) > 0 {
+		if _, err := self.localBackend.Batch(ops); err != nil {
+			return err
+		}
+	}
+
+	self.fileValue = fileValue
+
+	for _, svc := range svcList {
+		if prev, ok := self.fileSvc[svc.ID]; !ok || !prev.Equals(svc) {
+			if err := self.localBackend.Register(svc); err != nil {
+				return err
+			}
+		}
+	}
+
+	for id := range self.fileSvc {
+		if _, ok := fileSvc[id]; !ok {
+			self.localBackend.Deregister(id)
+		}
+	}
+
+	self.fileSvc = fileSvc
+
+	return nil
+}
+
+// modTime 返回文件的修改时间，文件不存在时返回零值
+func (self *fileDiscovery) modTime() time.Time {
+
+	if info, err := os.Stat(self.config.FileName); err == nil {
+		return info.ModTime()
+	}
+
+	return time.Time{}
+}
+
+// checkLoop 定时检查文件的修改时间，变化时重新加载
+// 参数:
+//   - lastModTime: 首次加载前的修改时间，加载过程中文件被修改时也能重新加载
+func (self *fileDiscovery) checkLoop(lastModTime time.Time) {
+
+	ticker := time.NewTicker(self.config.CheckDuration)
+	defer ticker.Stop()
+
+	for {
+
+		select {
+		case <-ticker.C:
+		case <-self.closed:
+			return
+		}
+
+		info, err := os.Stat(self.config.FileName)
+		if err != nil || info.ModTime().Equal(lastModTime) {
+			continue
+		}
+
+		lastModTime = info.ModTime()
+
+		if err := self.load(); err != nil {
+			log.GetLog().Errorf("reload discovery file failed: %s %s", self.config.FileName, err.Error())
+		}
+	}
+}
+
+func sortedKeys(m map[string][]byte) []string {
+
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
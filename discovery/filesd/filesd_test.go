@@ -0,0 +1,184 @@
+package filesd
+
+import (
+	"context"
+	"github.com/bobwong89757/cellmesh/discovery"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testYaml = `
+services:
+  - name: game
+    id: game#0@dev
+    host: 127.0.0.1
+    port: 9001
+    meta:
+      - {key: SvcGroup, value: dev}
+values:
+  - {key: config/name, value: dev}
+  - {key: config/Mixed, value: '{"MaxPlayer": 100}'}
+  - key: config/game
+    value: {maxplayer: 100}
+`
+
+func writeFile(t *testing.T, fileName, content string, modTime time.Time) {
+
+	if err := os.WriteFile(fileName, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// 保证修改时间变化，不依赖文件系统的时间精度
+	if err := os.Chtimes(fileName, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	t.Parallel()
+
+	fileName := filepath.Join(t.TempDir(), "sd.yaml")
+	writeFile(t, fileName, testYaml, time.Unix(1000, 0))
+
+	config := DefaultConfig()
+	config.FileName = fileName
+	config.CheckDuration = time.Millisecond * 10
+
+	sd, err := NewDiscovery(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer sd.(*fileDiscovery).Close()
+
+	list := sd.Query("game")
+	if len(list) != 1 || list[0].Port != 9001 || list[0].GetMeta("SvcGroup") != "dev" {
+		t.Fatalf("unexpected services: %+v", list)
+	}
+
+	var name string
+	if err := sd.GetValue("config/name", &name); err != nil || name != "dev" {
+		t.Fatalf("unexpected value: %s %v", name, err)
+	}
+
+	var game struct {
+		MaxPlayer int `json:"maxplayer"`
+	}
+	if err := sd.GetValue("config/game", &game); err != nil || game.MaxPlayer != 100 {
+		t.Fatalf("unexpected value: %+v %v", game, err)
+	}
+
+	// 列表项中的键及字符串值保持大小写
+	var mixed string
+	if err := sd.GetValue("config/Mixed", &mixed); err != nil || mixed != `{"MaxPlayer": 100}` {
+		t.Fatalf("unexpected mixed case value: %s %v", mixed, err)
+	}
+
+	// 本地设置的值不受重新加载影响
+	if err := sd.SetValue("local/key", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	added := sd.RegisterNotify("add")
+	defer sd.DeregisterNotify("add", added)
+
+	writeFile(t, fileName, `
+services:
+  - name: game
+    id: game#0@dev
+    port: 9002
+  - name: login
+    id: login#0@dev
+    port: 9003
+values:
+  - {key: config/name, value: test}
+`, time.Unix(2000, 0))
+
+	select {
+	case <-added:
+	case <-time.After(time.Second * 5):
+		t.Fatal("expect add notify")
+	}
+
+	// 服务逐个注册，等待全部加载
+	deadline := time.Now().Add(time.Second * 5)
+	for len(sd.Query("login")) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	if list := sd.Query("game"); len(list) != 1 || list[0].Port != 9002 {
+		t.Fatalf("unexpected services: %+v", list)
+	}
+
+	if len(sd.Query("login")) != 1 {
+		t.Fatal("expect login service")
+	}
+
+	if err := sd.GetValue("config/name", &name); err != nil || name != "test" {
+		t.Fatalf("unexpected value: %s %v", name, err)
+	}
+
+	if err := sd.GetValue("config/game", &game); err != ErrValueNotExists {
+		t.Fatalf("expect value removed, got %v", err)
+	}
+
+	var local int
+	if err := sd.GetValue("local/key", &local); err != nil || local != 1 {
+		t.Fatalf("unexpected local value: %d %v", local, err)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	t.Parallel()
+
+	fileName := filepath.Join(t.TempDir(), "sd.json")
+	writeFile(t, fileName, `{"services": [{"Name": "game", "ID": "game#0@dev", "Port": 9001}]}`, time.Unix(1000, 0))
+
+	ctx := context.Background()
+
+	sd, err := discovery.NewBackend(ctx, "file://"+fileName, discovery.BackendConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer sd.(*fileDiscovery).Close()
+
+	if len(sd.Query("game")) != 1 {
+		t.Fatal("expect game service")
+	}
+
+	// 默认只在本进程内注册
+	if err := sd.Register(&discovery.ServiceDesc{Name: "login", ID: "login#0@dev"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sd.Query("login")) != 1 {
+		t.Fatal("expect login service")
+	}
+
+	rejectSD, err := discovery.NewBackend(ctx, "file://"+fileName+"?register=reject", discovery.BackendConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer rejectSD.(*fileDiscovery).Close()
+
+	if err := rejectSD.Register(&discovery.ServiceDesc{Name: "login", ID: "login#0@dev"}); err != ErrRegisterRejected {
+		t.Fatalf("expect register rejected, got %v", err)
+	}
+
+	if err := rejectSD.Deregister("game#0@dev"); err != ErrRegisterRejected {
+		t.Fatalf("expect deregister rejected, got %v", err)
+	}
+
+	if _, err := discovery.NewBackend(ctx, "file://"+fileName+"?register=unknown", discovery.BackendConfig{}); err == nil {
+		t.Fatal("expect unknown register policy error")
+	}
+
+	// 读取失败时返回错误
+	if _, err := NewDiscovery(&Config{FileName: filepath.Join(t.TempDir(), "missing.yaml"), CheckDuration: time.Second}); err == nil {
+		t.Fatal("expect missing file error")
+	}
+}
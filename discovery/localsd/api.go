@@ -0,0 +1,120 @@
+package localsd
+
+import (
+	"context"
+	"github.com/bobwong89757/cellmesh/discovery"
+	"sync"
+)
+
+// 进程内的服务发现，数据只保存在内存中，供单元测试使用，不需要启动memsd
+// 修改立即生效，返回前数据已更新，事件也已投递
+// 错误值使用discovery包中各后端共用的值，针对memsd编写的判断(例如election、SafeGetValue)不需要修改
+
+// notifyContext 是通知上下文的内部结构
+type notifyContext struct {
+	stack string // 注册时的调用栈信息，用于调试
+	mode  string // 通知模式
+}
+
+// valueMeta 是一个配置值及其修订号
+type valueMeta struct {
+	Value    []byte
+	Revision int64
+}
+
+// localDiscovery 是进程内服务发现的实现
+type localDiscovery struct {
+	kv          map[string]*valueMeta               // 配置值，不包含服务描述
+	svcCache    map[string][]*discovery.ServiceDesc // 服务缓存，键为服务名，修改时替换列表，不修改已返回的列表
+	svcNameByID map[string]string                   // 服务ID对应的服务名
+	revision    int64                               // 最近一次修改的修订号
+	guard       sync.RWMutex                        // 保护以上数据的读写锁
+
+	modifySeq    int64      // 下一次修改的序号，在guard中分配
+	deliverSeq   int64      // 轮到投递事件的修改序号
+	deliverGuard sync.Mutex // 保护deliverSeq
+	deliverCond  *sync.Cond // deliverSeq变化时通知等待投递的修改
+
+	notifyMap     sync.Map // 通知通道映射，key为channel，value为notifyContext
+	watchMap      sync.Map // 服务事件侦听映射，key为channel，value为watchContext
+	valueWatchMap sync.Map // 配置值事件侦听映射，key为channel，value为watchContext
+}
+
+// NewDiscovery 创建一个空的进程内服务发现实例，每个实例的数据相互独立
+// 返回:
+//   - discovery.Discovery: 服务发现实例，同时实现了DiscoveryCtx、DiscoveryCAS及DiscoveryBatch
+func NewDiscovery() discovery.Discovery {
+
+	self := &localDiscovery{
+		kv:          make(map[string]*valueMeta),
+		svcCache:    make(map[string][]*discovery.ServiceDesc),
+		svcNameByID: make(map[string]string),
+	}
+
+	self.deliverCond = sync.NewCond(&self.deliverGuard)
+
+	return self
+}
+
+// modify 在数据锁中修改，返回的事件在释放数据锁后投递
+// 修改按取得数据锁的顺序排号，轮到时才投递，事件顺序与修改顺序一致
+// 投递时不持有数据锁，接收者可以在处理事件时查询
+func (self *localDiscovery) modify(f func() (events []func())) {
+
+	self.guard.Lock()
+	events := f()
+	seq := self.modifySeq
+	self.modifySeq++
+	self.guard.Unlock()
+
+	self.deliverGuard.Lock()
+	for self.deliverSeq != seq {
+		self.deliverCond.Wait()
+	}
+	self.deliverGuard.Unlock()
+
+	for _, ev := range events {
+		ev()
+	}
+
+	self.deliverGuard.Lock()
+	self.deliverSeq++
+	self.deliverCond.Broadcast()
+	self.deliverGuard.Unlock()
+}
+
+var (
+	sharedByAddr      = map[string]discovery.Discovery{}
+	sharedByAddrGuard sync.Mutex
+)
+
+// Shared 返回地址对应的共享实例，没有时创建
+// sdaddr为"local://<地址>"时，同一进程中使用相同地址的服务共享一个实例
+// 参数:
+//   - addr: 实例名称
+// 返回:
+//   - discovery.Discovery: 服务发现实例
+func Shared(addr string) discovery.Discovery {
+
+	sharedByAddrGuard.Lock()
+	defer sharedByAddrGuard.Unlock()
+
+	sd, ok := sharedByAddr[addr]
+	if !ok {
+		sd = NewDiscovery()
+		sharedByAddr[addr] = sd
+	}
+
+	return sd
+}
+
+func init() {
+
+	discovery.RegisterBackend("local", func(ctx context.Context, config *discovery.BackendConfig) (discovery.Discovery, error) {
+		return Shared(config.Address + "/" + config.Namespace), nil
+	})
+}
+
+var _ discovery.DiscoveryCtx = (*localDiscovery)(nil)
+var _ discovery.DiscoveryCAS = (*localDiscovery)(nil)
+var _ discovery.DiscoveryBatch = (*localDiscovery)(nil)
@@ -0,0 +1,15 @@
+package localsd
+
+import "github.com/bobwong89757/cellmesh/discovery"
+
+const (
+	MaxValueSize = discovery.MaxValueSize
+)
+
+// 与其他服务发现后端共用的错误值
+var (
+	ErrValueNotExists   = discovery.ErrValueNotExists
+	ErrValueTooLarge    = discovery.ErrValueTooLarge
+	ErrRevisionMismatch = discovery.ErrRevisionMismatch
+	ErrInvalidRequest   = discovery.ErrInvalidRequest
+)
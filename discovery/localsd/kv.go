@@ -0,0 +1,297 @@
+package localsd
+
+import (
+	"context"
+	"github.com/bobwong89757/cellmesh/discovery"
+	"sort"
+	"strings"
+	"time"
+)
+
+// prettyPrint 从选项列表中读取格式化输出选项，接受其他后端的Option，租约及临时键选项在进程内没有意义
+func prettyPrint(optList ...interface{}) bool {
+
+	for _, opt := range optList {
+
+		switch raw := opt.(type) {
+		case discovery.PrettyPrintOption:
+			return raw.IsPrettyPrint()
+		}
+	}
+
+	return false
+}
+
+// setLocked 设置值并分配修订号，需要持有guard
+// 返回:
+//   - func(): 投递设置事件
+func (self *localDiscovery) setLocked(key string, raw []byte) func() {
+
+	self.revision++
+	self.kv[key] = &valueMeta{
+		Value:    raw,
+		Revision: self.revision,
+	}
+
+	return func() {
+		self.triggerValueEvent(discovery.ValueEvent{
+			Kind:  discovery.ValueEventKind_Set,
+			Key:   key,
+			Value: raw,
+		}, time.Second*10)
+	}
+}
+
+// deleteLocked 删除值并分配修订号，需要持有guard
+// 返回:
+//   - func(): 投递删除事件
+func (self *localDiscovery) deleteLocked(key string) func() {
+
+	self.revision++
+	delete(self.kv, key)
+
+	return func() {
+		self.triggerValueEvent(discovery.ValueEvent{
+			Kind: discovery.ValueEventKind_Deleted,
+			Key:  key,
+		}, time.Second*10)
+	}
+}
+
+// currentRevision 键的当前修订号，不存在时为0，需要持有guard
+func (self *localDiscovery) currentRevision(key string) int64 {
+
+	if meta, ok := self.kv[key]; ok {
+		return meta.Revision
+	}
+
+	return 0
+}
+
+// encodeValue 与memsd相同地序列化值，服务描述不能通过配置值修改
+func encodeValue(key string, dataPtr interface{}, optList ...interface{}) ([]byte, error) {
+
+	if key == "" || discovery.IsServiceKey(key) {
+		return nil, ErrInvalidRequest
+	}
+
+	raw, err := discovery.AnyToBytes(dataPtr, prettyPrint(optList...))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(raw) > MaxValueSize {
+		return nil, ErrValueTooLarge
+	}
+
+	return raw, nil
+}
+
+func (self *localDiscovery) SetValue(key string, dataPtr interface{}, optList ...interface{}) error {
+	return self.SetValueCtx(context.Background(), key, dataPtr, optList...)
+}
+
+func (self *localDiscovery) SetValueCtx(ctx context.Context, key string, dataPtr interface{}, optList ...interface{}) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	raw, err := encodeValue(key, dataPtr, optList...)
+	if err != nil {
+		return err
+	}
+
+	self.modify(func() []func() {
+		return []func(){self.setLocked(key, raw)}
+	})
+
+	return nil
+}
+
+func (self *localDiscovery) GetValue(key string, valuePtr interface{}) error {
+	return self.GetValueCtx(context.Background(), key, valuePtr)
+}
+
+func (self *localDiscovery) GetValueCtx(ctx context.Context, key string, valuePtr interface{}) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	data, err := self.GetRawValue(key)
+	if err != nil {
+		return err
+	}
+
+	return discovery.BytesToAny(data, valuePtr)
+}
+
+// GetValueDirect 与GetValue相同，进程内没有缓存与服务器的区别
+func (self *localDiscovery) GetValueDirect(key string, valuePtr interface{}) error {
+	return self.GetValue(key, valuePtr)
+}
+
+func (self *localDiscovery) GetRawValue(key string) ([]byte, error) {
+
+	self.guard.RLock()
+	defer self.guard.RUnlock()
+
+	meta, ok := self.kv[key]
+	if !ok {
+		return nil, ErrValueNotExists
+	}
+
+	return meta.Value, nil
+}
+
+func (self *localDiscovery) DeleteValue(key string) error {
+	return self.DeleteValueCtx(context.Background(), key)
+}
+
+// DeleteValueCtx 与memsd相同，删除以key为前缀的所有值
+func (self *localDiscovery) DeleteValueCtx(ctx context.Context, key string) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	self.modify(func() (events []func()) {
+
+		var keys []string
+		for k := range self.kv {
+			if strings.HasPrefix(k, key) {
+				keys = append(keys, k)
+			}
+		}
+
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			events = append(events, self.deleteLocked(k))
+		}
+
+		return
+	})
+
+	return nil
+}
+
+func (self *localDiscovery) GetRawValueList(prefix string) (ret []discovery.ValueMeta) {
+
+	self.guard.RLock()
+	defer self.guard.RUnlock()
+
+	for key, meta := range self.kv {
+
+		if strings.HasPrefix(key, prefix) {
+			ret = append(ret, discovery.ValueMeta{
+				Key:   key,
+				Value: meta.Value,
+			})
+		}
+	}
+
+	return
+}
+
+func (self *localDiscovery) GetValueRevision(key string, valuePtr interface{}) (revision int64, err error) {
+
+	self.guard.RLock()
+	meta, ok := self.kv[key]
+	self.guard.RUnlock()
+
+	if !ok {
+		return 0, ErrValueNotExists
+	}
+
+	return meta.Revision, discovery.BytesToAny(meta.Value, valuePtr)
+}
+
+// SetValueCAS 比较并设置，修订号不一致时返回ErrRevisionMismatch及当前修订号
+func (self *localDiscovery) SetValueCAS(key string, dataPtr interface{}, revision int64, optList ...interface{}) (newRevision int64, err error) {
+
+	raw, err := encodeValue(key, dataPtr, optList...)
+	if err != nil {
+		return 0, err
+	}
+
+	self.modify(func() []func() {
+
+		if newRevision = self.currentRevision(key); newRevision != revision {
+			err = ErrRevisionMismatch
+			return nil
+		}
+
+		ev := self.setLocked(key, raw)
+		newRevision = self.revision
+
+		return []func(){ev}
+	})
+
+	return
+}
+
+// DeleteValueCAS 比较并删除，不按前缀删除
+func (self *localDiscovery) DeleteValueCAS(key string, revision int64) (err error) {
+
+	self.modify(func() []func() {
+
+		switch current := self.currentRevision(key); {
+		case current == 0:
+			err = ErrValueNotExists
+			return nil
+		case current != revision:
+			err = ErrRevisionMismatch
+			return nil
+		}
+
+		return []func(){self.deleteLocked(key)}
+	})
+
+	return
+}
+
+// Batch 检查所有操作后一起执行，任意操作检查失败时都不执行
+func (self *localDiscovery) Batch(ops []discovery.BatchOp) (revision int64, err error) {
+
+	values := make([][]byte, len(ops))
+	for index, op := range ops {
+
+		if op.Key == "" || discovery.IsServiceKey(op.Key) {
+			return 0, ErrInvalidRequest
+		}
+
+		if !op.Delete {
+			if values[index], err = encodeValue(op.Key, op.Value); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	self.modify(func() (events []func()) {
+
+		for _, op := range ops {
+			if op.CheckRevision && self.currentRevision(op.Key) != op.Revision {
+				err = ErrRevisionMismatch
+				return nil
+			}
+		}
+
+		for index, op := range ops {
+
+			switch {
+			case !op.Delete:
+				events = append(events, self.setLocked(op.Key, values[index]))
+			case self.kv[op.Key] != nil:
+				events = append(events, self.deleteLocked(op.Key))
+			}
+		}
+
+		revision = self.revision
+
+		return
+	})
+
+	return
+}
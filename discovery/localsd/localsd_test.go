@@ -0,0 +1,193 @@
+package localsd
+
+import (
+	"bytes"
+	"context"
+	"github.com/bobwong89757/cellmesh/discovery"
+	"github.com/bobwong89757/cellmesh/discovery/election"
+	"testing"
+	"time"
+)
+
+func TestService(t *testing.T) {
+	t.Parallel()
+
+	sd := NewDiscovery()
+
+	added := sd.RegisterNotify("add")
+	defer sd.DeregisterNotify("add", added)
+
+	events := sd.WatchService("game")
+	defer sd.UnwatchService(events)
+
+	desc := &discovery.ServiceDesc{Name: "game", ID: "game#0@dev", Port: 9091}
+	if err := sd.Register(desc); err != nil {
+		t.Fatal(err)
+	}
+
+	// 注册返回时通知及事件已投递
+	select {
+	case <-added:
+	default:
+		t.Fatal("expect add notify")
+	}
+
+	if ev := <-events; ev.Kind != discovery.ServiceEventKind_Added || ev.Desc.ID != "game#0@dev" {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+
+	list := sd.Query("game")
+
+	// 注册的是副本
+	desc.Port = 9092
+	if err := sd.Register(desc); err != nil {
+		t.Fatal(err)
+	}
+
+	if ev := <-events; ev.Kind != discovery.ServiceEventKind_Updated || ev.PrevDesc.Port != 9091 || ev.Desc.Port != 9092 {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+
+	if err := sd.Deregister("game#0@dev"); err != nil {
+		t.Fatal(err)
+	}
+
+	if ev := <-events; ev.Kind != discovery.ServiceEventKind_Removed {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+
+	// 持有的查询结果不受后续修改影响
+	if len(list) != 1 || list[0].Port != 9091 {
+		t.Fatalf("query result changed: %+v", list)
+	}
+
+	if len(sd.Query("game")) != 0 {
+		t.Fatal("expect no service")
+	}
+}
+
+func TestValue(t *testing.T) {
+	t.Parallel()
+
+	sd := NewDiscovery().(*localDiscovery)
+
+	events := sd.WatchValue("cfg/")
+	defer sd.UnwatchValue(events)
+
+	if err := sd.SetValue("cfg/a", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sd.SetValue("cfg/ab", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	var a int
+	if rev, err := sd.GetValueRevision("cfg/a", &a); err != nil || a != 1 || rev != 1 {
+		t.Fatalf("unexpected value: %d %d %v", a, rev, err)
+	}
+
+	if _, err := sd.SetValueCAS("cfg/a", 3, 0); err != ErrRevisionMismatch {
+		t.Fatalf("expect revision mismatch, got %v", err)
+	}
+
+	if _, err := sd.Batch([]discovery.BatchOp{
+		{Key: "cfg/c", Value: 4},
+		{Key: "cfg/a", Value: 5, CheckRevision: true, Revision: 100},
+	}); err != ErrRevisionMismatch {
+		t.Fatalf("expect revision mismatch, got %v", err)
+	}
+
+	if err := sd.GetValue("cfg/c", &a); err != ErrValueNotExists {
+		t.Fatalf("failed batch should not apply, got %v", err)
+	}
+
+	// 按前缀删除
+	if err := sd.DeleteValue("cfg/a"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sd.GetRawValueList("cfg/")) != 0 {
+		t.Fatal("expect all deleted")
+	}
+
+	var kinds []discovery.ValueEventKind
+	for len(events) > 0 {
+		kinds = append(kinds, (<-events).Kind)
+	}
+
+	if len(kinds) != 4 || kinds[0] != discovery.ValueEventKind_Set || kinds[3] != discovery.ValueEventKind_Deleted {
+		t.Fatalf("unexpected events: %v", kinds)
+	}
+}
+
+func TestSafeValue(t *testing.T) {
+	t.Parallel()
+
+	sd := NewDiscovery()
+
+	// 压缩后仍超过一个分片
+	origin := make([]byte, discovery.PackedValueSize*3)
+	for i := range origin {
+		origin[i] = byte(i * 7919 >> 3)
+	}
+
+	if err := discovery.SafeSetValue(sd, "safevalue/big", origin, true); err != nil {
+		t.Fatal(err)
+	}
+
+	var out []byte
+	if err := discovery.SafeGetValue(sd, "safevalue/big", &out, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(origin, out) {
+		t.Fatal("value mismatch")
+	}
+}
+
+func TestElection(t *testing.T) {
+	t.Parallel()
+
+	sd := NewDiscovery().(election.Client)
+
+	a := election.New(sd, "a")
+	b := election.New(sd, "b")
+
+	if ok, err := a.TryLock("lock"); !ok || err != nil {
+		t.Fatalf("lock failed, %v", err)
+	}
+
+	if ok, _ := b.TryLock("lock"); ok {
+		t.Fatal("lock should be held")
+	}
+
+	if err := a.Unlock("lock"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := b.Lock(ctx, "lock"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackend(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	a, err := discovery.NewBackend(ctx, "local://backend", discovery.BackendConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, _ := discovery.NewBackend(ctx, "local://backend", discovery.BackendConfig{})
+	other, _ := discovery.NewBackend(ctx, "local://backend", discovery.BackendConfig{Namespace: "other"})
+
+	if a != b || a == other {
+		t.Fatal("expect shared instance per address and namespace")
+	}
+}
@@ -0,0 +1,249 @@
+package localsd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/bobwong89757/cellmesh/discovery"
+	"github.com/bobwong89757/cellnet/log"
+	"github.com/bobwong89757/cellnet/util"
+	"time"
+)
+
+func (self *localDiscovery) Register(svc *discovery.ServiceDesc) error {
+	return self.RegisterCtx(context.Background(), svc)
+}
+
+// RegisterCtx 保存服务描述的副本，调用方之后修改svc不影响已注册的服务
+func (self *localDiscovery) RegisterCtx(ctx context.Context, svc *discovery.ServiceDesc) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if svc.Name == "" {
+		return errors.New("expect svc name")
+	}
+
+	if svc.ID == "" {
+		return errors.New("expect svc id")
+	}
+
+	// 与memsd一样经过序列化，查询得到的是独立的副本
+	data, err := json.Marshal(svc)
+	if err != nil {
+		return err
+	}
+
+	var desc discovery.ServiceDesc
+	if err = json.Unmarshal(data, &desc); err != nil {
+		return err
+	}
+
+	self.modify(func() (events []func()) {
+
+		// 服务名变化时从原来的列表移除
+		var prevDesc *discovery.ServiceDesc
+		if prevName, ok := self.svcNameByID[desc.ID]; ok && prevName != desc.Name {
+			prevDesc = self.removeSvcLocked(desc.ID, prevName)
+		}
+
+		if replaced := self.putSvcLocked(&desc); replaced != nil {
+			prevDesc = replaced
+		}
+
+		self.revision++
+
+		events = append(events, func() {
+			self.triggerNotify("add", time.Second*10)
+		})
+
+		switch {
+		case prevDesc == nil:
+			events = append(events, func() {
+				self.triggerServiceEvent(discovery.ServiceEvent{
+					Kind: discovery.ServiceEventKind_Added,
+					Desc: &desc,
+				}, time.Second*10)
+			})
+		case !prevDesc.Equals(&desc):
+			events = append(events, func() {
+				self.triggerServiceEvent(discovery.ServiceEvent{
+					Kind:     discovery.ServiceEventKind_Updated,
+					Desc:     &desc,
+					PrevDesc: prevDesc,
+				}, time.Second*10)
+			})
+		}
+
+		return
+	})
+
+	return nil
+}
+
+func (self *localDiscovery) Deregister(svcid string) error {
+	return self.DeregisterCtx(context.Background(), svcid)
+}
+
+// DeregisterCtx 移除服务，服务不存在时不返回错误
+func (self *localDiscovery) DeregisterCtx(ctx context.Context, svcid string) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	self.modify(func() (events []func()) {
+
+		svcName, ok := self.svcNameByID[svcid]
+		if !ok {
+			return
+		}
+
+		removedDesc := self.removeSvcLocked(svcid, svcName)
+		self.revision++
+
+		return append(events, func() {
+			self.triggerServiceEvent(discovery.ServiceEvent{
+				Kind: discovery.ServiceEventKind_Removed,
+				Desc: removedDesc,
+			}, time.Second*10)
+		})
+	})
+
+	return nil
+}
+
+// putSvcLocked 新增服务或在原来的位置替换服务，替换服务名对应的整个列表，需要持有guard
+// 返回:
+//   - prevDesc: 被替换的服务描述，新增时为nil
+func (self *localDiscovery) putSvcLocked(desc *discovery.ServiceDesc) (prevDesc *discovery.ServiceDesc) {
+
+	list := self.svcCache[desc.Name]
+	newList := make([]*discovery.ServiceDesc, 0, len(list)+1)
+
+	for _, svc := range list {
+		if svc.ID == desc.ID {
+			prevDesc = svc
+			newList = append(newList, desc)
+		} else {
+			newList = append(newList, svc)
+		}
+	}
+
+	if prevDesc == nil {
+		newList = append(newList, desc)
+	}
+
+	self.svcCache[desc.Name] = newList
+	self.svcNameByID[desc.ID] = desc.Name
+
+	return
+}
+
+// removeSvcLocked 从服务名对应的列表中移除服务，需要持有guard
+func (self *localDiscovery) removeSvcLocked(svcid, svcName string) (removedDesc *discovery.ServiceDesc) {
+
+	list := self.svcCache[svcName]
+	newList := make([]*discovery.ServiceDesc, 0, len(list))
+
+	for _, svc := range list {
+		if svc.ID == svcid {
+			removedDesc = svc
+		} else {
+			newList = append(newList, svc)
+		}
+	}
+
+	if len(newList) == 0 {
+		delete(self.svcCache, svcName)
+	} else {
+		self.svcCache[svcName] = newList
+	}
+
+	delete(self.svcNameByID, svcid)
+
+	return
+}
+
+// Query 查询服务，返回的列表不会被修改，可以持有
+func (self *localDiscovery) Query(name string) (ret []*discovery.ServiceDesc) {
+
+	self.guard.RLock()
+	defer self.guard.RUnlock()
+
+	return self.svcCache[name]
+}
+
+func (self *localDiscovery) QueryCtx(ctx context.Context, name string) (ret []*discovery.ServiceDesc, err error) {
+
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	return self.Query(name), nil
+}
+
+func (self *localDiscovery) QueryAll() (ret []*discovery.ServiceDesc) {
+
+	self.guard.RLock()
+	defer self.guard.RUnlock()
+
+	for _, list := range self.svcCache {
+		ret = append(ret, list...)
+	}
+
+	return
+}
+
+func (self *localDiscovery) triggerNotify(mode string, timeout time.Duration) {
+
+	self.notifyMap.Range(func(key, value interface{}) bool {
+
+		ctx := value.(*notifyContext)
+
+		if ctx.mode != mode {
+			return true
+		}
+
+		c := key.(chan struct{})
+
+		select {
+		case c <- struct{}{}:
+		case <-time.After(timeout):
+			// 接收通知阻塞太久，或者没有释放侦听的channel
+			log.GetLog().Errorf("notify(%s) timeout, not free? regstack: %s", ctx.mode, ctx.stack)
+		}
+
+		return true
+	})
+}
+
+// RegisterNotify 注册通知
+// 参数:
+//   - mode: "add"服务新增或变化；"ready"、"lost"、"reregister"与memsd兼容，进程内不会断开，不会收到
+func (self *localDiscovery) RegisterNotify(mode string) (ret chan struct{}) {
+	ret = make(chan struct{}, 10)
+
+	switch mode {
+	case "add", "ready", "lost", "reregister":
+		self.notifyMap.Store(ret, &notifyContext{
+			mode:  mode,
+			stack: util.StackToString(5),
+		})
+	default:
+		panic("unknown notify mode: " + mode)
+	}
+
+	return
+}
+
+func (self *localDiscovery) DeregisterNotify(mode string, c chan struct{}) {
+
+	switch mode {
+	case "add", "ready", "lost", "reregister":
+		self.notifyMap.Delete(c)
+	default:
+		panic("unknown notify mode: " + mode)
+	}
+}
@@ -0,0 +1,99 @@
+package localsd
+
+import (
+	"github.com/bobwong89757/cellmesh/discovery"
+	"github.com/bobwong89757/cellmesh/util"
+	"github.com/bobwong89757/cellnet/log"
+	"github.com/bobwong89757/cellnet/util"
+	"strings"
+	"time"
+)
+
+// watchContext 是服务事件侦听的内部结构
+type watchContext struct {
+	stack string // 注册时的调用栈信息，用于调试
+	name  string // 侦听的服务名，支持通配符；侦听配置值时为键前缀
+}
+
+func (self *localDiscovery) WatchService(name string) (ret chan discovery.ServiceEvent) {
+	ret = make(chan discovery.ServiceEvent, 100)
+
+	self.watchMap.Store(ret, &watchContext{
+		name:  name,
+		stack: util.StackToString(5),
+	})
+
+	return
+}
+
+func (self *localDiscovery) UnwatchService(c chan discovery.ServiceEvent) {
+	self.watchMap.Delete(c)
+}
+
+// triggerServiceEvent 将服务事件投递给所有匹配的侦听者
+func (self *localDiscovery) triggerServiceEvent(ev discovery.ServiceEvent, timeout time.Duration) {
+
+	self.watchMap.Range(func(key, value interface{}) bool {
+
+		ctx := value.(*watchContext)
+
+		if !meshutil.WildcardPatternMatch(ev.Desc.Name, ctx.name) {
+			return true
+		}
+
+		c := key.(chan discovery.ServiceEvent)
+
+		select {
+		case c <- ev:
+		case <-time.After(timeout):
+			// 接收事件阻塞太久，或者没有释放侦听的channel
+			log.GetLog().Errorf("service event(%s) timeout, not free? regstack: %s", ctx.name, ctx.stack)
+		}
+
+		return true
+	})
+}
+
+// WatchValue 侦听配置值的设置及删除事件
+// 参数:
+//   - prefix: 键前缀，为空时侦听所有键
+// 返回:
+//   - ret: 用于接收事件的channel
+func (self *localDiscovery) WatchValue(prefix string) (ret chan discovery.ValueEvent) {
+	ret = make(chan discovery.ValueEvent, 100)
+
+	self.valueWatchMap.Store(ret, &watchContext{
+		name:  prefix,
+		stack: util.StackToString(5),
+	})
+
+	return
+}
+
+func (self *localDiscovery) UnwatchValue(c chan discovery.ValueEvent) {
+	self.valueWatchMap.Delete(c)
+}
+
+// triggerValueEvent 将配置值事件投递给所有匹配的侦听者
+func (self *localDiscovery) triggerValueEvent(ev discovery.ValueEvent, timeout time.Duration) {
+
+	self.valueWatchMap.Range(func(key, value interface{}) bool {
+
+		ctx := value.(*watchContext)
+
+		if !strings.HasPrefix(ev.Key, ctx.name) {
+			return true
+		}
+
+		c := key.(chan discovery.ValueEvent)
+
+		select {
+		case c <- ev:
+		case <-time.After(timeout):
+			// 接收事件阻塞太久，或者没有释放侦听的channel
+			log.GetLog().Errorf("value event(%s) timeout, not free? regstack: %s", ctx.name, ctx.stack)
+		}
+
+		return true
+	})
+}
@@ -1,9 +1,10 @@
 package memsd
 
 import (
+	"context"
 	"github.com/bobwong89757/cellmesh/discovery"
-	"github.com/bobwong89757/cellmesh/discovery/memsd/model"
 	"github.com/bobwong89757/cellnet"
+	"github.com/bobwong89757/cellnet/log"
 	"sync"
 )
 
@@ -25,45 +26,147 @@ type memDiscovery struct {
 	kvCache      map[string][]byte // KV配置缓存
 	kvCacheGuard sync.RWMutex      // 保护KV缓存的读写锁
 
-	svcCache      map[string][]*discovery.ServiceDesc // 服务缓存，键为服务名，值为服务描述列表
-	svcCacheGuard sync.RWMutex                        // 保护服务缓存的读写锁
+	svcCache      *svcSnapshot // 当前版本的服务缓存，修改时整体替换
+	svcCacheGuard sync.RWMutex // 保护svcCache的读写锁
 
 	notifyMap sync.Map // 通知通道映射，key为channel，value为notifyContext
 
-	initWg *sync.WaitGroup // 初始化等待组，用于等待初始数据拉取完成
+	watchMap sync.Map // 服务事件侦听映射，key为channel，value为watchContext
+
+	localSvc       map[string]*discovery.ServiceDesc // 本实例注册的服务，键为服务ID，重连后重新注册
+	localSvcGuard  sync.Mutex                        // 保护localSvc及reregisterHook的互斥锁
+	reregisterHook discovery.ReregisterHook          // 重新注册之前的回调
+
+	valueWatchMap sync.Map // 配置值事件侦听映射，key为channel，value为watchContext
+
+	queue          cellnet.EventQueue // 处理网络事件的队列
+	stopQueueOnce  sync.Once          // 保证队列只停止一次
+	connector      cellnet.Peer       // 当前连接服务发现服务器的Connector
+	connectorGuard sync.Mutex         // 保护connector的互斥锁
+	addrIndex      int                // 当前连接的服务器在地址列表中的索引，只在队列中访问
+	failCount      int                // 连续连接失败的次数，只在队列中访问
+	redirectAddr   string             // 备机告知的主机地址，下次优先连接，只在队列中访问
+
+	initReady chan struct{} // 初始数据拉取完成时关闭
+	initOnce  sync.Once     // 保证initReady只关闭一次
+	initErr   error         // 初始化失败的原因，initReady关闭后读取
+	closed    int32         // 实例已关闭，不再处理新建立的连接
+
+	authFailCount int // 运行中连续认证失败的次数，用于计算重连间隔，只在队列中访问
 
 	token string // 认证令牌
+
+	revision  int64      // 缓存对应的修订号，只在队列中访问
+	historyID string     // 修订号所属的历史，只在队列中访问
+	syncing   bool       // 正在接收认证过程中的修改，只在队列中访问
+	syncItems []syncItem // 认证过程中收到的修改，只在队列中访问
+
+	callSeq      int64                  // 远程调用序号，原子递增
+	pending      map[int64]*pendingCall // 等待应答的远程调用，键为调用序号
+	pendingGuard sync.Mutex             // 保护pending的互斥锁
 }
 
 // NewDiscovery 创建一个新的memsd服务发现实例
+// 会一直阻塞，直到连接上服务器并拉取完初始数据
+// 认证失败时返回不可用的实例，请求服务器的调用均返回ErrAuthFailed，可通过Err获取失败原因
 // 参数:
 //   - config: 配置对象，如果为nil则使用默认配置
 // 返回:
-//   - discovery.Discovery: 服务发现实例
+//   - discovery.Discovery: 服务发现实例，不会为nil
 func NewDiscovery(config interface{}) discovery.Discovery {
 
+	// 不会取消的ctx，只会在连接成功或认证失败后返回
+	sd, err := newDiscovery(context.Background(), config)
+	if err != nil {
+		log.GetLog().Errorf("memsd discovery init failed, %s", err.Error())
+	}
+
+	return sd
+}
+
+// NewDiscoveryContext 创建一个新的memsd服务发现实例，可通过ctx取消或设置截止时间
+// 在ctx结束前未能连接服务器并拉取完初始数据时，停止连接并返回错误
+// 参数:
+//   - ctx: 控制连接的取消及截止时间
+//   - config: 配置对象，如果为nil则使用默认配置
+// 返回:
+//   - discovery.Discovery: 服务发现实例，同时实现了discovery.DiscoveryCtx
+//   - error: 取消或超时时返回ctx的错误，认证失败时返回ErrAuthFailed
+func NewDiscoveryContext(ctx context.Context, config interface{}) (discovery.Discovery, error) {
+
+	sd, err := newDiscovery(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+
+	return sd, nil
+}
+
+// newDiscovery 创建实例并等待拉取完初始数据，失败时返回已关闭的实例及错误
+func newDiscovery(ctx context.Context, config interface{}) (*memDiscovery, error) {
+
 	if config == nil {
 		config = DefaultConfig()
 	}
 
 	self := &memDiscovery{
-		config:   config.(*Config),
-		kvCache:  make(map[string][]byte),
-		svcCache: make(map[string][]*discovery.ServiceDesc),
+		config:    config.(*Config),
+		kvCache:   make(map[string][]byte),
+		svcCache:  newSvcSnapshot(),
+		localSvc:  make(map[string]*discovery.ServiceDesc),
+		pending:   make(map[int64]*pendingCall),
+		initReady: make(chan struct{}),
 	}
 
-	model.Queue = cellnet.NewEventQueue()
-	model.Queue.EnableCapturePanic(true)
-	model.Queue.StartLoop()
+	// 使用独立的队列，不影响同进程内memsd服务使用的model.Queue
+	self.queue = cellnet.NewEventQueue()
+	self.queue.EnableCapturePanic(true)
+	self.queue.StartLoop()
 
-	self.initWg = new(sync.WaitGroup)
-	self.initWg.Add(1)
-
-	self.connect(self.config.Address)
+	self.connect(self.config.addressList()[0])
 
 	// 等待拉取初始值
-	self.initWg.Wait()
-	self.initWg = nil
+	select {
+	case <-self.initReady:
+
+		if self.initErr != nil {
+			self.close()
+			return self, self.initErr
+		}
+
+		return self, nil
+	case <-ctx.Done():
+		self.close()
+		return self, ctx.Err()
+	}
+}
+
+// Err 返回实例初始化失败的原因，实例可用时返回nil
+func (self *memDiscovery) Err() error {
 
-	return self
+	select {
+	case <-self.initReady:
+		return self.initErr
+	default:
+		return nil
+	}
 }
+
+func init() {
+
+	discovery.RegisterBackend("memsd", func(ctx context.Context, backendConfig *discovery.BackendConfig) (discovery.Discovery, error) {
+
+		config := DefaultConfig()
+		config.Address = backendConfig.Address
+		config.ClientID = backendConfig.ClientID
+		config.Secret = backendConfig.Secret
+		config.Namespace = backendConfig.Namespace
+		config.TLS = backendConfig.TLS
+
+		return NewDiscoveryContext(ctx, config)
+	})
+}
+
+var _ discovery.DiscoveryCtx = (*memDiscovery)(nil)
+var _ discovery.DiscoveryCAS = (*memDiscovery)(nil)
+var _ discovery.DiscoveryBatch = (*memDiscovery)(nil)
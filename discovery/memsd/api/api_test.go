@@ -1,20 +1,45 @@
-package memsd
+package memsd_test
 
 import (
+	"context"
+	"fmt"
 	"github.com/bobwong89757/cellmesh/discovery"
+	memsd "github.com/bobwong89757/cellmesh/discovery/memsd/api"
+	"github.com/bobwong89757/cellmesh/discovery/memsd/deps"
 	_ "github.com/bobwong89757/cellnet/peer/tcp"
 	"testing"
 	"time"
 )
 
+// 使用进程内的memsd服务器，不需要在:8900上启动memsd
+// 外部测试包可以导入deps，deps依赖本包
 func TestAPI(t *testing.T) {
 
-	sd := NewDiscovery(nil)
+	p := deps.ListenSvc("127.0.0.1:0")
+	defer p.Stop()
 
-	sd.SetValue("mykey", 123456)
+	config := memsd.DefaultConfig()
+	config.Address = fmt.Sprintf("127.0.0.1:%d", p.(interface{ Port() int }).Port())
 
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	sd, err := memsd.NewDiscoveryContext(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sd.SetValue("mykey", 123456); err != nil {
+		t.Fatal(err)
+	}
+
+	// GetValue读取本地缓存，等待修改通知到达
 	var a int
-	sd.GetValue("mykey", &a)
+	for i := 0; i < 100 && a != 123456; i++ {
+		sd.GetValue("mykey", &a)
+		time.Sleep(time.Millisecond * 10)
+	}
+
 	if a != 123456 {
 		t.Fatalf("a != 123456")
 	}
@@ -23,7 +48,7 @@ func TestAPI(t *testing.T) {
 
 	time.Sleep(time.Millisecond * 100)
 
-	err := sd.GetValue("mykey", &a)
+	err = sd.GetValue("mykey", &a)
 	if err == nil {
 		t.Fatalf("getvalue == nil")
 	}
@@ -64,3 +89,27 @@ func TestAPI(t *testing.T) {
 
 	time.Sleep(time.Second)
 }
+
+func TestNewDiscoveryContextTimeout(t *testing.T) {
+
+	// 没有服务侦听的地址
+	config := memsd.DefaultConfig()
+	config.Address = "127.0.0.1:1"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*300)
+	defer cancel()
+
+	begin := time.Now()
+	sd, err := memsd.NewDiscoveryContext(ctx, config)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expect deadline exceeded, got %v", err)
+	}
+
+	if sd != nil {
+		t.Fatalf("expect nil discovery")
+	}
+
+	if time.Since(begin) > time.Second {
+		t.Fatalf("NewDiscoveryContext not return in time")
+	}
+}
@@ -1,21 +1,63 @@
 package memsd
 
-import "time"
+import (
+	"crypto/tls"
+	"strings"
+	"time"
+)
 
 // Config 是memsd服务发现的配置结构
 type Config struct {
-	Address        string        // 服务发现服务器地址，格式为"host:port"
-	RequestTimeout time.Duration // 请求超时时间
+	Address           string        // 服务发现服务器地址，格式为"host:port"，多个地址使用逗号分隔
+	AddressList       []string      // 服务发现服务器地址列表，设置时优先于Address
+	RequestTimeout    time.Duration // 请求超时时间
+	ReconnectDuration time.Duration // 所有地址都连接失败后，再次尝试的间隔
+
+	MaxAuthRetryDuration time.Duration // 运行中认证失败后，重连间隔从ReconnectDuration开始加倍，不超过此值
+
+	ClientID string // 客户端身份，服务器据此选择密钥及授权
+	Secret   string // 客户端密钥，设置后使用HMAC挑战认证，密钥不会在网络上传输
+
+	Namespace string // 命名空间，配置及服务的读写、通知均限定在此命名空间中，为空时使用默认命名空间
+
+	TLS *tls.Config // 设置后使用TLS连接，可由meshutil.LoadTLSConfig加载
 }
 
 // DefaultConfig 返回默认的配置
-// 默认地址为":8900"，超时时间为10秒
+// 默认地址为":8900"，超时时间为10秒，重连间隔为5秒，认证失败后的重连间隔最长1分钟
 // 返回:
 //   - *Config: 默认配置实例
 func DefaultConfig() *Config {
 
 	return &Config{
-		Address:        ":8900",
-		RequestTimeout: time.Second * 10,
+		Address:           ":8900",
+		RequestTimeout:    time.Second * 10,
+		ReconnectDuration: time.Second * 5,
+
+		MaxAuthRetryDuration: time.Minute,
+	}
+}
+
+// addressList 返回按顺序尝试的服务器地址列表
+// 返回:
+//   - ret: 地址列表，至少包含一个地址
+func (self *Config) addressList() (ret []string) {
+
+	if len(self.AddressList) > 0 {
+		return self.AddressList
+	}
+
+	for _, addr := range strings.Split(self.Address, ",") {
+
+		addr = strings.TrimSpace(addr)
+		if addr != "" {
+			ret = append(ret, addr)
+		}
+	}
+
+	if len(ret) == 0 {
+		ret = append(ret, self.Address)
 	}
+
+	return
 }
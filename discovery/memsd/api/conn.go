@@ -4,71 +4,210 @@ import (
 	"github.com/bobwong89757/cellmesh/discovery"
 	"github.com/bobwong89757/cellmesh/discovery/memsd/model"
 	"github.com/bobwong89757/cellmesh/discovery/memsd/proto"
+	"github.com/bobwong89757/cellmesh/util"
 	"github.com/bobwong89757/cellnet"
 	"github.com/bobwong89757/cellnet/log"
 	"github.com/bobwong89757/cellnet/peer"
 	"github.com/bobwong89757/cellnet/proc"
+	"sync/atomic"
 	"time"
 )
 
-func (self *memDiscovery) clearCache() {
+// connect 创建Connector连接指定地址的服务器
+// 不使用Connector自带的重连，断开或连接失败时由failover切换到下一个地址
+func (self *memDiscovery) connect(addr string) {
 
-	self.svcCacheGuard.Lock()
-	self.svcCache = map[string][]*discovery.ServiceDesc{}
-	self.svcCacheGuard.Unlock()
+	if atomic.LoadInt32(&self.closed) != 0 {
+		return
+	}
 
-	self.kvCacheGuard.Lock()
-	self.kvCache = map[string][]byte{}
-	self.kvCacheGuard.Unlock()
-}
+	p := peer.NewGenericPeer("tcp.Connector", "memsd", addr, self.queue)
 
-func (self *memDiscovery) connect(addr string) {
-	p := peer.NewGenericPeer("tcp.Connector", "memsd", addr, model.Queue)
+	// 供rpcHooker找到应答对应的客户端
+	p.(cellnet.ContextSet).SetContext("memsd", self)
+
+	meshutil.SetPeerTLS(p, self.config.TLS)
 
 	proc.BindProcessorHandler(p, "memsd.cli", func(ev cellnet.Event) {
 
+		// 忽略已被替换的Connector的迟到事件
+		if ev.Session().Peer() != self.currentConnector() {
+			return
+		}
+
 		switch msg := ev.Message().(type) {
 		case *cellnet.SessionConnected:
 
+			// 连接过程中实例已关闭
+			if atomic.LoadInt32(&self.closed) != 0 {
+				ev.Session().Close()
+				return
+			}
+
+			self.failCount = 0
+
 			self.sesGuard.Lock()
 			self.ses = ev.Session()
 			self.sesGuard.Unlock()
-			self.clearCache()
+			self.beginSync()
+
+			// 配置了密钥时，先获取随机数再签名认证
+			if self.config.Secret != "" {
+				ev.Session().Send(&proto.AuthChallengeREQ{
+					ClientID: self.config.ClientID,
+				})
+			} else {
+				ev.Session().Send(&proto.AuthREQ{
+					Token:     self.token,
+					ClientID:  self.config.ClientID,
+					Namespace: self.config.Namespace,
+					Revision:  self.revision,
+					HistoryID: self.historyID,
+				})
+			}
+
+		case *proto.AuthChallengeACK:
+
 			ev.Session().Send(&proto.AuthREQ{
-				Token: self.token,
+				Token:     self.token,
+				ClientID:  self.config.ClientID,
+				Signature: model.SignChallenge(self.config.Secret, msg.Nonce),
+				Namespace: self.config.Namespace,
+				Revision:  self.revision,
+				HistoryID: self.historyID,
 			})
+
+		case *cellnet.SessionConnectError:
+
+			self.failover()
+
 		case *cellnet.SessionClosed:
-			self.token = ""
+			self.sesGuard.Lock()
+			self.ses = nil
+			self.sesGuard.Unlock()
+			self.failPendingCalls(ErrSessionClosed)
 			log.GetLog().Errorf("memsd discovery lost!")
 
+			// 服务器会删除此会话注册的服务及临时键，配置了等待恢复时间时重连后保留
+			self.triggerNotify("lost", 0)
+
+			self.failover()
+
 		case *proto.AuthACK:
 
-			self.token = msg.Token
+			if msg.Code != proto.ResultCode_Result_OK {
+				log.GetLog().Errorf("memsd discovery auth failed! address: %s, client: '%s'", addr, self.config.ClientID)
+
+				// 初始化时凭据错误，重试也不会成功，停止连接
+				if !self.initDone() {
+					self.initErr = ErrAuthFailed
+					atomic.StoreInt32(&self.closed, 1)
+					self.initOnce.Do(func() {
+						close(self.initReady)
+					})
+					return
+				}
 
-			if self.initWg != nil {
-				// Pull的消息还要在queue里处理，这里确认处理完成后才算初始化完成
-				self.initWg.Done()
+				// 运行中认证失败，可能是服务器正在更换密钥，通知调用方并按退避间隔重连
+				self.authFailCount++
+				self.triggerNotify("authfailed", 0)
+				ev.Session().Close()
+				return
 			}
 
-			log.GetLog().Infof("memsd discovery ready!")
+			self.authFailCount = 0
+			self.token = msg.Token
+			self.finishSync(msg.Full, msg.Revision, msg.HistoryID)
+
+			// Pull的消息还要在queue里处理，这里确认处理完成后才算初始化完成
+			self.initOnce.Do(func() {
+				close(self.initReady)
+			})
+
+			log.GetLog().Infof("memsd discovery ready! address: %s", addr)
 
 			self.triggerNotify("ready", 0)
 
+			// 恢复会话时服务仍然有效，否则在队列外等待应答
+			if msg.Resumed {
+				log.GetLog().Infof("memsd session resumed")
+			} else {
+				go self.reregister()
+			}
+
+		case *proto.PrimaryChangeNotifyACK:
+
+			// 连接到了备机，下次优先连接主机
+			log.GetLog().Infof("memsd '%s' is standby, primary: '%s'", addr, msg.Address)
+			self.redirectAddr = msg.Address
+
 		case *proto.ValueChangeNotifyACK:
 
+			if self.syncing {
+				self.syncItems = append(self.syncItems, syncItem{
+					Key:     msg.Key,
+					Value:   msg.Value,
+					SvcName: msg.SvcName,
+				})
+				break
+			}
+
+			self.updateRevision(msg.Revision)
+
 			if model.IsServiceKey(msg.Key) {
 				self.updateSvcCache(msg.SvcName, msg.Value)
 			} else {
 				self.updateKVCache(msg.Key, msg.Value)
+				self.triggerValueEvent(discovery.ValueEvent{
+					Kind:  discovery.ValueEventKind_Set,
+					Key:   msg.Key,
+					Value: msg.Value,
+				}, time.Second*10)
+			}
+
+		case *proto.ValueBatchNotifyACK:
+
+			if self.syncing {
+				for _, op := range msg.Ops {
+					self.syncItems = append(self.syncItems, syncItem{
+						Delete: op.Delete,
+						Key:    op.Key,
+						Value:  op.Value,
+					})
+				}
+				break
+			}
+
+			for _, op := range msg.Ops {
+				self.updateRevision(op.Revision)
+			}
+
+			for _, ev := range self.applyKVBatch(msg.Ops) {
+				self.triggerValueEvent(ev, time.Second*10)
 			}
 
 		case *proto.ValueDeleteNotifyACK:
 
+			if self.syncing {
+				self.syncItems = append(self.syncItems, syncItem{
+					Delete:  true,
+					Key:     msg.Key,
+					SvcName: msg.SvcName,
+				})
+				break
+			}
+
+			self.updateRevision(msg.Revision)
+
 			if model.IsServiceKey(msg.Key) {
 				svcid := model.GetSvcIDByServiceKey(msg.Key)
 				self.deleteSvcCache(svcid, msg.SvcName)
 			} else {
 				self.deleteKVCache(msg.Key)
+				self.triggerValueEvent(discovery.ValueEvent{
+					Kind: discovery.ValueEventKind_Deleted,
+					Key:  msg.Key,
+				}, time.Second*10)
 			}
 		}
 	})
@@ -76,18 +215,114 @@ func (self *memDiscovery) connect(addr string) {
 	// noDelay
 	p.(cellnet.TCPSocketOption).SetSocketBuffer(1024*1024, 1024*1024, true)
 
-	// 断线后自动重连
-	p.(cellnet.TCPConnector).SetReconnectDuration(time.Second * 5)
+	self.connectorGuard.Lock()
+	self.connector = p
+	self.connectorGuard.Unlock()
 
 	p.Start()
+}
 
-	for {
+// initDone 初始数据是否已拉取完成
+func (self *memDiscovery) initDone() bool {
 
-		if p.(cellnet.PeerReadyChecker).IsReady() {
-			break
-		}
+	select {
+	case <-self.initReady:
+		return true
+	default:
+		return false
+	}
+}
+
+// authRetryDelay 返回第failCount次认证失败后的重连间隔，从base开始加倍，maxDelay大于0时不超过maxDelay
+func authRetryDelay(base, maxDelay time.Duration, failCount int) time.Duration {
+
+	// 限制加倍次数，避免溢出
+	delay := base
+	for i := 1; i < failCount && i < 16; i++ {
+		delay *= 2
+	}
+
+	if maxDelay > 0 && delay > maxDelay {
+		delay = maxDelay
+	}
+
+	return delay
+}
+
+func (self *memDiscovery) currentConnector() cellnet.Peer {
+	self.connectorGuard.Lock()
+	defer self.connectorGuard.Unlock()
+	return self.connector
+}
+
+// failover 切换到地址列表中的下一个服务器
+// 连续失败次数达到地址数量，即所有地址都尝试过一轮后，等待重连间隔再继续
+// 备机告知了主机地址时，直接连接主机
+func (self *memDiscovery) failover() {
+
+	if atomic.LoadInt32(&self.closed) != 0 {
+		return
+	}
+
+	if self.redirectAddr != "" {
+		addr := self.redirectAddr
+		self.redirectAddr = ""
 
-		time.Sleep(time.Millisecond * 500)
+		log.GetLog().Infof("memsd discovery redirect to primary '%s'", addr)
+
+		self.connect(addr)
+		return
+	}
+
+	addrList := self.config.addressList()
+
+	self.addrIndex = (self.addrIndex + 1) % len(addrList)
+	self.failCount++
+
+	var delay time.Duration
+	if self.failCount >= len(addrList) {
+		self.failCount = 0
+		delay = self.config.ReconnectDuration
 	}
 
+	// 认证失败后按失败次数加倍重连间隔
+	if self.authFailCount > 0 {
+		delay = authRetryDelay(self.config.ReconnectDuration, self.config.MaxAuthRetryDuration, self.authFailCount)
+	}
+
+	addr := addrList[self.addrIndex]
+
+	if len(addrList) > 1 {
+		log.GetLog().Infof("memsd discovery failover to '%s' after %s", addr, delay)
+	}
+
+	time.AfterFunc(delay, func() {
+		self.connect(addr)
+	})
+}
+
+// Close 断开与memsd的连接并停止事件队列，等待中的调用返回ErrSessionClosed
+// 会话断开后memsd删除本实例注册的服务及临时键，设置了SessionResumeGrace时在等待时间后删除
+func (self *memDiscovery) Close() {
+	self.close()
+}
+
+// close 停止连接及实例独占的事件队列，用于创建实例失败或关闭时释放资源
+func (self *memDiscovery) close() {
+
+	atomic.StoreInt32(&self.closed, 1)
+
+	// Stop等待连接结束，之后不再有事件投递到队列
+	self.currentConnector().Stop()
+
+	// 队列停止后不再处理SessionClosed，在这里清除会话，之后的调用立即返回错误
+	self.sesGuard.Lock()
+	self.ses = nil
+	self.sesGuard.Unlock()
+
+	self.failPendingCalls(ErrSessionClosed)
+
+	self.stopQueueOnce.Do(func() {
+		self.queue.StopLoop()
+	})
 }
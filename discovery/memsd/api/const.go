@@ -1,12 +1,25 @@
 package memsd
 
-import "errors"
+import (
+	"errors"
+	"github.com/bobwong89757/cellmesh/discovery"
+)
 
 const (
-	MaxValueSize = 512 * 1024
+	MaxValueSize = discovery.MaxValueSize
 )
 
 var (
-	ErrValueNotExists = errors.New("value not exists")
-	ErrValueTooLarge  = errors.New("value too large")
+	// 与其他服务发现后端共用的错误值
+	ErrValueNotExists   = discovery.ErrValueNotExists
+	ErrValueTooLarge    = discovery.ErrValueTooLarge
+	ErrRevisionMismatch = discovery.ErrRevisionMismatch
+	ErrInvalidRequest   = discovery.ErrInvalidRequest
+
+	ErrNotConnected     = errors.New("memsd not connected")
+	ErrRequestTimeout   = errors.New("Request time out")
+	ErrSessionClosed    = errors.New("memsd session closed")
+	ErrAuthFailed       = errors.New("memsd auth failed")
+	ErrPermissionDenied = errors.New("memsd permission denied")
+	ErrLeaseNotFound    = errors.New("memsd lease not found")
 )
@@ -1,14 +1,24 @@
 package memsd
 
 import (
+	"context"
 	"github.com/bobwong89757/cellmesh/discovery"
 	"github.com/bobwong89757/cellmesh/discovery/memsd/proto"
+	"github.com/bobwong89757/cellnet/log"
 	"strings"
+	"time"
 )
 
 // Option 是KV操作的选项配置
 type Option struct {
-	PrettyPrint bool // 是否使用格式化输出（JSON缩进）
+	PrettyPrint bool  // 是否使用格式化输出（JSON缩进）
+	LeaseID     int64 // 不为0时将键绑定到租约，租约过期或撤销时服务器删除该键
+	Ephemeral   bool  // 键归属于当前会话，会话断开时服务器删除该键
+}
+
+// IsPrettyPrint 是否使用格式化输出，实现discovery.PrettyPrintOption
+func (self Option) IsPrettyPrint() bool {
+	return self.PrettyPrint
 }
 
 // getOpt 从选项列表中提取Option配置
@@ -48,9 +58,45 @@ func (self *memDiscovery) deleteKVCache(key string) {
 	self.kvCacheGuard.Unlock()
 }
 
-func (self *memDiscovery) SetValue(key string, dataPtr interface{}, optList ...interface{}) (retErr error) {
+// applyKVBatch 在一次加锁中应用批量修改，读取缓存时不会看到只应用了一部分的状态
+// 返回:
+//   - []discovery.ValueEvent: 按顺序对应每个修改的事件
+func (self *memDiscovery) applyKVBatch(ops []proto.BatchOp) (ret []discovery.ValueEvent) {
+
+	self.kvCacheGuard.Lock()
+
+	for _, op := range ops {
+
+		if op.Delete {
+			delete(self.kvCache, op.Key)
+			ret = append(ret, discovery.ValueEvent{
+				Kind: discovery.ValueEventKind_Deleted,
+				Key:  op.Key,
+			})
+		} else {
+			self.kvCache[op.Key] = op.Value
+			ret = append(ret, discovery.ValueEvent{
+				Kind:  discovery.ValueEventKind_Set,
+				Key:   op.Key,
+				Value: op.Value,
+			})
+		}
+	}
+
+	self.kvCacheGuard.Unlock()
+
+	return
+}
 
-	raw, err := discovery.AnyToBytes(dataPtr, getOpt(optList...).PrettyPrint)
+func (self *memDiscovery) SetValue(key string, dataPtr interface{}, optList ...interface{}) error {
+	return self.SetValueCtx(context.Background(), key, dataPtr, optList...)
+}
+
+func (self *memDiscovery) SetValueCtx(ctx context.Context, key string, dataPtr interface{}, optList ...interface{}) (retErr error) {
+
+	opt := getOpt(optList...)
+
+	raw, err := discovery.AnyToBytes(dataPtr, opt.PrettyPrint)
 	if err != nil {
 		return err
 	}
@@ -59,9 +105,11 @@ func (self *memDiscovery) SetValue(key string, dataPtr interface{}, optList ...i
 		return ErrValueTooLarge
 	}
 
-	callErr := self.remoteCall(&proto.SetValueREQ{
-		Key:   key,
-		Value: raw,
+	callErr := self.remoteCallCtx(ctx, &proto.SetValueREQ{
+		Key:       key,
+		Value:     raw,
+		LeaseID:   opt.LeaseID,
+		Ephemeral: opt.Ephemeral,
 	}, func(ack *proto.SetValueACK) {
 		retErr = codeToError(ack.Code)
 	})
@@ -70,12 +118,23 @@ func (self *memDiscovery) SetValue(key string, dataPtr interface{}, optList ...i
 		return
 	}
 
-	retErr = callErr
+	if callErr == nil {
+		self.waitApplied(ctx)
+	}
 
-	return nil
+	return callErr
 }
 
 func (self *memDiscovery) GetValue(key string, valuePtr interface{}) error {
+	return self.GetValueCtx(context.Background(), key, valuePtr)
+}
+
+// GetValueCtx 从本地缓存读取，只在调用前检查ctx是否已结束
+func (self *memDiscovery) GetValueCtx(ctx context.Context, key string, valuePtr interface{}) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
 	data, ok := self.getKVCache(key)
 
@@ -115,9 +174,153 @@ func (self *memDiscovery) GetRawValue(key string) (retData []byte, retErr error)
 	return
 }
 
-func (self *memDiscovery) DeleteValue(key string) (ret error) {
+// GetValueRevision 从服务器读取值及修订号，不使用本地缓存
+func (self *memDiscovery) GetValueRevision(key string, valuePtr interface{}) (revision int64, retErr error) {
+
+	var data []byte
+	callErr := self.remoteCall(&proto.GetValueREQ{
+		Key: key,
+	}, func(ack *proto.GetValueACK) {
+		data = ack.Value
+		revision = ack.Revision
+		retErr = codeToError(ack.Code)
+	})
+
+	if retErr != nil {
+		return
+	}
+
+	if callErr != nil {
+		return 0, callErr
+	}
+
+	retErr = discovery.BytesToAny(data, valuePtr)
+
+	return
+}
+
+// SetValueCAS 比较并设置，修订号不一致时返回ErrRevisionMismatch及当前修订号
+func (self *memDiscovery) SetValueCAS(key string, dataPtr interface{}, revision int64, optList ...interface{}) (newRevision int64, retErr error) {
+
+	opt := getOpt(optList...)
+
+	raw, err := discovery.AnyToBytes(dataPtr, opt.PrettyPrint)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(raw) > MaxValueSize {
+		return 0, ErrValueTooLarge
+	}
+
+	callErr := self.remoteCall(&proto.SetValueREQ{
+		Key:           key,
+		Value:         raw,
+		CheckRevision: true,
+		Revision:      revision,
+		LeaseID:       opt.LeaseID,
+		Ephemeral:     opt.Ephemeral,
+	}, func(ack *proto.SetValueACK) {
+		newRevision = ack.Revision
+		retErr = codeToError(ack.Code)
+	})
+
+	if retErr != nil {
+		return
+	}
+
+	if callErr != nil {
+		return 0, callErr
+	}
+
+	self.waitApplied(context.Background())
+
+	return
+}
+
+// DeleteValueCAS 比较并删除，修订号不一致时返回ErrRevisionMismatch
+func (self *memDiscovery) DeleteValueCAS(key string, revision int64) (ret error) {
 
 	callErr := self.remoteCall(&proto.DeleteValueREQ{
+		Key:           key,
+		CheckRevision: true,
+		Revision:      revision,
+	}, func(ack *proto.DeleteValueACK) {
+		ret = codeToError(ack.Code)
+	})
+
+	if ret != nil {
+		return ret
+	}
+
+	if callErr == nil {
+		self.waitApplied(context.Background())
+	}
+
+	return callErr
+}
+
+// Batch 原子地执行一组设置及删除操作，任意操作检查失败时所有操作均不执行
+// 返回:
+//   - revision: 执行后的修订号
+//   - err: 服务描述键返回ErrInvalidRequest，修订号不一致返回ErrRevisionMismatch
+func (self *memDiscovery) Batch(ops []discovery.BatchOp) (revision int64, retErr error) {
+
+	req := &proto.BatchREQ{
+		Ops: make([]proto.BatchOp, 0, len(ops)),
+	}
+
+	for _, op := range ops {
+
+		batchOp := proto.BatchOp{
+			Delete:        op.Delete,
+			Key:           op.Key,
+			CheckRevision: op.CheckRevision,
+			Revision:      op.Revision,
+		}
+
+		if !op.Delete {
+
+			raw, err := discovery.AnyToBytes(op.Value, false)
+			if err != nil {
+				return 0, err
+			}
+
+			if len(raw) > MaxValueSize {
+				return 0, ErrValueTooLarge
+			}
+
+			batchOp.Value = raw
+		}
+
+		req.Ops = append(req.Ops, batchOp)
+	}
+
+	callErr := self.remoteCall(req, func(ack *proto.BatchACK) {
+		revision = ack.Revision
+		retErr = codeToError(ack.Code)
+	})
+
+	if retErr != nil {
+		return
+	}
+
+	if callErr != nil {
+		return 0, callErr
+	}
+
+	self.waitApplied(context.Background())
+
+	return
+}
+
+func (self *memDiscovery) DeleteValue(key string) error {
+	return self.DeleteValueCtx(context.Background(), key)
+}
+
+func (self *memDiscovery) DeleteValueCtx(ctx context.Context, key string) (ret error) {
+
+	callErr := self.remoteCallCtx(ctx, &proto.DeleteValueREQ{
 		Key: key,
 	}, func(ack *proto.DeleteValueACK) {
 		ret = codeToError(ack.Code)
@@ -127,9 +330,33 @@ func (self *memDiscovery) DeleteValue(key string) (ret error) {
 		return ret
 	}
 
+	if callErr == nil {
+		self.waitApplied(ctx)
+	}
+
 	return callErr
 }
 
+// waitApplied 等待队列处理完已收到的变化通知
+// 服务器先广播变化通知再发送应答，应答在收包线程中分派，通知在队列中应用到缓存
+// 写入返回前等待队列，之后读取本地缓存(GetValue、SafeGetValue)能看到本次写入，不超过Config.RequestTimeout
+func (self *memDiscovery) waitApplied(ctx context.Context) {
+
+	done := make(chan struct{})
+	self.queue.Post(func() {
+		close(done)
+	})
+
+	timeout := time.NewTimer(self.config.RequestTimeout)
+	defer timeout.Stop()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+	case <-timeout.C:
+	}
+}
+
 func (self *memDiscovery) GetRawValueList(prefix string) (ret []discovery.ValueMeta) {
 
 	self.kvCacheGuard.RLock()
@@ -151,5 +378,9 @@ func (self *memDiscovery) GetRawValueList(prefix string) (ret []discovery.ValueM
 }
 
 func (self *memDiscovery) ClearKey() {
-	self.remoteCall(&proto.ClearKeyREQ{}, func(ack *proto.ClearKeyACK) {})
+	self.remoteCall(&proto.ClearKeyREQ{}, func(ack *proto.ClearKeyACK) {
+		if err := codeToError(ack.Code); err != nil {
+			log.GetLog().Errorf("ClearKey failed, %s", err.Error())
+		}
+	})
 }
@@ -0,0 +1,108 @@
+package memsd
+
+import (
+	"context"
+	"github.com/bobwong89757/cellmesh/discovery/memsd/proto"
+	"github.com/bobwong89757/cellnet/log"
+	"time"
+)
+
+// GrantLease 申请租约，使用Option{LeaseID: leaseID}设置的键在租约过期或撤销时被删除
+// 参数:
+//   - ttl: 有效期，需要在到期前续约
+// 返回:
+//   - leaseID: 租约ID
+//   - err: 申请失败时返回错误
+func (self *memDiscovery) GrantLease(ttl time.Duration) (leaseID int64, retErr error) {
+
+	callErr := self.remoteCall(&proto.LeaseGrantREQ{
+		TTL: int64(ttl / time.Millisecond),
+	}, func(ack *proto.LeaseGrantACK) {
+		leaseID = ack.LeaseID
+		retErr = codeToError(ack.Code)
+	})
+
+	if retErr != nil {
+		return
+	}
+
+	if callErr != nil {
+		return 0, callErr
+	}
+
+	return
+}
+
+// KeepAliveLease 续约一次，有效期从服务器收到请求时重新计算
+// 返回:
+//   - ttl: 租约的有效期
+//   - err: 租约已过期或不存在时返回ErrLeaseNotFound
+func (self *memDiscovery) KeepAliveLease(leaseID int64) (ttl time.Duration, retErr error) {
+
+	callErr := self.remoteCall(&proto.LeaseKeepAliveREQ{
+		LeaseID: leaseID,
+	}, func(ack *proto.LeaseKeepAliveACK) {
+		ttl = time.Duration(ack.TTL) * time.Millisecond
+		retErr = codeToError(ack.Code)
+	})
+
+	if retErr != nil {
+		return
+	}
+
+	if callErr != nil {
+		return 0, callErr
+	}
+
+	return
+}
+
+// RevokeLease 撤销租约，服务器删除绑定到租约的所有键
+func (self *memDiscovery) RevokeLease(leaseID int64) (ret error) {
+
+	callErr := self.remoteCall(&proto.LeaseRevokeREQ{
+		LeaseID: leaseID,
+	}, func(ack *proto.LeaseRevokeACK) {
+		ret = codeToError(ack.Code)
+	})
+
+	if ret != nil {
+		return ret
+	}
+
+	return callErr
+}
+
+// KeepLeaseAlive 按有效期的三分之一间隔持续续约，阻塞直到ctx结束或租约丢失
+// 连接断开等临时错误会继续重试
+// 参数:
+//   - ctx: 结束时停止续约
+//   - leaseID: 租约ID
+// 返回:
+//   - error: ctx结束时返回ctx.Err()，租约丢失时返回ErrLeaseNotFound
+func (self *memDiscovery) KeepLeaseAlive(ctx context.Context, leaseID int64) error {
+
+	interval := time.Second
+
+	for {
+
+		ttl, err := self.KeepAliveLease(leaseID)
+
+		switch err {
+		case nil:
+			if ttl > 0 {
+				interval = ttl / 3
+			}
+		case ErrLeaseNotFound:
+			return err
+		default:
+			log.GetLog().Warnf("memsd keepalive lease %d failed, %s", leaseID, err.Error())
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
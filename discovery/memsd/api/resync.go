@@ -0,0 +1,201 @@
+package memsd
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/bobwong89757/cellmesh/discovery"
+	"github.com/bobwong89757/cellmesh/discovery/memsd/model"
+	"github.com/bobwong89757/cellnet/log"
+	"sort"
+	"time"
+)
+
+// 重连时不清空缓存，认证时上报缓存对应的修订号
+// 认证完成前收到的修改先暂存，AuthACK到达后生成新的缓存一次替换，并按新旧缓存的差异发送事件
+// 重连期间查询仍返回旧的缓存，不会出现缓存为空的窗口
+
+// syncItem 是认证过程中收到的一条修改
+type syncItem struct {
+	Delete  bool
+	Key     string
+	Value   []byte
+	SvcName string
+}
+
+// beginSync 开始接收认证过程中的修改，连接建立时调用
+func (self *memDiscovery) beginSync() {
+	self.syncing = true
+	self.syncItems = nil
+}
+
+// updateRevision 记录已应用到缓存的修订号
+func (self *memDiscovery) updateRevision(revision int64) {
+	if revision > self.revision {
+		self.revision = revision
+	}
+}
+
+// finishSync 应用认证过程中收到的修改并替换缓存
+// 参数:
+//   - full: 服务器发送的是全部值，不在缓存中的键视为已删除
+//   - revision: 同步完成时的修订号
+//   - historyID: 修订号所属的历史
+func (self *memDiscovery) finishSync(full bool, revision int64, historyID string) {
+
+	items := self.syncItems
+	self.syncing = false
+	self.syncItems = nil
+
+	self.kvCacheGuard.RLock()
+	oldKV := self.kvCache
+	self.kvCacheGuard.RUnlock()
+
+	oldSvc := self.loadSvcCache().byName
+
+	newKV := map[string][]byte{}
+	if !full {
+		for key, value := range oldKV {
+			newKV[key] = value
+		}
+	}
+
+	// 保持已有服务的顺序，新增的服务按收到的顺序追加
+	var order []string
+	oldDesc := map[string]*discovery.ServiceDesc{}
+	newDesc := map[string]*discovery.ServiceDesc{}
+	for _, list := range oldSvc {
+		for _, desc := range list {
+			order = append(order, desc.ID)
+			oldDesc[desc.ID] = desc
+
+			if !full {
+				newDesc[desc.ID] = desc
+			}
+		}
+	}
+
+	ordered := map[string]bool{}
+	for _, item := range items {
+
+		switch {
+		case !model.IsServiceKey(item.Key):
+
+			if item.Delete {
+				delete(newKV, item.Key)
+			} else {
+				newKV[item.Key] = item.Value
+			}
+
+		case item.Delete:
+			delete(newDesc, model.GetSvcIDByServiceKey(item.Key))
+		default:
+
+			var desc discovery.ServiceDesc
+			if err := json.Unmarshal(item.Value, &desc); err != nil {
+				log.GetLog().Errorf("ServiceDesc unmarshal failed, %s", err)
+				continue
+			}
+
+			if _, ok := oldDesc[desc.ID]; !ok && !ordered[desc.ID] {
+				ordered[desc.ID] = true
+				order = append(order, desc.ID)
+			}
+
+			newDesc[desc.ID] = &desc
+		}
+	}
+
+	newSvc := map[string][]*discovery.ServiceDesc{}
+	for _, svcid := range order {
+
+		desc, ok := newDesc[svcid]
+		if !ok {
+			continue
+		}
+
+		newSvc[desc.Name] = append(newSvc[desc.Name], desc)
+	}
+
+	self.kvCacheGuard.Lock()
+	self.kvCache = newKV
+	self.kvCacheGuard.Unlock()
+
+	self.svcCacheGuard.Lock()
+	self.svcCache = &svcSnapshot{
+		version: self.svcCache.version + 1,
+		byName:  newSvc,
+	}
+	self.svcCacheGuard.Unlock()
+
+	self.revision = revision
+	self.historyID = historyID
+
+	self.triggerSyncEvent(oldKV, newKV, order, oldDesc, newDesc)
+}
+
+// triggerSyncEvent 按替换前后缓存的差异发送事件
+func (self *memDiscovery) triggerSyncEvent(oldKV, newKV map[string][]byte, order []string, oldDesc, newDesc map[string]*discovery.ServiceDesc) {
+
+	var keys []string
+	for key := range oldKV {
+		if _, ok := newKV[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+
+	for key, value := range newKV {
+		if oldValue, ok := oldKV[key]; !ok || !bytes.Equal(oldValue, value) {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+
+		if value, ok := newKV[key]; ok {
+			self.triggerValueEvent(discovery.ValueEvent{
+				Kind:  discovery.ValueEventKind_Set,
+				Key:   key,
+				Value: value,
+			}, time.Second*10)
+		} else {
+			self.triggerValueEvent(discovery.ValueEvent{
+				Kind: discovery.ValueEventKind_Deleted,
+				Key:  key,
+			}, time.Second*10)
+		}
+	}
+
+	svcAdded := false
+	for _, svcid := range order {
+
+		prevDesc, existed := oldDesc[svcid]
+		desc, exists := newDesc[svcid]
+
+		switch {
+		case existed && !exists:
+			self.triggerServiceEvent(discovery.ServiceEvent{
+				Kind: discovery.ServiceEventKind_Removed,
+				Desc: prevDesc,
+			}, time.Second*10)
+		case !existed && exists:
+			svcAdded = true
+			self.triggerServiceEvent(discovery.ServiceEvent{
+				Kind: discovery.ServiceEventKind_Added,
+				Desc: desc,
+			}, time.Second*10)
+		case existed && exists && !prevDesc.Equals(desc):
+			svcAdded = true
+			self.triggerServiceEvent(discovery.ServiceEvent{
+				Kind:     discovery.ServiceEventKind_Updated,
+				Desc:     desc,
+				PrevDesc: prevDesc,
+			}, time.Second*10)
+		}
+	}
+
+	if svcAdded {
+		self.triggerNotify("add", time.Second*10)
+	}
+}
@@ -1,34 +1,35 @@
 package memsd
 
 import (
-	"errors"
+	"context"
 	"github.com/bobwong89757/cellnet"
+	"github.com/bobwong89757/cellnet/log"
 	"reflect"
-	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var (
-	callByType sync.Map // map[reflect.Type]func(interface{})
-)
-
-type typeRPCHooker struct {
+// pendingCall 是等待应答的远程调用
+type pendingCall struct {
+	ackType  reflect.Type     // 期望的应答消息类型
+	feedBack chan interface{} // 收到应答或出错时写入
 }
 
-func (typeRPCHooker) OnInboundEvent(inputEvent cellnet.Event) (outputEvent cellnet.Event) {
+// rpcHooker 在收包线程中将应答按调用序号分派给等待的调用
+type rpcHooker struct {
+}
 
-	incomingMsgType := reflect.TypeOf(inputEvent.Message()).Elem()
+func (rpcHooker) OnInboundEvent(inputEvent cellnet.Event) (outputEvent cellnet.Event) {
 
-	if rawFeedback, ok := callByType.Load(incomingMsgType); ok {
-		feedBack := rawFeedback.(chan interface{})
-		feedBack <- inputEvent.Message()
-		return inputEvent
+	var sd *memDiscovery
+	if inputEvent.Session().Peer().(cellnet.ContextSet).FetchContext("memsd", &sd) {
+		sd.dispatchAck(inputEvent.Message())
 	}
 
 	return inputEvent
 }
 
-func (typeRPCHooker) OnOutboundEvent(inputEvent cellnet.Event) (outputEvent cellnet.Event) {
+func (rpcHooker) OnOutboundEvent(inputEvent cellnet.Event) (outputEvent cellnet.Event) {
 
 	return inputEvent
 }
@@ -40,21 +41,116 @@ func (self *memDiscovery) Session() (ses cellnet.Session) {
 	return
 }
 
+// getCallID 获取消息中的调用序号，没有此字段时返回0
+func getCallID(msg interface{}) int64 {
+
+	v := reflect.Indirect(reflect.ValueOf(msg))
+	if v.Kind() != reflect.Struct {
+		return 0
+	}
+
+	field := v.FieldByName("CallID")
+	if !field.IsValid() || field.Kind() != reflect.Int64 {
+		return 0
+	}
+
+	return field.Int()
+}
+
+// setCallID 设置消息中的调用序号
+func setCallID(msg interface{}, callID int64) {
+
+	field := reflect.Indirect(reflect.ValueOf(msg)).FieldByName("CallID")
+	if field.IsValid() && field.CanSet() && field.Kind() == reflect.Int64 {
+		field.SetInt(callID)
+	}
+}
+
+// dispatchAck 根据调用序号找到等待的调用并投递应答
+func (self *memDiscovery) dispatchAck(msg interface{}) {
+
+	if msg == nil {
+		return
+	}
+
+	callID := getCallID(msg)
+	ackType := reflect.TypeOf(msg).Elem()
+
+	self.pendingGuard.Lock()
+
+	call, ok := self.pending[callID]
+
+	// 调用序号相同但应答类型不符时不投递，调用继续等待正确的应答或超时
+	if ok && call.ackType != ackType {
+		self.pendingGuard.Unlock()
+		log.GetLog().Warnf("memsd ack type mismatch, call: %d, expect: %s, got: %s", callID, call.ackType.Name(), ackType.Name())
+		return
+	}
+
+	// 旧版本服务器不回传调用序号，按应答类型匹配最早发出的调用
+	if !ok && callID == 0 {
+
+		for id, c := range self.pending {
+			if c.ackType == ackType && (!ok || id < callID) {
+				call, callID, ok = c, id, true
+			}
+		}
+	}
+
+	if ok {
+		delete(self.pending, callID)
+	}
+
+	self.pendingGuard.Unlock()
+
+	if ok {
+		call.feedBack <- msg
+	}
+}
+
+// failPendingCalls 会话断开时，让所有等待中的调用立即返回错误
+func (self *memDiscovery) failPendingCalls(err error) {
+
+	self.pendingGuard.Lock()
+	pending := self.pending
+	self.pending = map[int64]*pendingCall{}
+	self.pendingGuard.Unlock()
+
+	for _, call := range pending {
+		call.feedBack <- err
+	}
+}
+
 // callback =func(ack *YouMsgACK)
+// 请求中带有CallID字段时，会自动填充调用序号，多个调用可以同时在一个会话上进行
 func (self *memDiscovery) remoteCall(req interface{}, callback interface{}) error {
+	return self.remoteCallCtx(context.Background(), req, callback)
+}
+
+// remoteCallCtx 与remoteCall相同，ctx结束时立即返回ctx的错误
+// 无论ctx是否设置截止时间，都不会超过Config.RequestTimeout
+func (self *memDiscovery) remoteCallCtx(ctx context.Context, req interface{}, callback interface{}) error {
 
 	funcType := reflect.TypeOf(callback)
 	if funcType.Kind() != reflect.Func {
 		panic("callback require 'func'")
 	}
 
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	ses := self.Session()
 
 	if ses == nil {
-		return errors.New("memsd not connected")
-	}
 
-	feedBack := make(chan interface{})
+		// 认证失败而不可用的实例
+		if err := self.Err(); err != nil {
+			return err
+		}
+
+		return ErrNotConnected
+	}
 
 	// 获取回调第一个参数
 
@@ -67,25 +163,46 @@ func (self *memDiscovery) remoteCall(req interface{}, callback interface{}) erro
 		panic("callback func param format like 'func(ack *YouMsgACK)'")
 	}
 
-	ackType = ackType.Elem()
+	call := &pendingCall{
+		ackType: ackType.Elem(),
+		// 留一个缓冲，调用超时后迟到的应答不会阻塞收包线程
+		feedBack: make(chan interface{}, 1),
+	}
+
+	callID := atomic.AddInt64(&self.callSeq, 1)
+	setCallID(req, callID)
 
-	callByType.Store(ackType, feedBack)
+	self.pendingGuard.Lock()
+	self.pending[callID] = call
+	self.pendingGuard.Unlock()
 
-	defer callByType.Delete(ackType)
+	defer func() {
+		self.pendingGuard.Lock()
+		delete(self.pending, callID)
+		self.pendingGuard.Unlock()
+	}()
 
 	ses.Send(req)
 
+	timeout := time.NewTimer(self.config.RequestTimeout)
+	defer timeout.Stop()
+
 	select {
-	case ack := <-feedBack:
+	case ack := <-call.feedBack:
+
+		if err, ok := ack.(error); ok {
+			return err
+		}
 
 		vCall := reflect.ValueOf(callback)
 		vCall.Call([]reflect.Value{reflect.ValueOf(ack)})
 
 		return nil
-	case <-time.After(self.config.RequestTimeout):
+	case <-ctx.Done():
 
-		return errors.New("Request time out")
-	}
+		return ctx.Err()
+	case <-timeout.C:
 
-	return nil
+		return ErrRequestTimeout
+	}
 }
@@ -0,0 +1,47 @@
+package memsd
+
+import (
+	"github.com/bobwong89757/cellmesh/discovery/memsd/proto"
+	"reflect"
+	"testing"
+)
+
+func TestDispatchAck(t *testing.T) {
+
+	sd := newTestDiscovery()
+
+	call := &pendingCall{
+		ackType:  reflect.TypeOf(proto.SetValueACK{}),
+		feedBack: make(chan interface{}, 1),
+	}
+
+	sd.pending[1] = call
+
+	// 调用序号相同但类型不符的应答不投递，调用继续等待
+	sd.dispatchAck(&proto.GetValueACK{CallID: 1})
+
+	select {
+	case ack := <-call.feedBack:
+		t.Fatalf("unexpected ack delivered: %v", ack)
+	default:
+	}
+
+	if sd.pending[1] != call {
+		t.Fatal("pending call removed by mismatched ack")
+	}
+
+	sd.dispatchAck(&proto.SetValueACK{CallID: 1, Revision: 5})
+
+	select {
+	case ack := <-call.feedBack:
+		if ack.(*proto.SetValueACK).Revision != 5 {
+			t.Fatalf("unexpected ack: %v", ack)
+		}
+	default:
+		t.Fatal("ack not delivered")
+	}
+
+	if len(sd.pending) != 0 {
+		t.Fatal("pending call should be removed after delivery")
+	}
+}
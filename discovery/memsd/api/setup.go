@@ -15,9 +15,9 @@ func init() {
 		bundle.SetTransmitter(new(TCPMessageTransmitter))
 
 		if model.Debug {
-			bundle.SetHooker(proc.NewMultiHooker(new(tcp.MsgHooker), new(typeRPCHooker)))
+			bundle.SetHooker(proc.NewMultiHooker(new(tcp.MsgHooker), new(rpcHooker)))
 		} else {
-			bundle.SetHooker(new(typeRPCHooker))
+			bundle.SetHooker(new(rpcHooker))
 		}
 
 		bundle.SetCallback(proc.NewQueuedEventCallback(userCallback))
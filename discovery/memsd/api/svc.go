@@ -1,6 +1,7 @@
 package memsd
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"github.com/bobwong89757/cellmesh/discovery"
@@ -11,7 +12,11 @@ import (
 	"time"
 )
 
-func (self *memDiscovery) Register(svc *discovery.ServiceDesc) (retErr error) {
+func (self *memDiscovery) Register(svc *discovery.ServiceDesc) error {
+	return self.RegisterCtx(context.Background(), svc)
+}
+
+func (self *memDiscovery) RegisterCtx(ctx context.Context, svc *discovery.ServiceDesc) (retErr error) {
 
 	if svc.Name == "" {
 		return errors.New("expect svc name")
@@ -26,7 +31,7 @@ func (self *memDiscovery) Register(svc *discovery.ServiceDesc) (retErr error) {
 		return err
 	}
 
-	callErr := self.remoteCall(&proto.SetValueREQ{
+	callErr := self.remoteCallCtx(ctx, &proto.SetValueREQ{
 		Key:     model.ServiceKeyPrefix + svc.ID,
 		Value:   data,
 		SvcName: svc.Name,
@@ -38,36 +43,141 @@ func (self *memDiscovery) Register(svc *discovery.ServiceDesc) (retErr error) {
 		return
 	}
 
-	return callErr
+	if callErr != nil {
+		return callErr
+	}
+
+	self.localSvcGuard.Lock()
+	self.localSvc[svc.ID] = svc
+	self.localSvcGuard.Unlock()
+
+	return nil
 }
 
 func (self *memDiscovery) Deregister(svcid string) error {
 
-	return self.DeleteValue(model.ServiceKeyPrefix + svcid)
+	return self.DeregisterCtx(context.Background(), svcid)
+}
+
+func (self *memDiscovery) DeregisterCtx(ctx context.Context, svcid string) error {
+
+	self.localSvcGuard.Lock()
+	delete(self.localSvc, svcid)
+	self.localSvcGuard.Unlock()
+
+	return self.DeleteValueCtx(ctx, model.ServiceKeyPrefix+svcid)
 }
 
+// reregister 重连后重新注册本实例注册过的服务，完成后发送"reregister"通知
+// 会话断开时服务器已删除这些服务，需要在AuthACK之后调用
+func (self *memDiscovery) reregister() {
+
+	self.localSvcGuard.Lock()
+	var list []*discovery.ServiceDesc
+	for _, desc := range self.localSvc {
+		list = append(list, desc)
+	}
+	hook := self.reregisterHook
+	self.localSvcGuard.Unlock()
+
+	// 没有注册服务时也调用，回调可能需要重新获取与会话绑定的锁
+	if hook != nil {
+		list = self.applyReregisterHook(hook, list)
+	}
+
+	for _, desc := range list {
+
+		// 期间已注销
+		self.localSvcGuard.Lock()
+		_, ok := self.localSvc[desc.ID]
+		self.localSvcGuard.Unlock()
+
+		if !ok {
+			continue
+		}
+
+		if err := self.Register(desc); err != nil {
+			log.GetLog().Errorf("memsd reregister service '%s' failed, %s", desc.ID, err.Error())
+		} else {
+			log.GetLog().Infof("memsd reregister service '%s'", desc.ID)
+		}
+	}
+
+	self.triggerNotify("reregister", 0)
+}
+
+// SetReregisterHook 设置重新注册本实例服务之前的回调
+func (self *memDiscovery) SetReregisterHook(hook discovery.ReregisterHook) {
+
+	self.localSvcGuard.Lock()
+	self.reregisterHook = hook
+	self.localSvcGuard.Unlock()
+}
+
+// applyReregisterHook 调用回调并替换ID改变的服务，原来的服务不再重新注册
+func (self *memDiscovery) applyReregisterHook(hook discovery.ReregisterHook, list []*discovery.ServiceDesc) []*discovery.ServiceDesc {
+
+	newList := hook(list)
+
+	kept := make(map[string]bool, len(newList))
+	for _, desc := range newList {
+		kept[desc.ID] = true
+	}
+
+	self.localSvcGuard.Lock()
+	for _, desc := range list {
+		if !kept[desc.ID] {
+			delete(self.localSvc, desc.ID)
+		}
+	}
+
+	for _, desc := range newList {
+		self.localSvc[desc.ID] = desc
+	}
+	self.localSvcGuard.Unlock()
+
+	return newList
+}
+
+// Query 查询服务，返回当前版本服务缓存中的列表
+// 缓存修改时生成新的版本，不修改已返回的列表，结果可以持有及遍历
 func (self *memDiscovery) Query(name string) (ret []*discovery.ServiceDesc) {
 
-	self.svcCacheGuard.RLock()
-	defer self.svcCacheGuard.RUnlock()
+	return self.loadSvcCache().byName[name]
+}
+
+// QueryCtx 从本地缓存查询，只在调用前检查ctx是否已结束
+func (self *memDiscovery) QueryCtx(ctx context.Context, name string) (ret []*discovery.ServiceDesc, err error) {
+
+	if err = ctx.Err(); err != nil {
+		return
+	}
 
-	return self.svcCache[name]
+	return self.Query(name), nil
 }
 
 func (self *memDiscovery) QueryAll() (ret []*discovery.ServiceDesc) {
 
-	self.svcCacheGuard.RLock()
-	defer self.svcCacheGuard.RUnlock()
-
-	for _, list := range self.svcCache {
+	for _, list := range self.loadSvcCache().byName {
 		ret = append(ret, list...)
 	}
 
 	return
 }
 
+// ServiceVersion 返回服务缓存的版本，服务新增、变化或移除时递增
+// 版本不变时Query的结果不变，调用方可以据此判断是否需要重新查询
+func (self *memDiscovery) ServiceVersion() int64 {
+
+	return self.loadSvcCache().version
+}
+
 func (self *memDiscovery) ClearService() {
-	self.remoteCall(&proto.ClearSvcREQ{}, func(ack *proto.ClearSvcACK) {})
+	self.remoteCall(&proto.ClearSvcREQ{}, func(ack *proto.ClearSvcACK) {
+		if err := codeToError(ack.Code); err != nil {
+			log.GetLog().Errorf("ClearService failed, %s", err.Error())
+		}
+	})
 }
 
 func (self *memDiscovery) triggerNotify(mode string, timeout time.Duration) {
@@ -107,11 +217,14 @@ func (self *memDiscovery) triggerNotify(mode string, timeout time.Duration) {
 
 }
 
+// RegisterNotify 注册通知
+// 参数:
+//   - mode: "add"服务新增或变化，"ready"认证完成，"lost"会话断开，"reregister"重连后重新注册完本地服务，"authfailed"运行中重连认证失败
 func (self *memDiscovery) RegisterNotify(mode string) (ret chan struct{}) {
 	ret = make(chan struct{}, 10)
 
 	switch mode {
-	case "add", "ready":
+	case "add", "ready", "lost", "reregister", "authfailed":
 		self.notifyMap.Store(ret, &notifyContext{
 			mode:  mode,
 			stack: util.StackToString(5),
@@ -126,55 +239,135 @@ func (self *memDiscovery) RegisterNotify(mode string) (ret chan struct{}) {
 func (self *memDiscovery) DeregisterNotify(mode string, c chan struct{}) {
 
 	switch mode {
-	case "add", "ready":
+	case "add", "ready", "lost", "reregister", "authfailed":
 		self.notifyMap.Store(c, nil)
 	default:
 		panic("unknown notify mode: " + mode)
 	}
 }
 
-func (self *memDiscovery) updateSvcCache(svcName string, value []byte) {
-	self.svcCacheGuard.Lock()
+// svcSnapshot 是服务缓存的一个版本，创建后不再修改
+// 修改时复制服务名到列表的映射，并为变化的服务名创建新的列表，已返回的列表不受影响
+type svcSnapshot struct {
+	version int64                               // 缓存版本，每次修改递增
+	byName  map[string][]*discovery.ServiceDesc // 键为服务名，值为服务描述列表
+}
+
+// newSvcSnapshot 创建空的服务缓存
+func newSvcSnapshot() *svcSnapshot {
+	return &svcSnapshot{
+		byName: make(map[string][]*discovery.ServiceDesc),
+	}
+}
+
+// loadSvcCache 获取当前版本的服务缓存
+func (self *memDiscovery) loadSvcCache() *svcSnapshot {
+
+	self.svcCacheGuard.RLock()
+	defer self.svcCacheGuard.RUnlock()
+
+	return self.svcCache
+}
+
+// storeSvcListLocked 以新的列表替换服务名对应的列表，生成新版本的缓存，需要持有svcCacheGuard
+// 参数:
+//   - svcName: 服务名
+//   - list: 新的列表，为空时移除服务名
+func (self *memDiscovery) storeSvcListLocked(svcName string, list []*discovery.ServiceDesc) {
+
+	prev := self.svcCache
 
-	list := self.svcCache[svcName]
+	byName := make(map[string][]*discovery.ServiceDesc, len(prev.byName)+1)
+	for name, svcList := range prev.byName {
+		byName[name] = svcList
+	}
+
+	if len(list) == 0 {
+		delete(byName, svcName)
+	} else {
+		byName[svcName] = list
+	}
+
+	self.svcCache = &svcSnapshot{
+		version: prev.version + 1,
+		byName:  byName,
+	}
+}
+
+func (self *memDiscovery) updateSvcCache(svcName string, value []byte) {
 
 	var desc discovery.ServiceDesc
 	err := json.Unmarshal(value, &desc)
 	if err != nil {
 		log.GetLog().Errorf("ServiceDesc unmarshal failed, %s", err)
-		self.svcCacheGuard.Unlock()
 		return
 	}
 
-	var notfound = true
-	for index, svc := range list {
+	self.svcCacheGuard.Lock()
+
+	list := self.svcCache.byName[svcName]
+	newList := make([]*discovery.ServiceDesc, 0, len(list)+1)
+
+	var prevDesc *discovery.ServiceDesc
+	for _, svc := range list {
 		if svc.ID == desc.ID {
-			list[index] = &desc
-			notfound = false
-			break
+			prevDesc = svc
+			newList = append(newList, &desc)
+		} else {
+			newList = append(newList, svc)
 		}
 	}
 
-	if notfound {
-		list = append(list, &desc)
+	if prevDesc == nil {
+		newList = append(newList, &desc)
 	}
 
-	self.svcCache[svcName] = list
+	self.storeSvcListLocked(svcName, newList)
 	self.svcCacheGuard.Unlock()
 
 	self.triggerNotify("add", time.Second*10)
+
+	switch {
+	case prevDesc == nil:
+		self.triggerServiceEvent(discovery.ServiceEvent{
+			Kind: discovery.ServiceEventKind_Added,
+			Desc: &desc,
+		}, time.Second*10)
+	case !prevDesc.Equals(&desc):
+		self.triggerServiceEvent(discovery.ServiceEvent{
+			Kind:     discovery.ServiceEventKind_Updated,
+			Desc:     &desc,
+			PrevDesc: prevDesc,
+		}, time.Second*10)
+	}
 }
 
 func (self *memDiscovery) deleteSvcCache(svcid, svcName string) {
 
-	list := self.svcCache[svcName]
+	self.svcCacheGuard.Lock()
+
+	list := self.svcCache.byName[svcName]
+	newList := make([]*discovery.ServiceDesc, 0, len(list))
 
-	for index, svc := range list {
+	var removedDesc *discovery.ServiceDesc
+	for _, svc := range list {
 		if svc.ID == svcid {
-			list = append(list[:index], list[index+1:]...)
-			break
+			removedDesc = svc
+		} else {
+			newList = append(newList, svc)
 		}
 	}
 
-	self.svcCache[svcName] = list
+	if removedDesc != nil {
+		self.storeSvcListLocked(svcName, newList)
+	}
+
+	self.svcCacheGuard.Unlock()
+
+	if removedDesc != nil {
+		self.triggerServiceEvent(discovery.ServiceEvent{
+			Kind: discovery.ServiceEventKind_Removed,
+			Desc: removedDesc,
+		}, time.Second*10)
+	}
 }
@@ -0,0 +1,159 @@
+package memsd
+
+import (
+	"fmt"
+	"github.com/bobwong89757/cellmesh/discovery"
+	"sync"
+	"testing"
+)
+
+// 修改服务缓存的同时并发查询及处理通知，需要以-race运行
+func TestQueryConcurrent(t *testing.T) {
+
+	sd := newTestDiscovery()
+
+	const (
+		loopCount = 2000
+		idCount   = 8
+	)
+
+	added := sd.RegisterNotify("add")
+	events := sd.WatchService("*")
+
+	done := make(chan struct{})
+
+	var consumers sync.WaitGroup
+	consumers.Add(2)
+
+	// 收到通知时查询，版本不会回退
+	go func() {
+		defer consumers.Done()
+
+		var lastVersion int64
+		for {
+			select {
+			case <-added:
+				version := sd.ServiceVersion()
+				if version < lastVersion {
+					t.Errorf("version rollback: %d -> %d", lastVersion, version)
+				}
+
+				lastVersion = version
+
+				for _, desc := range sd.Query("game") {
+					if desc.Name != "game" {
+						t.Errorf("unexpected svc: %+v", desc)
+					}
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	go func() {
+		defer consumers.Done()
+
+		for {
+			select {
+			case <-events:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var readers sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				list := sd.Query("game")
+				held := append([]*discovery.ServiceDesc(nil), list...)
+
+				idSet := map[string]bool{}
+				for _, desc := range list {
+					if idSet[desc.ID] {
+						t.Errorf("duplicate svc: %s", desc.ID)
+					}
+
+					idSet[desc.ID] = true
+				}
+
+				sd.QueryAll()
+
+				// 持有的列表不随后续修改变化
+				for index, desc := range list {
+					if held[index] != desc {
+						t.Errorf("query result changed at %d", index)
+					}
+				}
+			}
+		}()
+	}
+
+	var writers sync.WaitGroup
+	for _, svcName := range []string{"game", "login"} {
+		writers.Add(1)
+		go func(svcName string) {
+			defer writers.Done()
+
+			for i := 0; i < loopCount; i++ {
+
+				desc := &discovery.ServiceDesc{
+					Name: svcName,
+					ID:   fmt.Sprintf("%s#%d@dev", svcName, i%idCount),
+					Port: i,
+				}
+
+				if i%3 == 2 {
+					sd.deleteSvcCache(desc.ID, svcName)
+				} else {
+					sd.updateSvcCache(svcName, mustMarshalDesc(t, desc))
+				}
+			}
+		}(svcName)
+	}
+
+	writers.Wait()
+	close(done)
+	readers.Wait()
+	consumers.Wait()
+
+	sd.DeregisterNotify("add", added)
+	sd.UnwatchService(events)
+
+	// 每个ID最后一次修改为删除或更新
+	for _, svcName := range []string{"game", "login"} {
+
+		expect := map[string]int{}
+		for i := 0; i < loopCount; i++ {
+
+			svcid := fmt.Sprintf("%s#%d@dev", svcName, i%idCount)
+			if i%3 == 2 {
+				delete(expect, svcid)
+			} else {
+				expect[svcid] = i
+			}
+		}
+
+		list := sd.Query(svcName)
+		if len(list) != len(expect) {
+			t.Fatalf("expect %d %s svc, got %d", len(expect), svcName, len(list))
+		}
+
+		for _, desc := range list {
+			if port, ok := expect[desc.ID]; !ok || port != desc.Port {
+				t.Fatalf("unexpected svc: %+v", desc)
+			}
+		}
+	}
+}
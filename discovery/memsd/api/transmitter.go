@@ -1,8 +1,8 @@
 package memsd
 
 import (
+	"github.com/bobwong89757/cellmesh/util"
 	"github.com/bobwong89757/cellnet"
-	"io"
 	"net"
 )
 
@@ -17,43 +17,41 @@ type socketOpt interface {
 
 func (TCPMessageTransmitter) OnRecvMessage(ses cellnet.Session) (msg interface{}, err error) {
 
-	reader, ok := ses.Raw().(io.Reader)
+	// 开启TLS时为TLS连接
+	conn := meshutil.SessionConn(ses)
 
 	// 转换错误，或者连接已经关闭时退出
-	if !ok || reader == nil {
+	if conn == nil {
 		return nil, nil
 	}
 
 	opt := ses.Peer().(socketOpt)
 
-	if conn, ok := reader.(net.Conn); ok {
+	// 有读超时时，设置超时
+	opt.ApplySocketReadTimeout(conn, func() {
 
-		// 有读超时时，设置超时
-		opt.ApplySocketReadTimeout(conn, func() {
+		msg, err = RecvLTVPacket(conn, opt.MaxPacketSize())
 
-			msg, err = RecvLTVPacket(reader, opt.MaxPacketSize())
-
-		})
-	}
+	})
 
 	return
 }
 
 func (TCPMessageTransmitter) OnSendMessage(ses cellnet.Session, msg interface{}) (err error) {
 
-	writer, ok := ses.Raw().(io.Writer)
+	conn := meshutil.SessionConn(ses)
 
 	// 转换错误，或者连接已经关闭时退出
-	if !ok || writer == nil {
+	if conn == nil {
 		return nil
 	}
 
 	opt := ses.Peer().(socketOpt)
 
 	// 有写超时时，设置超时
-	opt.ApplySocketWriteTimeout(writer.(net.Conn), func() {
+	opt.ApplySocketWriteTimeout(conn, func() {
 
-		err = SendLTVPacket(writer, ses.(cellnet.ContextSet), msg)
+		err = SendLTVPacket(conn, ses.(cellnet.ContextSet), msg)
 
 	})
 
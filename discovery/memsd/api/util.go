@@ -12,6 +12,14 @@ func codeToError(code proto.ResultCode) error {
 		return nil
 	case proto.ResultCode_Result_NotExists:
 		return ErrValueNotExists
+	case proto.ResultCode_Result_PermissionDenied:
+		return ErrPermissionDenied
+	case proto.ResultCode_Result_RevisionMismatch:
+		return ErrRevisionMismatch
+	case proto.ResultCode_Result_LeaseNotFound:
+		return ErrLeaseNotFound
+	case proto.ResultCode_Result_InvalidRequest:
+		return ErrInvalidRequest
 	}
 
 	return fmt.Errorf("error %s", code.String())
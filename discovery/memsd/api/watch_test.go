@@ -0,0 +1,75 @@
+package memsd
+
+import (
+	"encoding/json"
+	"github.com/bobwong89757/cellmesh/discovery"
+	"testing"
+)
+
+func newTestDiscovery() *memDiscovery {
+	return &memDiscovery{
+		config:   DefaultConfig(),
+		kvCache:  make(map[string][]byte),
+		svcCache: newSvcSnapshot(),
+		pending:  make(map[int64]*pendingCall),
+	}
+}
+
+func mustMarshalDesc(t *testing.T, desc *discovery.ServiceDesc) []byte {
+	data, err := json.Marshal(desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func TestWatchService(t *testing.T) {
+
+	sd := newTestDiscovery()
+
+	gameEvents := sd.WatchService("game")
+	allEvents := sd.WatchService("*")
+	defer sd.UnwatchService(gameEvents)
+	defer sd.UnwatchService(allEvents)
+
+	desc := &discovery.ServiceDesc{Name: "game", ID: "game#0@dev", Host: "127.0.0.1", Port: 9091}
+	sd.updateSvcCache(desc.Name, mustMarshalDesc(t, desc))
+
+	if ev := <-gameEvents; ev.Kind != discovery.ServiceEventKind_Added || ev.Desc.ID != desc.ID {
+		t.Fatalf("expect added event, got %s %v", ev.Kind, ev.Desc)
+	}
+
+	// 内容不变时不产生事件
+	sd.updateSvcCache(desc.Name, mustMarshalDesc(t, desc))
+
+	desc.Port = 9092
+	sd.updateSvcCache(desc.Name, mustMarshalDesc(t, desc))
+
+	ev := <-gameEvents
+	if ev.Kind != discovery.ServiceEventKind_Updated || ev.Desc.Port != 9092 || ev.PrevDesc.Port != 9091 {
+		t.Fatalf("expect updated event, got %s %v prev %v", ev.Kind, ev.Desc, ev.PrevDesc)
+	}
+
+	login := &discovery.ServiceDesc{Name: "login", ID: "login#0@dev", Host: "127.0.0.1", Port: 9093}
+	sd.updateSvcCache(login.Name, mustMarshalDesc(t, login))
+
+	sd.deleteSvcCache(desc.ID, desc.Name)
+
+	if ev := <-gameEvents; ev.Kind != discovery.ServiceEventKind_Removed || ev.Desc.ID != desc.ID {
+		t.Fatalf("expect removed event, got %s %v", ev.Kind, ev.Desc)
+	}
+
+	if len(gameEvents) != 0 {
+		t.Fatalf("unexpected event for 'game' watcher")
+	}
+
+	var kinds []discovery.ServiceEventKind
+	for len(allEvents) > 0 {
+		kinds = append(kinds, (<-allEvents).Kind)
+	}
+
+	if len(kinds) != 4 {
+		t.Fatalf("expect 4 events for '*' watcher, got %v", kinds)
+	}
+}
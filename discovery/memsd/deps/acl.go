@@ -0,0 +1,160 @@
+package deps
+
+import (
+	"encoding/json"
+	"github.com/bobwong89757/cellmesh/discovery/memsd/model"
+	"github.com/bobwong89757/cellmesh/util"
+	"github.com/bobwong89757/cellnet"
+	"github.com/bobwong89757/cellnet/log"
+	"os"
+	"time"
+)
+
+// 按客户端身份限制可写入的键及可注册的服务
+// 未加载规则时不做限制；加载后只允许规则中列出的操作
+
+// ACLRule 是一条授权规则，名称均支持*通配
+type ACLRule struct {
+	Client     string   // 客户端ID，如"game-*"
+	Namespaces []string // 规则生效的命名空间，为空时只在默认命名空间生效，"*"表示所有命名空间
+	Keys       []string // 可设置及删除的键，如"config/game/*"
+	Services   []string // 可注册及注销的服务名，如"game"
+	Clear      bool     // 是否允许ClearSvc、ClearKey
+}
+
+// ACLFile 是规则文件的结构，格式为JSON
+type ACLFile struct {
+	Rules []*ACLRule
+}
+
+var (
+	// ACLCheckDuration 检查规则文件修改的间隔
+	ACLCheckDuration = time.Second * 5
+
+	aclRules *ACLFile // 当前生效的规则，nil表示不限制，只在Queue中访问
+)
+
+// LoadACLFile 加载规则文件，在Queue中替换当前规则
+// 参数:
+//   - fileName: 规则文件名
+// 返回:
+//   - error: 读取或解析失败时返回错误，当前规则保持不变
+func LoadACLFile(fileName string) error {
+
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+
+	var file ACLFile
+	if err = json.Unmarshal(data, &file); err != nil {
+		return err
+	}
+
+	// ListenSvc之前加载时队列尚未创建，直接设置
+	if model.Queue == nil {
+		aclRules = &file
+	} else {
+		model.Queue.Post(func() {
+			aclRules = &file
+		})
+	}
+
+	log.GetLog().Infof("Load %d acl rules", len(file.Rules))
+
+	return nil
+}
+
+// StartACLCheck 规则文件修改后重新加载，阻塞运行
+// 参数:
+//   - fileName: 规则文件名，需要先调用LoadACLFile加载
+func StartACLCheck(fileName string) {
+
+	var lastModTime time.Time
+	if info, err := os.Stat(fileName); err == nil {
+		lastModTime = info.ModTime()
+	}
+
+	ticker := time.NewTicker(ACLCheckDuration)
+
+	for {
+
+		<-ticker.C
+
+		info, err := os.Stat(fileName)
+		if err != nil || info.ModTime().Equal(lastModTime) {
+			continue
+		}
+
+		lastModTime = info.ModTime()
+
+		if err := LoadACLFile(fileName); err != nil {
+			log.GetLog().Errorf("reload acl failed: %s %s", fileName, err.Error())
+		}
+	}
+}
+
+func matchAny(str string, patternList []string) bool {
+
+	for _, pattern := range patternList {
+		if meshutil.WildcardPatternMatch(str, pattern) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchNamespace 命名空间是否在规则的生效范围内
+func (self *ACLRule) matchNamespace(ns string) bool {
+
+	if len(self.Namespaces) == 0 {
+		return ns == ""
+	}
+
+	return matchAny(ns, self.Namespaces)
+}
+
+// checkRules 遍历会话身份及命名空间匹配的规则，callback返回true表示允许
+func checkRules(ses cellnet.Session, callback func(rule *ACLRule) bool) bool {
+
+	if aclRules == nil {
+		return true
+	}
+
+	clientID := model.GetSessionClientID(ses)
+	ns := model.GetSessionNamespace(ses)
+
+	for _, rule := range aclRules.Rules {
+		if meshutil.WildcardPatternMatch(clientID, rule.Client) && rule.matchNamespace(ns) && callback(rule) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CanWriteValue 会话是否可以设置或删除值
+// 参数:
+//   - ses: 客户端会话
+//   - key: 键名
+//   - svcName: 服务描述所属的服务名，普通键为空
+func CanWriteValue(ses cellnet.Session, key, svcName string) bool {
+
+	return checkRules(ses, func(rule *ACLRule) bool {
+
+		if model.IsServiceKey(key) {
+			return matchAny(svcName, rule.Services)
+		}
+
+		return matchAny(key, rule.Keys)
+	})
+}
+
+// CanClear 会话是否可以清空所有服务或配置
+func CanClear(ses cellnet.Session) bool {
+
+	return checkRules(ses, func(rule *ACLRule) bool {
+		return rule.Clear
+	})
+}
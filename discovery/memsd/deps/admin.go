@@ -0,0 +1,555 @@
+package deps
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/bobwong89757/cellmesh/discovery"
+	"github.com/bobwong89757/cellmesh/discovery/memsd/model"
+	"github.com/bobwong89757/cellmesh/discovery/memsd/proto"
+	"github.com/bobwong89757/cellmesh/util"
+	"github.com/bobwong89757/cellnet"
+	"github.com/bobwong89757/cellnet/log"
+	cellutil "github.com/bobwong89757/cellnet/util"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTP管理接口，供不能使用memsd二进制协议的运维脚本查看及修改数据
+// 列表及事件使用JSON，值在JSON中按base64编码；/v1/kv/直接读写原始值
+// 所有数据访问都投递到Queue中执行，与客户端请求一样无锁
+//
+//	GET    /v1/services?ns=&name=&group=&tag=  列出服务，name支持通配符
+//	GET    /v1/keys?ns=&prefix=                列出配置键
+//	GET    /v1/kv/<key>?ns=                    读取值，修订号在X-Memsd-Revision头中
+//	PUT    /v1/kv/<key>?ns=&revision=          设置值，带revision时比较并设置
+//	DELETE /v1/kv/<key>?ns=&revision=          删除值，带revision时比较并删除
+//	GET    /v1/clients                         列出连接的客户端及等待恢复的会话
+//	GET    /v1/watch?ns=&prefix=&revision=&timeout=  长轮询revision之后的修改
+//	GET    /v1/role                            查看本节点的角色及所知的主机地址
+//	POST   /v1/role                            将备机提升为主机
+
+var (
+	// AdminAddress 不为空时，StartSvc在此地址上启动管理接口
+	AdminAddress string
+
+	// AdminToken 不为空时，请求需要带有Authorization: Bearer <AdminToken>头
+	// 为空时管理接口只能侦听回环地址
+	AdminToken string
+
+	// AdminWatchTimeout 长轮询的默认及最大等待时间
+	AdminWatchTimeout = time.Second * 30
+
+	// 有修改时关闭并替换，唤醒等待的长轮询
+	adminChanged      = make(chan struct{})
+	adminChangedGuard sync.Mutex
+)
+
+var (
+	ErrAdminTokenRequired = errors.New("memsd admin token required for non-loopback address")
+)
+
+func init() {
+
+	model.OnValueSet = append(model.OnValueSet, func(meta *model.ValueMeta) {
+		notifyAdminWatch()
+	})
+
+	model.OnValueDelete = append(model.OnValueDelete, func(meta *model.ValueMeta) {
+		notifyAdminWatch()
+	})
+}
+
+func notifyAdminWatch() {
+	adminChangedGuard.Lock()
+	close(adminChanged)
+	adminChanged = make(chan struct{})
+	adminChangedGuard.Unlock()
+}
+
+// AdminEvent 是管理接口中的一次修改
+type AdminEvent struct {
+	Kind     string // "set"或"deleted"
+	Key      string
+	Value    []byte `json:",omitempty"`
+	SvcName  string `json:",omitempty"`
+	Revision int64
+}
+
+// AdminKey 是管理接口中列出的配置键
+type AdminKey struct {
+	Key       string
+	Revision  int64
+	Size      int
+	LeaseID   int64 `json:",omitempty"`
+	Ephemeral bool  `json:",omitempty"` // 归属于会话，会话断开时删除
+}
+
+// AdminClient 是管理接口中列出的客户端会话
+type AdminClient struct {
+	Address   string `json:",omitempty"`
+	ClientID  string
+	Namespace string
+	TokenID   string `json:",omitempty"` // 会话令牌的摘要，用于对应同一会话，不暴露令牌本身
+	Replica   bool   `json:",omitempty"` // 备机的复制连接
+	Offline   bool   `json:",omitempty"` // 已断开，等待恢复
+}
+
+// ListenAdmin 启动HTTP管理接口，需要在ListenSvc之后调用
+// 参数:
+//   - addr: 侦听地址，端口为0时自动分配，未设置AdminToken时只能是回环地址
+// 返回:
+//   - net.Listener: 侦听器，关闭时停止服务
+//   - error: 侦听失败，或未设置AdminToken时侦听非回环地址返回ErrAdminTokenRequired
+func ListenAdmin(addr string) (net.Listener, error) {
+
+	// 管理接口可以修改数据，没有令牌时不能暴露到其他主机
+	if AdminToken == "" && !isLoopbackAddress(addr) {
+		return nil, ErrAdminTokenRequired
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/services", adminServices)
+	mux.HandleFunc("/v1/keys", adminKeys)
+	mux.HandleFunc("/v1/kv/", adminKV)
+	mux.HandleFunc("/v1/clients", adminClients)
+	mux.HandleFunc("/v1/watch", adminWatch)
+	mux.HandleFunc("/v1/role", adminRole)
+
+	log.GetLog().Infof("memsd admin listen: %s", ln.Addr().String())
+
+	go http.Serve(ln, adminAuth(mux))
+
+	return ln, nil
+}
+
+// isLoopbackAddress 侦听地址是否只能从本机访问，主机为空时侦听所有地址
+func isLoopbackAddress(addr string) bool {
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// adminAuth 检查管理令牌，使用固定时间比较避免通过响应时间猜测令牌
+func adminAuth(handler http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if AdminToken != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+AdminToken)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// adminTokenID 返回会话令牌的摘要，令牌可以恢复及接管会话，不能在管理接口中返回
+func adminTokenID(token string) string {
+
+	if token == "" {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
+
+// queueCall 在Queue中执行并等待完成
+func queueCall(f func()) {
+
+	done := make(chan struct{})
+	model.Queue.Post(func() {
+		f()
+		close(done)
+	})
+
+	<-done
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func adminServices(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	name, group, tag := query.Get("name"), query.Get("group"), query.Get("tag")
+
+	ret := []*discovery.ServiceDesc{}
+	queueCall(func() {
+
+		model.VisitNamespaceValue(query.Get("ns"), func(meta *model.ValueMeta) bool {
+
+			if meta.SvcName == "" {
+				return true
+			}
+
+			desc := meta.ValueAsServiceDesc()
+
+			switch {
+			case name != "" && !meshutil.WildcardPatternMatch(desc.Name, name):
+			case group != "" && desc.GetMeta("SvcGroup") != group:
+			case tag != "" && !desc.ContainTags(tag):
+			default:
+				ret = append(ret, desc)
+			}
+
+			return true
+		})
+	})
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].ID < ret[j].ID
+	})
+
+	writeJSON(w, http.StatusOK, ret)
+}
+
+func adminKeys(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+
+	ret := []AdminKey{}
+	queueCall(func() {
+
+		model.VisitNamespaceValue(query.Get("ns"), func(meta *model.ValueMeta) bool {
+
+			if meta.SvcName == "" && strings.HasPrefix(meta.Key, prefix) {
+				ret = append(ret, AdminKey{
+					Key:       meta.Key,
+					Revision:  meta.Revision,
+					Size:      len(meta.Value),
+					LeaseID:   meta.LeaseID,
+					Ephemeral: meta.Token != "",
+				})
+			}
+
+			return true
+		})
+	})
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Key < ret[j].Key
+	})
+
+	writeJSON(w, http.StatusOK, ret)
+}
+
+func adminKV(w http.ResponseWriter, r *http.Request) {
+
+	key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+	if key == "" {
+		http.Error(w, "expect key", http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	ns := query.Get("ns")
+
+	checkRevision := query.Get("revision") != ""
+	revision, err := strconv.ParseInt(query.Get("revision"), 10, 64)
+	if checkRevision && err != nil {
+		http.Error(w, "invalid revision", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+
+		var meta *model.ValueMeta
+		queueCall(func() {
+			meta = model.GetValue(ns, key)
+		})
+
+		if meta == nil {
+			http.Error(w, "value not exists", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("X-Memsd-Revision", strconv.FormatInt(meta.Revision, 10))
+		w.Write(meta.Value)
+
+	case http.MethodPut:
+
+		// 服务描述需要与会话绑定，只能通过注册服务修改
+		if model.IsServiceKey(key) {
+			http.Error(w, "can not set service", http.StatusBadRequest)
+			return
+		}
+
+		value, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		code := http.StatusOK
+		queueCall(func() {
+
+			switch {
+			case !model.IsPrimary():
+				code = http.StatusServiceUnavailable
+				return
+			case checkRevision && currentRevision(ns, key) != revision:
+				code = http.StatusConflict
+				return
+			}
+
+			meta := &model.ValueMeta{
+				Value:     value,
+				Namespace: ns,
+			}
+
+			model.SetValue(key, meta)
+
+			log.GetLog().Infof("SetValue '%s' value(size:%d) by admin%s", key, len(value), nsSuffix(ns))
+
+			model.Broadcast(ns, &proto.ValueChangeNotifyACK{
+				Key:      key,
+				Value:    value,
+				Revision: meta.Revision,
+			})
+
+			revision = meta.Revision
+		})
+
+		writeKVResult(w, code, revision)
+
+	case http.MethodDelete:
+
+		code := http.StatusOK
+		queueCall(func() {
+
+			current := currentRevision(ns, key)
+
+			switch {
+			case !model.IsPrimary():
+				code = http.StatusServiceUnavailable
+			case current == 0:
+				code = http.StatusNotFound
+			case checkRevision && current != revision:
+				code = http.StatusConflict
+			default:
+				DeleteNotify(ns, key, "admin")
+				revision = model.Revision
+			}
+		})
+
+		writeKVResult(w, code, revision)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// writeKVResult 返回修改的结果
+func writeKVResult(w http.ResponseWriter, code int, revision int64) {
+
+	switch code {
+	case http.StatusOK:
+		writeJSON(w, http.StatusOK, map[string]int64{"Revision": revision})
+	case http.StatusServiceUnavailable:
+		http.Error(w, "not primary", code)
+	case http.StatusNotFound:
+		http.Error(w, "value not exists", code)
+	case http.StatusConflict:
+		http.Error(w, "revision mismatch", code)
+	}
+}
+
+func adminClients(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ret := []AdminClient{}
+	queueCall(func() {
+
+		model.Listener.(cellnet.TCPAcceptor).VisitSession(func(ses cellnet.Session) bool {
+
+			client := AdminClient{
+				Namespace: model.GetSessionNamespace(ses),
+				TokenID:   adminTokenID(model.GetSessionToken(ses)),
+				Replica:   model.IsReplicaSession(ses),
+			}
+
+			client.Address, _ = cellutil.GetRemoteAddrss(ses)
+			ses.(cellnet.ContextSet).FetchContext("clientid", &client.ClientID)
+
+			ret = append(ret, client)
+
+			return true
+		})
+
+		for token, offline := range offlineByToken {
+			ret = append(ret, AdminClient{
+				ClientID:  offline.ClientID,
+				Namespace: offline.Namespace,
+				TokenID:   adminTokenID(token),
+				Offline:   true,
+			})
+		}
+	})
+
+	writeJSON(w, http.StatusOK, ret)
+}
+
+// AdminRole 是/v1/role返回的节点角色
+type AdminRole struct {
+	Role    string // model.RolePrimary或model.RoleStandby
+	Primary string `json:",omitempty"` // 备机所知的主机地址
+}
+
+// adminRole 查看节点角色，POST时将备机提升为主机
+func adminRole(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var ret AdminRole
+	queueCall(func() {
+
+		if r.Method == http.MethodPost {
+			promote()
+		}
+
+		ret.Role = model.Role
+		ret.Primary = model.PrimaryAddress
+	})
+
+	writeJSON(w, http.StatusOK, ret)
+}
+
+// adminWatch 长轮询revision之后的修改
+// 没有revision时立即返回当前修订号；revision过旧无法增量获取时返回410，需要重新列出数据
+func adminWatch(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	ns, prefix := query.Get("ns"), query.Get("prefix")
+
+	timeout := AdminWatchTimeout
+	if raw := query.Get("timeout"); raw != "" {
+		if d, err := time.ParseDuration(raw); err == nil && d < timeout {
+			timeout = d
+		}
+	}
+
+	revision, _ := strconv.ParseInt(query.Get("revision"), 10, 64)
+	deadline := time.After(timeout)
+
+	for {
+
+		adminChangedGuard.Lock()
+		changed := adminChanged
+		adminChangedGuard.Unlock()
+
+		var (
+			resumable bool
+			current   int64
+			events    []AdminEvent
+		)
+
+		queueCall(func() {
+
+			current = model.Revision
+			resumable = revision != 0 && model.CanResume(model.HistoryID, revision)
+			if !resumable {
+				return
+			}
+
+			model.VisitChangeSince(ns, revision, func(meta *model.ValueMeta) {
+
+				if strings.HasPrefix(meta.Key, prefix) {
+					events = append(events, AdminEvent{
+						Kind:     discovery.ValueEventKind_Set.String(),
+						Key:      meta.Key,
+						Value:    meta.Value,
+						SvcName:  meta.SvcName,
+						Revision: meta.Revision,
+					})
+				}
+
+			}, func(rec *model.DeleteRecord) {
+
+				if strings.HasPrefix(rec.Key, prefix) {
+					events = append(events, AdminEvent{
+						Kind:     discovery.ValueEventKind_Deleted.String(),
+						Key:      rec.Key,
+						SvcName:  rec.SvcName,
+						Revision: rec.Revision,
+					})
+				}
+			})
+		})
+
+		switch {
+		case revision == 0:
+			writeJSON(w, http.StatusOK, map[string]interface{}{"Revision": current, "Events": []AdminEvent{}})
+			return
+		case !resumable:
+			writeJSON(w, http.StatusGone, map[string]interface{}{"Revision": current})
+			return
+		case len(events) > 0:
+			writeJSON(w, http.StatusOK, map[string]interface{}{"Revision": current, "Events": events})
+			return
+		}
+
+		// 已检查到current为止的修改
+		revision = current
+
+		select {
+		case <-changed:
+		case <-deadline:
+			writeJSON(w, http.StatusOK, map[string]interface{}{"Revision": current, "Events": []AdminEvent{}})
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package deps
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/bobwong89757/cellmesh/discovery"
+	memsd "github.com/bobwong89757/cellmesh/discovery/memsd/api"
+	"github.com/bobwong89757/cellmesh/discovery/memsd/model"
+	"github.com/bobwong89757/cellnet"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// adminRequest 发送管理接口请求，返回状态码及内容
+func adminRequest(t *testing.T, method, url, body string) (int, []byte) {
+
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+AdminToken)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp.StatusCode, data
+}
+
+func TestAdmin(t *testing.T) {
+
+	config := memsd.DefaultConfig()
+	config.Address = startTestSvc()
+	config.Namespace = "admin"
+	config.ClientID = "admin_test"
+	sd := memsd.NewDiscovery(config)
+
+	// 没有令牌时不能侦听非回环地址
+	if _, err := ListenAdmin(":0"); err != ErrAdminTokenRequired {
+		t.Fatalf("expect admin token required, got %v", err)
+	}
+
+	ln, err := ListenAdmin("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer ln.Close()
+
+	AdminToken = "secret"
+	defer func() {
+		AdminToken = ""
+	}()
+
+	base := fmt.Sprintf("http://%s/v1", ln.Addr().String())
+
+	if resp, err := http.Get(base + "/keys"); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expect unauthorized, got %v", err)
+	}
+
+	if err := sd.Register(&discovery.ServiceDesc{Name: "game", ID: "game#0@dev", Meta: map[string]string{"SvcGroup": "dev"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sd.Register(&discovery.ServiceDesc{Name: "login", ID: "login#0@dev"}); err != nil {
+		t.Fatal(err)
+	}
+
+	code, data := adminRequest(t, "GET", base+"/services?ns=admin&name=g*&group=dev", "")
+
+	var svcList []*discovery.ServiceDesc
+	if json.Unmarshal(data, &svcList); code != http.StatusOK || len(svcList) != 1 || svcList[0].ID != "game#0@dev" {
+		t.Fatalf("unexpected services: %d %s", code, data)
+	}
+
+	// 等待长轮询的当前修订号
+	code, data = adminRequest(t, "GET", base+"/watch?ns=admin", "")
+
+	var watchResult struct {
+		Revision int64
+		Events   []AdminEvent
+	}
+
+	if json.Unmarshal(data, &watchResult); code != http.StatusOK || watchResult.Revision == 0 {
+		t.Fatalf("unexpected watch: %d %s", code, data)
+	}
+
+	watchDone := make(chan []byte)
+	go func() {
+		_, data := adminRequest(t, "GET", fmt.Sprintf("%s/watch?ns=admin&prefix=cfg/&revision=%d&timeout=5s", base, watchResult.Revision), "")
+		watchDone <- data
+	}()
+
+	time.Sleep(time.Millisecond * 100)
+
+	code, data = adminRequest(t, "PUT", base+"/kv/cfg/a?ns=admin", "hello")
+	if code != http.StatusOK {
+		t.Fatalf("set failed: %d %s", code, data)
+	}
+
+	if json.Unmarshal(<-watchDone, &watchResult); len(watchResult.Events) != 1 || watchResult.Events[0].Key != "cfg/a" || string(watchResult.Events[0].Value) != "hello" {
+		t.Fatalf("unexpected watch events: %+v", watchResult)
+	}
+
+	// 客户端收到管理接口的修改
+	var value string
+	for i := 0; i < 100 && value == ""; i++ {
+		sd.GetValue("cfg/a", &value)
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	if value != "hello" {
+		t.Fatalf("expect client value hello, got '%s'", value)
+	}
+
+	code, data = adminRequest(t, "GET", base+"/kv/cfg/a?ns=admin", "")
+	if code != http.StatusOK || string(data) != "hello" {
+		t.Fatalf("unexpected get: %d %s", code, data)
+	}
+
+	if code, _ = adminRequest(t, "PUT", base+"/kv/cfg/a?ns=admin&revision=1", "world"); code != http.StatusConflict {
+		t.Fatalf("expect conflict, got %d", code)
+	}
+
+	code, data = adminRequest(t, "GET", base+"/keys?ns=admin&prefix=cfg/", "")
+
+	var keys []AdminKey
+	if json.Unmarshal(data, &keys); code != http.StatusOK || len(keys) != 1 || keys[0].Size != 5 {
+		t.Fatalf("unexpected keys: %d %s", code, data)
+	}
+
+	code, data = adminRequest(t, "GET", base+"/clients", "")
+
+	var clients []AdminClient
+	json.Unmarshal(data, &clients)
+
+	found := false
+	for _, client := range clients {
+		if client.ClientID == "admin_test" && client.Namespace == "admin" && client.TokenID != "" {
+			found = true
+		}
+	}
+
+	if code != http.StatusOK || !found {
+		t.Fatalf("client not listed: %d %s", code, data)
+	}
+
+	// 不返回会话令牌
+	var tokens []string
+	queueCall(func() {
+		model.Listener.(cellnet.TCPAcceptor).VisitSession(func(ses cellnet.Session) bool {
+			if token := model.GetSessionToken(ses); token != "" {
+				tokens = append(tokens, token)
+			}
+			return true
+		})
+	})
+
+	for _, token := range tokens {
+		if strings.Contains(string(data), token) {
+			t.Fatalf("session token exposed: %s", data)
+		}
+	}
+
+	// 令牌错误时拒绝
+	req, _ := http.NewRequest("GET", base+"/clients", nil)
+	req.Header.Set("Authorization", "Bearer secreT")
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expect unauthorized with wrong token, got %v", err)
+	}
+
+	if code, _ = adminRequest(t, "DELETE", base+"/kv/cfg/a?ns=admin", ""); code != http.StatusOK {
+		t.Fatalf("delete failed: %d", code)
+	}
+
+	if code, _ = adminRequest(t, "DELETE", base+"/kv/cfg/a?ns=admin", ""); code != http.StatusNotFound {
+		t.Fatalf("expect not found, got %d", code)
+	}
+}
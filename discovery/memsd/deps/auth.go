@@ -0,0 +1,97 @@
+package deps
+
+import (
+	"github.com/bobwong89757/cellmesh/discovery/memsd/model"
+	"github.com/bobwong89757/cellmesh/discovery/memsd/proto"
+	"github.com/bobwong89757/cellnet"
+	"github.com/bobwong89757/cellnet/log"
+)
+
+// 客户端认证
+// 未配置任何密钥时，保持兼容，客户端直接发送AuthREQ即可
+// 配置密钥后，客户端先通过AuthChallengeREQ获取随机数，再在AuthREQ中带上HMAC签名
+
+var (
+	// AuthSharedSecret 所有客户端共用的密钥
+	AuthSharedSecret string
+
+	// AuthClientSecrets 按客户端ID配置的密钥，优先于AuthSharedSecret
+	AuthClientSecrets = map[string]string{}
+)
+
+func init() {
+
+	proto.Handle_Memsd_AuthChallengeREQ = func(ev cellnet.Event) {
+
+		nonce := model.NewNonce()
+
+		ev.Session().(cellnet.ContextSet).SetContext("challenge", nonce)
+
+		ev.Session().Send(&proto.AuthChallengeACK{
+			Nonce: nonce,
+		})
+	}
+}
+
+// AuthRequired 是否配置了密钥，需要客户端认证
+func AuthRequired() bool {
+	return AuthSharedSecret != "" || len(AuthClientSecrets) > 0
+}
+
+// clientSecret 获取客户端ID对应的密钥
+func clientSecret(clientID string) (string, bool) {
+
+	if secret, ok := AuthClientSecrets[clientID]; ok {
+		return secret, true
+	}
+
+	if AuthSharedSecret != "" {
+		return AuthSharedSecret, true
+	}
+
+	return "", false
+}
+
+// verifyAuth 校验AuthREQ中的签名
+func verifyAuth(ses cellnet.Session, msg *proto.AuthREQ) bool {
+
+	if !AuthRequired() {
+		return true
+	}
+
+	nonce := takeChallenge(ses)
+	if len(nonce) == 0 {
+		return false
+	}
+
+	secret, ok := clientSecret(msg.ClientID)
+	if !ok {
+		return false
+	}
+
+	return model.VerifyChallenge(secret, nonce, msg.Signature)
+}
+
+// takeChallenge 取出会话最近一次获取的随机数，随机数只能使用一次
+func takeChallenge(ses cellnet.Session) (nonce []byte) {
+
+	if !ses.(cellnet.ContextSet).FetchContext("challenge", &nonce) {
+		return nil
+	}
+
+	ses.(cellnet.ContextSet).SetContext("challenge", []byte(nil))
+
+	return
+}
+
+// authFailed 通知客户端认证失败并断开
+func authFailed(ses cellnet.Session, clientID string) {
+
+	log.GetLog().Warnf("Auth failed, client: '%s'", clientID)
+
+	ses.Send(&proto.AuthACK{
+		Code: proto.ResultCode_Result_AuthFailed,
+	})
+
+	ses.Close()
+}
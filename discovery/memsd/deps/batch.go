@@ -0,0 +1,118 @@
+package deps
+
+import (
+	"github.com/bobwong89757/cellmesh/discovery/memsd/model"
+	"github.com/bobwong89757/cellmesh/discovery/memsd/proto"
+	"github.com/bobwong89757/cellnet"
+	"github.com/bobwong89757/cellnet/log"
+)
+
+// 批量操作在队列中一次处理，先检查所有操作，全部通过后才修改
+// 修改完成后只广播一条通知，客户端一起应用，不会观察到只写了一部分的状态
+
+func init() {
+
+	proto.Handle_Memsd_BatchREQ = func(ev cellnet.Event) {
+		msg := ev.Message().(*proto.BatchREQ)
+
+		if !CheckAuth(ev.Session()) {
+
+			ev.Session().Send(&proto.BatchACK{
+				Code:   proto.ResultCode_Result_AuthRequire,
+				CallID: msg.CallID,
+			})
+			return
+		}
+
+		ns := model.GetSessionNamespace(ev.Session())
+
+		if code := checkBatch(ev.Session(), ns, msg.Ops); code != proto.ResultCode_Result_OK {
+
+			ev.Session().Send(&proto.BatchACK{
+				Code:   code,
+				CallID: msg.CallID,
+			})
+			return
+		}
+
+		beginPersistBatch()
+		notify := applyBatch(ns, msg.Ops)
+		endPersistBatch()
+
+		log.GetLog().Infof("Batch ops: %d changed: %d revision: %d%s", len(msg.Ops), len(notify.Ops), model.Revision, nsSuffix(ns))
+
+		if len(notify.Ops) > 0 {
+			model.Broadcast(ns, notify)
+		}
+
+		ev.Session().Send(&proto.BatchACK{
+			Revision: model.Revision,
+			CallID:   msg.CallID,
+		})
+	}
+}
+
+// checkBatch 检查批量操作中的每个操作，修订号按执行前的状态比较
+// 返回:
+//   - proto.ResultCode: 第一个失败操作的错误码，全部通过时返回Result_OK
+func checkBatch(ses cellnet.Session, ns string, ops []proto.BatchOp) proto.ResultCode {
+
+	for _, op := range ops {
+
+		// 服务描述需要与会话绑定，只能通过注册服务修改
+		if op.Key == "" || model.IsServiceKey(op.Key) {
+			return proto.ResultCode_Result_InvalidRequest
+		}
+
+		if !CanWriteValue(ses, op.Key, "") {
+			return proto.ResultCode_Result_PermissionDenied
+		}
+
+		if op.CheckRevision && currentRevision(ns, op.Key) != op.Revision {
+			return proto.ResultCode_Result_RevisionMismatch
+		}
+	}
+
+	return proto.ResultCode_Result_OK
+}
+
+// applyBatch 执行检查过的批量操作，删除不存在的键时忽略
+// 返回:
+//   - *proto.ValueBatchNotifyACK: 实际发生的修改，每个操作带有修改后的修订号
+func applyBatch(ns string, ops []proto.BatchOp) *proto.ValueBatchNotifyACK {
+
+	var notify proto.ValueBatchNotifyACK
+
+	for _, op := range ops {
+
+		if op.Delete {
+
+			if model.DeleteValue(ns, op.Key) == nil {
+				continue
+			}
+
+			notify.Ops = append(notify.Ops, proto.BatchOp{
+				Delete:   true,
+				Key:      op.Key,
+				Revision: model.Revision,
+			})
+
+		} else {
+
+			meta := &model.ValueMeta{
+				Value:     op.Value,
+				Namespace: ns,
+			}
+
+			model.SetValue(op.Key, meta)
+
+			notify.Ops = append(notify.Ops, proto.BatchOp{
+				Key:      op.Key,
+				Value:    op.Value,
+				Revision: meta.Revision,
+			})
+		}
+	}
+
+	return &notify
+}
@@ -0,0 +1,43 @@
+package deps
+
+import (
+	"fmt"
+	"time"
+)
+
+// InitServerConfig 从配置映射设置memsd服务的参数，需要在StartSvc或ListenSvc之前调用
+// 未出现的键保持原来的值
+// 参数:
+//   - conf: 配置映射，键名包括: resumegrace、replica、advertise、namespace
+//     resumegrace为会话断开后等待恢复的时间，例如"30s"，为0时立即删除会话注册的服务及临时键
+//     replica为其他节点的地址(逗号分隔)，设置后以备机身份启动，见ReplicaAddress
+//     advertise为客户端可以访问的本节点地址，见AdvertiseAddress
+//     namespace为命令行工具操作的命名空间，见Namespace
+// 返回:
+//   - error: 值格式错误时返回错误信息
+func InitServerConfig(conf map[string]string) error {
+
+	if value, ok := conf["resumegrace"]; ok {
+
+		grace, err := time.ParseDuration(value)
+		if err != nil || grace < 0 {
+			return fmt.Errorf("invalid resumegrace '%s'", value)
+		}
+
+		SessionResumeGrace = grace
+	}
+
+	if value, ok := conf["replica"]; ok {
+		ReplicaAddress = value
+	}
+
+	if value, ok := conf["advertise"]; ok {
+		AdvertiseAddress = value
+	}
+
+	if value, ok := conf["namespace"]; ok {
+		Namespace = value
+	}
+
+	return nil
+}
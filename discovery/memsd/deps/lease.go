@@ -0,0 +1,233 @@
+package deps
+
+import (
+	"github.com/bobwong89757/cellmesh/discovery/memsd/model"
+	"github.com/bobwong89757/cellmesh/discovery/memsd/proto"
+	"github.com/bobwong89757/cellnet"
+	"github.com/bobwong89757/cellnet/log"
+	"time"
+)
+
+// 租约由客户端申请并定期续约，键在设置时绑定到租约
+// 租约到期未续约或被撤销时，删除绑定的所有键并通知客户端
+// 租约只保存在内存中并复制到备机，不持久化
+
+var (
+	// LeaseCheckDuration 检查租约到期的间隔
+	LeaseCheckDuration = time.Millisecond * 500
+
+	// MinLeaseTTL 租约的最小有效期，申请的有效期过短时使用此值
+	MinLeaseTTL = time.Second
+)
+
+func init() {
+
+	model.OnLeaseGrant = append(model.OnLeaseGrant, func(lease *model.Lease) {
+
+		if !model.IsPrimary() || model.Listener == nil {
+			return
+		}
+
+		model.BroadcastReplica(&proto.ReplicaLeaseACK{
+			LeaseID:   lease.ID,
+			TTL:       int64(lease.TTL / time.Millisecond),
+			Namespace: lease.Namespace,
+			Token:     lease.Token,
+			ClientID:  lease.ClientID,
+		})
+	})
+
+	model.OnLeaseRemove = append(model.OnLeaseRemove, func(lease *model.Lease) {
+
+		if !model.IsPrimary() || model.Listener == nil {
+			return
+		}
+
+		model.BroadcastReplica(&proto.ReplicaLeaseACK{
+			LeaseID: lease.ID,
+			Removed: true,
+		})
+	})
+
+	proto.Handle_Memsd_LeaseGrantREQ = func(ev cellnet.Event) {
+		msg := ev.Message().(*proto.LeaseGrantREQ)
+
+		if !CheckAuth(ev.Session()) {
+
+			ev.Session().Send(&proto.LeaseGrantACK{
+				Code:   proto.ResultCode_Result_AuthRequire,
+				CallID: msg.CallID,
+			})
+			return
+		}
+
+		ttl := time.Duration(msg.TTL) * time.Millisecond
+		if ttl < MinLeaseTTL {
+			ttl = MinLeaseTTL
+		}
+
+		lease := model.GrantLease(model.GetSessionNamespace(ev.Session()), model.GetSessionToken(ev.Session()), model.GetSessionClientID(ev.Session()), ttl)
+
+		log.GetLog().Debugf("GrantLease %d ttl: %s%s", lease.ID, ttl, nsSuffix(lease.Namespace))
+
+		ev.Session().Send(&proto.LeaseGrantACK{
+			LeaseID: lease.ID,
+			TTL:     int64(ttl / time.Millisecond),
+			CallID:  msg.CallID,
+		})
+	}
+
+	proto.Handle_Memsd_LeaseKeepAliveREQ = func(ev cellnet.Event) {
+		msg := ev.Message().(*proto.LeaseKeepAliveREQ)
+
+		if !CheckAuth(ev.Session()) {
+
+			ev.Session().Send(&proto.LeaseKeepAliveACK{
+				Code:   proto.ResultCode_Result_AuthRequire,
+				CallID: msg.CallID,
+			})
+			return
+		}
+
+		lease := getSessionLease(ev.Session(), msg.LeaseID)
+		if lease == nil {
+
+			ev.Session().Send(&proto.LeaseKeepAliveACK{
+				Code:   proto.ResultCode_Result_LeaseNotFound,
+				CallID: msg.CallID,
+			})
+			return
+		}
+
+		model.KeepAliveLease(msg.LeaseID)
+
+		ev.Session().Send(&proto.LeaseKeepAliveACK{
+			TTL:    int64(lease.TTL / time.Millisecond),
+			CallID: msg.CallID,
+		})
+	}
+
+	proto.Handle_Memsd_LeaseRevokeREQ = func(ev cellnet.Event) {
+		msg := ev.Message().(*proto.LeaseRevokeREQ)
+
+		if !CheckAuth(ev.Session()) {
+
+			ev.Session().Send(&proto.LeaseRevokeACK{
+				Code:   proto.ResultCode_Result_AuthRequire,
+				CallID: msg.CallID,
+			})
+			return
+		}
+
+		lease := getSessionLease(ev.Session(), msg.LeaseID)
+		if lease == nil {
+
+			ev.Session().Send(&proto.LeaseRevokeACK{
+				Code:   proto.ResultCode_Result_LeaseNotFound,
+				CallID: msg.CallID,
+			})
+			return
+		}
+
+		// 撤销会删除绑定的键，需要有所有键的权限
+		denied := false
+		model.VisitNamespaceValue(lease.Namespace, func(meta *model.ValueMeta) bool {
+
+			if meta.LeaseID == lease.ID && !CanWriteValue(ev.Session(), meta.Key, meta.SvcName) {
+				denied = true
+				return false
+			}
+
+			return true
+		})
+
+		if denied {
+			ev.Session().Send(&proto.LeaseRevokeACK{
+				Code:   proto.ResultCode_Result_PermissionDenied,
+				CallID: msg.CallID,
+			})
+			return
+		}
+
+		RevokeLease(msg.LeaseID, "revoke")
+
+		ev.Session().Send(&proto.LeaseRevokeACK{
+			CallID: msg.CallID,
+		})
+	}
+}
+
+// getSessionLease 获取会话申请的租约，租约不存在或属于其他会话时返回nil
+// 租约ID可以被猜测，不能只检查命名空间
+func getSessionLease(ses cellnet.Session, id int64) *model.Lease {
+
+	lease := model.GetLease(id)
+	if lease == nil || lease.Namespace != model.GetSessionNamespace(ses) || lease.Token != model.GetSessionToken(ses) {
+		return nil
+	}
+
+	return lease
+}
+
+// RevokeLease 移除租约，删除绑定的所有键并通知客户端
+// 参数:
+//   - id: 租约ID
+//   - reason: 删除原因，用于日志
+func RevokeLease(id int64, reason string) {
+
+	lease := model.RemoveLease(id)
+	if lease == nil {
+		return
+	}
+
+	var keyToDelete []string
+	model.VisitNamespaceValue(lease.Namespace, func(meta *model.ValueMeta) bool {
+
+		if meta.LeaseID == id {
+			keyToDelete = append(keyToDelete, meta.Key)
+		}
+
+		return true
+	})
+
+	for _, key := range keyToDelete {
+		DeleteNotify(lease.Namespace, key, reason)
+	}
+}
+
+// checkLeaseExpire 定期删除到期的租约，由ListenSvc启动
+func checkLeaseExpire() {
+
+	ticker := time.NewTicker(LeaseCheckDuration)
+
+	for {
+
+		<-ticker.C
+
+		// 与收发在一个队列中，保证无锁
+		model.Queue.Post(func() {
+
+			// 备机的租约由主机维护
+			if !model.IsPrimary() {
+				return
+			}
+
+			now := time.Now()
+
+			var expired []int64
+			model.VisitLease(func(lease *model.Lease) bool {
+
+				// 会话等待恢复期间客户端无法续约
+				if lease.Expired(now) && !isOfflineToken(lease.Token) {
+					expired = append(expired, lease.ID)
+				}
+
+				return true
+			})
+
+			for _, id := range expired {
+				RevokeLease(id, "lease expired")
+			}
+		})
+	}
+}
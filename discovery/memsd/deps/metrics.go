@@ -0,0 +1,216 @@
+package deps
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/bobwong89757/cellmesh/discovery/memsd/model"
+	"github.com/bobwong89757/cellnet"
+	"github.com/bobwong89757/cellnet/log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Prometheus文本格式的运行指标，不依赖Prometheus客户端库
+// 计数只在Queue中修改，输出时也投递到Queue中读取
+
+var (
+	// MetricsAddress 不为空时，StartSvc在此地址上提供/metrics
+	MetricsAddress string
+
+	// 按消息类型统计的请求数量，只在Queue中访问
+	requestCount = map[string]uint64{}
+
+	// 快照合并的耗时，只在Queue中访问
+	persistCompactSeconds = newHistogram(0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5)
+
+	// 快照合并失败的次数，只在Queue中访问
+	persistCompactErrors uint64
+)
+
+// histogram 是累计分桶的直方图
+type histogram struct {
+	bounds []float64
+	counts []uint64 // 与bounds对应，落在该上界以内的数量，不累计
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds ...float64) *histogram {
+	return &histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)),
+	}
+}
+
+// Observe 记录一次观测值
+func (self *histogram) Observe(v float64) {
+
+	for i, bound := range self.bounds {
+		if v <= bound {
+			self.counts[i]++
+			break
+		}
+	}
+
+	self.sum += v
+	self.count++
+}
+
+func (self *histogram) write(buf *bytes.Buffer, name, help string) {
+
+	writeMetricHeader(buf, name, help, "histogram")
+
+	var cumulative uint64
+	for i, bound := range self.bounds {
+		cumulative += self.counts[i]
+		fmt.Fprintf(buf, "%s_bucket{le=\"%g\"} %d\n", name, bound, cumulative)
+	}
+
+	fmt.Fprintf(buf, "%s_bucket{le=\"+Inf\"} %d\n", name, self.count)
+	fmt.Fprintf(buf, "%s_sum %g\n", name, self.sum)
+	fmt.Fprintf(buf, "%s_count %d\n", name, self.count)
+}
+
+// countRequest 统计客户端及备机发来的消息，在ListenSvc的处理函数中调用
+func countRequest(ev cellnet.Event) {
+
+	switch ev.Message().(type) {
+	case *cellnet.SessionAccepted, *cellnet.SessionClosed:
+		return
+	}
+
+	if name := cellnet.MessageToName(ev.Message()); name != "" {
+		requestCount[name]++
+	}
+}
+
+func writeMetricHeader(buf *bytes.Buffer, name, help, kind string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(buf, "# TYPE %s %s\n", name, kind)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeLabelMetric 按标签值排序输出一组指标
+func writeLabelMetric(buf *bytes.Buffer, name, help, kind string, labels []string, values map[string]uint64) {
+
+	writeMetricHeader(buf, name, help, kind)
+
+	var keys []string
+	for key := range values {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+
+		// 多个标签值以\x00分隔
+		var pairs []string
+		for i, value := range strings.Split(key, "\x00") {
+			pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", labels[i], labelEscaper.Replace(value)))
+		}
+
+		fmt.Fprintf(buf, "%s{%s} %d\n", name, strings.Join(pairs, ","), values[key])
+	}
+}
+
+// WriteMetrics 输出Prometheus文本格式的指标，需要在Queue中调用
+func WriteMetrics(buf *bytes.Buffer) {
+
+	sessions := map[string]uint64{"client": 0, "replica": 0}
+	model.Listener.(cellnet.TCPAcceptor).VisitSession(func(ses cellnet.Session) bool {
+
+		switch {
+		case model.IsReplicaSession(ses):
+			sessions["replica"]++
+		case CheckAuth(ses):
+			sessions["client"]++
+		}
+
+		return true
+	})
+
+	writeLabelMetric(buf, "memsd_sessions", "Authorized sessions connected to memsd.", "gauge", []string{"kind"}, sessions)
+
+	writeMetricHeader(buf, "memsd_offline_sessions", "Closed sessions waiting to resume.", "gauge")
+	fmt.Fprintf(buf, "memsd_offline_sessions %d\n", len(offlineByToken))
+
+	keys := map[string]uint64{}
+	services := map[string]uint64{}
+	model.VisitValue(func(meta *model.ValueMeta) bool {
+
+		if meta.SvcName == "" {
+			keys[meta.Namespace]++
+		} else {
+			services[meta.Namespace+"\x00"+meta.SvcName]++
+		}
+
+		return true
+	})
+
+	writeLabelMetric(buf, "memsd_keys", "Config keys stored in memsd.", "gauge", []string{"namespace"}, keys)
+	writeLabelMetric(buf, "memsd_services", "Registered service instances.", "gauge", []string{"namespace", "name"}, services)
+
+	writeMetricHeader(buf, "memsd_leases", "Active leases.", "gauge")
+	fmt.Fprintf(buf, "memsd_leases %d\n", model.LeaseCount())
+
+	writeMetricHeader(buf, "memsd_revision", "Current revision.", "gauge")
+	fmt.Fprintf(buf, "memsd_revision %d\n", model.Revision)
+
+	primary := 0
+	if model.IsPrimary() {
+		primary = 1
+	}
+
+	writeMetricHeader(buf, "memsd_primary", "1 when this node is the primary.", "gauge")
+	fmt.Fprintf(buf, "memsd_primary %d\n", primary)
+
+	writeLabelMetric(buf, "memsd_requests_total", "Messages received by message type.", "counter", []string{"msg"}, requestCount)
+
+	writeMetricHeader(buf, "memsd_broadcasts_total", "Change notifications broadcast to clients.", "counter")
+	fmt.Fprintf(buf, "memsd_broadcasts_total %d\n", model.BroadcastCount)
+
+	writeMetricHeader(buf, "memsd_broadcast_sends_total", "Messages sent to sessions by broadcasts.", "counter")
+	fmt.Fprintf(buf, "memsd_broadcast_sends_total %d\n", model.BroadcastSendCount)
+
+	persistCompactSeconds.write(buf, "memsd_persist_compact_duration_seconds", "Time spent writing snapshots.")
+
+	writeMetricHeader(buf, "memsd_persist_compact_errors_total", "Failed snapshot writes.", "counter")
+	fmt.Fprintf(buf, "memsd_persist_compact_errors_total %d\n", persistCompactErrors)
+}
+
+// ListenMetrics 在/metrics提供Prometheus文本格式的指标，需要在ListenSvc之后调用
+// 指标包含命名空间及服务名，设置了AdminToken时与管理接口一样需要带有Authorization: Bearer <AdminToken>头
+// 参数:
+//   - addr: 侦听地址，端口为0时自动分配
+// 返回:
+//   - net.Listener: 侦听器，关闭时停止服务
+//   - error: 侦听失败时返回错误
+func ListenMetrics(addr string) (net.Listener, error) {
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+
+		var buf bytes.Buffer
+		queueCall(func() {
+			WriteMetrics(&buf)
+		})
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write(buf.Bytes())
+	})
+
+	log.GetLog().Infof("memsd metrics listen: %s", ln.Addr().String())
+
+	go http.Serve(ln, adminAuth(mux))
+
+	return ln, nil
+}
@@ -0,0 +1,91 @@
+package deps
+
+import (
+	"fmt"
+	"github.com/bobwong89757/cellmesh/discovery"
+	memsd "github.com/bobwong89757/cellmesh/discovery/memsd/api"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+
+	config := memsd.DefaultConfig()
+	config.Address = startTestSvc()
+	config.Namespace = "metrics"
+	config.ClientID = "metrics_test"
+	sd := memsd.NewDiscovery(config)
+
+	AdminToken = "metrics"
+	defer func() {
+		AdminToken = ""
+	}()
+
+	ln, err := ListenMetrics("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer ln.Close()
+
+	url := fmt.Sprintf("http://%s/metrics", ln.Addr().String())
+
+	// 设置了管理令牌时，没有令牌的请求被拒绝
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expect unauthorized without token, got %d", resp.StatusCode)
+	}
+
+	if err := sd.Register(&discovery.ServiceDesc{Name: "game", ID: "game#0@metrics"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sd.Register(&discovery.ServiceDesc{Name: "game", ID: "game#1@metrics"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sd.SetValue("cfg/a", "hello"); err != nil {
+		t.Fatal(err)
+	}
+
+	postWait(func() {
+		persistCompactSeconds.Observe(0.002)
+	})
+
+	code, data := adminRequest(t, "GET", url, "")
+	if code != http.StatusOK {
+		t.Fatalf("unexpected status: %d %s", code, data)
+	}
+
+	text := string(data)
+
+	for _, line := range []string{
+		`memsd_keys{namespace="metrics"} 1`,
+		`memsd_services{namespace="metrics",name="game"} 2`,
+		`memsd_persist_compact_duration_seconds_bucket{le="0.001"} 0`,
+		`memsd_persist_compact_duration_seconds_bucket{le="0.005"} 1`,
+		`memsd_primary 1`,
+		`# TYPE memsd_requests_total counter`,
+	} {
+		if !strings.Contains(text, line+"\n") {
+			t.Fatalf("missing metric %q in:\n%s", line, text)
+		}
+	}
+
+	for _, prefix := range []string{
+		`memsd_requests_total{msg="SetValueREQ"} `,
+		`memsd_sessions{kind="client"} `,
+		`memsd_broadcast_sends_total `,
+	} {
+		if !strings.Contains(text, prefix) || strings.Contains(text, prefix+"0\n") {
+			t.Fatalf("expect non-zero %q in:\n%s", prefix, text)
+		}
+	}
+}
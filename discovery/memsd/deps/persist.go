@@ -1,68 +1,302 @@
 package deps
 
 import (
+	"encoding/json"
 	"github.com/bobwong89757/cellmesh/discovery/memsd/model"
 	"github.com/bobwong89757/cellnet/log"
 	"os"
 	"time"
 )
 
+// 持久化由快照文件及追加日志组成
+// 每次修改追加一条记录到日志(fileName+".log")，定期将全部数据写入快照并清空日志
+// 快照先写入临时文件再改名替换，任何时刻崩溃都不会损坏已有快照
+
+const (
+	PersistSyncAlways = iota // 每条记录写入后立即同步到磁盘
+	PersistSyncSecond        // 每秒同步一次，崩溃时最多丢失1秒的修改
+	PersistSyncNone          // 由操作系统决定何时写入磁盘
+)
+
+var (
+	// PersistSyncPolicy 日志同步到磁盘的策略
+	PersistSyncPolicy = PersistSyncSecond
+
+	// PersistCompactDuration 将日志合并为快照的间隔
+	PersistCompactDuration = time.Minute
+
+	persistLog      *os.File         // 追加日志，只在Queue中访问
+	persistBatch    *model.LogRecord // 不为nil时记录合并到此批量记录中，只在Queue中访问
+	persistFileName string           // 打开日志时的快照文件名，只在Queue中访问
+)
+
+func init() {
+
+	model.OnValueSet = append(model.OnValueSet, func(meta *model.ValueMeta) {
+
+		// 绑定租约的值不持久化，记为删除以覆盖之前持久化的值
+		if meta.LeaseID != 0 {
+			appendPersistLog(&model.LogRecord{
+				Op:        model.LogOpDelete,
+				Key:       meta.Key,
+				Namespace: meta.Namespace,
+				Revision:  meta.Revision,
+			})
+			return
+		}
+
+		appendPersistLog(&model.LogRecord{
+			Op:        model.LogOpSet,
+			Key:       meta.Key,
+			Namespace: meta.Namespace,
+			Meta:      meta,
+		})
+	})
+
+	model.OnValueDelete = append(model.OnValueDelete, func(meta *model.ValueMeta) {
+		appendPersistLog(&model.LogRecord{
+			Op:        model.LogOpDelete,
+			Key:       meta.Key,
+			Namespace: meta.Namespace,
+			Revision:  model.Revision,
+		})
+	})
+}
+
+func persistLogName(fileName string) string {
+	return fileName + ".log"
+}
+
+// LoadPersistFile 加载快照，并重放快照之后的日志
+// 日志没有逐条同步到磁盘或尾部损坏时，崩溃前最后的修改可能已丢失，之后的修改会重新使用这些修订号
+// 此时开始新的历史，客户端重连时全量同步，而不是误认为已经收到了这些修订号
+// 参数:
+//   - fileName: 快照文件名
 func LoadPersistFile(fileName string) {
 
+	keepHistory := PersistSyncPolicy == PersistSyncAlways
+
+	defer func() {
+		if !keepHistory {
+			model.HistoryID = model.NewToken()
+		}
+	}()
+
 	fileHandle, err := os.OpenFile(fileName, os.O_RDONLY, 0666)
 
 	// 可能文件不存在，忽略
-	if err != nil {
-		return
+	if err == nil {
+
+		log.GetLog().Infof("Load values...")
+
+		err = model.LoadValue(fileHandle)
+		fileHandle.Close()
+
+		if err != nil {
+			keepHistory = false
+			log.GetLog().Errorf("load values failed: %s %s", fileName, err.Error())
+			return
+		}
 	}
 
-	log.GetLog().Infof("Load values...")
+	logName := persistLogName(fileName)
+	logHandle, err := os.OpenFile(logName, os.O_RDWR, 0666)
 
-	err = model.LoadValue(fileHandle)
-	if err != nil {
-		log.GetLog().Errorf("load values failed: %s %s", fileName, err.Error())
-		return
+	if err == nil {
+
+		validSize, count, err := model.ReplayLog(logHandle)
+
+		if err == model.ErrLogCorrupted {
+
+			// 截掉损坏的尾部，之后的记录才能正确追加
+			log.GetLog().Warnf("log corrupted after %d records, truncate: %s", count, logName)
+			keepHistory = false
+			err = logHandle.Truncate(validSize)
+		}
+
+		logHandle.Close()
+
+		if err != nil {
+			keepHistory = false
+			log.GetLog().Errorf("replay log failed: %s %s", logName, err.Error())
+			return
+		}
+
+		log.GetLog().Infof("Replay %d records", count)
 	}
 
 	log.GetLog().Infof("Load %d values", model.ValueCount())
 }
 
+// StartPersistCheck 开启持久化，阻塞运行
+// 参数:
+//   - fileName: 快照文件名，需要先调用LoadPersistFile加载已有数据
 func StartPersistCheck(fileName string) {
 
-	ticker := time.NewTicker(time.Minute)
+	// 与收发在一个队列中，保证无锁
+	model.Queue.Post(func() {
 
-	for {
+		if err := openPersistLog(fileName); err != nil {
+			log.GetLog().Errorf("open persist log failed: %s %s", fileName, err.Error())
+		}
+	})
 
-		<-ticker.C
+	compactTicker := time.NewTicker(PersistCompactDuration)
+	syncTicker := time.NewTicker(time.Second)
 
-		// 与收发在一个队列中，保证无锁
-		model.Queue.Post(func() {
+	for {
 
-			if model.ValueDirty {
+		select {
+		case <-compactTicker.C:
 
-				log.GetLog().Infof("Save values...")
+			model.Queue.Post(func() {
 
-				fileHandle, err := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY, 0666)
-				if err != nil {
-					log.GetLog().Errorf("save persist file failed: %s %s", fileName, err.Error())
+				if !model.ValueDirty {
 					return
 				}
 
-				err = model.SaveValue(fileHandle)
+				log.GetLog().Infof("Save values...")
+
+				begin := time.Now()
+				err := compactPersist(fileName)
+				persistCompactSeconds.Observe(time.Since(begin).Seconds())
 
 				if err != nil {
+					persistCompactErrors++
 					log.GetLog().Errorf("save values failed: %s %s", fileName, err.Error())
 					return
 				}
 
 				log.GetLog().Infof("Save %d values", model.ValueCount())
+			})
 
-				model.ValueDirty = false
+		case <-syncTicker.C:
 
+			if PersistSyncPolicy != PersistSyncSecond {
+				continue
 			}
 
-		})
+			model.Queue.Post(func() {
+				if persistLog != nil {
+					persistLog.Sync()
+				}
+			})
+		}
+	}
+}
+
+func openPersistLog(fileName string) (err error) {
+
+	persistLog, err = os.OpenFile(persistLogName(fileName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	persistFileName = fileName
+
+	return
+}
+
+// resetPersist 数据被整体替换后立即写入快照并清空日志，备机全量同步时调用
+func resetPersist() {
+
+	if persistLog == nil {
+		return
+	}
+
+	if err := compactPersist(persistFileName); err != nil {
+		persistCompactErrors++
+		log.GetLog().Errorf("save values failed: %s %s", persistFileName, err.Error())
+	}
+}
+
+func closePersistLog() {
+
+	if persistLog != nil {
+		persistLog.Close()
+		persistLog = nil
+	}
+}
+
+// beginPersistBatch 开始合并记录，批量操作的所有修改写为一条日志记录，崩溃时不会只重放一部分
+func beginPersistBatch() {
+	persistBatch = &model.LogRecord{Op: model.LogOpBatch}
+}
+
+// endPersistBatch 写入合并的批量记录
+func endPersistBatch() {
+
+	rec := persistBatch
+	persistBatch = nil
+
+	if rec != nil && len(rec.Ops) > 0 {
+		appendPersistLog(rec)
+	}
+}
+
+func appendPersistLog(rec *model.LogRecord) {
+
+	if persistLog == nil {
+		return
+	}
+
+	if persistBatch != nil {
+		persistBatch.Ops = append(persistBatch.Ops, rec)
+		return
+	}
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		log.GetLog().Errorf("marshal log record failed: %s %s", rec.Key, err.Error())
+		return
+	}
+
+	data = append(data, '\n')
+
+	if _, err = persistLog.Write(data); err != nil {
+		log.GetLog().Errorf("write log failed: %s", err.Error())
+		return
+	}
+
+	if PersistSyncPolicy == PersistSyncAlways {
+		persistLog.Sync()
+	}
+}
+
+// compactPersist 将全部数据写入快照，并清空日志
+func compactPersist(fileName string) error {
+
+	tempName := fileName + ".tmp"
+
+	fileHandle, err := os.OpenFile(tempName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+
+	err = model.SaveValue(fileHandle)
+
+	if err == nil {
+		err = fileHandle.Sync()
+	}
+
+	fileHandle.Close()
+
+	if err != nil {
+		os.Remove(tempName)
+		return err
+	}
+
+	if err = os.Rename(tempName, fileName); err != nil {
+		return err
+	}
+
+	model.ValueDirty = false
+
+	// 快照已包含日志中的所有修改，在此之前崩溃时重放日志的结果也相同
+	if persistLog != nil {
+
+		if err = persistLog.Truncate(0); err != nil {
+			return err
+		}
 
+		return persistLog.Sync()
 	}
 
+	return nil
 }
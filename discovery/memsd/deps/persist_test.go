@@ -0,0 +1,210 @@
+package deps
+
+import (
+	"github.com/bobwong89757/cellmesh/discovery/memsd/model"
+	"github.com/bobwong89757/cellmesh/discovery/memsd/proto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPersistLog(t *testing.T) {
+
+	fileName := filepath.Join(t.TempDir(), "memsd.json")
+
+	model.ResetValue()
+
+	if err := openPersistLog(fileName); err != nil {
+		t.Fatal(err)
+	}
+
+	model.SetValue("a", &model.ValueMeta{Key: "a", Value: []byte("1")})
+	model.SetValue("b", &model.ValueMeta{Key: "b", Value: []byte("2")})
+	model.SetValue("a", &model.ValueMeta{Key: "a", Value: []byte("3"), Namespace: "dev"})
+	model.DeleteValue("", "a")
+
+	closePersistLog()
+
+	// 模拟写入过程中崩溃留下的不完整记录
+	logHandle, err := os.OpenFile(persistLogName(fileName), os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logHandle.WriteString(`{"Op":"set","Key":"c"`)
+	logHandle.Close()
+
+	model.ResetValue()
+	LoadPersistFile(fileName)
+
+	if model.GetValue("", "a") != nil || model.GetValue("", "c") != nil {
+		t.Fatal("deleted or corrupted value restored")
+	}
+
+	if meta := model.GetValue("", "b"); meta == nil || string(meta.Value) != "2" {
+		t.Fatal("value lost after replay")
+	}
+
+	// 修订号包含最后一次删除
+	if model.Revision != 4 {
+		t.Fatalf("expect revision 4 after replay, got %d", model.Revision)
+	}
+
+	// 同名的键在其他命名空间中不受影响
+	if meta := model.GetValue("dev", "a"); meta == nil || string(meta.Value) != "3" {
+		t.Fatal("namespaced value lost after replay")
+	}
+
+	// 合并为快照后，日志应被清空
+	if err := openPersistLog(fileName); err != nil {
+		t.Fatal(err)
+	}
+
+	model.SetValue("d", &model.ValueMeta{Key: "d", Value: []byte("4")})
+	model.SetValue("f", &model.ValueMeta{Key: "f", Value: []byte("6"), LeaseID: 1})
+
+	if err := compactPersist(fileName); err != nil {
+		t.Fatal(err)
+	}
+
+	model.SetValue("e", &model.ValueMeta{Key: "e", Value: []byte("5")})
+
+	closePersistLog()
+
+	model.ResetValue()
+	LoadPersistFile(fileName)
+
+	for _, key := range []string{"b", "d", "e"} {
+		if model.GetValue("", key) == nil {
+			t.Fatalf("value '%s' lost after compaction", key)
+		}
+	}
+
+	if model.GetValue("dev", "a") == nil {
+		t.Fatal("namespaced value lost after compaction")
+	}
+
+	if model.GetValue("", "f") != nil {
+		t.Fatal("leased value should not be persisted")
+	}
+
+	if model.ValueCount() != 4 {
+		t.Fatalf("expect 4 values, got %d", model.ValueCount())
+	}
+
+	model.ResetValue()
+}
+
+func TestPersistBatch(t *testing.T) {
+
+	fileName := filepath.Join(t.TempDir(), "memsd.json")
+
+	model.ResetValue()
+
+	if err := openPersistLog(fileName); err != nil {
+		t.Fatal(err)
+	}
+
+	beginPersistBatch()
+	applyBatch("", []proto.BatchOp{
+		{Key: "big.0", Value: []byte("a")},
+		{Key: "big.1", Value: []byte("b")},
+		{Key: "big.chunks", Value: []byte("2")},
+	})
+	endPersistBatch()
+
+	closePersistLog()
+
+	data, err := os.ReadFile(persistLogName(fileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lines := strings.Count(string(data), "\n"); lines != 1 {
+		t.Fatalf("expect batch in one record, got %d", lines)
+	}
+
+	// 模拟写入第二个批量操作时崩溃，整个批量操作都不重放
+	logHandle, err := os.OpenFile(persistLogName(fileName), os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logHandle.WriteString(`{"Op":"batch","Ops":[{"Op":"set","Key":"big.0","Meta":{"Key":"big.0","Value":"eA==","Revision":4}}`)
+	logHandle.Close()
+
+	model.ResetValue()
+	LoadPersistFile(fileName)
+
+	for key, value := range map[string]string{"big.0": "a", "big.1": "b", "big.chunks": "2"} {
+		if meta := model.GetValue("", key); meta == nil || string(meta.Value) != value {
+			t.Fatalf("unexpected value after replay: %s", key)
+		}
+	}
+
+	if model.Revision != 3 {
+		t.Fatalf("expect revision 3 after replay, got %d", model.Revision)
+	}
+}
+
+func TestPersistHistory(t *testing.T) {
+
+	fileName := filepath.Join(t.TempDir(), "memsd.json")
+
+	prePolicy := PersistSyncPolicy
+	defer func() {
+		PersistSyncPolicy = prePolicy
+	}()
+
+	model.ResetValue()
+
+	if err := openPersistLog(fileName); err != nil {
+		t.Fatal(err)
+	}
+
+	model.SetValue("a", &model.ValueMeta{Key: "a", Value: []byte("1")})
+
+	if err := compactPersist(fileName); err != nil {
+		t.Fatal(err)
+	}
+
+	model.SetValue("b", &model.ValueMeta{Key: "b", Value: []byte("2")})
+
+	closePersistLog()
+
+	savedHistory := model.HistoryID
+
+	load := func() string {
+		model.ResetValue()
+		LoadPersistFile(fileName)
+		return model.HistoryID
+	}
+
+	// 逐条同步的完整日志沿用原来的历史，客户端可以增量同步
+	PersistSyncPolicy = PersistSyncAlways
+	if load() != savedHistory {
+		t.Fatal("history should be kept when every record is synced")
+	}
+
+	// 每秒同步时，崩溃可能丢失最后的修改，修订号会被重新分配
+	PersistSyncPolicy = PersistSyncSecond
+	if load() == savedHistory {
+		t.Fatal("expect new history when log may lose records")
+	}
+
+	// 日志尾部损坏时同样开始新的历史
+	logHandle, err := os.OpenFile(persistLogName(fileName), os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logHandle.WriteString(`{"Op":"set","Key":"c"`)
+	logHandle.Close()
+
+	PersistSyncPolicy = PersistSyncAlways
+	model.HistoryID = savedHistory
+
+	if load() == savedHistory {
+		t.Fatal("expect new history after log truncated")
+	}
+
+	model.ResetValue()
+}
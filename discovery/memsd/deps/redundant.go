@@ -15,23 +15,32 @@ func StartCheckRedundantValue() {
 		<-ticker.C
 
 		// 与收发在一个队列中，保证无锁
-		model.Queue.Post(func() {
+		model.Queue.Post(removeRedundantValue)
+	}
 
-			var svcToDelete []*model.ValueMeta
+}
 
-			model.VisitValue(func(meta *model.ValueMeta) bool {
+// removeRedundantValue 删除会话已不存在的服务及临时键，需要在Queue中调用
+// 等待恢复的会话仍然保留，超过SessionResumeGrace后由sessionOffline删除
+func removeRedundantValue() {
 
-				if meta.Token != "" && !model.TokenExists(meta.Token) && meta.ValueAsServiceDesc().GetMeta("@Persist") == "" {
-					svcToDelete = append(svcToDelete, meta)
-				}
+	// 备机的数据由主机维护
+	if !model.IsPrimary() {
+		return
+	}
 
-				return true
-			})
+	var svcToDelete []*model.ValueMeta
 
-			for _, meta := range svcToDelete {
-				DeleteNotify(meta.Key, "check redundant")
-			}
-		})
-	}
+	model.VisitValue(func(meta *model.ValueMeta) bool {
 
+		if meta.Token != "" && !model.TokenExists(meta.Token) && !isOfflineToken(meta.Token) && meta.ValueAsServiceDesc().GetMeta("@Persist") == "" {
+			svcToDelete = append(svcToDelete, meta)
+		}
+
+		return true
+	})
+
+	for _, meta := range svcToDelete {
+		DeleteNotify(meta.Namespace, meta.Key, "check redundant")
+	}
 }
@@ -0,0 +1,400 @@
+package deps
+
+import (
+	"github.com/bobwong89757/cellmesh/discovery/memsd/model"
+	"github.com/bobwong89757/cellmesh/discovery/memsd/proto"
+	"github.com/bobwong89757/cellmesh/util"
+	"github.com/bobwong89757/cellnet"
+	"github.com/bobwong89757/cellnet/log"
+	"github.com/bobwong89757/cellnet/peer"
+	"github.com/bobwong89757/cellnet/proc"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 主备复制
+// 主机将每次model.SetValue/model.DeleteValue推送给所有备机
+// 备机通过StartReplica连接主机，拉取全量数据后持续接收修改，主机失效后通过Promote提升为主机
+// 连接到备机的客户端会被告知主机地址
+// 设置ReplicaAddress后节点总是以备机身份启动，重启的原主机不会与新主机同时处理客户端请求
+
+var (
+	// ReplicaRetryDuration 备机尝试完所有地址后，再次尝试的间隔
+	ReplicaRetryDuration = time.Second * 3
+
+	// ReplicaClientID 备机连接主机时报告的身份，用于日志
+	ReplicaClientID string
+
+	// ReplicaSecret 主备之间的密钥，所有节点需要设置为相同的值，与客户端密钥分开
+	// 复制数据包含会话令牌，未设置时主机拒绝所有备机，备机也不会启动复制
+	ReplicaSecret string
+
+	// ReplicaAddress 不为空时，ListenSvc以备机身份启动并连接这些节点(逗号分隔)，直到调用Promote
+	ReplicaAddress string
+
+	// AdvertiseAddress 客户端可以访问的本节点地址，提升为主机时通知给已连接的会话，为空时使用侦听地址
+	AdvertiseAddress string
+
+	replicaAddrList  []string     // 备机可连接的其他节点地址
+	replicaIndex     int          // 当前连接的地址索引
+	replicaFailCount int          // 连续连接失败的次数
+	replicaRedirect  string       // 对方告知的主机地址，下次优先连接
+	replicaConnector cellnet.Peer // 连接主机的Connector，以上变量都只在Queue中访问
+)
+
+func init() {
+
+	model.OnValueSet = append(model.OnValueSet, func(meta *model.ValueMeta) {
+
+		if !model.IsPrimary() || model.Listener == nil {
+			return
+		}
+
+		model.BroadcastReplica(&proto.ReplicaSetACK{
+			Key:       meta.Key,
+			Value:     meta.Value,
+			SvcName:   meta.SvcName,
+			Token:     meta.Token,
+			Namespace: meta.Namespace,
+			Revision:  meta.Revision,
+			LeaseID:   meta.LeaseID,
+		})
+	})
+
+	model.OnValueDelete = append(model.OnValueDelete, func(meta *model.ValueMeta) {
+
+		if !model.IsPrimary() || model.Listener == nil {
+			return
+		}
+
+		model.BroadcastReplica(&proto.ReplicaDeleteACK{
+			Key:       meta.Key,
+			Namespace: meta.Namespace,
+			Revision:  model.Revision,
+		})
+	})
+
+	proto.Handle_Memsd_ReplicaSyncREQ = func(ev cellnet.Event) {
+
+		if !model.IsPrimary() {
+			ev.Session().Send(&proto.ReplicaSyncACK{
+				Code:    proto.ResultCode_Result_NotPrimary,
+				Primary: model.PrimaryAddress,
+			})
+			return
+		}
+
+		msg := ev.Message().(*proto.ReplicaSyncREQ)
+
+		// 客户端的认证不能用于复制，复制数据中的令牌可以接管其他客户端的会话
+		if ReplicaSecret == "" {
+
+			log.GetLog().Warnf("Replica rejected, replica secret not set, client: '%s'", msg.ClientID)
+
+			ev.Session().Send(&proto.ReplicaSyncACK{
+				Code: proto.ResultCode_Result_PermissionDenied,
+			})
+			ev.Session().Close()
+			return
+		}
+
+		nonce := takeChallenge(ev.Session())
+		if len(nonce) == 0 || !model.VerifyChallenge(ReplicaSecret, nonce, msg.Signature) {
+
+			log.GetLog().Warnf("Replica auth failed, client: '%s'", msg.ClientID)
+
+			ev.Session().Send(&proto.ReplicaSyncACK{
+				Code: proto.ResultCode_Result_AuthFailed,
+			})
+			ev.Session().Close()
+			return
+		}
+
+		ev.Session().(cellnet.ContextSet).SetContext("replica", true)
+
+		ev.Session().Send(&proto.ReplicaSyncACK{
+			Revision:  model.Revision,
+			HistoryID: model.HistoryID,
+		})
+
+		// 租约先于绑定的值同步
+		model.VisitLease(func(lease *model.Lease) bool {
+
+			ev.Session().Send(&proto.ReplicaLeaseACK{
+				LeaseID:   lease.ID,
+				TTL:       int64(lease.TTL / time.Millisecond),
+				Namespace: lease.Namespace,
+				Token:     lease.Token,
+				ClientID:  lease.ClientID,
+			})
+
+			return true
+		})
+
+		model.VisitValue(func(meta *model.ValueMeta) bool {
+
+			ev.Session().Send(&proto.ReplicaSetACK{
+				Key:       meta.Key,
+				Value:     meta.Value,
+				SvcName:   meta.SvcName,
+				Token:     meta.Token,
+				Namespace: meta.Namespace,
+				Revision:  meta.Revision,
+				LeaseID:   meta.LeaseID,
+			})
+
+			return true
+		})
+
+		log.GetLog().Infof("Replica attached, client: '%s', session: %d, sync %d values", msg.ClientID, ev.Session().ID(), model.ValueCount())
+	}
+}
+
+// StartReplica 以备机身份启动，从主机同步数据，需要在ListenSvc之后调用
+// 参数:
+//   - addr: 其他节点的地址，多个地址使用逗号分隔，地址需要能被客户端访问
+func StartReplica(addr string) {
+
+	var addrList []string
+	for _, a := range strings.Split(addr, ",") {
+		a = strings.TrimSpace(a)
+		if a != "" {
+			addrList = append(addrList, a)
+		}
+	}
+
+	if len(addrList) == 0 {
+		log.GetLog().Errorf("replica address required")
+		return
+	}
+
+	if ReplicaSecret == "" {
+		log.GetLog().Errorf("replica secret required")
+		return
+	}
+
+	model.Queue.Post(func() {
+
+		model.Role = model.RoleStandby
+		replicaAddrList = addrList
+		replicaIndex = 0
+		replicaFailCount = 0
+
+		log.GetLog().Infof("Start as standby, primary candidates: %v", addrList)
+
+		connectReplica(addrList[0])
+	})
+}
+
+// Promote 将备机提升为主机，停止从原主机同步，开始处理客户端请求
+func Promote() {
+	model.Queue.Post(promote)
+}
+
+// promote 在Queue中提升为主机，并将本节点地址通知给所有已连接的会话
+func promote() {
+
+	if model.IsPrimary() {
+		return
+	}
+
+	model.Role = model.RolePrimary
+	model.PrimaryAddress = ""
+
+	// 备机不接收续约，给客户端留出完整的有效期重新续约
+	model.RefreshLease()
+
+	if replicaConnector != nil {
+		// Stop会等待连接结束，不能在队列中等待
+		go replicaConnector.Stop()
+		replicaConnector = nil
+	}
+
+	// 正在连接本节点的客户端及其他备机据此切换到新的主机
+	address := advertiseAddress()
+	model.Listener.(cellnet.TCPAcceptor).VisitSession(func(ses cellnet.Session) bool {
+		ses.Send(&proto.PrimaryChangeNotifyACK{
+			Address: address,
+		})
+
+		return true
+	})
+
+	log.GetLog().Infof("Promoted to primary, address: %s, %d values", address, model.ValueCount())
+}
+
+// advertiseAddress 返回客户端可以访问的本节点地址，未设置AdvertiseAddress时使用侦听地址及实际端口
+func advertiseAddress() string {
+
+	if AdvertiseAddress != "" {
+		return AdvertiseAddress
+	}
+
+	host, _, err := net.SplitHostPort(model.Listener.(cellnet.PeerProperty).Address())
+	if err != nil {
+		return model.Listener.(cellnet.PeerProperty).Address()
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(model.Listener.(cellnet.TCPAcceptor).Port()))
+}
+
+func connectReplica(addr string) {
+
+	p := peer.NewGenericPeer("tcp.Connector", "memsd.replica", addr, model.Queue)
+
+	meshutil.SetPeerTLS(p, TLSConfig)
+
+	proc.BindProcessorHandler(p, "memsd.cli", func(ev cellnet.Event) {
+
+		// 已提升为主机或已切换地址
+		if p != replicaConnector {
+			return
+		}
+
+		switch msg := ev.Message().(type) {
+		case *cellnet.SessionConnected:
+
+			replicaFailCount = 0
+
+			ev.Session().Send(&proto.AuthChallengeREQ{
+				ClientID: ReplicaClientID,
+			})
+
+		case *proto.AuthChallengeACK:
+
+			ev.Session().Send(&proto.ReplicaSyncREQ{
+				ClientID:  ReplicaClientID,
+				Signature: model.SignChallenge(ReplicaSecret, msg.Nonce),
+			})
+
+		case *proto.PrimaryChangeNotifyACK:
+
+			// 认证时连接到了备机
+			if msg.Address != addr {
+				replicaRedirect = msg.Address
+			}
+
+		case *cellnet.SessionConnectError:
+
+			nextReplica()
+
+		case *cellnet.SessionClosed:
+
+			log.GetLog().Errorf("Replica lost primary: %s", addr)
+			nextReplica()
+
+		case *proto.ReplicaSyncACK:
+
+			switch msg.Code {
+			case proto.ResultCode_Result_OK:
+			case proto.ResultCode_Result_NotPrimary:
+
+				// 对方也是备机，转向它所知的主机
+				if msg.Primary != addr {
+					replicaRedirect = msg.Primary
+				}
+
+				ev.Session().Close()
+				return
+			default:
+				log.GetLog().Errorf("Replica sync rejected: %s %s", addr, msg.Code)
+				ev.Session().Close()
+				return
+			}
+
+			model.ResetValue()
+			model.ResetLease()
+			model.Revision = msg.Revision
+			model.HistoryID = msg.HistoryID
+			model.ResetDeleteLog()
+			model.PrimaryAddress = addr
+
+			// 清空的数据写入快照，之后同步的值追加到日志，重启时不会加载到同步之前的数据
+			resetPersist()
+
+			log.GetLog().Infof("Replica sync from primary: %s", addr)
+
+		case *proto.ReplicaSetACK:
+
+			// 保留主机分配的修订号，提升为主机后修订号保持连续
+			model.ApplyValue(&model.ValueMeta{
+				Key:       msg.Key,
+				Value:     msg.Value,
+				SvcName:   msg.SvcName,
+				Token:     msg.Token,
+				Namespace: msg.Namespace,
+				Revision:  msg.Revision,
+				LeaseID:   msg.LeaseID,
+			})
+
+		case *proto.ReplicaDeleteACK:
+
+			model.ApplyDelete(msg.Namespace, msg.Key, msg.Revision)
+
+		case *proto.ReplicaLeaseACK:
+
+			if msg.Removed {
+				model.RemoveLease(msg.LeaseID)
+			} else {
+				model.ApplyLease(&model.Lease{
+					ID:        msg.LeaseID,
+					TTL:       time.Duration(msg.TTL) * time.Millisecond,
+					Namespace: msg.Namespace,
+					Token:     msg.Token,
+					ClientID:  msg.ClientID,
+				})
+			}
+		}
+	})
+
+	// 100M封包大小
+	p.(cellnet.TCPSocketOption).SetMaxPacketSize(1024 * 1024 * 100)
+	p.(cellnet.TCPSocketOption).SetSocketBuffer(1024*1024, 1024*1024, true)
+
+	replicaConnector = p
+
+	p.Start()
+}
+
+// nextReplica 连接下一个节点，所有地址都尝试过后等待ReplicaRetryDuration
+func nextReplica() {
+
+	if model.IsPrimary() {
+		return
+	}
+
+	model.PrimaryAddress = ""
+
+	var addr string
+	var delay time.Duration
+
+	if replicaRedirect != "" {
+		addr = replicaRedirect
+		replicaRedirect = ""
+	} else {
+
+		replicaIndex = (replicaIndex + 1) % len(replicaAddrList)
+		replicaFailCount++
+
+		if replicaFailCount >= len(replicaAddrList) {
+			replicaFailCount = 0
+			delay = ReplicaRetryDuration
+		}
+
+		addr = replicaAddrList[replicaIndex]
+	}
+
+	// 等待期间不再处理旧Connector的事件
+	replicaConnector = nil
+
+	time.AfterFunc(delay, func() {
+		model.Queue.Post(func() {
+
+			if !model.IsPrimary() && replicaConnector == nil {
+				connectReplica(addr)
+			}
+		})
+	})
+}
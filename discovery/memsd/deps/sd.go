@@ -29,16 +29,21 @@ type DiscoveryExtend interface {
 	GetRawValueList(prefix string) (ret []discovery.ValueMeta)
 }
 
+// Namespace 命令行工具操作的命名空间，为空时使用默认命名空间，可以通过InitServerConfig的namespace设置
+var Namespace string
+
 // InitSD 初始化服务发现客户端
 // 参数:
 //   - arg: 服务发现服务器地址，如果为空则使用默认地址
 // 返回:
-//   - DiscoveryExtend: 服务发现实例
+//   - DiscoveryExtend: 服务发现实例，操作限定在Namespace中
 func InitSD(arg *string) DiscoveryExtend {
 	config := memsd.DefaultConfig()
 	if *arg != "" {
 		config.Address = *arg
 	}
 
+	config.Namespace = Namespace
+
 	return memsd.NewDiscovery(config).(DiscoveryExtend)
 }
@@ -0,0 +1,142 @@
+package deps
+
+import (
+	"github.com/bobwong89757/cellmesh/discovery/memsd/model"
+	"github.com/bobwong89757/cellmesh/discovery/memsd/proto"
+	"github.com/bobwong89757/cellnet"
+	"github.com/bobwong89757/cellnet/log"
+	"time"
+)
+
+// 会话断开后，在SessionResumeGrace内保留其注册的服务、临时键及租约
+// 客户端重连时出示原令牌即可恢复会话，避免memsd或网络短暂故障时服务在集群中反复上下线
+
+var (
+	// SessionResumeGrace 会话断开后等待恢复的时间，为0时立即删除会话注册的服务及临时键
+	SessionResumeGrace time.Duration
+)
+
+// offlineSession 是等待恢复的会话
+type offlineSession struct {
+	Namespace string
+	ClientID  string
+}
+
+// 等待恢复的会话，键为令牌，只在Queue中访问
+var offlineByToken = map[string]*offlineSession{}
+
+// isOfflineToken 令牌所属的会话是否正在等待恢复
+func isOfflineToken(token string) bool {
+	_, ok := offlineByToken[token]
+	return ok
+}
+
+// sessionOffline 已认证的会话断开时调用，删除会话注册的服务及临时键，配置了等待时间时延后删除
+func sessionOffline(ses cellnet.Session) {
+
+	token := model.GetSessionToken(ses)
+
+	// 客户端已经用此令牌恢复了会话
+	if model.GetTokenSession(token, ses) != nil {
+		return
+	}
+
+	if SessionResumeGrace <= 0 {
+		removeSessionValues(token, "offline")
+		return
+	}
+
+	offline := &offlineSession{
+		Namespace: model.GetSessionNamespace(ses),
+	}
+
+	ses.(cellnet.ContextSet).FetchContext("clientid", &offline.ClientID)
+
+	offlineByToken[token] = offline
+
+	log.GetLog().Infof("Session offline, wait resume in %s, client: '%s'%s", SessionResumeGrace, offline.ClientID, nsSuffix(offline.Namespace))
+
+	time.AfterFunc(SessionResumeGrace, func() {
+
+		model.Queue.Post(func() {
+
+			// 已恢复，或者恢复后再次断开
+			if offlineByToken[token] != offline {
+				return
+			}
+
+			delete(offlineByToken, token)
+			removeSessionValues(token, "offline")
+		})
+	})
+}
+
+// resumeSession 认证时尝试用原令牌恢复会话，命名空间及客户端身份需要与原会话一致
+// 返回:
+//   - bool: 令牌所属的会话正在等待恢复或仍然在线时返回true，此时会话继续使用原令牌
+func resumeSession(ses cellnet.Session, msg *proto.AuthREQ) bool {
+
+	if msg.Token == "" {
+		return false
+	}
+
+	if offline := offlineByToken[msg.Token]; offline != nil {
+
+		if offline.Namespace != msg.Namespace || offline.ClientID != msg.ClientID {
+			return false
+		}
+
+		delete(offlineByToken, msg.Token)
+
+	} else {
+
+		// 服务器还没有发现旧连接断开，关闭旧连接
+		old := model.GetTokenSession(msg.Token, ses)
+		if old == nil || model.GetSessionNamespace(old) != msg.Namespace {
+			return false
+		}
+
+		var clientID string
+		old.(cellnet.ContextSet).FetchContext("clientid", &clientID)
+		if clientID != msg.ClientID {
+			return false
+		}
+
+		old.Close()
+	}
+
+	// 等待期间没有续约，恢复后重新计算有效期
+	model.VisitLease(func(lease *model.Lease) bool {
+
+		if lease.Token == msg.Token {
+			model.KeepAliveLease(lease.ID)
+		}
+
+		return true
+	})
+
+	return true
+}
+
+// removeSessionValues 删除令牌对应的会话注册的服务及临时键
+func removeSessionValues(token, reason string) {
+
+	var svcToDelete []*model.ValueMeta
+	model.VisitValue(func(meta *model.ValueMeta) bool {
+
+		if meta.Token == token {
+
+			// 工具写入的db服务，要持久化保存
+
+			if meta.ValueAsServiceDesc().GetMeta("@Persist") == "" {
+				svcToDelete = append(svcToDelete, meta)
+			}
+		}
+
+		return true
+	})
+
+	for _, meta := range svcToDelete {
+		DeleteNotify(meta.Namespace, meta.Key, reason)
+	}
+}
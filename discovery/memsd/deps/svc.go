@@ -1,10 +1,11 @@
 package deps
 
 import (
+	"crypto/tls"
 	"github.com/bobwong89757/cellmesh/discovery/memsd/api"
 	"github.com/bobwong89757/cellmesh/discovery/memsd/model"
 	"github.com/bobwong89757/cellmesh/discovery/memsd/proto"
-	"github.com/bobwong89757/cellmesh/service"
+	"github.com/bobwong89757/cellmesh/util"
 	"github.com/bobwong89757/cellnet"
 	"github.com/bobwong89757/cellnet/log"
 	"github.com/bobwong89757/cellnet/peer"
@@ -12,6 +13,12 @@ import (
 	"strings"
 )
 
+// TLSConfig 设置后memsd服务及备机复制连接使用TLS，需要在ListenSvc之前设置
+var TLSConfig *tls.Config
+
+// StartSvc 启动memsd服务，阻塞直到收到退出信号
+// 参数:
+//   - arg: 侦听地址，为空时使用默认地址
 func StartSvc(arg *string) {
 
 	config := memsd.DefaultConfig()
@@ -19,18 +26,47 @@ func StartSvc(arg *string) {
 		config.Address = *arg
 	}
 
+	ListenSvc(config.Address)
+
+	if AdminAddress != "" {
+		if _, err := ListenAdmin(AdminAddress); err != nil {
+			log.GetLog().Errorf("memsd admin listen failed, %s", err.Error())
+		}
+	}
+
+	if MetricsAddress != "" {
+		if _, err := ListenMetrics(MetricsAddress); err != nil {
+			log.GetLog().Errorf("memsd metrics listen failed, %s", err.Error())
+		}
+	}
+
+	meshutil.WaitExitSignal()
+}
+
+// ListenSvc 启动memsd服务侦听，不阻塞
+// 设置ReplicaAddress时以备机身份启动，在开始侦听之前就不处理客户端请求
+// 参数:
+//   - addr: 侦听地址，端口为0时自动分配
+// 返回:
+//   - cellnet.Peer: 侦听的Acceptor
+func ListenSvc(addr string) cellnet.Peer {
+
 	model.Queue = cellnet.NewEventQueue()
 	model.Queue.EnableCapturePanic(true)
 	model.Queue.StartLoop()
 
-	p := peer.NewGenericPeer("tcp.Acceptor", "memsd", config.Address, model.Queue)
+	p := peer.NewGenericPeer("tcp.Acceptor", "memsd", addr, model.Queue)
 	p.(cellnet.PeerCaptureIOPanic).EnableCaptureIOPanic(true)
 
+	meshutil.SetPeerTLS(p, TLSConfig)
+
 	model.Listener = p
 	msgFunc := proto.GetMessageHandler("memsd")
 
 	proc.BindProcessorHandler(p, "memsd.svc", func(ev cellnet.Event) {
 
+		countRequest(ev)
+
 		if msgFunc != nil {
 			msgFunc(ev)
 		}
@@ -40,14 +76,27 @@ func StartSvc(arg *string) {
 	p.(cellnet.TCPSocketOption).SetMaxPacketSize(1024 * 1024 * 100)
 	p.(cellnet.TCPSocketOption).SetSocketBuffer(1024*1024, 1024*1024, true)
 	p.(cellnet.PeerCaptureIOPanic).EnableCaptureIOPanic(true)
+
+	if ReplicaAddress != "" {
+		model.Role = model.RoleStandby
+	}
+
 	p.Start()
-	service.WaitExitSignal()
+
+	if ReplicaAddress != "" {
+		StartReplica(ReplicaAddress)
+	}
+
+	go checkLeaseExpire()
+
+	return p
 }
 
-func DeleteValueRecurse(key, reason string) {
+// DeleteValueRecurse 删除命名空间中以key为前缀的所有值，并通知客户端
+func DeleteValueRecurse(ns, key, reason string) {
 
 	var keyToDelete []string
-	model.VisitValue(func(meta *model.ValueMeta) bool {
+	model.VisitNamespaceValue(ns, func(meta *model.ValueMeta) bool {
 
 		if strings.HasPrefix(meta.Key, key) {
 			keyToDelete = append(keyToDelete, meta.Key)
@@ -57,15 +106,17 @@ func DeleteValueRecurse(key, reason string) {
 	})
 
 	for _, key := range keyToDelete {
-		DeleteNotify(key, reason)
+		DeleteNotify(ns, key, reason)
 	}
 }
 
-func DeleteNotify(key, reason string) {
-	valueMeta := model.DeleteValue(key)
+// DeleteNotify 删除命名空间中的值，并通知该命名空间的客户端
+func DeleteNotify(ns, key, reason string) {
+	valueMeta := model.DeleteValue(ns, key)
 
 	var ack proto.ValueDeleteNotifyACK
 	ack.Key = key
+	ack.Revision = model.Revision
 
 	if valueMeta != nil {
 		ack.SvcName = valueMeta.SvcName
@@ -74,17 +125,81 @@ func DeleteNotify(key, reason string) {
 	if valueMeta != nil {
 
 		if valueMeta.SvcName == "" {
-			log.GetLog().Infof("DeleteValue '%s'  reason: %s", key, reason)
+			log.GetLog().Infof("DeleteValue '%s'  reason: %s%s", key, reason, nsSuffix(ns))
 		} else {
-			log.GetLog().Infof("DeregisterService '%s'  reason: %s", model.GetSvcIDByServiceKey(key), reason)
+			log.GetLog().Infof("DeregisterService '%s'  reason: %s%s", model.GetSvcIDByServiceKey(key), reason, nsSuffix(ns))
 		}
 	}
 
-	model.Broadcast(&ack)
+	model.Broadcast(ns, &ack)
 
 }
 
+// syncSession 认证时向客户端发送命名空间中的数据
+// 客户端缓存的修订号仍可用时只发送之后的修改，否则发送全部值
+// 返回:
+//   - full: 是否发送了全部值
+func syncSession(ses cellnet.Session, msg *proto.AuthREQ) (full bool) {
+
+	if model.CanResume(msg.HistoryID, msg.Revision) {
+
+		model.VisitChangeSince(msg.Namespace, msg.Revision, func(meta *model.ValueMeta) {
+
+			ses.Send(&proto.ValueChangeNotifyACK{
+				Key:      meta.Key,
+				Value:    meta.Value,
+				SvcName:  meta.SvcName,
+				Revision: meta.Revision,
+			})
+
+		}, func(rec *model.DeleteRecord) {
+
+			ses.Send(&proto.ValueDeleteNotifyACK{
+				Key:      rec.Key,
+				SvcName:  rec.SvcName,
+				Revision: rec.Revision,
+			})
+		})
+
+		return false
+	}
+
+	model.VisitNamespaceValue(msg.Namespace, func(meta *model.ValueMeta) bool {
+
+		ses.Send(&proto.ValueChangeNotifyACK{
+			Key:      meta.Key,
+			Value:    meta.Value,
+			SvcName:  meta.SvcName,
+			Revision: meta.Revision,
+		})
+
+		return true
+	})
+
+	return true
+}
+
+// currentRevision 返回键的当前修订号，键不存在时返回0
+func currentRevision(ns, key string) int64 {
+
+	if meta := model.GetValue(ns, key); meta != nil {
+		return meta.Revision
+	}
+
+	return 0
+}
+
 func CheckAuth(ses cellnet.Session) bool {
 
 	return model.GetSessionToken(ses) != ""
 }
+
+// nsSuffix 日志中标注非默认的命名空间
+func nsSuffix(ns string) string {
+
+	if ns == "" {
+		return ""
+	}
+
+	return " namespace: " + ns
+}
@@ -5,7 +5,7 @@ import (
 	"github.com/bobwong89757/cellmesh/discovery/memsd/proto"
 	"github.com/bobwong89757/cellnet"
 	"github.com/bobwong89757/cellnet/log"
-	"strconv"
+	"strings"
 )
 
 func init() {
@@ -16,37 +16,106 @@ func init() {
 		if !CheckAuth(ev.Session()) {
 
 			ev.Session().Send(&proto.SetValueACK{
-				Code: proto.ResultCode_Result_AuthRequire,
+				Code:   proto.ResultCode_Result_AuthRequire,
+				CallID: msg.CallID,
 			})
 			return
 		}
 
+		ns := model.GetSessionNamespace(ev.Session())
+
+		// 服务名取自服务描述，不信任请求中的SvcName
+		var svcName string
+		if model.IsServiceKey(msg.Key) {
+
+			desc := (&model.ValueMeta{Value: msg.Value}).ValueAsServiceDesc()
+			if desc.ID == "" || desc.Name == "" || msg.Key != model.ServiceKeyPrefix+desc.ID {
+				ev.Session().Send(&proto.SetValueACK{
+					Code:   proto.ResultCode_Result_InvalidRequest,
+					CallID: msg.CallID,
+				})
+				return
+			}
+
+			svcName = desc.Name
+
+			if prev := model.GetValue(ns, msg.Key); prev != nil && !canReplaceService(ev.Session(), prev, svcName) {
+				ev.Session().Send(&proto.SetValueACK{
+					Code:   proto.ResultCode_Result_PermissionDenied,
+					CallID: msg.CallID,
+				})
+				return
+			}
+		}
+
+		if !CanWriteValue(ev.Session(), msg.Key, svcName) {
+
+			ev.Session().Send(&proto.SetValueACK{
+				Code:   proto.ResultCode_Result_PermissionDenied,
+				CallID: msg.CallID,
+			})
+			return
+		}
+
+		if msg.CheckRevision {
+
+			current := currentRevision(ns, msg.Key)
+			if current != msg.Revision {
+				ev.Session().Send(&proto.SetValueACK{
+					Code:     proto.ResultCode_Result_RevisionMismatch,
+					CallID:   msg.CallID,
+					Revision: current,
+				})
+				return
+			}
+		}
+
+		// 只能绑定本会话申请的租约
+		if msg.LeaseID != 0 {
+
+			if getSessionLease(ev.Session(), msg.LeaseID) == nil {
+				ev.Session().Send(&proto.SetValueACK{
+					Code:   proto.ResultCode_Result_LeaseNotFound,
+					CallID: msg.CallID,
+				})
+				return
+			}
+		}
+
 		meta := &model.ValueMeta{
-			Key:   msg.Key,
-			Value: msg.Value,
+			Key:       msg.Key,
+			Value:     msg.Value,
+			Namespace: ns,
+			LeaseID:   msg.LeaseID,
 		}
 
 		// 注册服务
 		if model.IsServiceKey(msg.Key) {
-			meta.SvcName = msg.SvcName
+			meta.SvcName = svcName
+			meta.Token = model.GetSessionToken(ev.Session())
+		} else if msg.Ephemeral {
 			meta.Token = model.GetSessionToken(ev.Session())
 		}
 
 		model.SetValue(msg.Key, meta)
 
 		if model.IsServiceKey(msg.Key) {
-			log.GetLog().Infof("RegisterService '%s'", meta.ValueAsServiceDesc().ID)
+			log.GetLog().Infof("RegisterService '%s'%s", meta.ValueAsServiceDesc().ID, nsSuffix(ns))
 		} else {
-			log.GetLog().Infof("SetValue '%s' value(size:%d)", msg.Key, len(msg.Value))
+			log.GetLog().Infof("SetValue '%s' value(size:%d)%s", msg.Key, len(msg.Value), nsSuffix(ns))
 		}
 
-		model.Broadcast(&proto.ValueChangeNotifyACK{
-			Key:     msg.Key,
-			Value:   msg.Value,
-			SvcName: msg.SvcName,
+		model.Broadcast(ns, &proto.ValueChangeNotifyACK{
+			Key:      msg.Key,
+			Value:    msg.Value,
+			SvcName:  svcName,
+			Revision: meta.Revision,
 		})
 
-		ev.Session().Send(&proto.SetValueACK{})
+		ev.Session().Send(&proto.SetValueACK{
+			CallID:   msg.CallID,
+			Revision: meta.Revision,
+		})
 
 	}
 
@@ -56,21 +125,25 @@ func init() {
 		if !CheckAuth(ev.Session()) {
 
 			ev.Session().Send(&proto.GetValueACK{
-				Code: proto.ResultCode_Result_AuthRequire,
+				Code:   proto.ResultCode_Result_AuthRequire,
+				CallID: msg.CallID,
 			})
 			return
 		}
 
-		valueMeta := model.GetValue(msg.Key)
+		valueMeta := model.GetValue(model.GetSessionNamespace(ev.Session()), msg.Key)
 		if valueMeta != nil {
 			ev.Session().Send(&proto.GetValueACK{
-				Key:   msg.Key,
-				Value: valueMeta.Value,
+				Key:      msg.Key,
+				Value:    valueMeta.Value,
+				CallID:   msg.CallID,
+				Revision: valueMeta.Revision,
 			})
 		} else {
 			ev.Session().Send(&proto.GetValueACK{
-				Key:  msg.Key,
-				Code: proto.ResultCode_Result_NotExists,
+				Key:    msg.Key,
+				Code:   proto.ResultCode_Result_NotExists,
+				CallID: msg.CallID,
 			})
 		}
 
@@ -82,15 +155,65 @@ func init() {
 		if !CheckAuth(ev.Session()) {
 
 			ev.Session().Send(&proto.DeleteValueACK{
-				Code: proto.ResultCode_Result_AuthRequire,
+				Code:   proto.ResultCode_Result_AuthRequire,
+				CallID: msg.CallID,
+			})
+			return
+		}
+
+		ns := model.GetSessionNamespace(ev.Session())
+
+		// 比较并删除只针对键本身
+		if msg.CheckRevision {
+
+			code := proto.ResultCode_Result_OK
+			meta := model.GetValue(ns, msg.Key)
+
+			switch {
+			case meta == nil:
+				code = proto.ResultCode_Result_NotExists
+			case !canDeleteValue(ev.Session(), meta):
+				code = proto.ResultCode_Result_PermissionDenied
+			case meta.Revision != msg.Revision:
+				code = proto.ResultCode_Result_RevisionMismatch
+			default:
+				DeleteNotify(ns, msg.Key, "api")
+			}
+
+			ev.Session().Send(&proto.DeleteValueACK{
+				Key:    msg.Key,
+				Code:   code,
+				CallID: msg.CallID,
 			})
 			return
 		}
 
-		DeleteValueRecurse(msg.Key, "api")
+		// 会按前缀删除多个值，需要有所有值的权限
+		denied := false
+		model.VisitNamespaceValue(ns, func(meta *model.ValueMeta) bool {
+
+			if strings.HasPrefix(meta.Key, msg.Key) && !canDeleteValue(ev.Session(), meta) {
+				denied = true
+				return false
+			}
+
+			return true
+		})
+
+		if denied {
+			ev.Session().Send(&proto.DeleteValueACK{
+				Key:    msg.Key,
+				Code:   proto.ResultCode_Result_PermissionDenied,
+				CallID: msg.CallID,
+			})
+			return
+		}
+
+		DeleteValueRecurse(ns, msg.Key, "api")
 
 		ev.Session().Send(&proto.DeleteValueACK{
-			Key: msg.Key,
+			Key:    msg.Key,
+			CallID: msg.CallID,
 		})
 	}
 
@@ -98,43 +221,81 @@ func init() {
 
 		msg := ev.Message().(*proto.AuthREQ)
 
-		model.VisitValue(func(meta *model.ValueMeta) bool {
-
-			ev.Session().Send(&proto.ValueChangeNotifyACK{
-				Key:     meta.Key,
-				Value:   meta.Value,
-				SvcName: meta.SvcName,
+		// 备机不处理客户端请求，告知主机地址后断开
+		if !model.IsPrimary() {
+			ev.Session().Send(&proto.PrimaryChangeNotifyACK{
+				Address: model.PrimaryAddress,
 			})
+			ev.Session().Close()
+			return
+		}
 
-			return true
+		if !verifyAuth(ev.Session(), msg) {
+			authFailed(ev.Session(), msg.ClientID)
+			return
+		}
 
-		})
+		// 之后的所有操作均限定在此命名空间中
+		ev.Session().(cellnet.ContextSet).SetContext("namespace", msg.Namespace)
+
+		full := syncSession(ev.Session(), msg)
+
+		// 恢复会话时沿用原token，否则生成随机token并与ses绑定
+		ack := proto.AuthACK{
+			Token:     model.NewToken(),
+			Revision:  model.Revision,
+			HistoryID: model.HistoryID,
+			Full:      full,
+			Resumed:   resumeSession(ev.Session(), msg),
+		}
 
-		var ack proto.AuthACK
+		if ack.Resumed {
+			ack.Token = msg.Token
+		} else if msg.Token != "" && !isOfflineToken(msg.Token) && model.GetTokenSession(msg.Token, ev.Session()) == nil {
 
-		// 首次生成token并与ses绑定
-		if msg.Token == "" {
-			ack.Token = strconv.Itoa(int(model.IDGen.Generate()))
+			// 未能恢复会话时，出示原令牌的同一客户端继续持有原来的租约
+			if count := model.TransferLease(msg.Namespace, msg.Token, ack.Token, msg.ClientID); count > 0 {
+				log.GetLog().Infof("Transfer %d leases to reconnected client: '%s'%s", count, msg.ClientID, nsSuffix(msg.Namespace))
+			}
 		}
 
 		ev.Session().(cellnet.ContextSet).SetContext("token", ack.Token)
+		ev.Session().(cellnet.ContextSet).SetContext("clientid", msg.ClientID)
+
+		if ack.Resumed {
+			log.GetLog().Infof("Client resumed: '%s'%s", msg.ClientID, nsSuffix(msg.Namespace))
+		} else if msg.ClientID != "" {
+			log.GetLog().Infof("Client authorized: '%s'%s", msg.ClientID, nsSuffix(msg.Namespace))
+		}
 
 		ev.Session().Send(&ack)
 	}
 
 	proto.Handle_Memsd_ClearSvcREQ = func(ev cellnet.Event) {
+		msg := ev.Message().(*proto.ClearSvcREQ)
 
 		if !CheckAuth(ev.Session()) {
 			ev.Session().Send(&proto.ClearSvcACK{
-				Code: proto.ResultCode_Result_AuthRequire,
+				Code:   proto.ResultCode_Result_AuthRequire,
+				CallID: msg.CallID,
+			})
+			return
+		}
+
+		if !CanClear(ev.Session()) {
+			ev.Session().Send(&proto.ClearSvcACK{
+				Code:   proto.ResultCode_Result_PermissionDenied,
+				CallID: msg.CallID,
 			})
 			return
 		}
 
-		log.GetLog().Infof("ClearSvc")
+		ns := model.GetSessionNamespace(ev.Session())
+
+		log.GetLog().Infof("ClearSvc%s", nsSuffix(ns))
 
 		var svcToDelete []*model.ValueMeta
-		model.VisitValue(func(meta *model.ValueMeta) bool {
+		model.VisitNamespaceValue(ns, func(meta *model.ValueMeta) bool {
 
 			if meta.SvcName != "" {
 				svcToDelete = append(svcToDelete, meta)
@@ -144,25 +305,39 @@ func init() {
 		})
 
 		for _, meta := range svcToDelete {
-			DeleteNotify(meta.Key, "clearsvc")
+			DeleteNotify(ns, meta.Key, "clearsvc")
 		}
 
-		ev.Session().Send(&proto.ClearSvcACK{})
+		ev.Session().Send(&proto.ClearSvcACK{
+			CallID: msg.CallID,
+		})
 	}
 
 	proto.Handle_Memsd_ClearKeyREQ = func(ev cellnet.Event) {
+		msg := ev.Message().(*proto.ClearKeyREQ)
 
 		if !CheckAuth(ev.Session()) {
 			ev.Session().Send(&proto.ClearKeyACK{
-				Code: proto.ResultCode_Result_AuthRequire,
+				Code:   proto.ResultCode_Result_AuthRequire,
+				CallID: msg.CallID,
 			})
 			return
 		}
 
-		log.GetLog().Infof("ClearValue")
+		if !CanClear(ev.Session()) {
+			ev.Session().Send(&proto.ClearKeyACK{
+				Code:   proto.ResultCode_Result_PermissionDenied,
+				CallID: msg.CallID,
+			})
+			return
+		}
+
+		ns := model.GetSessionNamespace(ev.Session())
+
+		log.GetLog().Infof("ClearValue%s", nsSuffix(ns))
 
 		var svcToDelete []*model.ValueMeta
-		model.VisitValue(func(meta *model.ValueMeta) bool {
+		model.VisitNamespaceValue(ns, func(meta *model.ValueMeta) bool {
 
 			if meta.SvcName == "" {
 				svcToDelete = append(svcToDelete, meta)
@@ -172,10 +347,12 @@ func init() {
 		})
 
 		for _, meta := range svcToDelete {
-			DeleteNotify(meta.Key, "clearkey")
+			DeleteNotify(ns, meta.Key, "clearkey")
 		}
 
-		ev.Session().Send(&proto.ClearKeyACK{})
+		ev.Session().Send(&proto.ClearKeyACK{
+			CallID: msg.CallID,
+		})
 	}
 
 	proto.Handle_Memsd_Default = func(ev cellnet.Event) {
@@ -186,26 +363,34 @@ func init() {
 		case *cellnet.SessionClosed:
 
 			if CheckAuth(ev.Session()) {
-				var svcToDelete []*model.ValueMeta
-				model.VisitValue(func(meta *model.ValueMeta) bool {
+				sessionOffline(ev.Session())
+			}
 
-					if meta.Token == model.GetSessionToken(ev.Session()) {
+		}
+	}
+}
 
-						// 工具写入的db服务，要持久化保存
+// canDeleteValue 会话是否可以删除值，服务描述与覆盖时一样不能删除其他在线会话注册的服务
+func canDeleteValue(ses cellnet.Session, meta *model.ValueMeta) bool {
 
-						if meta.ValueAsServiceDesc().GetMeta("@Persist") == "" {
-							svcToDelete = append(svcToDelete, meta)
-						}
-					}
+	if !CanWriteValue(ses, meta.Key, meta.SvcName) {
+		return false
+	}
 
-					return true
-				})
+	return !model.IsServiceKey(meta.Key) || canReplaceService(ses, meta, meta.SvcName)
+}
 
-				for _, meta := range svcToDelete {
-					DeleteNotify(meta.Key, "offline")
-				}
-			}
+// canReplaceService 会话是否可以覆盖已注册的服务描述
+// 服务名不能改变；服务归属于其他仍在线或等待恢复的会话时不能覆盖
+func canReplaceService(ses cellnet.Session, prev *model.ValueMeta, svcName string) bool {
 
-		}
+	if prev.SvcName != svcName {
+		return false
 	}
+
+	if prev.Token == "" || prev.Token == model.GetSessionToken(ses) {
+		return true
+	}
+
+	return !model.TokenExists(prev.Token) && !isOfflineToken(prev.Token)
 }
@@ -0,0 +1,1686 @@
+package deps
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"github.com/bobwong89757/cellmesh/discovery"
+	memsd "github.com/bobwong89757/cellmesh/discovery/memsd/api"
+	"github.com/bobwong89757/cellmesh/discovery/memsd/model"
+	"github.com/bobwong89757/cellmesh/discovery/memsd/proto"
+	"github.com/bobwong89757/cellnet"
+	"github.com/bobwong89757/cellnet/peer"
+	"github.com/bobwong89757/cellnet/proc"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	testSvcAddr string
+	testSvcOnce sync.Once
+)
+
+// startTestSvc 在进程内启动一个memsd服务，返回侦听地址
+func startTestSvc() string {
+
+	testSvcOnce.Do(func() {
+		p := ListenSvc("127.0.0.1:0")
+		testSvcAddr = fmt.Sprintf("127.0.0.1:%d", p.(interface{ Port() int }).Port())
+	})
+
+	return testSvcAddr
+}
+
+func newTestClient() DiscoveryExtend {
+
+	config := memsd.DefaultConfig()
+	config.Address = startTestSvc()
+	config.RequestTimeout = time.Second * 5
+
+	return memsd.NewDiscovery(config).(DiscoveryExtend)
+}
+
+func TestPipelinedCalls(t *testing.T) {
+
+	sd := newTestClient()
+
+	const callCount = 200
+
+	var wg sync.WaitGroup
+	errs := make(chan error, callCount)
+
+	for i := 0; i < callCount; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- sd.SetValue(fmt.Sprintf("pipeline/%d", i), i)
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	type directGetter interface {
+		GetValueDirect(key string, valuePtr interface{}) error
+	}
+
+	// 并发读取不同的key，每个调用必须拿到自己的应答
+	mismatch := make(chan string, callCount)
+	for i := 0; i < callCount; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			var v int
+			if err := sd.(directGetter).GetValueDirect(fmt.Sprintf("pipeline/%d", i), &v); err != nil {
+				mismatch <- err.Error()
+			} else if v != i {
+				mismatch <- fmt.Sprintf("pipeline/%d got %d", i, v)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	close(mismatch)
+
+	for m := range mismatch {
+		t.Error(m)
+	}
+}
+
+func TestCallContext(t *testing.T) {
+
+	sd := newTestClient().(discovery.DiscoveryCtx)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := sd.SetValueCtx(ctx, "ctx/canceled", 1); err != context.Canceled {
+		t.Fatalf("expect canceled, got %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := sd.SetValueCtx(ctx, "ctx/value", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sd.DeleteValueCtx(ctx, "ctx/value"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClose(t *testing.T) {
+
+	sd := newTestClient()
+	observer := newTestClient()
+
+	if err := sd.Register(&discovery.ServiceDesc{Name: "close", ID: "close#0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	waitCondition := func(desc string, cond func() bool) {
+		deadline := time.Now().Add(time.Second * 3)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("wait %s timeout", desc)
+			}
+
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+
+	waitCondition("register", func() bool {
+		return len(observer.Query("close")) == 1
+	})
+
+	sd.(interface{ Close() }).Close()
+
+	// 关闭后调用立即失败，不等待请求超时
+	begin := time.Now()
+	if err := sd.SetValue("close/value", 1); err != memsd.ErrNotConnected || time.Since(begin) > time.Second {
+		t.Fatalf("expect not connected after close, got %v", err)
+	}
+
+	// 会话断开，服务被删除
+	waitCondition("service removed", func() bool {
+		return len(observer.Query("close")) == 0
+	})
+
+	// 重复关闭
+	sd.(interface{ Close() }).Close()
+}
+
+func TestFailover(t *testing.T) {
+
+	writer := newTestClient()
+	if err := writer.SetValue("failover/value", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// 第一个地址无法连接，应切换到第二个地址并拉取到数据
+	config := memsd.DefaultConfig()
+	config.Address = "127.0.0.1:1, " + startTestSvc()
+	config.ReconnectDuration = time.Millisecond * 100
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	sd, err := memsd.NewDiscoveryContext(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var v int
+	if err := sd.GetValue("failover/value", &v); err != nil || v != 1 {
+		t.Fatalf("expect cached value 1, got %d, %v", v, err)
+	}
+}
+
+// dialRaw 以原始消息方式连接memsd服务，收到的消息写入返回的通道
+func dialRaw(addr string, onConnected interface{}) (chan interface{}, cellnet.Peer) {
+
+	msgChan := make(chan interface{}, 1000)
+
+	queue := cellnet.NewEventQueue()
+	queue.StartLoop()
+
+	p := peer.NewGenericPeer("tcp.Connector", "test", addr, queue)
+	proc.BindProcessorHandler(p, "memsd.cli", func(ev cellnet.Event) {
+
+		switch ev.Message().(type) {
+		case *cellnet.SessionConnected:
+			ev.Session().Send(onConnected)
+		default:
+			msgChan <- ev.Message()
+		}
+	})
+
+	p.Start()
+
+	return msgChan, p
+}
+
+// waitMsg 等待满足条件的消息，忽略其他消息
+func waitMsg(t *testing.T, msgChan chan interface{}, match func(msg interface{}) bool) interface{} {
+
+	timeout := time.After(time.Second * 5)
+	for {
+		select {
+		case msg := <-msgChan:
+			if match(msg) {
+				return msg
+			}
+		case <-timeout:
+			t.Fatal("wait message timeout")
+			return nil
+		}
+	}
+}
+
+// dialReplica 以备机身份连接memsd服务，使用secret签名后请求同步
+func dialReplica(t *testing.T, addr, secret string) (chan interface{}, cellnet.Peer, *proto.ReplicaSyncACK) {
+
+	msgChan, p := dialRaw(addr, &proto.AuthChallengeREQ{ClientID: "standby"})
+
+	challenge := waitMsg(t, msgChan, func(msg interface{}) bool {
+		_, ok := msg.(*proto.AuthChallengeACK)
+		return ok
+	}).(*proto.AuthChallengeACK)
+
+	p.(interface{ Session() cellnet.Session }).Session().Send(&proto.ReplicaSyncREQ{
+		ClientID:  "standby",
+		Signature: model.SignChallenge(secret, challenge.Nonce),
+	})
+
+	ack := waitMsg(t, msgChan, func(msg interface{}) bool {
+		_, ok := msg.(*proto.ReplicaSyncACK)
+		return ok
+	}).(*proto.ReplicaSyncACK)
+
+	return msgChan, p, ack
+}
+
+func TestReplicaStream(t *testing.T) {
+
+	sd := newTestClient()
+
+	if err := sd.SetValue("replica/before", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// 未设置备机密钥时不允许复制
+	_, p, ack := dialReplica(t, startTestSvc(), "")
+	p.Stop()
+
+	if ack.Code != proto.ResultCode_Result_PermissionDenied {
+		t.Fatalf("expect permission denied without replica secret, got %s", ack.Code)
+	}
+
+	postWait(func() {
+		ReplicaSecret = "replica"
+	})
+
+	defer postWait(func() {
+		ReplicaSecret = ""
+	})
+
+	// 客户端密钥或错误的密钥不能用于复制
+	_, p, ack = dialReplica(t, startTestSvc(), "wrong")
+	p.Stop()
+
+	if ack.Code != proto.ResultCode_Result_AuthFailed {
+		t.Fatalf("expect auth failed with wrong replica secret, got %s", ack.Code)
+	}
+
+	msgChan, p, ack := dialReplica(t, startTestSvc(), "replica")
+	defer p.Stop()
+
+	if ack.Code != proto.ResultCode_Result_OK {
+		t.Fatalf("expect primary, got %s", ack.Code)
+	}
+
+	// 全量同步
+	waitMsg(t, msgChan, func(msg interface{}) bool {
+		set, ok := msg.(*proto.ReplicaSetACK)
+		return ok && set.Key == "replica/before"
+	})
+
+	// 后续的修改
+	if err := sd.SetValue("replica/after", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	waitMsg(t, msgChan, func(msg interface{}) bool {
+		set, ok := msg.(*proto.ReplicaSetACK)
+		return ok && set.Key == "replica/after"
+	})
+
+	if err := sd.DeleteValue("replica/after"); err != nil {
+		t.Fatal(err)
+	}
+
+	waitMsg(t, msgChan, func(msg interface{}) bool {
+		del, ok := msg.(*proto.ReplicaDeleteACK)
+		return ok && del.Key == "replica/after"
+	})
+
+	// 租约同样复制到备机
+	leaseID, err := sd.(interface {
+		GrantLease(ttl time.Duration) (int64, error)
+	}).GrantLease(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 备机需要租约的归属，提升为主机后才能校验续约及撤销
+	lease := waitMsg(t, msgChan, func(msg interface{}) bool {
+		lease, ok := msg.(*proto.ReplicaLeaseACK)
+		return ok && lease.LeaseID == leaseID && !lease.Removed
+	}).(*proto.ReplicaLeaseACK)
+
+	if lease.Token == "" {
+		t.Fatalf("expect lease owner replicated")
+	}
+}
+
+func TestStandbyRedirect(t *testing.T) {
+
+	addr := startTestSvc()
+
+	model.Queue.Post(func() {
+		model.Role = model.RoleStandby
+		model.PrimaryAddress = "10.0.0.1:8900"
+	})
+
+	defer Promote()
+
+	// 备机不接受客户端，告知主机地址
+	msgChan, p := dialRaw(addr, &proto.AuthREQ{})
+	defer p.Stop()
+
+	notify := waitMsg(t, msgChan, func(msg interface{}) bool {
+		_, ok := msg.(*proto.PrimaryChangeNotifyACK)
+		return ok
+	}).(*proto.PrimaryChangeNotifyACK)
+
+	if notify.Address != "10.0.0.1:8900" {
+		t.Fatalf("unexpected primary: %s", notify.Address)
+	}
+
+	// 备机不接受其他备机的同步
+	msgChan, p2 := dialRaw(addr, &proto.ReplicaSyncREQ{})
+	defer p2.Stop()
+
+	ack := waitMsg(t, msgChan, func(msg interface{}) bool {
+		_, ok := msg.(*proto.ReplicaSyncACK)
+		return ok
+	}).(*proto.ReplicaSyncACK)
+
+	if ack.Code != proto.ResultCode_Result_NotPrimary || ack.Primary != "10.0.0.1:8900" {
+		t.Fatalf("unexpected sync ack: %v", ack)
+	}
+}
+
+// postWait 在memsd服务的队列中执行，并等待完成
+func postWait(f func()) {
+
+	done := make(chan struct{})
+	model.Queue.Post(func() {
+		f()
+		close(done)
+	})
+
+	<-done
+}
+
+func TestAuth(t *testing.T) {
+
+	addr := startTestSvc()
+
+	postWait(func() {
+		AuthClientSecrets = map[string]string{"game": "s3cret"}
+	})
+
+	defer postWait(func() {
+		AuthClientSecrets = map[string]string{}
+	})
+
+	connect := func(clientID, secret string) (discovery.Discovery, error) {
+		config := memsd.DefaultConfig()
+		config.Address = addr
+		config.ClientID = clientID
+		config.Secret = secret
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+
+		return memsd.NewDiscoveryContext(ctx, config)
+	}
+
+	sd, err := connect("game", "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sd.SetValue("auth/value", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := connect("game", "wrong"); err != memsd.ErrAuthFailed {
+		t.Fatalf("expect auth failed with wrong secret, got %v", err)
+	}
+
+	if _, err := connect("", ""); err != memsd.ErrAuthFailed {
+		t.Fatalf("expect auth failed without secret, got %v", err)
+	}
+
+	// 阻塞创建的实例认证失败时不为nil，调用返回认证失败
+	config := memsd.DefaultConfig()
+	config.Address = addr
+	config.ClientID = "game"
+	config.Secret = "wrong"
+
+	failed := memsd.NewDiscovery(config)
+	if failed == nil {
+		t.Fatal("expect client on auth failed")
+	}
+
+	if err := failed.(DiscoveryExtend).SetValue("auth/value", 2); err != memsd.ErrAuthFailed {
+		t.Fatalf("expect auth failed on call, got %v", err)
+	}
+
+	if err := failed.(interface{ Err() error }).Err(); err != memsd.ErrAuthFailed {
+		t.Fatalf("expect auth failed from Err, got %v", err)
+	}
+
+	// 运行中服务器更换密钥，客户端通知认证失败并继续重连
+	config.Secret = "s3cret"
+	config.ReconnectDuration = time.Millisecond * 100
+
+	sd = memsd.NewDiscovery(config)
+
+	authFailed := sd.RegisterNotify("authfailed")
+	defer sd.DeregisterNotify("authfailed", authFailed)
+
+	ready := sd.RegisterNotify("ready")
+	defer sd.DeregisterNotify("ready", ready)
+
+	postWait(func() {
+		AuthClientSecrets = map[string]string{"game": "rotated"}
+	})
+
+	sd.(interface{ Session() cellnet.Session }).Session().Close()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-authFailed:
+		case <-time.After(time.Second * 3):
+			t.Fatal("wait auth failed notify timeout")
+		}
+	}
+
+	postWait(func() {
+		AuthClientSecrets = map[string]string{"game": "s3cret"}
+	})
+
+	select {
+	case <-ready:
+	case <-time.After(time.Second * 3):
+		t.Fatal("wait reconnect after auth failed timeout")
+	}
+
+	if err := sd.SetValue("auth/value", 3); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestACL(t *testing.T) {
+
+	addr := startTestSvc()
+
+	fileName := filepath.Join(t.TempDir(), "acl.json")
+	err := os.WriteFile(fileName, []byte(`{
+	"Rules": [
+		{"Client": "admin", "Keys": ["*"], "Services": ["*"], "Clear": true},
+		{"Client": "game-*", "Keys": ["config/game/*"], "Services": ["game"]},
+		{"Client": "prod-*", "Namespaces": ["prod"], "Keys": ["*"]}
+	]
+}`), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := LoadACLFile(fileName); err != nil {
+		t.Fatal(err)
+	}
+
+	defer postWait(func() {
+		aclRules = nil
+	})
+
+	connectNamespace := func(clientID, ns string) DiscoveryExtend {
+		config := memsd.DefaultConfig()
+		config.Address = addr
+		config.ClientID = clientID
+		config.Namespace = ns
+		return memsd.NewDiscovery(config).(DiscoveryExtend)
+	}
+
+	connect := func(clientID string) DiscoveryExtend {
+		return connectNamespace(clientID, "")
+	}
+
+	admin := connect("admin")
+	game := connect("game-1")
+
+	if err := admin.SetValue("config/other", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := game.SetValue("config/game/a", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := game.SetValue("config/other", 2); err != memsd.ErrPermissionDenied {
+		t.Fatalf("expect permission denied, got %v", err)
+	}
+
+	if err := game.Register(&discovery.ServiceDesc{Name: "game", ID: "game#acl"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := game.Register(&discovery.ServiceDesc{Name: "login", ID: "login#acl"}); err != memsd.ErrPermissionDenied {
+		t.Fatalf("expect permission denied, got %v", err)
+	}
+
+	// 服务名取自服务描述，不能借用有权限的服务名覆盖其他服务
+	if err := admin.Register(&discovery.ServiceDesc{Name: "login", ID: "login#acl"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := game.Register(&discovery.ServiceDesc{Name: "game", ID: "login#acl"}); err != memsd.ErrPermissionDenied {
+		t.Fatalf("expect permission denied, got %v", err)
+	}
+
+	// 不能覆盖其他在线会话注册的服务
+	game2 := connect("game-2")
+	if err := game2.Register(&discovery.ServiceDesc{Name: "game", ID: "game#acl"}); err != memsd.ErrPermissionDenied {
+		t.Fatalf("expect permission denied, got %v", err)
+	}
+
+	// 同样不能删除，包括按前缀及比较并删除
+	if err := game2.DeleteValue(model.ServiceKeyPrefix + "game#acl"); err != memsd.ErrPermissionDenied {
+		t.Fatalf("expect delete of other's service denied, got %v", err)
+	}
+
+	if err := game2.DeleteValue(model.ServiceKeyPrefix + "game#"); err != memsd.ErrPermissionDenied {
+		t.Fatalf("expect prefix delete of other's service denied, got %v", err)
+	}
+
+	if err := game2.(discovery.DiscoveryCAS).DeleteValueCAS(model.ServiceKeyPrefix+"game#acl", 0); err != memsd.ErrPermissionDenied {
+		t.Fatalf("expect cas delete of other's service denied, got %v", err)
+	}
+
+	if len(admin.Query("game")) != 1 {
+		t.Fatal("service should not be deleted by other session")
+	}
+
+	// 键必须与服务描述的ID一致
+	msgChan, p := dialRaw(addr, &proto.AuthREQ{ClientID: "game-1"})
+	defer p.Stop()
+
+	waitMsg(t, msgChan, func(msg interface{}) bool {
+		_, ok := msg.(*proto.AuthACK)
+		return ok
+	})
+
+	p.(interface{ Session() cellnet.Session }).Session().Send(&proto.SetValueREQ{
+		Key:     model.ServiceKeyPrefix + "game#raw",
+		Value:   []byte(`{"Name":"game","ID":"game#other"}`),
+		SvcName: "game",
+	})
+
+	if ack := waitMsg(t, msgChan, func(msg interface{}) bool {
+		_, ok := msg.(*proto.SetValueACK)
+		return ok
+	}).(*proto.SetValueACK); ack.Code != proto.ResultCode_Result_InvalidRequest {
+		t.Fatalf("expect invalid request, got %s", ack.Code)
+	}
+
+	// 规则只在列出的命名空间生效
+	if err := connectNamespace("game-1", "other").SetValue("config/game/a", 1); err != memsd.ErrPermissionDenied {
+		t.Fatalf("expect permission denied in other namespace, got %v", err)
+	}
+
+	if err := connectNamespace("prod-1", "prod").SetValue("config/prod", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := connect("prod-1").SetValue("config/prod", 1); err != memsd.ErrPermissionDenied {
+		t.Fatalf("expect permission denied in default namespace, got %v", err)
+	}
+
+	// 按前缀删除时包含了无权限的键
+	if err := game.DeleteValue("config/"); err != memsd.ErrPermissionDenied {
+		t.Fatalf("expect permission denied, got %v", err)
+	}
+
+	game.ClearKey()
+
+	type directGetter interface {
+		GetValueDirect(key string, valuePtr interface{}) error
+	}
+
+	var v int
+	if err := admin.(directGetter).GetValueDirect("config/other", &v); err != nil || v != 1 {
+		t.Fatalf("value should not be cleared, got %d, %v", v, err)
+	}
+
+	if err := admin.DeleteValue("config/"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNamespace(t *testing.T) {
+
+	connect := func(ns string) DiscoveryExtend {
+		config := memsd.DefaultConfig()
+		config.Address = startTestSvc()
+		config.Namespace = ns
+		return memsd.NewDiscovery(config).(DiscoveryExtend)
+	}
+
+	dev := connect("dev")
+	test := connect("test")
+
+	if err := dev.SetValue("ns/value", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := test.SetValue("ns/value", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	type directGetter interface {
+		GetValueDirect(key string, valuePtr interface{}) error
+	}
+
+	var v int
+	if err := dev.(directGetter).GetValueDirect("ns/value", &v); err != nil || v != 1 {
+		t.Fatalf("expect 1 in dev, got %d, %v", v, err)
+	}
+
+	if err := test.(directGetter).GetValueDirect("ns/value", &v); err != nil || v != 2 {
+		t.Fatalf("expect 2 in test, got %d, %v", v, err)
+	}
+
+	if err := dev.Register(&discovery.ServiceDesc{Name: "nsgame", ID: "nsgame#0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 等待通知送达
+	time.Sleep(time.Millisecond * 200)
+
+	if len(dev.Query("nsgame")) != 1 {
+		t.Fatal("service not found in own namespace")
+	}
+
+	if len(test.Query("nsgame")) != 0 {
+		t.Fatal("service leaked to other namespace")
+	}
+
+	// 清空只影响自己的命名空间
+	dev.ClearKey()
+
+	if err := dev.(directGetter).GetValueDirect("ns/value", &v); err != memsd.ErrValueNotExists {
+		t.Fatalf("expect value cleared in dev, got %v", err)
+	}
+
+	if err := test.(directGetter).GetValueDirect("ns/value", &v); err != nil || v != 2 {
+		t.Fatalf("value in test should not be cleared, got %d, %v", v, err)
+	}
+
+	dev.ClearService()
+	test.ClearKey()
+}
+
+func TestCAS(t *testing.T) {
+
+	sd := newTestClient().(discovery.DiscoveryCAS)
+
+	rev, err := sd.SetValueCAS("cas/value", 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 键已存在，不能再按不存在创建
+	if _, err := sd.SetValueCAS("cas/value", 2, 0); err != memsd.ErrRevisionMismatch {
+		t.Fatalf("expect revision mismatch, got %v", err)
+	}
+
+	var v int
+	getRev, err := sd.GetValueRevision("cas/value", &v)
+	if err != nil || getRev != rev || v != 1 {
+		t.Fatalf("expect value 1 at revision %d, got %d at %d, %v", rev, v, getRev, err)
+	}
+
+	// 其他工具修改后，旧的修订号失效
+	if err := sd.SetValue("cas/value", 3); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := sd.SetValueCAS("cas/value", 4, rev); err != memsd.ErrRevisionMismatch {
+		t.Fatalf("expect revision mismatch, got %v", err)
+	}
+
+	if err := sd.DeleteValueCAS("cas/value", rev); err != memsd.ErrRevisionMismatch {
+		t.Fatalf("expect revision mismatch, got %v", err)
+	}
+
+	rev, err = sd.GetValueRevision("cas/value", &v)
+	if err != nil || v != 3 {
+		t.Fatalf("expect value 3, got %d, %v", v, err)
+	}
+
+	newRev, err := sd.SetValueCAS("cas/value", 5, rev)
+	if err != nil || newRev <= rev {
+		t.Fatalf("expect new revision after %d, got %d, %v", rev, newRev, err)
+	}
+
+	if err := sd.DeleteValueCAS("cas/value", newRev); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLease(t *testing.T) {
+
+	startTestSvc()
+
+	postWait(func() {
+		MinLeaseTTL = time.Millisecond * 100
+	})
+
+	defer postWait(func() {
+		MinLeaseTTL = time.Second
+	})
+
+	type leaseClient interface {
+		DiscoveryExtend
+		GrantLease(ttl time.Duration) (int64, error)
+		RevokeLease(leaseID int64) error
+		KeepLeaseAlive(ctx context.Context, leaseID int64) error
+		GetValueDirect(key string, valuePtr interface{}) error
+	}
+
+	sd := newTestClient().(leaseClient)
+
+	if err := sd.SetValue("lease/invalid", 1, memsd.Option{LeaseID: 1}); err != memsd.ErrLeaseNotFound {
+		t.Fatalf("expect lease not found, got %v", err)
+	}
+
+	expireID, err := sd.GrantLease(time.Millisecond * 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keepID, err := sd.GrantLease(time.Millisecond * 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sd.SetValue("lease/expire", 1, memsd.Option{LeaseID: expireID}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sd.SetValue("lease/keep", 2, memsd.Option{LeaseID: keepID}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	keepDone := make(chan error, 1)
+	go func() {
+		keepDone <- sd.KeepLeaseAlive(ctx, keepID)
+	}()
+
+	time.Sleep(LeaseCheckDuration*2 + time.Millisecond*500)
+
+	var v int
+	if err := sd.GetValueDirect("lease/expire", &v); err != memsd.ErrValueNotExists {
+		t.Fatalf("expect expired value deleted, got %v", err)
+	}
+
+	// 删除通知已更新本地缓存
+	if err := sd.GetValue("lease/expire", &v); err != memsd.ErrValueNotExists {
+		t.Fatalf("expect expired value removed from cache, got %v", err)
+	}
+
+	if err := sd.GetValueDirect("lease/keep", &v); err != nil || v != 2 {
+		t.Fatalf("expect value kept alive, got %d, %v", v, err)
+	}
+
+	if err := sd.RevokeLease(keepID); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-keepDone; err != memsd.ErrLeaseNotFound {
+		t.Fatalf("expect keepalive stopped by lease not found, got %v", err)
+	}
+	cancel()
+
+	if err := sd.GetValueDirect("lease/keep", &v); err != memsd.ErrValueNotExists {
+		t.Fatalf("expect revoked value deleted, got %v", err)
+	}
+}
+
+func TestLeaseOwner(t *testing.T) {
+
+	startTestSvc()
+
+	type leaseClient interface {
+		DiscoveryExtend
+		GrantLease(ttl time.Duration) (int64, error)
+		RevokeLease(leaseID int64) error
+		KeepLeaseAlive(ctx context.Context, leaseID int64) error
+		GetValueDirect(key string, valuePtr interface{}) error
+	}
+
+	owner := newTestClient().(leaseClient)
+	other := newTestClient().(leaseClient)
+
+	leaseID, err := owner.GrantLease(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var leaseToken string
+	postWait(func() {
+		leaseToken = model.GetLease(leaseID).Token
+	})
+
+	if leaseToken == "" {
+		t.Fatalf("expect lease owner set on grant")
+	}
+
+	if err := owner.SetValue("leaseowner/key", 1, memsd.Option{LeaseID: leaseID}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 其他会话不能绑定、续约及撤销
+	if err := other.SetValue("leaseowner/other", 1, memsd.Option{LeaseID: leaseID}); err != memsd.ErrLeaseNotFound {
+		t.Fatalf("expect attach to other's lease denied, got %v", err)
+	}
+
+	if err := other.KeepLeaseAlive(context.Background(), leaseID); err != memsd.ErrLeaseNotFound {
+		t.Fatalf("expect keepalive of other's lease denied, got %v", err)
+	}
+
+	if err := other.RevokeLease(leaseID); err != memsd.ErrLeaseNotFound {
+		t.Fatalf("expect revoke of other's lease denied, got %v", err)
+	}
+
+	var v int
+	if err := other.GetValueDirect("leaseowner/key", &v); err != nil || v != 1 {
+		t.Fatalf("expect value kept, got %d, %v", v, err)
+	}
+
+	// 撤销需要绑定的所有键的写权限
+	postWait(func() {
+		aclRules = &ACLFile{Rules: []*ACLRule{
+			{Client: "*", Keys: []string{"leaseowner/other"}},
+		}}
+	})
+
+	err = owner.RevokeLease(leaseID)
+
+	postWait(func() {
+		aclRules = nil
+	})
+
+	if err != memsd.ErrPermissionDenied {
+		t.Fatalf("expect revoke denied by acl, got %v", err)
+	}
+
+	if err := owner.RevokeLease(leaseID); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := other.GetValueDirect("leaseowner/key", &v); err != memsd.ErrValueNotExists {
+		t.Fatalf("expect revoked value deleted, got %v", err)
+	}
+}
+
+func TestLeaseTransfer(t *testing.T) {
+
+	addr := startTestSvc()
+
+	// 原令牌的会话已不存在，模拟客户端未能在等待时间内恢复
+	var leaseID int64
+	postWait(func() {
+		leaseID = model.GrantLease("", "transfer-token", "owner", time.Minute).ID
+	})
+
+	defer postWait(func() {
+		model.RemoveLease(leaseID)
+	})
+
+	leaseToken := func() (token string) {
+		postWait(func() {
+			token = model.GetLease(leaseID).Token
+		})
+		return
+	}
+
+	auth := func(clientID string) string {
+
+		msgChan, p := dialRaw(addr, &proto.AuthREQ{ClientID: clientID, Token: "transfer-token"})
+		defer p.Stop()
+
+		_, ack := collectSync(t, msgChan)
+		return ack.Token
+	}
+
+	// 其他客户端出示原令牌不能取得租约
+	auth("thief")
+
+	if token := leaseToken(); token != "transfer-token" {
+		t.Fatalf("lease should not transfer to other client, got token %s", token)
+	}
+
+	newToken := auth("owner")
+
+	if token := leaseToken(); token != newToken {
+		t.Fatalf("lease should transfer to owner, expect %s got %s", newToken, token)
+	}
+}
+
+func TestBatch(t *testing.T) {
+
+	type batchClient interface {
+		discovery.DiscoveryBatch
+		WatchValue(prefix string) chan discovery.ValueEvent
+		UnwatchValue(c chan discovery.ValueEvent)
+		GetRawValue(key string) ([]byte, error)
+	}
+
+	sd := newTestClient().(batchClient)
+	reader := newTestClient().(batchClient)
+
+	watch := reader.WatchValue("batch/")
+	defer reader.UnwatchValue(watch)
+
+	if err := sd.SetValue("batch/old", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if ev := <-watch; ev.Key != "batch/old" {
+		t.Fatalf("unexpected event %+v", ev)
+	}
+
+	// 任意操作检查失败时，所有操作都不执行
+	_, err := sd.Batch([]discovery.BatchOp{
+		{Key: "batch/a", Value: 1},
+		{Key: "batch/old", Value: 2, CheckRevision: true},
+	})
+	if err != memsd.ErrRevisionMismatch {
+		t.Fatalf("expect revision mismatch, got %v", err)
+	}
+
+	if _, err := sd.Batch([]discovery.BatchOp{{Key: model.ServiceKeyPrefix + "svc", Value: 1}}); err != memsd.ErrInvalidRequest {
+		t.Fatalf("expect invalid request, got %v", err)
+	}
+
+	if _, err := sd.GetRawValue("batch/a"); err != memsd.ErrValueNotExists {
+		t.Fatalf("batch/a should not exist, got %v", err)
+	}
+
+	rev, err := sd.Batch([]discovery.BatchOp{
+		{Key: "batch/a", Value: 1, CheckRevision: true},
+		{Key: "batch/b", Value: 2},
+		{Key: "batch/old", Delete: true},
+		{Key: "batch/missing", Delete: true},
+	})
+	if err != nil || rev == 0 {
+		t.Fatalf("batch failed, revision %d, %v", rev, err)
+	}
+
+	// 其他客户端一起收到所有修改，不存在的键不产生事件
+	expect := []discovery.ValueEvent{
+		{Kind: discovery.ValueEventKind_Set, Key: "batch/a", Value: []byte("1")},
+		{Kind: discovery.ValueEventKind_Set, Key: "batch/b", Value: []byte("2")},
+		{Kind: discovery.ValueEventKind_Deleted, Key: "batch/old"},
+	}
+
+	for _, e := range expect {
+
+		select {
+		case ev := <-watch:
+			if ev.Kind != e.Kind || ev.Key != e.Key || string(ev.Value) != string(e.Value) {
+				t.Fatalf("expect event %+v, got %+v", e, ev)
+			}
+		case <-time.After(time.Second * 3):
+			t.Fatalf("wait event %+v timeout", e)
+		}
+	}
+
+	var v int
+	if err := reader.GetValue("batch/b", &v); err != nil || v != 2 {
+		t.Fatalf("expect cached value 2, got %d, %v", v, err)
+	}
+
+	if err := reader.GetValue("batch/old", &v); err != memsd.ErrValueNotExists {
+		t.Fatalf("batch/old should be deleted from cache, got %v", err)
+	}
+}
+
+func TestSafeSetValueBatch(t *testing.T) {
+
+	type rawClient interface {
+		DiscoveryExtend
+		GetRawValue(key string) ([]byte, error)
+		GetValueDirect(key string, valuePtr interface{}) error
+	}
+
+	sd := newTestClient().(rawClient)
+
+	// 随机数据无法压缩，会分成3个分片
+	large := make([]byte, discovery.PackedValueSize*2+100)
+	rand.Read(large)
+
+	if err := discovery.SafeSetValue(sd, "safevalue/big", large, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := sd.GetRawValue("safevalue/big.2"); err != nil {
+		t.Fatalf("expect 3 chunks, %v", err)
+	}
+
+	var out []byte
+	if err := discovery.SafeGetValue(sd, "safevalue/big", &out, true); err != nil || !bytes.Equal(out, large) {
+		t.Fatalf("safe get large value failed, %v", err)
+	}
+
+	// 值变小后，多余的分片一起删除
+	small := []byte("small")
+	if err := discovery.SafeSetValue(sd, "safevalue/big", small, true); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"safevalue/big.1", "safevalue/big.2"} {
+		if _, err := sd.GetRawValue(key); err != memsd.ErrValueNotExists {
+			t.Fatalf("chunk %s should be deleted, got %v", key, err)
+		}
+	}
+
+	if err := discovery.SafeGetValue(sd, "safevalue/big", &out, true); err != nil || !bytes.Equal(out, small) {
+		t.Fatalf("safe get small value failed, %v", err)
+	}
+}
+
+func TestReadAfterWrite(t *testing.T) {
+
+	sd := newTestClient()
+
+	large := make([]byte, discovery.PackedValueSize*2+100)
+
+	for i := 0; i < 50; i++ {
+
+		if err := sd.SetValue("raw/counter", i); err != nil {
+			t.Fatal(err)
+		}
+
+		var v int
+		if err := sd.GetValue("raw/counter", &v); err != nil || v != i {
+			t.Fatalf("read after set, expect %d got %d, %v", i, v, err)
+		}
+
+		// 分片数量在1和3之间交替变化
+		data := []byte(fmt.Sprintf("small %d", i))
+		if i%2 == 0 {
+			rand.Read(large)
+			data = large
+		}
+
+		if err := discovery.SafeSetValue(sd, "raw/safe", data, true); err != nil {
+			t.Fatal(err)
+		}
+
+		var out []byte
+		if err := discovery.SafeGetValue(sd, "raw/safe", &out, true); err != nil || !bytes.Equal(out, data) {
+			t.Fatalf("read after safe set failed at %d, %v", i, err)
+		}
+	}
+
+	if err := sd.DeleteValue("raw/counter"); err != nil {
+		t.Fatal(err)
+	}
+
+	var v int
+	if err := sd.GetValue("raw/counter", &v); err != memsd.ErrValueNotExists {
+		t.Fatalf("read after delete, got %v", err)
+	}
+}
+
+// collectSync 收集认证时发送的同步消息，直到AuthACK
+func collectSync(t *testing.T, msgChan chan interface{}) (ret []interface{}, ack *proto.AuthACK) {
+
+	waitMsg(t, msgChan, func(msg interface{}) bool {
+
+		switch m := msg.(type) {
+		case *proto.ValueChangeNotifyACK, *proto.ValueDeleteNotifyACK:
+			ret = append(ret, m)
+		case *proto.AuthACK:
+			ack = m
+			return true
+		}
+
+		return false
+	})
+
+	return
+}
+
+func TestResyncDelta(t *testing.T) {
+
+	config := memsd.DefaultConfig()
+	config.Address = startTestSvc()
+	config.Namespace = "resync"
+	sd := memsd.NewDiscovery(config)
+
+	if err := sd.SetValue("resync/a", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sd.SetValue("resync/b", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	msgChan, p := dialRaw(config.Address, &proto.AuthREQ{Namespace: "resync"})
+	msgs, ack := collectSync(t, msgChan)
+	p.Stop()
+
+	if !ack.Full || len(msgs) != 2 {
+		t.Fatalf("expect full sync of 2 values, got full: %v, %d", ack.Full, len(msgs))
+	}
+
+	if err := sd.SetValue("resync/c", 3); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sd.DeleteValue("resync/a"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 只发送之后的修改，按修订号顺序
+	msgChan, p = dialRaw(config.Address, &proto.AuthREQ{
+		Namespace: "resync",
+		Revision:  ack.Revision,
+		HistoryID: ack.HistoryID,
+	})
+	msgs, deltaAck := collectSync(t, msgChan)
+	p.Stop()
+
+	if deltaAck.Full || len(msgs) != 2 {
+		t.Fatalf("expect delta of 2 changes, got full: %v, %d", deltaAck.Full, len(msgs))
+	}
+
+	if set, ok := msgs[0].(*proto.ValueChangeNotifyACK); !ok || set.Key != "resync/c" {
+		t.Fatalf("expect set resync/c, got %v", msgs[0])
+	}
+
+	if del, ok := msgs[1].(*proto.ValueDeleteNotifyACK); !ok || del.Key != "resync/a" {
+		t.Fatalf("expect delete resync/a, got %v", msgs[1])
+	}
+
+	// 不同历史的修订号不可比较
+	msgChan, p = dialRaw(config.Address, &proto.AuthREQ{
+		Namespace: "resync",
+		Revision:  ack.Revision,
+		HistoryID: "other",
+	})
+	_, otherAck := collectSync(t, msgChan)
+	p.Stop()
+
+	if !otherAck.Full {
+		t.Fatal("expect full sync for other history")
+	}
+}
+
+func TestResyncClient(t *testing.T) {
+
+	config := memsd.DefaultConfig()
+	config.Address = startTestSvc()
+	config.Namespace = "resync_client"
+	config.ReconnectDuration = time.Millisecond * 300
+
+	writer := memsd.NewDiscovery(config)
+	reader := memsd.NewDiscovery(config)
+
+	type watchClient interface {
+		WatchValue(prefix string) chan discovery.ValueEvent
+		UnwatchValue(c chan discovery.ValueEvent)
+		Session() cellnet.Session
+	}
+
+	if err := writer.SetValue("keep", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writer.SetValue("remove", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"keep", "remove"} {
+		waitValue(t, reader, key)
+	}
+
+	watch := reader.(watchClient).WatchValue("")
+	defer reader.(watchClient).UnwatchValue(watch)
+
+	ready := reader.RegisterNotify("ready")
+	defer reader.DeregisterNotify("ready", ready)
+
+	reader.(watchClient).Session().Close()
+
+	if err := writer.DeleteValue("remove"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writer.SetValue("add", 3); err != nil {
+		t.Fatal(err)
+	}
+
+	// 断开期间缓存保持不变
+	var v int
+	if err := reader.GetValue("keep", &v); err != nil || v != 1 {
+		t.Fatalf("expect cached value 1, got %d, %v", v, err)
+	}
+
+	select {
+	case <-ready:
+	case <-time.After(time.Second * 5):
+		t.Fatal("wait reconnect timeout")
+	}
+
+	// 只收到断开期间变化的事件
+	expect := []discovery.ValueEvent{
+		{Kind: discovery.ValueEventKind_Set, Key: "add", Value: []byte("3")},
+		{Kind: discovery.ValueEventKind_Deleted, Key: "remove"},
+	}
+
+	for _, e := range expect {
+
+		select {
+		case ev := <-watch:
+			if ev.Kind != e.Kind || ev.Key != e.Key || string(ev.Value) != string(e.Value) {
+				t.Fatalf("expect event %+v, got %+v", e, ev)
+			}
+		case <-time.After(time.Second * 3):
+			t.Fatalf("wait event %+v timeout", e)
+		}
+	}
+
+	select {
+	case ev := <-watch:
+		t.Fatalf("unexpected event %+v", ev)
+	default:
+	}
+
+	if err := reader.GetValue("remove", &v); err != memsd.ErrValueNotExists {
+		t.Fatalf("remove should be deleted, got %v", err)
+	}
+}
+
+// waitValue 等待客户端缓存中出现键
+func waitValue(t *testing.T, sd discovery.Discovery, key string) {
+
+	var raw interface{}
+	for i := 0; i < 100; i++ {
+
+		if sd.GetValue(key, &raw) == nil {
+			return
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	t.Fatalf("wait value '%s' timeout", key)
+}
+
+func TestReregister(t *testing.T) {
+
+	config := memsd.DefaultConfig()
+	config.Address = startTestSvc()
+	config.Namespace = "reregister"
+	config.ReconnectDuration = time.Millisecond * 100
+
+	sd := memsd.NewDiscovery(config)
+	observer := memsd.NewDiscovery(config)
+
+	watch := observer.WatchService("reregister")
+	defer observer.UnwatchService(watch)
+
+	reregister := sd.RegisterNotify("reregister")
+	defer sd.DeregisterNotify("reregister", reregister)
+
+	desc := &discovery.ServiceDesc{Name: "reregister", ID: "reregister#0", Host: "127.0.0.1", Port: 1000}
+	if err := sd.Register(desc); err != nil {
+		t.Fatal(err)
+	}
+
+	waitEvent := func(kind discovery.ServiceEventKind) {
+		select {
+		case ev := <-watch:
+			if ev.Kind != kind || ev.Desc.ID != desc.ID {
+				t.Fatalf("expect %s, got %s %s", kind, ev.Kind, ev.Desc.ID)
+			}
+		case <-time.After(time.Second * 3):
+			t.Fatalf("wait %s timeout", kind)
+		}
+	}
+
+	waitEvent(discovery.ServiceEventKind_Added)
+
+	// 会话断开时服务器删除服务，重连后自动重新注册
+	sd.(interface{ Session() cellnet.Session }).Session().Close()
+
+	waitEvent(discovery.ServiceEventKind_Removed)
+	waitEvent(discovery.ServiceEventKind_Added)
+
+	select {
+	case <-reregister:
+	case <-time.After(time.Second * 3):
+		t.Fatal("wait reregister notify timeout")
+	}
+
+	// 注销后不再重新注册
+	if err := sd.Deregister(desc.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	waitEvent(discovery.ServiceEventKind_Removed)
+
+	// 没有注册的服务时同样调用回调，回调可以重新获取与会话绑定的锁
+	hookCalled := make(chan int, 1)
+	sd.(discovery.DiscoveryReregister).SetReregisterHook(func(list []*discovery.ServiceDesc) []*discovery.ServiceDesc {
+		hookCalled <- len(list)
+		return list
+	})
+
+	sd.(interface{ Session() cellnet.Session }).Session().Close()
+
+	select {
+	case n := <-hookCalled:
+		if n != 0 {
+			t.Fatalf("expect empty list in hook, got %d", n)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("wait reregister hook timeout")
+	}
+
+	time.Sleep(time.Millisecond * 200)
+
+	if list := observer.Query("reregister"); len(list) != 0 {
+		t.Fatalf("expect no service after deregister, got %d", len(list))
+	}
+}
+
+func TestSessionResume(t *testing.T) {
+
+	addr := startTestSvc()
+
+	postWait(func() {
+		SessionResumeGrace = time.Millisecond * 500
+	})
+
+	defer postWait(func() {
+		SessionResumeGrace = 0
+	})
+
+	config := memsd.DefaultConfig()
+	config.Address = addr
+	config.Namespace = "resume"
+	config.ReconnectDuration = time.Millisecond * 100
+
+	sd := memsd.NewDiscovery(config)
+	observer := memsd.NewDiscovery(config)
+
+	watch := observer.WatchService("resume")
+	defer observer.UnwatchService(watch)
+
+	if err := sd.Register(&discovery.ServiceDesc{Name: "resume", ID: "resume#0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if ev := <-watch; ev.Kind != discovery.ServiceEventKind_Added {
+		t.Fatalf("expect added, got %s", ev.Kind)
+	}
+
+	ready := sd.RegisterNotify("ready")
+	defer sd.DeregisterNotify("ready", ready)
+
+	// 等待时间内重连，服务不下线
+	sd.(interface{ Session() cellnet.Session }).Session().Close()
+
+	select {
+	case <-ready:
+	case <-time.After(time.Second * 3):
+		t.Fatal("wait reconnect timeout")
+	}
+
+	select {
+	case ev := <-watch:
+		t.Fatalf("unexpected event %s %s", ev.Kind, ev.Desc.ID)
+	case <-time.After(time.Millisecond * 700):
+	}
+
+	// 超过等待时间未恢复，服务下线
+	msgChan, p := dialRaw(addr, &proto.AuthREQ{Namespace: "resume"})
+
+	waitMsg(t, msgChan, func(msg interface{}) bool {
+		_, ok := msg.(*proto.AuthACK)
+		return ok
+	})
+
+	p.(interface{ Session() cellnet.Session }).Session().Send(&proto.SetValueREQ{
+		Key:     model.ServiceKeyPrefix + "resume#1",
+		Value:   []byte(`{"Name":"resume","ID":"resume#1"}`),
+		SvcName: "resume",
+	})
+
+	waitMsg(t, msgChan, func(msg interface{}) bool {
+		_, ok := msg.(*proto.SetValueACK)
+		return ok
+	})
+
+	if ev := <-watch; ev.Kind != discovery.ServiceEventKind_Added || ev.Desc.ID != "resume#1" {
+		t.Fatalf("expect resume#1 added, got %s %s", ev.Kind, ev.Desc.ID)
+	}
+
+	closeTime := time.Now()
+	p.Stop()
+
+	select {
+	case ev := <-watch:
+		if ev.Kind != discovery.ServiceEventKind_Removed || ev.Desc.ID != "resume#1" {
+			t.Fatalf("expect resume#1 removed, got %s %s", ev.Kind, ev.Desc.ID)
+		}
+
+		if time.Since(closeTime) < time.Millisecond*400 {
+			t.Fatal("service removed before grace expired")
+		}
+
+	case <-time.After(time.Second * 3):
+		t.Fatal("wait service removed timeout")
+	}
+}
+
+// 等待恢复的会话注册的服务不会被冗余检查删除
+func TestRedundantDuringResume(t *testing.T) {
+
+	addr := startTestSvc()
+
+	if err := InitServerConfig(map[string]string{"resumegrace": "500ms"}); err != nil {
+		t.Fatal(err)
+	}
+
+	defer postWait(func() {
+		SessionResumeGrace = 0
+	})
+
+	msgChan, p := dialRaw(addr, &proto.AuthREQ{Namespace: "redundant"})
+
+	waitMsg(t, msgChan, func(msg interface{}) bool {
+		_, ok := msg.(*proto.AuthACK)
+		return ok
+	})
+
+	key := model.ServiceKeyPrefix + "redundant#0"
+
+	p.(interface{ Session() cellnet.Session }).Session().Send(&proto.SetValueREQ{
+		Key:     key,
+		Value:   []byte(`{"Name":"redundant","ID":"redundant#0"}`),
+		SvcName: "redundant",
+	})
+
+	waitMsg(t, msgChan, func(msg interface{}) bool {
+		_, ok := msg.(*proto.SetValueACK)
+		return ok
+	})
+
+	p.Stop()
+
+	// 等待服务器发现连接断开
+	deadline := time.Now().Add(time.Second * 3)
+	for {
+
+		var offline bool
+		postWait(func() {
+			offline = len(offlineByToken) > 0
+		})
+
+		if offline {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("wait session offline timeout")
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	var exists bool
+	postWait(func() {
+		removeRedundantValue()
+		exists = model.GetValue("redundant", key) != nil
+	})
+
+	if !exists {
+		t.Fatal("service removed during resume grace")
+	}
+
+	// 超时未恢复后删除
+	time.Sleep(time.Millisecond * 700)
+
+	postWait(func() {
+		exists = model.GetValue("redundant", key) != nil
+	})
+
+	if exists {
+		t.Fatal("expect service removed after resume grace")
+	}
+
+	if err := InitServerConfig(map[string]string{"resumegrace": "bad"}); err == nil {
+		t.Fatal("expect invalid resumegrace error")
+	}
+}
+
+func TestInitServerConfigNamespace(t *testing.T) {
+
+	addr := startTestSvc()
+
+	defer func() {
+		Namespace = ""
+	}()
+
+	if err := InitServerConfig(map[string]string{"namespace": "tools"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 命令行工具的客户端只操作配置的命名空间
+	sd := InitSD(&addr)
+	defer sd.(interface{ Close() }).Close()
+
+	if err := sd.SetValue("tool_key", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	var inNamespace, inDefault bool
+	postWait(func() {
+		inNamespace = model.GetValue("tools", "tool_key") != nil
+		inDefault = model.GetValue("", "tool_key") != nil
+	})
+
+	if !inNamespace || inDefault {
+		t.Fatalf("expect value only in namespace 'tools', got %v %v", inNamespace, inDefault)
+	}
+}
+
+func TestPromote(t *testing.T) {
+
+	addr := startTestSvc()
+	fileName := filepath.Join(t.TempDir(), "memsd.json")
+
+	postWait(func() {
+		ReplicaSecret = "replica"
+		AdvertiseAddress = "10.0.0.2:8900"
+
+		if err := openPersistLog(fileName); err != nil {
+			t.Error(err)
+		}
+
+		model.SetValue("promote/stale", &model.ValueMeta{Key: "promote/stale", Value: []byte("1")})
+	})
+
+	defer postWait(func() {
+		ReplicaSecret = ""
+		AdvertiseAddress = ""
+		closePersistLog()
+	})
+
+	// 模拟主机，备机请求同步后发送全量数据
+	queue := cellnet.NewEventQueue()
+	queue.StartLoop()
+	defer queue.StopLoop()
+
+	primary := peer.NewGenericPeer("tcp.Acceptor", "primary", "127.0.0.1:0", queue)
+	proc.BindProcessorHandler(primary, "memsd.svc", func(ev cellnet.Event) {
+
+		switch ev.Message().(type) {
+		case *proto.AuthChallengeREQ:
+			ev.Session().Send(&proto.AuthChallengeACK{Nonce: []byte("nonce")})
+		case *proto.ReplicaSyncREQ:
+			ev.Session().Send(&proto.ReplicaSyncACK{Revision: 100, HistoryID: "primary-history"})
+			ev.Session().Send(&proto.ReplicaSetACK{Key: "promote/synced", Value: []byte("2"), Revision: 100})
+		}
+	})
+	primary.Start()
+	defer primary.Stop()
+
+	StartReplica(fmt.Sprintf("127.0.0.1:%d", primary.(cellnet.TCPAcceptor).Port()))
+
+	deadline := time.Now().Add(time.Second * 5)
+	for synced := false; !synced; {
+
+		postWait(func() {
+			synced = model.GetValue("", "promote/synced") != nil
+		})
+
+		if time.Now().After(deadline) {
+			t.Fatal("wait full sync timeout")
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	// 全量同步清空的数据立即写入快照，重启后不会加载同步之前的值
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var file model.PersistFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		t.Fatal(err)
+	}
+
+	if file.HistoryID != "primary-history" || len(file.Values) != 0 {
+		t.Fatalf("expect empty snapshot of primary history, got %s %d values", file.HistoryID, len(file.Values))
+	}
+
+	// 提升后通知已连接的会话新的主机地址
+	msgChan, p := dialRaw(addr, &proto.AuthChallengeREQ{})
+	defer p.Stop()
+
+	waitMsg(t, msgChan, func(msg interface{}) bool {
+		_, ok := msg.(*proto.AuthChallengeACK)
+		return ok
+	})
+
+	ln, err := ListenAdmin("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer ln.Close()
+
+	code, body := adminRequest(t, http.MethodPost, "http://"+ln.Addr().String()+"/v1/role", "")
+
+	var role AdminRole
+	if code != http.StatusOK || json.Unmarshal(body, &role) != nil || role.Role != model.RolePrimary {
+		t.Fatalf("promote by admin failed, %d %s", code, body)
+	}
+
+	notify := waitMsg(t, msgChan, func(msg interface{}) bool {
+		_, ok := msg.(*proto.PrimaryChangeNotifyACK)
+		return ok
+	}).(*proto.PrimaryChangeNotifyACK)
+
+	if notify.Address != "10.0.0.2:8900" {
+		t.Fatalf("expect advertise address, got %s", notify.Address)
+	}
+}
@@ -0,0 +1,54 @@
+package model
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/bobwong89757/cellnet"
+)
+
+// NewToken 生成随机的会话令牌
+func NewToken() string {
+	return hex.EncodeToString(NewNonce())
+}
+
+// NewNonce 生成认证挑战使用的随机数
+func NewNonce() []byte {
+
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+
+	return buf
+}
+
+// SignChallenge 使用密钥对随机数签名
+// 参数:
+//   - secret: 客户端密钥
+//   - nonce: 服务器下发的随机数
+// 返回:
+//   - string: HMAC-SHA256签名的十六进制
+func SignChallenge(secret string, nonce []byte) string {
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(nonce)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyChallenge 校验签名是否由密钥生成
+func VerifyChallenge(secret string, nonce []byte, signature string) bool {
+
+	expect := SignChallenge(secret, nonce)
+
+	return hmac.Equal([]byte(expect), []byte(signature))
+}
+
+// GetSessionClientID 获取会话认证的客户端身份，未配置密钥时为客户端自报的ID
+func GetSessionClientID(ses cellnet.Session) (clientID string) {
+	ses.(cellnet.ContextSet).FetchContext("clientid", &clientID)
+
+	return
+}
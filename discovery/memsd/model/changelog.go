@@ -0,0 +1,107 @@
+package model
+
+import "sort"
+
+// 客户端重连时上报本地缓存的修订号，服务器只发送之后的修改
+// 值本身带有修订号，删除则需要单独记录，记录的数量有限，过旧的修订号需要全量同步
+
+// DeleteRecord 是一次删除的记录
+type DeleteRecord struct {
+	Namespace string
+	Key       string
+	SvcName   string // 服务名称，只有服务描述才有此字段
+	Revision  int64  // 删除时的修订号
+}
+
+var (
+	// MaxDeleteLog 保留的删除记录数量，客户端断开期间的删除超过此数量时需要全量同步
+	MaxDeleteLog = 10000
+
+	// HistoryID 标识修订号所属的历史，没有持久化时重启后修订号重新开始，不同历史的修订号不可比较
+	HistoryID = NewToken()
+
+	deleteLog []*DeleteRecord
+
+	// 修订号不大于此值的删除可能没有记录
+	deleteLogFloor int64
+)
+
+// appendDeleteLog 记录删除，超过数量时丢弃最早的记录
+func appendDeleteLog(meta *ValueMeta, revision int64) {
+
+	deleteLog = append(deleteLog, &DeleteRecord{
+		Namespace: meta.Namespace,
+		Key:       meta.Key,
+		SvcName:   meta.SvcName,
+		Revision:  revision,
+	})
+
+	if overflow := len(deleteLog) - MaxDeleteLog; overflow > 0 {
+		deleteLogFloor = deleteLog[overflow-1].Revision
+		deleteLog = deleteLog[overflow:]
+	}
+}
+
+// ResetDeleteLog 清空删除记录，之后只能从当前修订号开始增量同步
+// 加载持久化文件及备机全量同步后调用
+func ResetDeleteLog() {
+	deleteLog = nil
+	deleteLogFloor = Revision
+}
+
+// CanResume 客户端缓存是否可以增量同步
+// 参数:
+//   - historyID: 客户端缓存所属的历史
+//   - revision: 客户端缓存的修订号
+// 返回:
+//   - bool: 修订号属于当前历史，且之后的删除都有记录时返回true
+func CanResume(historyID string, revision int64) bool {
+	return historyID == HistoryID && revision >= deleteLogFloor && revision <= Revision
+}
+
+// VisitChangeSince 按修订号顺序遍历命名空间中修订号大于revision的设置及删除
+// 参数:
+//   - ns: 命名空间
+//   - revision: 客户端缓存的修订号
+//   - onSet: 仍存在的值
+//   - onDelete: 已删除的值
+func VisitChangeSince(ns string, revision int64, onSet func(*ValueMeta), onDelete func(*DeleteRecord)) {
+
+	type change struct {
+		revision int64
+		meta     *ValueMeta
+		deleted  *DeleteRecord
+	}
+
+	var changes []change
+
+	VisitNamespaceValue(ns, func(meta *ValueMeta) bool {
+
+		if meta.Revision > revision {
+			changes = append(changes, change{revision: meta.Revision, meta: meta})
+		}
+
+		return true
+	})
+
+	for _, rec := range deleteLog {
+
+		if rec.Namespace == ns && rec.Revision > revision {
+			changes = append(changes, change{revision: rec.Revision, deleted: rec})
+		}
+	}
+
+	// 删除后又设置的键，需要先删除再设置
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].revision < changes[j].revision
+	})
+
+	for _, c := range changes {
+
+		if c.meta != nil {
+			onSet(c.meta)
+		} else {
+			onDelete(c.deleted)
+		}
+	}
+}
@@ -1,21 +1,29 @@
 package model
 
 import (
+	"bufio"
 	"encoding/json"
+	"errors"
 	"github.com/bobwong89757/cellmesh/discovery"
 	"io"
 	"sort"
 )
 
 // ValueMeta 是KV存储中值的元数据
-// 包含键、值、服务名（如果是服务描述）和认证令牌
+// 包含键、值、服务名（如果是服务描述）、认证令牌、修订号和租约
 type ValueMeta struct {
-	Key     string // 键名
-	Value   []byte // 值（字节数组）
-	SvcName string // 服务名称，只有服务描述才有此字段
-	Token   string // 认证令牌
+	Key       string // 键名
+	Value     []byte // 值（字节数组）
+	SvcName   string // 服务名称，只有服务描述才有此字段
+	Token     string // 所属会话的令牌，服务描述及临时键在会话断开时删除
+	Namespace string `json:",omitempty"` // 所属命名空间，默认命名空间为空
+	Revision  int64  `json:",omitempty"` // 最后一次修改时的修订号
+	LeaseID   int64  `json:",omitempty"` // 绑定的租约，租约过期或撤销时删除
 }
 
+// ErrLogCorrupted 日志中存在不完整或无法解析的记录
+var ErrLogCorrupted = errors.New("log record corrupted")
+
 // ErrDesc 是无效服务描述的占位符
 var ErrDesc = discovery.ServiceDesc{Name: "invalid desc"}
 
@@ -34,35 +42,132 @@ func (self *ValueMeta) ValueAsServiceDesc() *discovery.ServiceDesc {
 }
 
 var (
-	valueByKey = map[string]*ValueMeta{}
+	// 按命名空间保存的值，key为命名空间，value为该命名空间中键对应的值
+	valueByKey = map[string]map[string]*ValueMeta{}
 
 	ValueDirty bool
+
+	// Revision 当前修订号，每次设置或删除值时递增，所有命名空间共用
+	Revision int64
+
+	// 值修改后的回调，用于复制到备机及写入日志
+	OnValueSet    []func(meta *ValueMeta)
+	OnValueDelete []func(meta *ValueMeta)
 )
 
+// setValue 写入值，不触发回调
+func setValue(meta *ValueMeta) {
+
+	values := valueByKey[meta.Namespace]
+	if values == nil {
+		values = map[string]*ValueMeta{}
+		valueByKey[meta.Namespace] = values
+	}
+
+	values[meta.Key] = meta
+}
+
+// deleteValue 删除值，不触发回调
+func deleteValue(ns, key string) *ValueMeta {
+
+	values := valueByKey[ns]
+	ret := values[key]
+	delete(values, key)
+
+	if len(values) == 0 {
+		delete(valueByKey, ns)
+	}
+
+	return ret
+}
+
+// SetValue 写入值，命名空间由meta.Namespace指定，并分配新的修订号
 func SetValue(key string, meta *ValueMeta) {
+	Revision++
+	meta.Key = key
+	meta.Revision = Revision
+	ApplyValue(meta)
+}
+
+// ApplyValue 写入值并保留meta.Revision，用于备机应用主机的修改
+func ApplyValue(meta *ValueMeta) {
 	ValueDirty = true
-	valueByKey[key] = meta
+	updateRevision(meta.Revision)
+	setValue(meta)
+
+	for _, callback := range OnValueSet {
+		callback(meta)
+	}
+}
+
+func GetValue(ns, key string) *ValueMeta {
+
+	return valueByKey[ns][key]
 }
 
-func GetValue(key string) *ValueMeta {
+// DeleteValue 删除值，存在时分配新的修订号
+func DeleteValue(ns, key string) *ValueMeta {
 
-	return valueByKey[key]
+	if GetValue(ns, key) == nil {
+		return nil
+	}
+
+	return ApplyDelete(ns, key, Revision+1)
 }
 
-func DeleteValue(key string) *ValueMeta {
+// ApplyDelete 删除值并将当前修订号更新为revision，用于备机应用主机的修改
+func ApplyDelete(ns, key string, revision int64) *ValueMeta {
 	ValueDirty = true
-	ret := valueByKey[key]
-	delete(valueByKey, key)
+	updateRevision(revision)
+	ret := deleteValue(ns, key)
+
+	if ret != nil {
+		appendDeleteLog(ret, revision)
+
+		for _, callback := range OnValueDelete {
+			callback(ret)
+		}
+	}
 
 	return ret
 }
 
-func ValueCount() int {
-	return len(valueByKey)
+// ResetValue 清空所有值及修订号，备机接收全量同步前调用
+func ResetValue() {
+	ValueDirty = true
+	Revision = 0
+	valueByKey = map[string]map[string]*ValueMeta{}
+}
+
+// updateRevision 修订号只增不减
+func updateRevision(revision int64) {
+	if revision > Revision {
+		Revision = revision
+	}
+}
+
+func ValueCount() (ret int) {
+	for _, values := range valueByKey {
+		ret += len(values)
+	}
+
+	return
 }
 
+// VisitValue 遍历所有命名空间的值
 func VisitValue(callback func(*ValueMeta) bool) {
-	for _, vmeta := range valueByKey {
+	for _, values := range valueByKey {
+		for _, vmeta := range values {
+			if !callback(vmeta) {
+				return
+			}
+		}
+	}
+}
+
+// VisitNamespaceValue 遍历指定命名空间的值
+func VisitNamespaceValue(ns string, callback func(*ValueMeta) bool) {
+	for _, vmeta := range valueByKey[ns] {
 		if !callback(vmeta) {
 			return
 		}
@@ -72,8 +177,10 @@ func VisitValue(callback func(*ValueMeta) bool) {
 // PersistFile 是持久化文件的结构
 // 用于将内存中的数据保存到文件或从文件加载
 type PersistFile struct {
-	Version int          // 文件版本号
-	Values  []*ValueMeta // 值列表
+	Version   int          // 文件版本号
+	Revision  int64        // 保存时的修订号
+	HistoryID string       `json:",omitempty"` // 修订号所属的历史
+	Values    []*ValueMeta // 值列表
 }
 
 var (
@@ -87,12 +194,24 @@ func SaveValue(writer io.Writer) error {
 
 	var file PersistFile
 	file.Version = fileVersion
-	for _, vmeta := range valueByKey {
-		file.Values = append(file.Values, vmeta)
-	}
+	file.Revision = Revision
+	file.HistoryID = HistoryID
+	VisitValue(func(vmeta *ValueMeta) bool {
+
+		// 租约不持久化，绑定租约的值重启后也应失效
+		if vmeta.LeaseID == 0 {
+			file.Values = append(file.Values, vmeta)
+		}
+
+		return true
+	})
 
 	sort.SliceStable(file.Values, func(i, j int) bool {
 
+		if file.Values[i].Namespace != file.Values[j].Namespace {
+			return file.Values[i].Namespace < file.Values[j].Namespace
+		}
+
 		return file.Values[i].Key < file.Values[j].Key
 	})
 
@@ -115,11 +234,127 @@ func LoadValue(reader io.Reader) error {
 		return err
 	}
 
-	valueByKey = map[string]*ValueMeta{}
+	valueByKey = map[string]map[string]*ValueMeta{}
+	Revision = file.Revision
 
 	for _, v := range file.Values {
-		valueByKey[v.Key] = v
+		updateRevision(v.Revision)
+		setValue(v)
 	}
 
+	// 旧版本的文件没有记录历史，沿用新生成的。日志可能丢失修改时由调用者开始新的历史
+	if file.HistoryID != "" {
+		HistoryID = file.HistoryID
+	}
+
+	ResetDeleteLog()
+
 	return nil
 }
+
+const (
+	LogOpSet    = "set"    // 设置值
+	LogOpDelete = "delete" // 删除值
+	LogOpBatch  = "batch"  // 批量操作，Ops中的修改一起重放
+)
+
+// LogRecord 是追加日志中的一条修改记录，每条记录占一行JSON
+type LogRecord struct {
+	Op        string       // 操作类型，LogOpSet、LogOpDelete或LogOpBatch
+	Key       string       // 键名
+	Namespace string       `json:",omitempty"` // 命名空间
+	Meta      *ValueMeta   `json:",omitempty"` // 设置的值，删除时为空
+	Revision  int64        `json:",omitempty"` // 删除时的修订号，设置时使用Meta.Revision
+	Ops       []*LogRecord `json:",omitempty"` // 批量操作中的修改，不能嵌套批量操作
+}
+
+// validLogRecord 检查记录是否完整，批量操作中的记录全部完整时才重放
+func validLogRecord(rec *LogRecord, allowBatch bool) bool {
+
+	switch rec.Op {
+	case LogOpSet:
+		return rec.Meta != nil
+	case LogOpDelete:
+		return true
+	case LogOpBatch:
+		if !allowBatch {
+			return false
+		}
+
+		for _, op := range rec.Ops {
+			if op == nil || !validLogRecord(op, false) {
+				return false
+			}
+		}
+
+		return true
+	default:
+		return false
+	}
+}
+
+// replayLogRecord 重放一条设置或删除记录
+func replayLogRecord(rec *LogRecord) {
+
+	switch rec.Op {
+	case LogOpSet:
+		updateRevision(rec.Meta.Revision)
+		setValue(rec.Meta)
+	case LogOpDelete:
+		updateRevision(rec.Revision)
+		if meta := deleteValue(rec.Namespace, rec.Key); meta != nil {
+			appendDeleteLog(meta, rec.Revision)
+		}
+	}
+}
+
+// ReplayLog 按顺序重放日志中的记录，不触发修改回调
+// 遇到不完整或无法解析的记录时停止，通常是写入过程中进程退出留下的尾部
+// 参数:
+//   - reader: 日志内容
+// 返回:
+//   - validSize: 可以正确解析的日志长度，之后的内容应被截断
+//   - count: 重放的记录数量
+//   - err: 读取失败或遇到损坏记录时返回错误
+func ReplayLog(reader io.Reader) (validSize int64, count int, err error) {
+
+	bufReader := bufio.NewReader(reader)
+
+	for {
+
+		line, readErr := bufReader.ReadBytes('\n')
+
+		if readErr == io.EOF {
+
+			// 没有换行结尾，记录不完整
+			if len(line) > 0 {
+				err = ErrLogCorrupted
+			}
+
+			return
+		}
+
+		if readErr != nil {
+			err = readErr
+			return
+		}
+
+		var rec LogRecord
+		if json.Unmarshal(line, &rec) != nil || !validLogRecord(&rec, true) {
+			err = ErrLogCorrupted
+			return
+		}
+
+		if rec.Op == LogOpBatch {
+			for _, op := range rec.Ops {
+				replayLogRecord(op)
+			}
+		} else {
+			replayLogRecord(&rec)
+		}
+
+		ValueDirty = true
+		validSize += int64(len(line))
+		count++
+	}
+}
@@ -0,0 +1,143 @@
+package model
+
+import "time"
+
+// Lease 是键的租约，到期未续约时删除绑定到租约的所有键
+type Lease struct {
+	ID        int64         // 租约ID
+	TTL       time.Duration // 有效期
+	Namespace string        // 申请租约的命名空间，只有该命名空间的键可以绑定
+	Deadline  time.Time     // 到期时间
+	Token     string        // 申请租约的会话令牌，只有此会话可以操作租约，会话等待恢复期间租约不到期
+	ClientID  string        // 申请租约的客户端身份，只有同一身份的客户端可以凭原令牌转移租约
+}
+
+// Expired 租约是否已到期
+func (self *Lease) Expired(now time.Time) bool {
+	return now.After(self.Deadline)
+}
+
+var (
+	leaseByID = map[int64]*Lease{}
+
+	// 租约授予、转移及移除后的回调，用于复制到备机
+	OnLeaseGrant  []func(lease *Lease)
+	OnLeaseRemove []func(lease *Lease)
+)
+
+// GrantLease 分配新的租约
+// 参数:
+//   - ns: 命名空间
+//   - token: 申请租约的会话令牌，只有此会话可以续约、撤销及绑定
+//   - clientID: 申请租约的客户端身份
+//   - ttl: 有效期
+// 返回:
+//   - *Lease: 新的租约
+func GrantLease(ns, token, clientID string, ttl time.Duration) *Lease {
+
+	lease := &Lease{
+		ID:        int64(IDGen.Generate()),
+		TTL:       ttl,
+		Namespace: ns,
+		Token:     token,
+		ClientID:  clientID,
+	}
+
+	ApplyLease(lease)
+
+	for _, callback := range OnLeaseGrant {
+		callback(lease)
+	}
+
+	return lease
+}
+
+// ApplyLease 保存租约并从现在开始计算有效期，用于备机应用主机的租约
+func ApplyLease(lease *Lease) {
+	lease.Deadline = time.Now().Add(lease.TTL)
+	leaseByID[lease.ID] = lease
+}
+
+func GetLease(id int64) *Lease {
+	return leaseByID[id]
+}
+
+// KeepAliveLease 续约，返回nil表示租约不存在
+func KeepAliveLease(id int64) *Lease {
+
+	lease := leaseByID[id]
+	if lease != nil {
+		lease.Deadline = time.Now().Add(lease.TTL)
+	}
+
+	return lease
+}
+
+// TransferLease 将令牌的所有租约转移到新的令牌，客户端未能恢复会话而重新认证时调用
+// 只转移同一客户端身份申请的租约，出示他人令牌的客户端不能取得租约
+// 参数:
+//   - ns: 命名空间，只转移此命名空间的租约
+//   - oldToken: 客户端出示的原令牌
+//   - newToken: 新会话的令牌
+//   - clientID: 新会话认证的客户端身份
+// 返回:
+//   - int: 转移的租约数量
+func TransferLease(ns, oldToken, newToken, clientID string) (count int) {
+
+	for _, lease := range leaseByID {
+
+		if lease.Token != oldToken || lease.Namespace != ns || lease.ClientID != clientID {
+			continue
+		}
+
+		lease.Token = newToken
+		count++
+
+		for _, callback := range OnLeaseGrant {
+			callback(lease)
+		}
+	}
+
+	return
+}
+
+// RemoveLease 移除租约，不删除绑定的键
+func RemoveLease(id int64) *Lease {
+
+	lease := leaseByID[id]
+	if lease == nil {
+		return nil
+	}
+
+	delete(leaseByID, id)
+
+	for _, callback := range OnLeaseRemove {
+		callback(lease)
+	}
+
+	return lease
+}
+
+// RefreshLease 所有租约从现在开始重新计算有效期，备机提升为主机时调用
+func RefreshLease() {
+	for _, lease := range leaseByID {
+		lease.Deadline = time.Now().Add(lease.TTL)
+	}
+}
+
+// ResetLease 清空所有租约，备机接收全量同步前调用
+func ResetLease() {
+	leaseByID = map[int64]*Lease{}
+}
+
+func LeaseCount() int {
+	return len(leaseByID)
+}
+
+func VisitLease(callback func(*Lease) bool) {
+	for _, lease := range leaseByID {
+		if !callback(lease) {
+			return
+		}
+	}
+}
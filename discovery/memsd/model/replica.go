@@ -0,0 +1,37 @@
+package model
+
+import "github.com/bobwong89757/cellnet"
+
+const (
+	RolePrimary = "primary" // 主机，处理客户端请求并向备机推送修改
+	RoleStandby = "standby" // 备机，只接收主机推送的修改
+)
+
+var (
+	Role           = RolePrimary // 当前节点的角色，只在Queue中访问
+	PrimaryAddress string        // 备机所知的主机地址，用于引导客户端
+)
+
+// IsPrimary 当前节点是否为主机
+func IsPrimary() bool {
+	return Role == RolePrimary
+}
+
+// IsReplicaSession 会话是否为备机的复制连接
+func IsReplicaSession(ses cellnet.Session) (ret bool) {
+	ses.(cellnet.ContextSet).FetchContext("replica", &ret)
+
+	return
+}
+
+// BroadcastReplica 将消息发送给所有备机
+func BroadcastReplica(msg interface{}) {
+	Listener.(cellnet.TCPAcceptor).VisitSession(func(ses cellnet.Session) bool {
+
+		if IsReplicaSession(ses) {
+			ses.Send(msg)
+		}
+
+		return true
+	})
+}
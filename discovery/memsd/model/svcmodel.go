@@ -1,13 +1,13 @@
 package model
 
 import (
+	"github.com/bobwong89757/cellmesh/discovery"
 	"github.com/bobwong89757/cellmesh/util"
 	"github.com/bobwong89757/cellnet"
-	"strings"
 )
 
 const (
-	ServiceKeyPrefix = "_svcdesc_" // 服务描述在KV存储中的键前缀
+	ServiceKeyPrefix = discovery.ServiceKeyPrefix // 服务描述在KV存储中的键前缀
 )
 
 var (
@@ -18,20 +18,19 @@ var (
 	Debug    bool         // 调试模式标志
 
 	Version = "0.1.0" // 版本号
+
+	BroadcastCount     uint64 // 广播的次数，只在Queue中访问
+	BroadcastSendCount uint64 // 广播发送给会话的消息数量，只在Queue中访问
 )
 
 func IsServiceKey(rawkey string) bool {
 
-	return strings.HasPrefix(rawkey, ServiceKeyPrefix)
+	return discovery.IsServiceKey(rawkey)
 }
 
 func GetSvcIDByServiceKey(rawkey string) string {
 
-	if IsServiceKey(rawkey) {
-		return rawkey[len(ServiceKeyPrefix):]
-	}
-
-	return ""
+	return discovery.GetSvcIDByServiceKey(rawkey)
 }
 
 func init() {
@@ -45,9 +44,25 @@ func GetSessionToken(ses cellnet.Session) (token string) {
 	return
 }
 
-func Broadcast(msg interface{}) {
+// GetSessionNamespace 获取会话认证时选择的命名空间
+func GetSessionNamespace(ses cellnet.Session) (ns string) {
+	ses.(cellnet.ContextSet).FetchContext("namespace", &ns)
+
+	return
+}
+
+// Broadcast 将消息发送给指定命名空间的所有客户端
+func Broadcast(ns string, msg interface{}) {
+	BroadcastCount++
+
 	Listener.(cellnet.TCPAcceptor).VisitSession(func(ses cellnet.Session) bool {
-		ses.Send(msg)
+
+		// 备机通过ReplicaSetACK/ReplicaDeleteACK同步，未认证的客户端在认证时同步
+		if !IsReplicaSession(ses) && GetSessionToken(ses) != "" && GetSessionNamespace(ses) == ns {
+			ses.Send(msg)
+			BroadcastSendCount++
+		}
+
 		return true
 	})
 }
@@ -65,3 +80,23 @@ func TokenExists(token string) (ret bool) {
 
 	return
 }
+
+// GetTokenSession 查找使用令牌的其他会话
+// 参数:
+//   - token: 会话令牌
+//   - except: 排除的会话，通常为当前会话
+// 返回:
+//   - cellnet.Session: 没有其他会话使用该令牌时返回nil
+func GetTokenSession(token string, except cellnet.Session) (ret cellnet.Session) {
+	Listener.(cellnet.TCPAcceptor).VisitSession(func(ses cellnet.Session) bool {
+
+		if ses != except && GetSessionToken(ses) == token {
+			ret = ses
+			return false
+		}
+
+		return true
+	})
+
+	return
+}
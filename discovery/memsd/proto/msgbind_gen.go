@@ -19,13 +19,19 @@ var (
 
 // memsd
 var (
-	Handle_Memsd_AuthREQ        = func(ev cellnet.Event) { panic("'AuthREQ' not handled") }
-	Handle_Memsd_ClearKeyREQ    = func(ev cellnet.Event) { panic("'ClearKeyREQ' not handled") }
-	Handle_Memsd_ClearSvcREQ    = func(ev cellnet.Event) { panic("'ClearSvcREQ' not handled") }
-	Handle_Memsd_DeleteValueREQ = func(ev cellnet.Event) { panic("'DeleteValueREQ' not handled") }
-	Handle_Memsd_GetValueREQ    = func(ev cellnet.Event) { panic("'GetValueREQ' not handled") }
-	Handle_Memsd_SetValueREQ    = func(ev cellnet.Event) { panic("'SetValueREQ' not handled") }
-	Handle_Memsd_Default        func(ev cellnet.Event)
+	Handle_Memsd_AuthChallengeREQ  = func(ev cellnet.Event) { panic("'AuthChallengeREQ' not handled") }
+	Handle_Memsd_AuthREQ           = func(ev cellnet.Event) { panic("'AuthREQ' not handled") }
+	Handle_Memsd_BatchREQ          = func(ev cellnet.Event) { panic("'BatchREQ' not handled") }
+	Handle_Memsd_ClearKeyREQ       = func(ev cellnet.Event) { panic("'ClearKeyREQ' not handled") }
+	Handle_Memsd_ClearSvcREQ       = func(ev cellnet.Event) { panic("'ClearSvcREQ' not handled") }
+	Handle_Memsd_DeleteValueREQ    = func(ev cellnet.Event) { panic("'DeleteValueREQ' not handled") }
+	Handle_Memsd_GetValueREQ       = func(ev cellnet.Event) { panic("'GetValueREQ' not handled") }
+	Handle_Memsd_LeaseGrantREQ     = func(ev cellnet.Event) { panic("'LeaseGrantREQ' not handled") }
+	Handle_Memsd_LeaseKeepAliveREQ = func(ev cellnet.Event) { panic("'LeaseKeepAliveREQ' not handled") }
+	Handle_Memsd_LeaseRevokeREQ    = func(ev cellnet.Event) { panic("'LeaseRevokeREQ' not handled") }
+	Handle_Memsd_ReplicaSyncREQ    = func(ev cellnet.Event) { panic("'ReplicaSyncREQ' not handled") }
+	Handle_Memsd_SetValueREQ       = func(ev cellnet.Event) { panic("'SetValueREQ' not handled") }
+	Handle_Memsd_Default           func(ev cellnet.Event)
 )
 
 func GetMessageHandler(svcName string) cellnet.EventCallback {
@@ -34,8 +40,12 @@ func GetMessageHandler(svcName string) cellnet.EventCallback {
 	case "memsd":
 		return func(ev cellnet.Event) {
 			switch ev.Message().(type) {
+			case *AuthChallengeREQ:
+				Handle_Memsd_AuthChallengeREQ(ev)
 			case *AuthREQ:
 				Handle_Memsd_AuthREQ(ev)
+			case *BatchREQ:
+				Handle_Memsd_BatchREQ(ev)
 			case *ClearKeyREQ:
 				Handle_Memsd_ClearKeyREQ(ev)
 			case *ClearSvcREQ:
@@ -44,6 +54,14 @@ func GetMessageHandler(svcName string) cellnet.EventCallback {
 				Handle_Memsd_DeleteValueREQ(ev)
 			case *GetValueREQ:
 				Handle_Memsd_GetValueREQ(ev)
+			case *LeaseGrantREQ:
+				Handle_Memsd_LeaseGrantREQ(ev)
+			case *LeaseKeepAliveREQ:
+				Handle_Memsd_LeaseKeepAliveREQ(ev)
+			case *LeaseRevokeREQ:
+				Handle_Memsd_LeaseRevokeREQ(ev)
+			case *ReplicaSyncREQ:
+				Handle_Memsd_ReplicaSyncREQ(ev)
 			case *SetValueREQ:
 				Handle_Memsd_SetValueREQ(ev)
 			default:
@@ -99,6 +117,16 @@ func init() {
 		Type:  reflect.TypeOf((*ValueDeleteNotifyACK)(nil)).Elem(),
 		ID:    35212,
 	})
+	cellnet.RegisterMessageMeta(&cellnet.MessageMeta{
+		Codec: codec.MustGetCodec("protoplus"),
+		Type:  reflect.TypeOf((*AuthChallengeREQ)(nil)).Elem(),
+		ID:    61841,
+	})
+	cellnet.RegisterMessageMeta(&cellnet.MessageMeta{
+		Codec: codec.MustGetCodec("protoplus"),
+		Type:  reflect.TypeOf((*AuthChallengeACK)(nil)).Elem(),
+		ID:    23672,
+	})
 	cellnet.RegisterMessageMeta(&cellnet.MessageMeta{
 		Codec: codec.MustGetCodec("protoplus"),
 		Type:  reflect.TypeOf((*AuthREQ)(nil)).Elem(),
@@ -129,4 +157,79 @@ func init() {
 		Type:  reflect.TypeOf((*ClearKeyACK)(nil)).Elem(),
 		ID:    33811,
 	})
+	cellnet.RegisterMessageMeta(&cellnet.MessageMeta{
+		Codec: codec.MustGetCodec("protoplus"),
+		Type:  reflect.TypeOf((*ReplicaSyncREQ)(nil)).Elem(),
+		ID:    25305,
+	})
+	cellnet.RegisterMessageMeta(&cellnet.MessageMeta{
+		Codec: codec.MustGetCodec("protoplus"),
+		Type:  reflect.TypeOf((*ReplicaSyncACK)(nil)).Elem(),
+		ID:    52672,
+	})
+	cellnet.RegisterMessageMeta(&cellnet.MessageMeta{
+		Codec: codec.MustGetCodec("protoplus"),
+		Type:  reflect.TypeOf((*ReplicaSetACK)(nil)).Elem(),
+		ID:    47663,
+	})
+	cellnet.RegisterMessageMeta(&cellnet.MessageMeta{
+		Codec: codec.MustGetCodec("protoplus"),
+		Type:  reflect.TypeOf((*ReplicaDeleteACK)(nil)).Elem(),
+		ID:    17622,
+	})
+	cellnet.RegisterMessageMeta(&cellnet.MessageMeta{
+		Codec: codec.MustGetCodec("protoplus"),
+		Type:  reflect.TypeOf((*ReplicaLeaseACK)(nil)).Elem(),
+		ID:    42829,
+	})
+	cellnet.RegisterMessageMeta(&cellnet.MessageMeta{
+		Codec: codec.MustGetCodec("protoplus"),
+		Type:  reflect.TypeOf((*PrimaryChangeNotifyACK)(nil)).Elem(),
+		ID:    29286,
+	})
+	cellnet.RegisterMessageMeta(&cellnet.MessageMeta{
+		Codec: codec.MustGetCodec("protoplus"),
+		Type:  reflect.TypeOf((*LeaseGrantREQ)(nil)).Elem(),
+		ID:    19938,
+	})
+	cellnet.RegisterMessageMeta(&cellnet.MessageMeta{
+		Codec: codec.MustGetCodec("protoplus"),
+		Type:  reflect.TypeOf((*LeaseGrantACK)(nil)).Elem(),
+		ID:    47305,
+	})
+	cellnet.RegisterMessageMeta(&cellnet.MessageMeta{
+		Codec: codec.MustGetCodec("protoplus"),
+		Type:  reflect.TypeOf((*LeaseKeepAliveREQ)(nil)).Elem(),
+		ID:    45052,
+	})
+	cellnet.RegisterMessageMeta(&cellnet.MessageMeta{
+		Codec: codec.MustGetCodec("protoplus"),
+		Type:  reflect.TypeOf((*LeaseKeepAliveACK)(nil)).Elem(),
+		ID:    6883,
+	})
+	cellnet.RegisterMessageMeta(&cellnet.MessageMeta{
+		Codec: codec.MustGetCodec("protoplus"),
+		Type:  reflect.TypeOf((*LeaseRevokeREQ)(nil)).Elem(),
+		ID:    26354,
+	})
+	cellnet.RegisterMessageMeta(&cellnet.MessageMeta{
+		Codec: codec.MustGetCodec("protoplus"),
+		Type:  reflect.TypeOf((*LeaseRevokeACK)(nil)).Elem(),
+		ID:    53721,
+	})
+	cellnet.RegisterMessageMeta(&cellnet.MessageMeta{
+		Codec: codec.MustGetCodec("protoplus"),
+		Type:  reflect.TypeOf((*BatchREQ)(nil)).Elem(),
+		ID:    40350,
+	})
+	cellnet.RegisterMessageMeta(&cellnet.MessageMeta{
+		Codec: codec.MustGetCodec("protoplus"),
+		Type:  reflect.TypeOf((*BatchACK)(nil)).Elem(),
+		ID:    2181,
+	})
+	cellnet.RegisterMessageMeta(&cellnet.MessageMeta{
+		Codec: codec.MustGetCodec("protoplus"),
+		Type:  reflect.TypeOf((*ValueBatchNotifyACK)(nil)).Elem(),
+		ID:    38107,
+	})
 }
@@ -15,22 +15,40 @@ var (
 type ResultCode int32
 
 const (
-	ResultCode_Result_OK          ResultCode = 0
-	ResultCode_Result_NotExists   ResultCode = 1
-	ResultCode_Result_AuthRequire ResultCode = 2
+	ResultCode_Result_OK               ResultCode = 0
+	ResultCode_Result_NotExists        ResultCode = 1
+	ResultCode_Result_AuthRequire      ResultCode = 2
+	ResultCode_Result_NotPrimary       ResultCode = 3
+	ResultCode_Result_AuthFailed       ResultCode = 4
+	ResultCode_Result_PermissionDenied ResultCode = 5
+	ResultCode_Result_RevisionMismatch ResultCode = 6
+	ResultCode_Result_LeaseNotFound    ResultCode = 7
+	ResultCode_Result_InvalidRequest   ResultCode = 8
 )
 
 var (
 	ResultCodeMapperValueByName = map[string]int32{
-		"Result_OK":          0,
-		"Result_NotExists":   1,
-		"Result_AuthRequire": 2,
+		"Result_OK":               0,
+		"Result_NotExists":        1,
+		"Result_AuthRequire":      2,
+		"Result_NotPrimary":       3,
+		"Result_AuthFailed":       4,
+		"Result_PermissionDenied": 5,
+		"Result_RevisionMismatch": 6,
+		"Result_LeaseNotFound":    7,
+		"Result_InvalidRequest":   8,
 	}
 
 	ResultCodeMapperNameByValue = map[int32]string{
 		0: "Result_OK",
 		1: "Result_NotExists",
 		2: "Result_AuthRequire",
+		3: "Result_NotPrimary",
+		4: "Result_AuthFailed",
+		5: "Result_PermissionDenied",
+		6: "Result_RevisionMismatch",
+		7: "Result_LeaseNotFound",
+		8: "Result_InvalidRequest",
 	}
 )
 
@@ -39,9 +57,14 @@ func (self ResultCode) String() string {
 }
 
 type SetValueREQ struct {
-	Key     string
-	Value   []byte
-	SvcName string
+	Key           string
+	Value         []byte
+	SvcName       string
+	CallID        int64 // 调用序号，ACK原样带回，用于匹配请求
+	CheckRevision bool  // 为true时比较并设置，只在键的当前修订号等于Revision时写入
+	Revision      int64 // 期望的修订号，0表示键必须不存在
+	LeaseID       int64 // 不为0时将键绑定到租约，租约过期或撤销时删除
+	Ephemeral     bool  // 为true时键归属于当前会话，与服务注册一样在会话断开时删除
 }
 
 func (self *SetValueREQ) String() string { return proto.CompactTextString(self) }
@@ -54,6 +77,16 @@ func (self *SetValueREQ) Size() (ret int) {
 
 	ret += proto.SizeString(2, self.SvcName)
 
+	ret += proto.SizeInt64(3, self.CallID)
+
+	ret += proto.SizeBool(4, self.CheckRevision)
+
+	ret += proto.SizeInt64(5, self.Revision)
+
+	ret += proto.SizeInt64(6, self.LeaseID)
+
+	ret += proto.SizeBool(7, self.Ephemeral)
+
 	return
 }
 
@@ -65,6 +98,16 @@ func (self *SetValueREQ) Marshal(buffer *proto.Buffer) error {
 
 	proto.MarshalString(buffer, 2, self.SvcName)
 
+	proto.MarshalInt64(buffer, 3, self.CallID)
+
+	proto.MarshalBool(buffer, 4, self.CheckRevision)
+
+	proto.MarshalInt64(buffer, 5, self.Revision)
+
+	proto.MarshalInt64(buffer, 6, self.LeaseID)
+
+	proto.MarshalBool(buffer, 7, self.Ephemeral)
+
 	return nil
 }
 
@@ -76,6 +119,16 @@ func (self *SetValueREQ) Unmarshal(buffer *proto.Buffer, fieldIndex uint64, wt p
 		return proto.UnmarshalBytes(buffer, wt, &self.Value)
 	case 2:
 		return proto.UnmarshalString(buffer, wt, &self.SvcName)
+	case 3:
+		return proto.UnmarshalInt64(buffer, wt, &self.CallID)
+	case 4:
+		return proto.UnmarshalBool(buffer, wt, &self.CheckRevision)
+	case 5:
+		return proto.UnmarshalInt64(buffer, wt, &self.Revision)
+	case 6:
+		return proto.UnmarshalInt64(buffer, wt, &self.LeaseID)
+	case 7:
+		return proto.UnmarshalBool(buffer, wt, &self.Ephemeral)
 
 	}
 
@@ -83,7 +136,9 @@ func (self *SetValueREQ) Unmarshal(buffer *proto.Buffer, fieldIndex uint64, wt p
 }
 
 type SetValueACK struct {
-	Code ResultCode
+	Code     ResultCode
+	CallID   int64 // 调用序号，ACK原样带回，用于匹配请求
+	Revision int64 // 写入后的修订号
 }
 
 func (self *SetValueACK) String() string { return proto.CompactTextString(self) }
@@ -92,6 +147,10 @@ func (self *SetValueACK) Size() (ret int) {
 
 	ret += proto.SizeInt32(0, int32(self.Code))
 
+	ret += proto.SizeInt64(1, self.CallID)
+
+	ret += proto.SizeInt64(2, self.Revision)
+
 	return
 }
 
@@ -99,6 +158,10 @@ func (self *SetValueACK) Marshal(buffer *proto.Buffer) error {
 
 	proto.MarshalInt32(buffer, 0, int32(self.Code))
 
+	proto.MarshalInt64(buffer, 1, self.CallID)
+
+	proto.MarshalInt64(buffer, 2, self.Revision)
+
 	return nil
 }
 
@@ -106,6 +169,10 @@ func (self *SetValueACK) Unmarshal(buffer *proto.Buffer, fieldIndex uint64, wt p
 	switch fieldIndex {
 	case 0:
 		return proto.UnmarshalInt32(buffer, wt, (*int32)(&self.Code))
+	case 1:
+		return proto.UnmarshalInt64(buffer, wt, &self.CallID)
+	case 2:
+		return proto.UnmarshalInt64(buffer, wt, &self.Revision)
 
 	}
 
@@ -113,7 +180,8 @@ func (self *SetValueACK) Unmarshal(buffer *proto.Buffer, fieldIndex uint64, wt p
 }
 
 type GetValueREQ struct {
-	Key string
+	Key    string
+	CallID int64 // 调用序号，ACK原样带回，用于匹配请求
 }
 
 func (self *GetValueREQ) String() string { return proto.CompactTextString(self) }
@@ -122,6 +190,8 @@ func (self *GetValueREQ) Size() (ret int) {
 
 	ret += proto.SizeString(0, self.Key)
 
+	ret += proto.SizeInt64(1, self.CallID)
+
 	return
 }
 
@@ -129,6 +199,8 @@ func (self *GetValueREQ) Marshal(buffer *proto.Buffer) error {
 
 	proto.MarshalString(buffer, 0, self.Key)
 
+	proto.MarshalInt64(buffer, 1, self.CallID)
+
 	return nil
 }
 
@@ -136,6 +208,8 @@ func (self *GetValueREQ) Unmarshal(buffer *proto.Buffer, fieldIndex uint64, wt p
 	switch fieldIndex {
 	case 0:
 		return proto.UnmarshalString(buffer, wt, &self.Key)
+	case 1:
+		return proto.UnmarshalInt64(buffer, wt, &self.CallID)
 
 	}
 
@@ -143,9 +217,11 @@ func (self *GetValueREQ) Unmarshal(buffer *proto.Buffer, fieldIndex uint64, wt p
 }
 
 type GetValueACK struct {
-	Code  ResultCode
-	Key   string
-	Value []byte
+	Code     ResultCode
+	Key      string
+	Value    []byte
+	CallID   int64 // 调用序号，ACK原样带回，用于匹配请求
+	Revision int64 // 值最后一次修改时的修订号
 }
 
 func (self *GetValueACK) String() string { return proto.CompactTextString(self) }
@@ -158,6 +234,10 @@ func (self *GetValueACK) Size() (ret int) {
 
 	ret += proto.SizeBytes(2, self.Value)
 
+	ret += proto.SizeInt64(3, self.CallID)
+
+	ret += proto.SizeInt64(4, self.Revision)
+
 	return
 }
 
@@ -169,6 +249,10 @@ func (self *GetValueACK) Marshal(buffer *proto.Buffer) error {
 
 	proto.MarshalBytes(buffer, 2, self.Value)
 
+	proto.MarshalInt64(buffer, 3, self.CallID)
+
+	proto.MarshalInt64(buffer, 4, self.Revision)
+
 	return nil
 }
 
@@ -180,6 +264,10 @@ func (self *GetValueACK) Unmarshal(buffer *proto.Buffer, fieldIndex uint64, wt p
 		return proto.UnmarshalString(buffer, wt, &self.Key)
 	case 2:
 		return proto.UnmarshalBytes(buffer, wt, &self.Value)
+	case 3:
+		return proto.UnmarshalInt64(buffer, wt, &self.CallID)
+	case 4:
+		return proto.UnmarshalInt64(buffer, wt, &self.Revision)
 
 	}
 
@@ -187,7 +275,10 @@ func (self *GetValueACK) Unmarshal(buffer *proto.Buffer, fieldIndex uint64, wt p
 }
 
 type DeleteValueREQ struct {
-	Key string
+	Key           string
+	CallID        int64 // 调用序号，ACK原样带回，用于匹配请求
+	CheckRevision bool  // 为true时只删除Key本身，且只在当前修订号等于Revision时删除
+	Revision      int64 // 期望的修订号
 }
 
 func (self *DeleteValueREQ) String() string { return proto.CompactTextString(self) }
@@ -196,6 +287,12 @@ func (self *DeleteValueREQ) Size() (ret int) {
 
 	ret += proto.SizeString(0, self.Key)
 
+	ret += proto.SizeInt64(1, self.CallID)
+
+	ret += proto.SizeBool(2, self.CheckRevision)
+
+	ret += proto.SizeInt64(3, self.Revision)
+
 	return
 }
 
@@ -203,6 +300,12 @@ func (self *DeleteValueREQ) Marshal(buffer *proto.Buffer) error {
 
 	proto.MarshalString(buffer, 0, self.Key)
 
+	proto.MarshalInt64(buffer, 1, self.CallID)
+
+	proto.MarshalBool(buffer, 2, self.CheckRevision)
+
+	proto.MarshalInt64(buffer, 3, self.Revision)
+
 	return nil
 }
 
@@ -210,6 +313,12 @@ func (self *DeleteValueREQ) Unmarshal(buffer *proto.Buffer, fieldIndex uint64, w
 	switch fieldIndex {
 	case 0:
 		return proto.UnmarshalString(buffer, wt, &self.Key)
+	case 1:
+		return proto.UnmarshalInt64(buffer, wt, &self.CallID)
+	case 2:
+		return proto.UnmarshalBool(buffer, wt, &self.CheckRevision)
+	case 3:
+		return proto.UnmarshalInt64(buffer, wt, &self.Revision)
 
 	}
 
@@ -217,8 +326,9 @@ func (self *DeleteValueREQ) Unmarshal(buffer *proto.Buffer, fieldIndex uint64, w
 }
 
 type DeleteValueACK struct {
-	Code ResultCode
-	Key  string
+	Code   ResultCode
+	Key    string
+	CallID int64 // 调用序号，ACK原样带回，用于匹配请求
 }
 
 func (self *DeleteValueACK) String() string { return proto.CompactTextString(self) }
@@ -229,6 +339,8 @@ func (self *DeleteValueACK) Size() (ret int) {
 
 	ret += proto.SizeString(1, self.Key)
 
+	ret += proto.SizeInt64(2, self.CallID)
+
 	return
 }
 
@@ -238,6 +350,8 @@ func (self *DeleteValueACK) Marshal(buffer *proto.Buffer) error {
 
 	proto.MarshalString(buffer, 1, self.Key)
 
+	proto.MarshalInt64(buffer, 2, self.CallID)
+
 	return nil
 }
 
@@ -247,6 +361,8 @@ func (self *DeleteValueACK) Unmarshal(buffer *proto.Buffer, fieldIndex uint64, w
 		return proto.UnmarshalInt32(buffer, wt, (*int32)(&self.Code))
 	case 1:
 		return proto.UnmarshalString(buffer, wt, &self.Key)
+	case 2:
+		return proto.UnmarshalInt64(buffer, wt, &self.CallID)
 
 	}
 
@@ -254,9 +370,10 @@ func (self *DeleteValueACK) Unmarshal(buffer *proto.Buffer, fieldIndex uint64, w
 }
 
 type ValueChangeNotifyACK struct {
-	Key     string
-	Value   []byte
-	SvcName string
+	Key      string
+	Value    []byte
+	SvcName  string
+	Revision int64 // 值修改时的修订号
 }
 
 func (self *ValueChangeNotifyACK) String() string { return proto.CompactTextString(self) }
@@ -269,6 +386,8 @@ func (self *ValueChangeNotifyACK) Size() (ret int) {
 
 	ret += proto.SizeString(2, self.SvcName)
 
+	ret += proto.SizeInt64(3, self.Revision)
+
 	return
 }
 
@@ -280,6 +399,8 @@ func (self *ValueChangeNotifyACK) Marshal(buffer *proto.Buffer) error {
 
 	proto.MarshalString(buffer, 2, self.SvcName)
 
+	proto.MarshalInt64(buffer, 3, self.Revision)
+
 	return nil
 }
 
@@ -291,6 +412,8 @@ func (self *ValueChangeNotifyACK) Unmarshal(buffer *proto.Buffer, fieldIndex uin
 		return proto.UnmarshalBytes(buffer, wt, &self.Value)
 	case 2:
 		return proto.UnmarshalString(buffer, wt, &self.SvcName)
+	case 3:
+		return proto.UnmarshalInt64(buffer, wt, &self.Revision)
 
 	}
 
@@ -298,8 +421,9 @@ func (self *ValueChangeNotifyACK) Unmarshal(buffer *proto.Buffer, fieldIndex uin
 }
 
 type ValueDeleteNotifyACK struct {
-	Key     string
-	SvcName string
+	Key      string
+	SvcName  string
+	Revision int64 // 删除时的修订号
 }
 
 func (self *ValueDeleteNotifyACK) String() string { return proto.CompactTextString(self) }
@@ -310,6 +434,8 @@ func (self *ValueDeleteNotifyACK) Size() (ret int) {
 
 	ret += proto.SizeString(1, self.SvcName)
 
+	ret += proto.SizeInt64(2, self.Revision)
+
 	return
 }
 
@@ -319,6 +445,8 @@ func (self *ValueDeleteNotifyACK) Marshal(buffer *proto.Buffer) error {
 
 	proto.MarshalString(buffer, 1, self.SvcName)
 
+	proto.MarshalInt64(buffer, 2, self.Revision)
+
 	return nil
 }
 
@@ -328,6 +456,68 @@ func (self *ValueDeleteNotifyACK) Unmarshal(buffer *proto.Buffer, fieldIndex uin
 		return proto.UnmarshalString(buffer, wt, &self.Key)
 	case 1:
 		return proto.UnmarshalString(buffer, wt, &self.SvcName)
+	case 2:
+		return proto.UnmarshalInt64(buffer, wt, &self.Revision)
+
+	}
+
+	return proto.ErrUnknownField
+}
+
+type AuthChallengeREQ struct {
+	ClientID string
+}
+
+func (self *AuthChallengeREQ) String() string { return proto.CompactTextString(self) }
+
+func (self *AuthChallengeREQ) Size() (ret int) {
+
+	ret += proto.SizeString(0, self.ClientID)
+
+	return
+}
+
+func (self *AuthChallengeREQ) Marshal(buffer *proto.Buffer) error {
+
+	proto.MarshalString(buffer, 0, self.ClientID)
+
+	return nil
+}
+
+func (self *AuthChallengeREQ) Unmarshal(buffer *proto.Buffer, fieldIndex uint64, wt proto.WireType) error {
+	switch fieldIndex {
+	case 0:
+		return proto.UnmarshalString(buffer, wt, &self.ClientID)
+
+	}
+
+	return proto.ErrUnknownField
+}
+
+type AuthChallengeACK struct {
+	Nonce []byte
+}
+
+func (self *AuthChallengeACK) String() string { return proto.CompactTextString(self) }
+
+func (self *AuthChallengeACK) Size() (ret int) {
+
+	ret += proto.SizeBytes(0, self.Nonce)
+
+	return
+}
+
+func (self *AuthChallengeACK) Marshal(buffer *proto.Buffer) error {
+
+	proto.MarshalBytes(buffer, 0, self.Nonce)
+
+	return nil
+}
+
+func (self *AuthChallengeACK) Unmarshal(buffer *proto.Buffer, fieldIndex uint64, wt proto.WireType) error {
+	switch fieldIndex {
+	case 0:
+		return proto.UnmarshalBytes(buffer, wt, &self.Nonce)
 
 	}
 
@@ -335,7 +525,12 @@ func (self *ValueDeleteNotifyACK) Unmarshal(buffer *proto.Buffer, fieldIndex uin
 }
 
 type AuthREQ struct {
-	Token string
+	Token     string
+	ClientID  string
+	Signature string // HMAC-SHA256(密钥, Nonce)的十六进制
+	Namespace string // 会话使用的命名空间，所有键及服务都在此命名空间中，为空时使用默认命名空间
+	Revision  int64  // 重连时本地缓存对应的修订号，服务器只发送之后的修改
+	HistoryID string // 修订号所属的历史，与服务器不一致时全量同步
 }
 
 func (self *AuthREQ) String() string { return proto.CompactTextString(self) }
@@ -344,6 +539,16 @@ func (self *AuthREQ) Size() (ret int) {
 
 	ret += proto.SizeString(0, self.Token)
 
+	ret += proto.SizeString(1, self.ClientID)
+
+	ret += proto.SizeString(2, self.Signature)
+
+	ret += proto.SizeString(3, self.Namespace)
+
+	ret += proto.SizeInt64(4, self.Revision)
+
+	ret += proto.SizeString(5, self.HistoryID)
+
 	return
 }
 
@@ -351,6 +556,16 @@ func (self *AuthREQ) Marshal(buffer *proto.Buffer) error {
 
 	proto.MarshalString(buffer, 0, self.Token)
 
+	proto.MarshalString(buffer, 1, self.ClientID)
+
+	proto.MarshalString(buffer, 2, self.Signature)
+
+	proto.MarshalString(buffer, 3, self.Namespace)
+
+	proto.MarshalInt64(buffer, 4, self.Revision)
+
+	proto.MarshalString(buffer, 5, self.HistoryID)
+
 	return nil
 }
 
@@ -358,6 +573,16 @@ func (self *AuthREQ) Unmarshal(buffer *proto.Buffer, fieldIndex uint64, wt proto
 	switch fieldIndex {
 	case 0:
 		return proto.UnmarshalString(buffer, wt, &self.Token)
+	case 1:
+		return proto.UnmarshalString(buffer, wt, &self.ClientID)
+	case 2:
+		return proto.UnmarshalString(buffer, wt, &self.Signature)
+	case 3:
+		return proto.UnmarshalString(buffer, wt, &self.Namespace)
+	case 4:
+		return proto.UnmarshalInt64(buffer, wt, &self.Revision)
+	case 5:
+		return proto.UnmarshalString(buffer, wt, &self.HistoryID)
 
 	}
 
@@ -365,7 +590,12 @@ func (self *AuthREQ) Unmarshal(buffer *proto.Buffer, fieldIndex uint64, wt proto
 }
 
 type AuthACK struct {
-	Token string
+	Token     string
+	Code      ResultCode
+	Revision  int64  // 同步完成时的修订号
+	HistoryID string // 修订号所属的历史
+	Full      bool   // 为true时之前发送的是全量数据，客户端替换缓存，否则在缓存上应用修改
+	Resumed   bool   // 为true时恢复了断开前的会话，服务、临时键及租约仍然有效
 }
 
 func (self *AuthACK) String() string { return proto.CompactTextString(self) }
@@ -374,6 +604,16 @@ func (self *AuthACK) Size() (ret int) {
 
 	ret += proto.SizeString(0, self.Token)
 
+	ret += proto.SizeInt32(1, int32(self.Code))
+
+	ret += proto.SizeInt64(2, self.Revision)
+
+	ret += proto.SizeString(3, self.HistoryID)
+
+	ret += proto.SizeBool(4, self.Full)
+
+	ret += proto.SizeBool(5, self.Resumed)
+
 	return
 }
 
@@ -381,6 +621,16 @@ func (self *AuthACK) Marshal(buffer *proto.Buffer) error {
 
 	proto.MarshalString(buffer, 0, self.Token)
 
+	proto.MarshalInt32(buffer, 1, int32(self.Code))
+
+	proto.MarshalInt64(buffer, 2, self.Revision)
+
+	proto.MarshalString(buffer, 3, self.HistoryID)
+
+	proto.MarshalBool(buffer, 4, self.Full)
+
+	proto.MarshalBool(buffer, 5, self.Resumed)
+
 	return nil
 }
 
@@ -388,6 +638,16 @@ func (self *AuthACK) Unmarshal(buffer *proto.Buffer, fieldIndex uint64, wt proto
 	switch fieldIndex {
 	case 0:
 		return proto.UnmarshalString(buffer, wt, &self.Token)
+	case 1:
+		return proto.UnmarshalInt32(buffer, wt, (*int32)(&self.Code))
+	case 2:
+		return proto.UnmarshalInt64(buffer, wt, &self.Revision)
+	case 3:
+		return proto.UnmarshalString(buffer, wt, &self.HistoryID)
+	case 4:
+		return proto.UnmarshalBool(buffer, wt, &self.Full)
+	case 5:
+		return proto.UnmarshalBool(buffer, wt, &self.Resumed)
 
 	}
 
@@ -395,22 +655,29 @@ func (self *AuthACK) Unmarshal(buffer *proto.Buffer, fieldIndex uint64, wt proto
 }
 
 type ClearSvcREQ struct {
+	CallID int64 // 调用序号，ACK原样带回，用于匹配请求
 }
 
 func (self *ClearSvcREQ) String() string { return proto.CompactTextString(self) }
 
 func (self *ClearSvcREQ) Size() (ret int) {
 
+	ret += proto.SizeInt64(0, self.CallID)
+
 	return
 }
 
 func (self *ClearSvcREQ) Marshal(buffer *proto.Buffer) error {
 
+	proto.MarshalInt64(buffer, 0, self.CallID)
+
 	return nil
 }
 
 func (self *ClearSvcREQ) Unmarshal(buffer *proto.Buffer, fieldIndex uint64, wt proto.WireType) error {
 	switch fieldIndex {
+	case 0:
+		return proto.UnmarshalInt64(buffer, wt, &self.CallID)
 
 	}
 
@@ -418,7 +685,8 @@ func (self *ClearSvcREQ) Unmarshal(buffer *proto.Buffer, fieldIndex uint64, wt p
 }
 
 type ClearSvcACK struct {
-	Code ResultCode
+	Code   ResultCode
+	CallID int64 // 调用序号，ACK原样带回，用于匹配请求
 }
 
 func (self *ClearSvcACK) String() string { return proto.CompactTextString(self) }
@@ -427,6 +695,8 @@ func (self *ClearSvcACK) Size() (ret int) {
 
 	ret += proto.SizeInt32(0, int32(self.Code))
 
+	ret += proto.SizeInt64(1, self.CallID)
+
 	return
 }
 
@@ -434,6 +704,8 @@ func (self *ClearSvcACK) Marshal(buffer *proto.Buffer) error {
 
 	proto.MarshalInt32(buffer, 0, int32(self.Code))
 
+	proto.MarshalInt64(buffer, 1, self.CallID)
+
 	return nil
 }
 
@@ -441,6 +713,8 @@ func (self *ClearSvcACK) Unmarshal(buffer *proto.Buffer, fieldIndex uint64, wt p
 	switch fieldIndex {
 	case 0:
 		return proto.UnmarshalInt32(buffer, wt, (*int32)(&self.Code))
+	case 1:
+		return proto.UnmarshalInt64(buffer, wt, &self.CallID)
 
 	}
 
@@ -448,22 +722,29 @@ func (self *ClearSvcACK) Unmarshal(buffer *proto.Buffer, fieldIndex uint64, wt p
 }
 
 type ClearKeyREQ struct {
+	CallID int64 // 调用序号，ACK原样带回，用于匹配请求
 }
 
 func (self *ClearKeyREQ) String() string { return proto.CompactTextString(self) }
 
 func (self *ClearKeyREQ) Size() (ret int) {
 
+	ret += proto.SizeInt64(0, self.CallID)
+
 	return
 }
 
 func (self *ClearKeyREQ) Marshal(buffer *proto.Buffer) error {
 
+	proto.MarshalInt64(buffer, 0, self.CallID)
+
 	return nil
 }
 
 func (self *ClearKeyREQ) Unmarshal(buffer *proto.Buffer, fieldIndex uint64, wt proto.WireType) error {
 	switch fieldIndex {
+	case 0:
+		return proto.UnmarshalInt64(buffer, wt, &self.CallID)
 
 	}
 
@@ -471,7 +752,8 @@ func (self *ClearKeyREQ) Unmarshal(buffer *proto.Buffer, fieldIndex uint64, wt p
 }
 
 type ClearKeyACK struct {
-	Code ResultCode
+	Code   ResultCode
+	CallID int64 // 调用序号，ACK原样带回，用于匹配请求
 }
 
 func (self *ClearKeyACK) String() string { return proto.CompactTextString(self) }
@@ -480,6 +762,8 @@ func (self *ClearKeyACK) Size() (ret int) {
 
 	ret += proto.SizeInt32(0, int32(self.Code))
 
+	ret += proto.SizeInt64(1, self.CallID)
+
 	return
 }
 
@@ -487,6 +771,8 @@ func (self *ClearKeyACK) Marshal(buffer *proto.Buffer) error {
 
 	proto.MarshalInt32(buffer, 0, int32(self.Code))
 
+	proto.MarshalInt64(buffer, 1, self.CallID)
+
 	return nil
 }
 
@@ -494,6 +780,744 @@ func (self *ClearKeyACK) Unmarshal(buffer *proto.Buffer, fieldIndex uint64, wt p
 	switch fieldIndex {
 	case 0:
 		return proto.UnmarshalInt32(buffer, wt, (*int32)(&self.Code))
+	case 1:
+		return proto.UnmarshalInt64(buffer, wt, &self.CallID)
+
+	}
+
+	return proto.ErrUnknownField
+}
+
+type ReplicaSyncREQ struct {
+	ClientID  string // 备机身份，用于日志
+	Signature string // HMAC-SHA256(备机密钥, Nonce)的十六进制
+}
+
+func (self *ReplicaSyncREQ) String() string { return proto.CompactTextString(self) }
+
+func (self *ReplicaSyncREQ) Size() (ret int) {
+
+	ret += proto.SizeString(0, self.ClientID)
+
+	ret += proto.SizeString(1, self.Signature)
+
+	return
+}
+
+func (self *ReplicaSyncREQ) Marshal(buffer *proto.Buffer) error {
+
+	proto.MarshalString(buffer, 0, self.ClientID)
+
+	proto.MarshalString(buffer, 1, self.Signature)
+
+	return nil
+}
+
+func (self *ReplicaSyncREQ) Unmarshal(buffer *proto.Buffer, fieldIndex uint64, wt proto.WireType) error {
+	switch fieldIndex {
+	case 0:
+		return proto.UnmarshalString(buffer, wt, &self.ClientID)
+	case 1:
+		return proto.UnmarshalString(buffer, wt, &self.Signature)
+
+	}
+
+	return proto.ErrUnknownField
+}
+
+type ReplicaSyncACK struct {
+	Code      ResultCode
+	Primary   string // Code为Result_NotPrimary时，对方所知的主机地址
+	Revision  int64  // 主机当前的修订号
+	HistoryID string // 主机修订号所属的历史
+}
+
+func (self *ReplicaSyncACK) String() string { return proto.CompactTextString(self) }
+
+func (self *ReplicaSyncACK) Size() (ret int) {
+
+	ret += proto.SizeInt32(0, int32(self.Code))
+
+	ret += proto.SizeString(1, self.Primary)
+
+	ret += proto.SizeInt64(2, self.Revision)
+
+	ret += proto.SizeString(3, self.HistoryID)
+
+	return
+}
+
+func (self *ReplicaSyncACK) Marshal(buffer *proto.Buffer) error {
+
+	proto.MarshalInt32(buffer, 0, int32(self.Code))
+
+	proto.MarshalString(buffer, 1, self.Primary)
+
+	proto.MarshalInt64(buffer, 2, self.Revision)
+
+	proto.MarshalString(buffer, 3, self.HistoryID)
+
+	return nil
+}
+
+func (self *ReplicaSyncACK) Unmarshal(buffer *proto.Buffer, fieldIndex uint64, wt proto.WireType) error {
+	switch fieldIndex {
+	case 0:
+		return proto.UnmarshalInt32(buffer, wt, (*int32)(&self.Code))
+	case 1:
+		return proto.UnmarshalString(buffer, wt, &self.Primary)
+	case 2:
+		return proto.UnmarshalInt64(buffer, wt, &self.Revision)
+	case 3:
+		return proto.UnmarshalString(buffer, wt, &self.HistoryID)
+
+	}
+
+	return proto.ErrUnknownField
+}
+
+type ReplicaSetACK struct {
+	Key       string
+	Value     []byte
+	SvcName   string
+	Token     string
+	Namespace string
+	Revision  int64
+	LeaseID   int64
+}
+
+func (self *ReplicaSetACK) String() string { return proto.CompactTextString(self) }
+
+func (self *ReplicaSetACK) Size() (ret int) {
+
+	ret += proto.SizeString(0, self.Key)
+
+	ret += proto.SizeBytes(1, self.Value)
+
+	ret += proto.SizeString(2, self.SvcName)
+
+	ret += proto.SizeString(3, self.Token)
+
+	ret += proto.SizeString(4, self.Namespace)
+
+	ret += proto.SizeInt64(5, self.Revision)
+
+	ret += proto.SizeInt64(6, self.LeaseID)
+
+	return
+}
+
+func (self *ReplicaSetACK) Marshal(buffer *proto.Buffer) error {
+
+	proto.MarshalString(buffer, 0, self.Key)
+
+	proto.MarshalBytes(buffer, 1, self.Value)
+
+	proto.MarshalString(buffer, 2, self.SvcName)
+
+	proto.MarshalString(buffer, 3, self.Token)
+
+	proto.MarshalString(buffer, 4, self.Namespace)
+
+	proto.MarshalInt64(buffer, 5, self.Revision)
+
+	proto.MarshalInt64(buffer, 6, self.LeaseID)
+
+	return nil
+}
+
+func (self *ReplicaSetACK) Unmarshal(buffer *proto.Buffer, fieldIndex uint64, wt proto.WireType) error {
+	switch fieldIndex {
+	case 0:
+		return proto.UnmarshalString(buffer, wt, &self.Key)
+	case 1:
+		return proto.UnmarshalBytes(buffer, wt, &self.Value)
+	case 2:
+		return proto.UnmarshalString(buffer, wt, &self.SvcName)
+	case 3:
+		return proto.UnmarshalString(buffer, wt, &self.Token)
+	case 4:
+		return proto.UnmarshalString(buffer, wt, &self.Namespace)
+	case 5:
+		return proto.UnmarshalInt64(buffer, wt, &self.Revision)
+	case 6:
+		return proto.UnmarshalInt64(buffer, wt, &self.LeaseID)
+
+	}
+
+	return proto.ErrUnknownField
+}
+
+type ReplicaDeleteACK struct {
+	Key       string
+	Namespace string
+	Revision  int64 // 删除时的修订号
+}
+
+func (self *ReplicaDeleteACK) String() string { return proto.CompactTextString(self) }
+
+func (self *ReplicaDeleteACK) Size() (ret int) {
+
+	ret += proto.SizeString(0, self.Key)
+
+	ret += proto.SizeString(1, self.Namespace)
+
+	ret += proto.SizeInt64(2, self.Revision)
+
+	return
+}
+
+func (self *ReplicaDeleteACK) Marshal(buffer *proto.Buffer) error {
+
+	proto.MarshalString(buffer, 0, self.Key)
+
+	proto.MarshalString(buffer, 1, self.Namespace)
+
+	proto.MarshalInt64(buffer, 2, self.Revision)
+
+	return nil
+}
+
+func (self *ReplicaDeleteACK) Unmarshal(buffer *proto.Buffer, fieldIndex uint64, wt proto.WireType) error {
+	switch fieldIndex {
+	case 0:
+		return proto.UnmarshalString(buffer, wt, &self.Key)
+	case 1:
+		return proto.UnmarshalString(buffer, wt, &self.Namespace)
+	case 2:
+		return proto.UnmarshalInt64(buffer, wt, &self.Revision)
+
+	}
+
+	return proto.ErrUnknownField
+}
+
+type ReplicaLeaseACK struct {
+	LeaseID   int64
+	TTL       int64 // 有效期，毫秒
+	Namespace string
+	Removed   bool   // 租约已撤销或过期
+	Token     string // 申请租约的会话令牌，提升为主机后用于校验租约的归属
+	ClientID  string // 申请租约的客户端身份，提升为主机后用于校验租约的转移
+}
+
+func (self *ReplicaLeaseACK) String() string { return proto.CompactTextString(self) }
+
+func (self *ReplicaLeaseACK) Size() (ret int) {
+
+	ret += proto.SizeInt64(0, self.LeaseID)
+
+	ret += proto.SizeInt64(1, self.TTL)
+
+	ret += proto.SizeString(2, self.Namespace)
+
+	ret += proto.SizeBool(3, self.Removed)
+
+	ret += proto.SizeString(4, self.Token)
+
+	ret += proto.SizeString(5, self.ClientID)
+
+	return
+}
+
+func (self *ReplicaLeaseACK) Marshal(buffer *proto.Buffer) error {
+
+	proto.MarshalInt64(buffer, 0, self.LeaseID)
+
+	proto.MarshalInt64(buffer, 1, self.TTL)
+
+	proto.MarshalString(buffer, 2, self.Namespace)
+
+	proto.MarshalBool(buffer, 3, self.Removed)
+
+	proto.MarshalString(buffer, 4, self.Token)
+
+	proto.MarshalString(buffer, 5, self.ClientID)
+
+	return nil
+}
+
+func (self *ReplicaLeaseACK) Unmarshal(buffer *proto.Buffer, fieldIndex uint64, wt proto.WireType) error {
+	switch fieldIndex {
+	case 0:
+		return proto.UnmarshalInt64(buffer, wt, &self.LeaseID)
+	case 1:
+		return proto.UnmarshalInt64(buffer, wt, &self.TTL)
+	case 2:
+		return proto.UnmarshalString(buffer, wt, &self.Namespace)
+	case 3:
+		return proto.UnmarshalBool(buffer, wt, &self.Removed)
+	case 4:
+		return proto.UnmarshalString(buffer, wt, &self.Token)
+	case 5:
+		return proto.UnmarshalString(buffer, wt, &self.ClientID)
+
+	}
+
+	return proto.ErrUnknownField
+}
+
+type PrimaryChangeNotifyACK struct {
+	Address string
+}
+
+func (self *PrimaryChangeNotifyACK) String() string { return proto.CompactTextString(self) }
+
+func (self *PrimaryChangeNotifyACK) Size() (ret int) {
+
+	ret += proto.SizeString(0, self.Address)
+
+	return
+}
+
+func (self *PrimaryChangeNotifyACK) Marshal(buffer *proto.Buffer) error {
+
+	proto.MarshalString(buffer, 0, self.Address)
+
+	return nil
+}
+
+func (self *PrimaryChangeNotifyACK) Unmarshal(buffer *proto.Buffer, fieldIndex uint64, wt proto.WireType) error {
+	switch fieldIndex {
+	case 0:
+		return proto.UnmarshalString(buffer, wt, &self.Address)
+
+	}
+
+	return proto.ErrUnknownField
+}
+
+type LeaseGrantREQ struct {
+	TTL    int64 // 有效期，毫秒
+	CallID int64 // 调用序号，ACK原样带回，用于匹配请求
+}
+
+func (self *LeaseGrantREQ) String() string { return proto.CompactTextString(self) }
+
+func (self *LeaseGrantREQ) Size() (ret int) {
+
+	ret += proto.SizeInt64(0, self.TTL)
+
+	ret += proto.SizeInt64(1, self.CallID)
+
+	return
+}
+
+func (self *LeaseGrantREQ) Marshal(buffer *proto.Buffer) error {
+
+	proto.MarshalInt64(buffer, 0, self.TTL)
+
+	proto.MarshalInt64(buffer, 1, self.CallID)
+
+	return nil
+}
+
+func (self *LeaseGrantREQ) Unmarshal(buffer *proto.Buffer, fieldIndex uint64, wt proto.WireType) error {
+	switch fieldIndex {
+	case 0:
+		return proto.UnmarshalInt64(buffer, wt, &self.TTL)
+	case 1:
+		return proto.UnmarshalInt64(buffer, wt, &self.CallID)
+
+	}
+
+	return proto.ErrUnknownField
+}
+
+type LeaseGrantACK struct {
+	Code    ResultCode
+	LeaseID int64
+	TTL     int64 // 服务器实际使用的有效期，毫秒
+	CallID  int64 // 调用序号，ACK原样带回，用于匹配请求
+}
+
+func (self *LeaseGrantACK) String() string { return proto.CompactTextString(self) }
+
+func (self *LeaseGrantACK) Size() (ret int) {
+
+	ret += proto.SizeInt32(0, int32(self.Code))
+
+	ret += proto.SizeInt64(1, self.LeaseID)
+
+	ret += proto.SizeInt64(2, self.TTL)
+
+	ret += proto.SizeInt64(3, self.CallID)
+
+	return
+}
+
+func (self *LeaseGrantACK) Marshal(buffer *proto.Buffer) error {
+
+	proto.MarshalInt32(buffer, 0, int32(self.Code))
+
+	proto.MarshalInt64(buffer, 1, self.LeaseID)
+
+	proto.MarshalInt64(buffer, 2, self.TTL)
+
+	proto.MarshalInt64(buffer, 3, self.CallID)
+
+	return nil
+}
+
+func (self *LeaseGrantACK) Unmarshal(buffer *proto.Buffer, fieldIndex uint64, wt proto.WireType) error {
+	switch fieldIndex {
+	case 0:
+		return proto.UnmarshalInt32(buffer, wt, (*int32)(&self.Code))
+	case 1:
+		return proto.UnmarshalInt64(buffer, wt, &self.LeaseID)
+	case 2:
+		return proto.UnmarshalInt64(buffer, wt, &self.TTL)
+	case 3:
+		return proto.UnmarshalInt64(buffer, wt, &self.CallID)
+
+	}
+
+	return proto.ErrUnknownField
+}
+
+type LeaseKeepAliveREQ struct {
+	LeaseID int64
+	CallID  int64 // 调用序号，ACK原样带回，用于匹配请求
+}
+
+func (self *LeaseKeepAliveREQ) String() string { return proto.CompactTextString(self) }
+
+func (self *LeaseKeepAliveREQ) Size() (ret int) {
+
+	ret += proto.SizeInt64(0, self.LeaseID)
+
+	ret += proto.SizeInt64(1, self.CallID)
+
+	return
+}
+
+func (self *LeaseKeepAliveREQ) Marshal(buffer *proto.Buffer) error {
+
+	proto.MarshalInt64(buffer, 0, self.LeaseID)
+
+	proto.MarshalInt64(buffer, 1, self.CallID)
+
+	return nil
+}
+
+func (self *LeaseKeepAliveREQ) Unmarshal(buffer *proto.Buffer, fieldIndex uint64, wt proto.WireType) error {
+	switch fieldIndex {
+	case 0:
+		return proto.UnmarshalInt64(buffer, wt, &self.LeaseID)
+	case 1:
+		return proto.UnmarshalInt64(buffer, wt, &self.CallID)
+
+	}
+
+	return proto.ErrUnknownField
+}
+
+type LeaseKeepAliveACK struct {
+	Code   ResultCode
+	TTL    int64 // 有效期，毫秒
+	CallID int64 // 调用序号，ACK原样带回，用于匹配请求
+}
+
+func (self *LeaseKeepAliveACK) String() string { return proto.CompactTextString(self) }
+
+func (self *LeaseKeepAliveACK) Size() (ret int) {
+
+	ret += proto.SizeInt32(0, int32(self.Code))
+
+	ret += proto.SizeInt64(1, self.TTL)
+
+	ret += proto.SizeInt64(2, self.CallID)
+
+	return
+}
+
+func (self *LeaseKeepAliveACK) Marshal(buffer *proto.Buffer) error {
+
+	proto.MarshalInt32(buffer, 0, int32(self.Code))
+
+	proto.MarshalInt64(buffer, 1, self.TTL)
+
+	proto.MarshalInt64(buffer, 2, self.CallID)
+
+	return nil
+}
+
+func (self *LeaseKeepAliveACK) Unmarshal(buffer *proto.Buffer, fieldIndex uint64, wt proto.WireType) error {
+	switch fieldIndex {
+	case 0:
+		return proto.UnmarshalInt32(buffer, wt, (*int32)(&self.Code))
+	case 1:
+		return proto.UnmarshalInt64(buffer, wt, &self.TTL)
+	case 2:
+		return proto.UnmarshalInt64(buffer, wt, &self.CallID)
+
+	}
+
+	return proto.ErrUnknownField
+}
+
+type LeaseRevokeREQ struct {
+	LeaseID int64
+	CallID  int64 // 调用序号，ACK原样带回，用于匹配请求
+}
+
+func (self *LeaseRevokeREQ) String() string { return proto.CompactTextString(self) }
+
+func (self *LeaseRevokeREQ) Size() (ret int) {
+
+	ret += proto.SizeInt64(0, self.LeaseID)
+
+	ret += proto.SizeInt64(1, self.CallID)
+
+	return
+}
+
+func (self *LeaseRevokeREQ) Marshal(buffer *proto.Buffer) error {
+
+	proto.MarshalInt64(buffer, 0, self.LeaseID)
+
+	proto.MarshalInt64(buffer, 1, self.CallID)
+
+	return nil
+}
+
+func (self *LeaseRevokeREQ) Unmarshal(buffer *proto.Buffer, fieldIndex uint64, wt proto.WireType) error {
+	switch fieldIndex {
+	case 0:
+		return proto.UnmarshalInt64(buffer, wt, &self.LeaseID)
+	case 1:
+		return proto.UnmarshalInt64(buffer, wt, &self.CallID)
+
+	}
+
+	return proto.ErrUnknownField
+}
+
+type LeaseRevokeACK struct {
+	Code   ResultCode
+	CallID int64 // 调用序号，ACK原样带回，用于匹配请求
+}
+
+func (self *LeaseRevokeACK) String() string { return proto.CompactTextString(self) }
+
+func (self *LeaseRevokeACK) Size() (ret int) {
+
+	ret += proto.SizeInt32(0, int32(self.Code))
+
+	ret += proto.SizeInt64(1, self.CallID)
+
+	return
+}
+
+func (self *LeaseRevokeACK) Marshal(buffer *proto.Buffer) error {
+
+	proto.MarshalInt32(buffer, 0, int32(self.Code))
+
+	proto.MarshalInt64(buffer, 1, self.CallID)
+
+	return nil
+}
+
+func (self *LeaseRevokeACK) Unmarshal(buffer *proto.Buffer, fieldIndex uint64, wt proto.WireType) error {
+	switch fieldIndex {
+	case 0:
+		return proto.UnmarshalInt32(buffer, wt, (*int32)(&self.Code))
+	case 1:
+		return proto.UnmarshalInt64(buffer, wt, &self.CallID)
+
+	}
+
+	return proto.ErrUnknownField
+}
+
+// 批量操作中的一个操作
+type BatchOp struct {
+	Delete        bool // 为true时删除Key本身，不按前缀删除，否则设置Value
+	Key           string
+	Value         []byte
+	CheckRevision bool  // 为true时比较当前修订号，不一致时整个批量操作失败
+	Revision      int64 // 期望的修订号；通知中为修改后的修订号
+}
+
+func (self *BatchOp) String() string { return proto.CompactTextString(self) }
+
+func (self *BatchOp) Size() (ret int) {
+
+	ret += proto.SizeBool(0, self.Delete)
+
+	ret += proto.SizeString(1, self.Key)
+
+	ret += proto.SizeBytes(2, self.Value)
+
+	ret += proto.SizeBool(3, self.CheckRevision)
+
+	ret += proto.SizeInt64(4, self.Revision)
+
+	return
+}
+
+func (self *BatchOp) Marshal(buffer *proto.Buffer) error {
+
+	proto.MarshalBool(buffer, 0, self.Delete)
+
+	proto.MarshalString(buffer, 1, self.Key)
+
+	proto.MarshalBytes(buffer, 2, self.Value)
+
+	proto.MarshalBool(buffer, 3, self.CheckRevision)
+
+	proto.MarshalInt64(buffer, 4, self.Revision)
+
+	return nil
+}
+
+func (self *BatchOp) Unmarshal(buffer *proto.Buffer, fieldIndex uint64, wt proto.WireType) error {
+	switch fieldIndex {
+	case 0:
+		return proto.UnmarshalBool(buffer, wt, &self.Delete)
+	case 1:
+		return proto.UnmarshalString(buffer, wt, &self.Key)
+	case 2:
+		return proto.UnmarshalBytes(buffer, wt, &self.Value)
+	case 3:
+		return proto.UnmarshalBool(buffer, wt, &self.CheckRevision)
+	case 4:
+		return proto.UnmarshalInt64(buffer, wt, &self.Revision)
+
+	}
+
+	return proto.ErrUnknownField
+}
+
+type BatchREQ struct {
+	Ops    []BatchOp
+	CallID int64 // 调用序号，ACK原样带回，用于匹配请求
+}
+
+func (self *BatchREQ) String() string { return proto.CompactTextString(self) }
+
+func (self *BatchREQ) Size() (ret int) {
+
+	if len(self.Ops) > 0 {
+		for _, elm := range self.Ops {
+			ret += proto.SizeStruct(0, &elm)
+		}
+	}
+
+	ret += proto.SizeInt64(1, self.CallID)
+
+	return
+}
+
+func (self *BatchREQ) Marshal(buffer *proto.Buffer) error {
+
+	for _, elm := range self.Ops {
+		proto.MarshalStruct(buffer, 0, &elm)
+	}
+
+	proto.MarshalInt64(buffer, 1, self.CallID)
+
+	return nil
+}
+
+func (self *BatchREQ) Unmarshal(buffer *proto.Buffer, fieldIndex uint64, wt proto.WireType) error {
+	switch fieldIndex {
+	case 0:
+		var elm BatchOp
+		if err := proto.UnmarshalStruct(buffer, wt, &elm); err != nil {
+			return err
+		} else {
+			self.Ops = append(self.Ops, elm)
+			return nil
+		}
+	case 1:
+		return proto.UnmarshalInt64(buffer, wt, &self.CallID)
+
+	}
+
+	return proto.ErrUnknownField
+}
+
+type BatchACK struct {
+	Code     ResultCode
+	Revision int64 // 执行后的修订号
+	CallID   int64 // 调用序号，ACK原样带回，用于匹配请求
+}
+
+func (self *BatchACK) String() string { return proto.CompactTextString(self) }
+
+func (self *BatchACK) Size() (ret int) {
+
+	ret += proto.SizeInt32(0, int32(self.Code))
+
+	ret += proto.SizeInt64(1, self.Revision)
+
+	ret += proto.SizeInt64(2, self.CallID)
+
+	return
+}
+
+func (self *BatchACK) Marshal(buffer *proto.Buffer) error {
+
+	proto.MarshalInt32(buffer, 0, int32(self.Code))
+
+	proto.MarshalInt64(buffer, 1, self.Revision)
+
+	proto.MarshalInt64(buffer, 2, self.CallID)
+
+	return nil
+}
+
+func (self *BatchACK) Unmarshal(buffer *proto.Buffer, fieldIndex uint64, wt proto.WireType) error {
+	switch fieldIndex {
+	case 0:
+		return proto.UnmarshalInt32(buffer, wt, (*int32)(&self.Code))
+	case 1:
+		return proto.UnmarshalInt64(buffer, wt, &self.Revision)
+	case 2:
+		return proto.UnmarshalInt64(buffer, wt, &self.CallID)
+
+	}
+
+	return proto.ErrUnknownField
+}
+
+type ValueBatchNotifyACK struct {
+	Ops []BatchOp
+}
+
+func (self *ValueBatchNotifyACK) String() string { return proto.CompactTextString(self) }
+
+func (self *ValueBatchNotifyACK) Size() (ret int) {
+
+	if len(self.Ops) > 0 {
+		for _, elm := range self.Ops {
+			ret += proto.SizeStruct(0, &elm)
+		}
+	}
+
+	return
+}
+
+func (self *ValueBatchNotifyACK) Marshal(buffer *proto.Buffer) error {
+
+	for _, elm := range self.Ops {
+		proto.MarshalStruct(buffer, 0, &elm)
+	}
+
+	return nil
+}
+
+func (self *ValueBatchNotifyACK) Unmarshal(buffer *proto.Buffer, fieldIndex uint64, wt proto.WireType) error {
+	switch fieldIndex {
+	case 0:
+		var elm BatchOp
+		if err := proto.UnmarshalStruct(buffer, wt, &elm); err != nil {
+			return err
+		} else {
+			self.Ops = append(self.Ops, elm)
+			return nil
+		}
 
 	}
 
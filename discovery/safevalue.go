@@ -1,9 +1,14 @@
 package discovery
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/bobwong89757/cellnet/log"
 	"github.com/bobwong89757/cellnet/util"
 	"reflect"
+	"strconv"
+	"strings"
 )
 
 // PackedValueSize 定义KV存储中单个分片的最大大小
@@ -13,6 +18,9 @@ const (
 	PackedValueSize = 300 * 1024 // 单个分片的最大大小，单位：字节
 )
 
+// ErrChunkMismatch 分片数量与头部记录的不一致，值正在被不支持批量操作的服务发现写入或已损坏
+var ErrChunkMismatch = errors.New("safe value chunks mismatch")
+
 // rawGetter 是获取原始值的接口
 // 用于支持大值分片存储和读取的内部接口
 type rawGetter interface {
@@ -33,101 +41,235 @@ type rawGetter interface {
 	GetValueDirect(key string, valuePtr interface{}) error
 }
 
-// getMultiKey 获取大值分片存储的所有键名列表
-// 大值会被分割成多个分片，使用key, key.1, key.2...的格式存储
+// rawListGetter 是在一次加锁中读取本地缓存的接口，memsd、etcdsd、localsd实现了该接口
+// 批量修改在一次加锁中应用到缓存，一次读取所有分片不会看到只写了一部分的值
+type rawListGetter interface {
+	// GetRawValueList 获取指定前缀的所有配置值
+	GetRawValueList(prefix string) []ValueMeta
+}
+
+// chunkCountKey 返回记录分片数量的头部键名，头部与所有分片一起写入
+func chunkCountKey(key string) string {
+	return key + ".chunks"
+}
+
+// isChunkKey 是否为主键的分片或头部键名，排除前缀相同的其他键
+func isChunkKey(key, name string) bool {
+
+	if name == key || name == chunkCountKey(key) {
+		return true
+	}
+
+	if !strings.HasPrefix(name, key+".") {
+		return false
+	}
+
+	_, err := strconv.Atoi(name[len(key)+1:])
+	return err == nil
+}
+
+// loadChunkValues 读取主键、头部及所有分片的原始值
+// 服务发现实现了rawListGetter时从本地缓存一次读取，否则逐个读取直到分片不存在
 // 参数:
-//   - sd: 实现了rawGetter接口的对象
+//   - sd: 服务发现实例
 //   - key: 主键名
 // 返回:
-//   - ret: 所有分片键名的列表，包括主键和分片键
-func getMultiKey(sd rawGetter, key string) (ret []string) {
+//   - map[string][]byte: 键名对应的原始值，不存在的键不包含在内
+func loadChunkValues(sd Discovery, key string) map[string][]byte {
+
+	values := map[string][]byte{}
 
-	mainKey := key
+	if lg, ok := sd.(rawListGetter); ok {
 
-	ret = append(ret, mainKey)
+		for _, meta := range lg.GetRawValueList(key) {
+			if isChunkKey(key, meta.Key) {
+				values[meta.Key] = meta.Value
+			}
+		}
+
+		return values
+	}
+
+	var header string
+	if sd.GetValue(chunkCountKey(key), &header) == nil {
+		values[chunkCountKey(key)] = []byte(header)
+	}
+
+	for index := 0; ; index++ {
 
-	for i := 1; ; i++ {
+		var raw json.RawMessage
+		if sd.GetValue(chunkKey(key, index), &raw) != nil {
+			return values
+		}
+
+		values[chunkKey(key, index)] = raw
+	}
+}
 
-		key = fmt.Sprintf("%s.%d", mainKey, i)
+// chunkCount 按头部返回分片数量，没有头部时按连续存在的分片计算，兼容没有头部的旧数据
+func chunkCount(values map[string][]byte, key string) (int, error) {
+
+	header, ok := values[chunkCountKey(key)]
+	if !ok {
+
+		count := 0
+		for {
+			if _, ok := values[chunkKey(key, count)]; !ok {
+				return count, nil
+			}
 
-		_, err := sd.GetRawValue(key)
-		if err != nil && err.Error() == "value not exists" {
-			return
+			count++
 		}
+	}
 
-		ret = append(ret, key)
+	var count int
+	if err := BytesToAny(header, &count); err != nil || count < 1 {
+		return 0, ErrChunkMismatch
 	}
 
+	return count, nil
 }
 
-// SafeSetValue 安全地设置配置值，支持大值分片存储和压缩
-// 当值较大时，会自动分割成多个分片存储（key, key.1, key.2...）
-// 参数:
-//   - sd: 服务发现实例
-//   - key: 配置项的键名
-//   - value: 配置项的值，compress为true时必须是[]byte类型
-//   - compress: 是否启用压缩，启用后会对数据进行压缩后再存储
-// 返回:
-//   - error: 设置失败时返回错误信息
-func SafeSetValue(sd Discovery, key string, value interface{}, compress bool) error {
-	if compress {
-		cData, err := util.CompressBytes(value.([]byte))
-		if err != nil {
-			return err
+// splitChunks 按PackedValueSize分割数据
+func splitChunks(data []byte) (ret [][]byte) {
+
+	for len(data) > PackedValueSize {
+		ret = append(ret, data[:PackedValueSize])
+		data = data[PackedValueSize:]
+	}
+
+	return append(ret, data)
+}
+
+// chunkKey 返回第index个分片的键名，第0个分片使用主键
+func chunkKey(key string, index int) string {
+
+	if index == 0 {
+		return key
+	}
+
+	return fmt.Sprintf("%s.%d", key, index)
+}
+
+// batchSetChunks 在一次批量操作中写入所有分片，并删除之前多出的分片
+// 读取方不会看到只写了一部分的值，写入失败时也不会留下残余的分片
+func batchSetChunks(sd DiscoveryBatch, key string, data []byte) error {
+
+	chunks := splitChunks(data)
+
+	var ops []BatchOp
+	for index, chunk := range chunks {
+		ops = append(ops, BatchOp{
+			Key:   chunkKey(key, index),
+			Value: chunk,
+		})
+	}
+
+	ops = append(ops, BatchOp{
+		Key:   chunkCountKey(key),
+		Value: len(chunks),
+	})
+
+	for name := range loadChunkValues(sd, key) {
+
+		if name == chunkCountKey(key) {
+			continue
 		}
 
-		if len(cData) >= PackedValueSize {
+		if index := chunkIndex(key, name); index >= len(chunks) {
+			ops = append(ops, BatchOp{
+				Delete: true,
+				Key:    name,
+			})
+		}
+	}
 
-			for _, multiKey := range getMultiKey(sd.(rawGetter), key) {
+	_, err := sd.Batch(ops)
+	return err
+}
 
-				err := sd.DeleteValue(multiKey)
-				if err != nil {
-					fmt.Printf("delete kv error, %s\n", err)
-				}
-			}
+// chunkIndex 返回分片键名对应的序号，主键为0
+func chunkIndex(key, name string) int {
 
-			var pos = PackedValueSize
+	if name == key {
+		return 0
+	}
 
-			err = sd.SetValue(key, cData[:pos])
-			if err != nil {
-				return err
-			}
+	index, _ := strconv.Atoi(name[len(key)+1:])
+	return index
+}
 
-			index := 1
-			for len(cData)-pos > PackedValueSize {
+// setChunks 服务发现不支持批量操作时逐个写入分片
+// 先删除头部，写完所有分片后再写入头部，删除多出的旧分片
+func setChunks(sd Discovery, key string, data []byte) error {
 
-				multiKey := fmt.Sprintf("%s.%d", key, index)
-				err = sd.SetValue(multiKey, cData[pos:pos+PackedValueSize])
-				if err != nil {
-					return err
-				}
-				pos += PackedValueSize
-				index++
-			}
+	chunks := splitChunks(data)
 
-			if len(cData)-pos > 0 {
-				multiKey := fmt.Sprintf("%s.%d", key, index)
-				err = sd.SetValue(multiKey, cData[pos:])
-				if err != nil {
-					return err
-				}
-			}
+	oldValues := loadChunkValues(sd, key)
+
+	if _, ok := oldValues[chunkCountKey(key)]; ok {
+		if err := sd.DeleteValue(chunkCountKey(key)); err != nil {
+			return err
+		}
+	}
+
+	for index, chunk := range chunks {
+		if err := sd.SetValue(chunkKey(key, index), chunk); err != nil {
+			return err
+		}
+	}
+
+	if err := sd.SetValue(chunkCountKey(key), len(chunks)); err != nil {
+		return err
+	}
 
-			return nil
+	for name := range oldValues {
 
-		} else {
-			return sd.SetValue(key, cData)
+		if name == chunkCountKey(key) || chunkIndex(key, name) < len(chunks) {
+			continue
 		}
 
-	} else {
+		if err := sd.DeleteValue(name); err != nil {
+			log.GetLog().Warnf("delete chunk '%s' failed, %s", name, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// SafeSetValue 安全地设置配置值，支持大值分片存储和压缩
+// 当值较大时，会自动分割成多个分片存储（key, key.1, key.2...），头部key.chunks记录分片数量
+// 服务发现实现了DiscoveryBatch时，头部及所有分片在一次批量操作中原子写入
+// 参数:
+//   - sd: 服务发现实例
+//   - key: 配置项的键名
+//   - value: 配置项的值，compress为true时必须是[]byte类型
+//   - compress: 是否启用压缩，启用后会对数据进行压缩后再存储
+// 返回:
+//   - error: 设置失败时返回错误信息
+func SafeSetValue(sd Discovery, key string, value interface{}, compress bool) error {
+
+	if !compress {
 		return sd.SetValue(key, value)
 	}
+
+	cData, err := util.CompressBytes(value.([]byte))
+	if err != nil {
+		return err
+	}
+
+	if batch, ok := sd.(DiscoveryBatch); ok {
+		return batchSetChunks(batch, key, cData)
+	}
+
+	return setChunks(sd, key, cData)
 }
 
 // SafeGetValue 安全地获取配置值，支持大值分片读取和解压缩
 // 如果值被分片存储，会自动合并所有分片；如果被压缩，会自动解压
+// 头部及所有分片从同一份缓存中读取，分片数量与头部不一致时返回ErrChunkMismatch
 // 参数:
-//   - sd: 服务发现实例，必须实现rawGetter接口
+//   - sd: 服务发现实例
 //   - key: 配置项的键名
 //   - valuePtr: 指向目标变量的指针，用于接收配置值
 //   - decompress: 是否启用解压缩，如果存储时使用了压缩，这里必须为true
@@ -135,41 +277,54 @@ func SafeSetValue(sd Discovery, key string, value interface{}, compress bool) er
 //   - error: 获取失败时返回错误信息
 func SafeGetValue(sd Discovery, key string, valuePtr interface{}, decompress bool) error {
 
-	rg := sd.(rawGetter)
+	if !decompress {
 
-	var (
-		finalData []byte
-		err       error
-	)
+		if rg, ok := sd.(rawGetter); ok {
+			return rg.GetValueDirect(key, valuePtr)
+		}
 
-	if decompress {
+		return sd.GetValue(key, valuePtr)
+	}
 
+	values := loadChunkValues(sd, key)
+
+	// 主键不存在时返回服务发现自身的错误
+	if _, ok := values[key]; !ok {
 		var data []byte
-		for _, multiKey := range getMultiKey(rg, key) {
+		if err := sd.GetValue(key, &data); err != nil {
+			return err
+		}
 
-			var partData []byte
-			err := rg.GetValueDirect(multiKey, &partData)
-			if err != nil {
-				return err
-			}
+		return ErrChunkMismatch
+	}
 
-			data = append(data, partData...)
-		}
+	count, err := chunkCount(values, key)
+	if err != nil {
+		return err
+	}
 
-		finalData, err = util.DecompressBytes(data)
+	var data []byte
+	for index := 0; index < count; index++ {
 
-		if err != nil {
-			return err
+		raw, ok := values[chunkKey(key, index)]
+		if !ok {
+			return ErrChunkMismatch
 		}
 
-		reflect.ValueOf(valuePtr).Elem().Set(reflect.ValueOf(finalData))
-	} else {
-		err = rg.GetValueDirect(key, &finalData)
-
-		if err != nil {
+		var partData []byte
+		if err := BytesToAny(raw, &partData); err != nil {
 			return err
 		}
+
+		data = append(data, partData...)
 	}
 
+	finalData, err := util.DecompressBytes(data)
+	if err != nil {
+		return err
+	}
+
+	reflect.ValueOf(valuePtr).Elem().Set(reflect.ValueOf(finalData))
+
 	return nil
 }
@@ -1,8 +1,10 @@
-package discovery
+package discovery_test
 
 import (
-	memsd "github.com/bobwong89757/cellmesh/discovery/memsd/api"
-	"github.com/bobwong89757/cellmesh/service"
+	"bytes"
+	"crypto/rand"
+	"github.com/bobwong89757/cellmesh/discovery"
+	"github.com/bobwong89757/cellmesh/discovery/localsd"
 	"reflect"
 	"testing"
 )
@@ -15,18 +17,16 @@ func TestSafeGetValue(t *testing.T) {
 		origin = append(origin, byte(i))
 	}
 
-	sdConfig := memsd.DefaultConfig()
-	sdConfig.Address = service.GetDiscoveryAddr()
-	Default = memsd.NewDiscovery(sdConfig)
+	sd := localsd.NewDiscovery()
 
-	err := SafeSetValue(Default, "config/test", origin, true)
+	err := discovery.SafeSetValue(sd, "config/test", origin, true)
 	if err != nil {
 		t.Error(err)
 		t.FailNow()
 	}
 
 	var outData []byte
-	err = SafeGetValue(Default, "config/test", &outData, true)
+	err = discovery.SafeGetValue(sd, "config/test", &outData, true)
 	if err != nil {
 		t.Error(err)
 		t.FailNow()
@@ -36,3 +36,76 @@ func TestSafeGetValue(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+// plainDiscovery 只暴露Discovery接口，用于验证不支持批量操作及缓存读取时的退化处理
+type plainDiscovery struct {
+	discovery.Discovery
+}
+
+func TestSafeValueChunks(t *testing.T) {
+
+	// 随机数据无法压缩，会分成3个分片
+	large := make([]byte, discovery.PackedValueSize*2+100)
+	rand.Read(large)
+
+	local := localsd.NewDiscovery()
+
+	for _, sd := range []discovery.Discovery{local, &plainDiscovery{localsd.NewDiscovery()}} {
+
+		if err := discovery.SafeSetValue(sd, "config/big", large, true); err != nil {
+			t.Fatal(err)
+		}
+
+		var chunks int
+		if err := sd.GetValue("config/big.chunks", &chunks); err != nil || chunks != 3 {
+			t.Fatalf("expect header with 3 chunks, got %d, %v", chunks, err)
+		}
+
+		var out []byte
+		if err := discovery.SafeGetValue(sd, "config/big", &out, true); err != nil || !bytes.Equal(out, large) {
+			t.Fatalf("safe get large value failed, %v", err)
+		}
+
+		// 值变小后，多余的分片一起删除
+		small := []byte("small")
+		if err := discovery.SafeSetValue(sd, "config/big", small, true); err != nil {
+			t.Fatal(err)
+		}
+
+		var v []byte
+		if err := sd.GetValue("config/big.1", &v); err == nil {
+			t.Fatal("stale chunk should be deleted")
+		}
+
+		if err := discovery.SafeGetValue(sd, "config/big", &out, true); err != nil || !bytes.Equal(out, small) {
+			t.Fatalf("safe get small value failed, %v", err)
+		}
+	}
+
+	// 分片数量与头部不一致
+	if err := discovery.SafeSetValue(local, "config/broken", large, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := local.(discovery.DiscoveryBatch).Batch([]discovery.BatchOp{{Delete: true, Key: "config/broken.2"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var out []byte
+	if err := discovery.SafeGetValue(local, "config/broken", &out, true); err != discovery.ErrChunkMismatch {
+		t.Fatalf("expect chunk mismatch, got %v", err)
+	}
+
+	// 前缀相同的其他键不影响读取
+	if err := local.SetValue("config/big.extra", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := discovery.SafeGetValue(local, "config/big", &out, true); err != nil || string(out) != "small" {
+		t.Fatalf("safe get with unrelated key failed, %v", err)
+	}
+
+	if err := discovery.SafeGetValue(local, "config/none", &out, true); err == nil {
+		t.Fatal("expect error for missing value")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"reflect"
 	"strconv"
+	"strings"
 )
 
 // BytesToAny 将字节数组转换为指定的类型
@@ -120,3 +121,19 @@ func AnyToBytes(data interface{}, prettyPrint bool) ([]byte, error) {
 		}
 	}
 }
+
+// IsServiceKey 键是否为服务描述
+func IsServiceKey(rawkey string) bool {
+
+	return strings.HasPrefix(rawkey, ServiceKeyPrefix)
+}
+
+// GetSvcIDByServiceKey 从服务描述的键中取出服务ID，不是服务描述时返回空
+func GetSvcIDByServiceKey(rawkey string) string {
+
+	if IsServiceKey(rawkey) {
+		return rawkey[len(ServiceKeyPrefix):]
+	}
+
+	return ""
+}
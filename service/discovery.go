@@ -11,17 +11,20 @@ type DiscoveryOption struct {
 	Rules         []MatchRule // 匹配规则列表，用于过滤要连接的服务
 	MaxCount      int         // 最大连接数，0表示不限制，默认发起多条连接
 	MatchSvcGroup string      // 匹配的服务组，空字符串时匹配所有同类服务，否则只连接指定组的服务
+
+	// OnRemove 服务从服务发现中注销，对应连接被停止并移除后的回调，可选
+	OnRemove func(MultiPeer, *discovery.ServiceDesc)
 }
 
 // DiscoveryService 发现并连接到指定的服务
 // 服务可能拥有多个实例，每个实例都会创建一个连接
-// 函数会持续监听服务变化，自动处理服务的添加、更新和移除
+// 函数会持续监听服务变化，自动处理服务的添加、更新和移除，移除后按MaxCount连接其他实例
 // 参数:
 //   - tgtSvcName: 目标服务名称
 //   - opt: 发现选项配置
 //   - peerCreator: Peer创建函数，当发现新服务时会调用此函数创建连接
 // 返回:
-//   - cellnet.Peer: MultiPeer实例，可以通过IsReady()判断所有连接是否已准备好
+//   - cellnet.Peer: MultiPeer实例，可以通过IsReady()判断所有连接是否已准备好，Stop()停止发现及所有连接
 func DiscoveryService(tgtSvcName string, opt DiscoveryOption, peerCreator func(MultiPeer, *discovery.ServiceDesc)) cellnet.Peer {
 
 	// 从发现到连接有一个过程，需要用Map防止还没连上，又创建一个新的连接
@@ -29,53 +32,93 @@ func DiscoveryService(tgtSvcName string, opt DiscoveryOption, peerCreator func(M
 
 	go func() {
 
-		notify := discovery.Default.RegisterNotify("add")
+		events := discovery.Default.WatchService(tgtSvcName)
+		defer discovery.Default.UnwatchService(events)
+
+		connectService(tgtSvcName, opt, multiPeer, peerCreator)
+
 		for {
 
-			QueryService(tgtSvcName,
-				Filter_MatchRule(opt.Rules),
-				Filter_MatchSvcGroup(opt.MatchSvcGroup),
-				func(desc *discovery.ServiceDesc) interface{} {
+			select {
+			case ev := <-events:
 
-					//log.Info("found '%s' address '%s' ", tgtSvcName, desc.Address())
+				if ev.Kind == discovery.ServiceEventKind_Removed {
+					removeService(opt, multiPeer, ev.Desc)
+				}
 
-					prePeer := multiPeer.GetPeer(desc.ID)
+				// 移除后空出的MaxCount名额由其他实例补上
+				connectService(tgtSvcName, opt, multiPeer, peerCreator)
 
-					// 如果svcid重复汇报, 可能svcid内容有变化
-					if prePeer != nil {
+			case <-multiPeer.stopNotify:
+				return
+			}
+		}
 
-						var preDesc *discovery.ServiceDesc
-						if prePeer.(cellnet.ContextSet).FetchContext("sd", &preDesc) && !preDesc.Equals(desc) {
+	}()
 
-							log.GetLog().Infof("service '%s' change desc, %+v -> %+v...", desc.ID, preDesc, desc)
+	return multiPeer
+}
+
+// connectService 查询目标服务，为尚未连接或描述已变化的服务创建连接
+func connectService(tgtSvcName string, opt DiscoveryOption, multiPeer *multiPeer, peerCreator func(MultiPeer, *discovery.ServiceDesc)) {
+
+	QueryService(tgtSvcName,
+		Filter_MatchRule(opt.Rules),
+		Filter_MatchSvcGroup(opt.MatchSvcGroup),
+		func(desc *discovery.ServiceDesc) interface{} {
 
-							// 移除之前的连接
-							multiPeer.RemovePeer(desc.ID)
+			//log.Info("found '%s' address '%s' ", tgtSvcName, desc.Address())
 
-							// 停止重连
-							prePeer.Stop()
+			prePeer := multiPeer.GetPeer(desc.ID)
 
-						} else {
-							return true
-						}
+			// 如果svcid重复汇报, 可能svcid内容有变化
+			if prePeer != nil {
 
-					}
+				var preDesc *discovery.ServiceDesc
+				if prePeer.(cellnet.ContextSet).FetchContext("sd", &preDesc) && !preDesc.Equals(desc) {
 
-					// 达到最大连接
-					if opt.MaxCount > 0 && len(multiPeer.GetPeers()) >= opt.MaxCount {
-						return true
-					}
+					log.GetLog().Infof("service '%s' change desc, %+v -> %+v...", desc.ID, preDesc, desc)
 
-					// 用户创建peer
-					peerCreator(multiPeer, desc)
+					// 移除之前的连接
+					multiPeer.RemovePeer(desc.ID)
 
+					// 停止重连
+					prePeer.Stop()
+
+				} else {
 					return true
-				})
+				}
 
-			<-notify
-		}
+			}
 
-	}()
+			// 达到最大连接
+			if opt.MaxCount > 0 && len(multiPeer.GetPeers()) >= opt.MaxCount {
+				return true
+			}
 
-	return multiPeer
+			// 用户创建peer
+			peerCreator(multiPeer, desc)
+
+			return true
+		})
+}
+
+// removeService 服务注销时，停止并移除对应的连接
+func removeService(opt DiscoveryOption, multiPeer *multiPeer, desc *discovery.ServiceDesc) {
+
+	prePeer := multiPeer.GetPeer(desc.ID)
+	if prePeer == nil {
+		return
+	}
+
+	log.GetLog().Infof("service '%s' removed, stop connecting %s", desc.ID, desc.Address())
+
+	multiPeer.RemovePeer(desc.ID)
+
+	// 停止重连
+	prePeer.Stop()
+
+	if opt.OnRemove != nil {
+		opt.OnRemove(multiPeer, desc)
+	}
 }
@@ -0,0 +1,218 @@
+package service
+
+import (
+	"fmt"
+	"github.com/bobwong89757/cellmesh/discovery"
+	"github.com/bobwong89757/cellmesh/discovery/localsd"
+	"github.com/bobwong89757/cellnet"
+	"github.com/bobwong89757/cellnet/peer"
+	"github.com/bobwong89757/cellnet/proc"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// watchCountDiscovery 记录正在侦听的服务事件数量，用于检查侦听是否泄漏
+type watchCountDiscovery struct {
+	discovery.Discovery
+	watching int32
+}
+
+func (self *watchCountDiscovery) WatchService(name string) chan discovery.ServiceEvent {
+	atomic.AddInt32(&self.watching, 1)
+	return self.Discovery.WatchService(name)
+}
+
+func (self *watchCountDiscovery) UnwatchService(c chan discovery.ServiceEvent) {
+	self.Discovery.UnwatchService(c)
+	atomic.AddInt32(&self.watching, -1)
+}
+
+// testPeer 不建立连接的Peer，记录是否已停止
+type testPeer struct {
+	peer.CoreContextSet
+	stopped int32
+}
+
+func (self *testPeer) Start() cellnet.Peer { return self }
+func (self *testPeer) Stop()               { atomic.StoreInt32(&self.stopped, 1) }
+func (self *testPeer) TypeName() string    { return "test" }
+
+func waitCondition(t *testing.T, desc string, cond func() bool) {
+
+	deadline := time.Now().Add(time.Second * 3)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("wait %s timeout", desc)
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestDiscoveryService(t *testing.T) {
+
+	sd := &watchCountDiscovery{Discovery: localsd.NewDiscovery()}
+
+	preDefault := discovery.Default
+	discovery.Default = sd
+	defer func() {
+		discovery.Default = preDefault
+	}()
+
+	for _, id := range []string{"game#0@dev", "game#1@dev"} {
+		if err := sd.Register(&discovery.ServiceDesc{Name: "game", ID: id, Host: "127.0.0.1", Port: 1000}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var peerGuard sync.Mutex
+	peerByID := map[string]*testPeer{}
+	getPeer := func(id string) *testPeer {
+		peerGuard.Lock()
+		defer peerGuard.Unlock()
+		return peerByID[id]
+	}
+
+	var peerCount int32
+
+	removed := make(chan string, 1)
+
+	mp := DiscoveryService("game", DiscoveryOption{
+		Rules:    []MatchRule{{Target: "*"}},
+		MaxCount: 1,
+		OnRemove: func(_ MultiPeer, desc *discovery.ServiceDesc) {
+			removed <- desc.ID
+		},
+	}, func(mp MultiPeer, desc *discovery.ServiceDesc) {
+		p := &testPeer{}
+		peerGuard.Lock()
+		peerByID[desc.ID] = p
+		peerGuard.Unlock()
+		atomic.AddInt32(&peerCount, 1)
+		mp.AddPeer(desc, p)
+	}).(*multiPeer)
+
+	waitCondition(t, "first peer", func() bool {
+		return len(mp.GetPeers()) == 1
+	})
+
+	// 只连接一个实例
+	time.Sleep(time.Millisecond * 100)
+	if atomic.LoadInt32(&peerCount) != 1 {
+		t.Fatalf("expect 1 peer with MaxCount, got %d", peerCount)
+	}
+
+	firstID := getSvcIDByPeer(mp.GetPeers()[0])
+	first := getPeer(firstID)
+
+	// 注销已连接的实例，停止连接并回调OnRemove
+	if err := sd.Deregister(firstID); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case id := <-removed:
+		if id != firstID {
+			t.Fatalf("expect OnRemove '%s', got '%s'", firstID, id)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("wait OnRemove timeout")
+	}
+
+	if atomic.LoadInt32(&first.stopped) == 0 {
+		t.Fatal("removed peer should be stopped")
+	}
+
+	// 空出的名额由另一个实例补上
+	waitCondition(t, "refill peer", func() bool {
+		peers := mp.GetPeers()
+		return len(peers) == 1 && getSvcIDByPeer(peers[0]) != firstID
+	})
+
+	second := getPeer(getSvcIDByPeer(mp.GetPeers()[0]))
+
+	// Stop停止所有连接，发现协程退出并解除侦听
+	mp.Stop()
+
+	if atomic.LoadInt32(&second.stopped) == 0 {
+		t.Fatal("peer should be stopped by Stop")
+	}
+
+	select {
+	case <-mp.stopNotify:
+	default:
+		t.Fatal("stopNotify should be closed")
+	}
+
+	waitCondition(t, "unwatch", func() bool {
+		return atomic.LoadInt32(&sd.watching) == 0
+	})
+
+	// 重复调用不会再次关闭
+	mp.Stop()
+}
+
+func TestMultiPeerStop(t *testing.T) {
+
+	mp := newMultiPeer()
+
+	for _, id := range []string{"game#0", "game#1", "game#2"} {
+		mp.AddPeer(&discovery.ServiceDesc{Name: "game", ID: id}, &testPeer{})
+	}
+
+	// 返回的列表不受之后移除的影响
+	peers := mp.GetPeers()
+	mp.RemovePeer("game#1")
+
+	if len(peers) != 3 || getSvcIDByPeer(peers[1]) != "game#1" || getSvcIDByPeer(peers[2]) != "game#2" {
+		t.Fatalf("GetPeers result changed by RemovePeer")
+	}
+
+	mp.Stop()
+
+	// 停止后添加的Peer直接停止，不再管理
+	late := &testPeer{}
+	mp.AddPeer(&discovery.ServiceDesc{Name: "game", ID: "game#3"}, late)
+
+	if atomic.LoadInt32(&late.stopped) == 0 {
+		t.Fatal("peer added after Stop should be stopped")
+	}
+
+	if len(mp.GetPeers()) != 0 {
+		t.Fatal("peer added after Stop should not be kept")
+	}
+
+	// AddPeer之后才Start的Peer，连接建立时断开，不上报身份
+	identified := make(chan string, 1)
+
+	queue := cellnet.NewEventQueue()
+	queue.StartLoop()
+	defer queue.StopLoop()
+
+	acceptor := peer.NewGenericPeer("tcp.Acceptor", "game", "127.0.0.1:0", queue)
+	proc.BindProcessorHandler(acceptor, "tcp.svc", func(ev cellnet.Event) {
+		if msg, ok := ev.Message().(*ServiceIdentifyACK); ok {
+			identified <- msg.SvcName
+		}
+	})
+	acceptor.Start()
+	defer acceptor.Stop()
+
+	connector := peer.NewGenericPeer("tcp.Connector", "game", fmt.Sprintf("127.0.0.1:%d", acceptor.(cellnet.TCPAcceptor).Port()), queue)
+	proc.BindProcessorHandler(connector, "tcp.svc", func(ev cellnet.Event) {})
+	mp.AddPeer(&discovery.ServiceDesc{Name: "game", ID: "game#4"}, connector)
+	connector.Start()
+	defer connector.Stop()
+
+	select {
+	case <-identified:
+		t.Fatal("peer started after Stop should not identify")
+	case <-time.After(time.Millisecond * 300):
+	}
+
+	waitCondition(t, "connector stop", func() bool {
+		return !connector.(interface{ IsRunning() bool }).IsRunning()
+	})
+}
@@ -1,7 +1,15 @@
 package service
 
+import (
+	"github.com/bobwong89757/cellmesh/util"
+	"strconv"
+)
+
 var (
-	flagDiscoveryAddr string // 服务发现服务器地址
+	flagDiscoveryAddr string // 服务发现服务器地址，多个地址使用逗号分隔
+	flagSDClientID    string // 连接服务发现使用的客户端身份
+	flagSDSecret      string // 连接服务发现使用的客户端密钥
+	flagSDNamespace   string // 服务发现的命名空间
 	flagLinkRule      string // 服务互联规则
 	flagSvcGroup      string // 服务分组
 	flagSvcIndex      string // 服务索引
@@ -12,11 +20,22 @@ var (
 // InitServerConfig 初始化服务器配置
 // 从配置映射中读取并设置各种服务参数
 // 参数:
-//   - serviceConf: 配置映射，键名包括: sdaddr, linkrule, svcgroup, svcindex, wanip, commtype
+//   - serviceConf: 配置映射，键名包括: sdaddr, sdclientid, sdsecret, sdnamespace, tlscert, tlskey, tlsca, tlsclientauth, tlsservername, linkrule, svcgroup, svcindex, wanip, commtype
+//     sdaddr可以使用逗号分隔多个地址，断开时按顺序切换到下一个服务器
+//     sdaddr可以带有scheme选择服务发现后端，例如etcd://127.0.0.1:2379，需要导入对应的后端包
+//     svcindex为auto时，连接服务发现后自动分配同名同组服务中最小的空闲索引
+//     配置了tlscert或tlsca时，服务互联及连接服务发现使用TLS，证书加载失败时panic
 func InitServerConfig(serviceConf map[string]string) {
 	// 服务发现地址
 	flagDiscoveryAddr = serviceConf["sdaddr"]
 
+	// 服务发现认证
+	flagSDClientID = serviceConf["sdclientid"]
+	flagSDSecret = serviceConf["sdsecret"]
+
+	// 服务发现命名空间，不同环境可共用一个服务发现服务器
+	flagSDNamespace = serviceConf["sdnamespace"]
+
 	// 服务发现规则
 	flagLinkRule = serviceConf["linkrule"]
 
@@ -31,4 +50,31 @@ func InitServerConfig(serviceConf map[string]string) {
 
 	// 通讯类型
 	flagCommType = serviceConf["commtype"]
+
+	// TLS证书，不能在加载失败时退回到明文
+	if serviceConf["tlscert"] != "" || serviceConf["tlsca"] != "" {
+
+		// 设置了CA时默认要求客户端证书，tlsclientauth=false时只校验服务器证书
+		clientAuth := serviceConf["tlsca"] != ""
+		if value := serviceConf["tlsclientauth"]; value != "" {
+
+			var err error
+			if clientAuth, err = strconv.ParseBool(value); err != nil {
+				panic(err)
+			}
+		}
+
+		config, err := meshutil.LoadTLSConfigOption(meshutil.TLSOption{
+			CertFile:   serviceConf["tlscert"],
+			KeyFile:    serviceConf["tlskey"],
+			CAFile:     serviceConf["tlsca"],
+			ServerName: serviceConf["tlsservername"],
+			ClientAuth: clientAuth,
+		})
+		if err != nil {
+			panic(err)
+		}
+
+		SetTLSConfig(config)
+	}
 }
\ No newline at end of file
@@ -2,6 +2,7 @@ package service
 
 import (
 	"github.com/bobwong89757/cellmesh/discovery"
+	"github.com/bobwong89757/cellmesh/util"
 	"github.com/bobwong89757/cellnet"
 	"github.com/bobwong89757/cellnet/log"
 	_ "github.com/bobwong89757/cellnet/peer/tcp"
@@ -28,6 +29,13 @@ func (SvcEventHooker) OnInboundEvent(inputEvent cellnet.Event) (outputEvent cell
 
 		ctx := inputEvent.Session().Peer().(cellnet.ContextSet)
 
+		// 所属的MultiPeer已经停止，AddPeer之后才Start的Peer不再保持连接
+		var mp *multiPeer
+		if ctx.FetchContext("multipeer", &mp) && mp.isStopped() {
+			go inputEvent.Session().Peer().Stop()
+			return nil
+		}
+
 		var sd *discovery.ServiceDesc
 		if ctx.FetchContext("sd", &sd) {
 
@@ -62,7 +70,10 @@ func init() {
 	// 服务器间通讯协议
 	proc.RegisterProcessor("tcp.svc", func(bundle proc.ProcessorBundle, userCallback cellnet.EventCallback, args ...interface{}) {
 
-		bundle.SetTransmitter(new(tcp.TCPMessageTransmitter))
+		// 配置了TLS时，服务间连接使用TLS
+		meshutil.SetPeerTLS(bundle.(cellnet.Peer), tlsConfig)
+
+		bundle.SetTransmitter(new(svcMessageTransmitter))
 		bundle.SetHooker(proc.NewMultiHooker(new(SvcEventHooker), new(tcp.MsgHooker)))
 		bundle.SetCallback(proc.NewQueuedEventCallback(userCallback))
 	})
@@ -1,13 +1,13 @@
 package service
 
 import (
+	"context"
 	"github.com/bobwong89757/cellmesh/discovery"
-	"github.com/bobwong89757/cellmesh/discovery/memsd/api"
+	_ "github.com/bobwong89757/cellmesh/discovery/memsd/api"
+	"github.com/bobwong89757/cellmesh/util"
 	"github.com/bobwong89757/cellnet/log"
 	"github.com/bobwong89757/cellnet/util"
 	"os"
-	"os/signal"
-	"syscall"
 )
 
 // Init 初始化服务框架
@@ -50,19 +50,48 @@ func LogParameter() {
 // ConnectDiscovery 连接到服务发现服务器
 // 建议在service.Init()之后、服务器逻辑开始之前调用
 // 函数会阻塞直到连接建立并完成初始化
-func ConnectDiscovery() {
+// 返回:
+//   - error: 认证失败或svcindex为auto而申请索引失败时返回错误信息
+func ConnectDiscovery() error {
+	return ConnectDiscoveryContext(context.Background())
+}
+
+// ConnectDiscoveryContext 连接到服务发现服务器，可通过ctx取消或设置截止时间
+// 按sdaddr中的scheme选择后端，例如"etcd://127.0.0.1:2379"，没有scheme时使用memsd
+// 连接成功后设置discovery.Default，ctx结束前未能连接时返回错误，discovery.Default保持不变
+// svcindex配置为auto时，连接后申请服务索引
+// 参数:
+//   - ctx: 控制连接的取消及截止时间
+// 返回:
+//   - error: 取消或超时时返回错误信息
+func ConnectDiscoveryContext(ctx context.Context) error {
 	log.GetLog().Debugf("Connecting to discovery '%s' ...", flagDiscoveryAddr)
-	sdConfig := memsd.DefaultConfig()
-	sdConfig.Address = flagDiscoveryAddr
-	discovery.Default = memsd.NewDiscovery(sdConfig)
+	sd, err := discovery.NewBackend(ctx, flagDiscoveryAddr, discovery.BackendConfig{
+		ClientID:  flagSDClientID,
+		Secret:    flagSDSecret,
+		Namespace: flagSDNamespace,
+		TLS:       tlsConfig,
+	})
+	if err != nil {
+		log.GetLog().Errorf("connect to discovery '%s' failed, %s", flagDiscoveryAddr, err.Error())
+		return err
+	}
+
+	discovery.Default = sd
+
+	if IsAutoSvcIndex() {
+		if err = allocSvcIndex(); err != nil {
+			log.GetLog().Errorf("alloc svcindex failed, %s", err.Error())
+			return err
+		}
+	}
+
+	return nil
 }
 
 // WaitExitSignal 等待退出信号
 // 阻塞当前goroutine，直到收到SIGTERM、SIGINT或SIGQUIT信号
 // 通常用于主函数中等待程序退出
 func WaitExitSignal() {
-	ch := make(chan os.Signal, 1)
-	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
-
-	<-ch
+	meshutil.WaitExitSignal()
 }
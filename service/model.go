@@ -30,15 +30,20 @@ func GetSvcGroup() string {
 
 // GetSvcIndex 获取服务索引
 // 服务索引用于标识同类服务的不同进程实例，同类服务中的索引必须唯一
+// 配置为auto时，连接服务发现后返回自动分配的索引，断线期间索引被占用时返回新的索引
 // 返回:
 //   - string: 服务索引
 func GetSvcIndex() string {
+
+	svcIndexGuard.RLock()
+	defer svcIndexGuard.RUnlock()
+
 	return flagSvcIndex
 }
 
 // GetDiscoveryAddr 获取服务发现服务器的地址
 // 返回:
-//   - string: 服务发现服务器地址，格式为"host:port"
+//   - string: 服务发现服务器地址，格式为"host:port"，多个地址使用逗号分隔
 func GetDiscoveryAddr() string {
 	return flagDiscoveryAddr
 }
@@ -31,27 +31,54 @@ type MultiPeer interface {
 type multiPeer struct {
 	peer.CoreContextSet // 提供上下文管理功能
 	peers      []cellnet.Peer // 管理的Peer列表
-	peersGuard sync.RWMutex   // 保护peers列表的读写锁
+	peersGuard sync.RWMutex   // 保护peers列表及stopped的读写锁
+	stopped    bool           // 已停止，之后添加的Peer直接停止
 	context    interface{}     // 上下文数据
+
+	stopNotify chan struct{} // 停止时关闭，通知服务发现协程退出
+	stopOnce   sync.Once     // 保证只停止一次
 }
 
 func (self *multiPeer) Start() cellnet.Peer {
 	return self
 }
 
+// Stop 停止服务发现，并停止所有管理的Peer
 func (self *multiPeer) Stop() {
 
+	self.stopOnce.Do(func() {
+		close(self.stopNotify)
+	})
+
+	self.peersGuard.Lock()
+	peers := self.peers
+	self.peers = nil
+	self.stopped = true
+	self.peersGuard.Unlock()
+
+	for _, p := range peers {
+		p.Stop()
+	}
 }
 
 func (self *multiPeer) TypeName() string {
 	return ""
 }
 
+// GetPeers 返回Peer列表的副本，RemovePeer不会影响已返回的列表
 func (self *multiPeer) GetPeers() []cellnet.Peer {
 	self.peersGuard.RLock()
 	defer self.peersGuard.RUnlock()
 
-	return self.peers
+	return append([]cellnet.Peer(nil), self.peers...)
+}
+
+// isStopped 是否已经调用Stop
+func (self *multiPeer) isStopped() bool {
+	self.peersGuard.RLock()
+	defer self.peersGuard.RUnlock()
+
+	return self.stopped
 }
 
 func (self *multiPeer) IsReady() bool {
@@ -73,6 +100,7 @@ func (self *multiPeer) IsReady() bool {
 
 // AddPeer 添加一个Peer到管理列表中
 // 注意: 必须在Peer.Start()之前调用，否则连接建立时可能因为缺少服务描述信息而导致服务信息无法正确上报
+// 已经Stop时不再添加并停止Peer，之后才Start的Peer在连接建立时断开
 // 参数:
 //   - sd: 服务描述信息，会被设置到Peer的上下文中
 //   - p: 要添加的Peer实例
@@ -80,8 +108,16 @@ func (self *multiPeer) AddPeer(sd *discovery.ServiceDesc, p cellnet.Peer) {
 
 	contextSet := p.(cellnet.ContextSet)
 	contextSet.SetContext("sd", sd)
+	contextSet.SetContext("multipeer", self)
 
 	self.peersGuard.Lock()
+
+	if self.stopped {
+		self.peersGuard.Unlock()
+		p.Stop()
+		return
+	}
+
 	self.peers = append(self.peers, p)
 	self.peersGuard.Unlock()
 }
@@ -92,6 +128,9 @@ func (self *multiPeer) AddPeer(sd *discovery.ServiceDesc, p cellnet.Peer) {
 // 返回:
 //   - cellnet.Peer: 找到的Peer实例，如果不存在则返回nil
 func (self *multiPeer) GetPeer(svcid string) cellnet.Peer {
+	self.peersGuard.RLock()
+	defer self.peersGuard.RUnlock()
+
 	for _, p := range self.peers {
 
 		if getSvcIDByPeer(p) == svcid {
@@ -136,5 +175,7 @@ func getSvcIDByPeer(p cellnet.Peer) string {
 // 返回:
 //   - *multiPeer: MultiPeer实例
 func newMultiPeer() *multiPeer {
-	return &multiPeer{}
+	return &multiPeer{
+		stopNotify: make(chan struct{}),
+	}
 }
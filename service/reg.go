@@ -58,6 +58,12 @@ func Register(p cellnet.Peer, options ...interface{}) *discovery.ServiceDesc {
 
 	p.(cellnet.ContextSet).SetContext("sd", sd)
 
+	// 自动分配的索引按服务名持有，已被其他进程的同名服务持有时不注册，避免覆盖对方的服务
+	if err := holdSvcIndex(sd.Name); err != nil {
+		log.GetLog().Errorf("service register failed, %s %s", sd.String(), err.Error())
+		return sd
+	}
+
 	// 有同名的要先解除注册，再注册，防止watch不触发
 	discovery.Default.Deregister(sd.ID)
 	err := discovery.Default.Register(sd)
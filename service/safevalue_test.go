@@ -2,12 +2,13 @@ package service
 
 import (
 	"github.com/bobwong89757/cellmesh/discovery"
-	memsd "github.com/bobwong89757/cellmesh/discovery/memsd/api"
+	"github.com/bobwong89757/cellmesh/discovery/localsd"
 	"reflect"
 	"testing"
 )
 
 func TestSafeGetValue(t *testing.T) {
+	t.Parallel()
 
 	var origin []byte
 	for i := 0; i < 12; i++ {
@@ -15,18 +16,16 @@ func TestSafeGetValue(t *testing.T) {
 		origin = append(origin, byte(i))
 	}
 
-	sdConfig := memsd.DefaultConfig()
-	sdConfig.Address = GetDiscoveryAddr()
-	discovery.Default = memsd.NewDiscovery(sdConfig)
+	sd := localsd.NewDiscovery()
 
-	err := discovery.SafeSetValue(discovery.Default, "config/test", origin, true)
+	err := discovery.SafeSetValue(sd, "config/test", origin, true)
 	if err != nil {
 		t.Error(err)
 		t.FailNow()
 	}
 
 	var outData []byte
-	err = discovery.SafeGetValue(discovery.Default, "config/test", &outData, true)
+	err = discovery.SafeGetValue(sd, "config/test", &outData, true)
 	if err != nil {
 		t.Error(err)
 		t.FailNow()
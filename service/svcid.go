@@ -28,7 +28,7 @@ func MakeSvcID(svcName string, svcIndex int, svcGroup string) string {
 // 返回:
 //   - string: 格式化的服务ID
 func MakeLocalSvcID(svcName string) string {
-	index,_ := strconv.Atoi(flagSvcIndex)
+	index,_ := strconv.Atoi(GetSvcIndex())
 	return MakeSvcID(svcName,index, flagSvcGroup)
 }
 
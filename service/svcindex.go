@@ -0,0 +1,241 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"github.com/bobwong89757/cellmesh/discovery"
+	"github.com/bobwong89757/cellmesh/discovery/election"
+	"github.com/bobwong89757/cellnet/log"
+	"strconv"
+	"sync"
+)
+
+// svcindex配置为auto时，连接服务发现后申请同名同组服务中最小的空闲索引
+// 索引按服务名通过election锁持有，服务ID由服务名及索引组成，进程名不同的进程注册同名服务时也不会冲突
+// 会话断开时由服务发现释放，重连后重新申请同一个索引
+// 断线期间索引被其他进程获取时，申请新的索引，本实例的服务以新的ID重新注册
+
+const (
+	SvcIndexAuto = "auto" // 自动分配服务索引的配置值
+)
+
+var (
+	svcIndexGuard    sync.RWMutex       // 保护自动分配时修改的flagSvcIndex及svcIndexElection
+	svcIndexElection *election.Election // 自动分配索引时持有索引锁的选举实例
+
+	// MaxAutoSvcIndex 自动分配时尝试的索引上限
+	MaxAutoSvcIndex = 1000
+
+	ErrNoFreeSvcIndex          = errors.New("no free svcindex")
+	ErrAutoSvcIndexUnsupported = errors.New("discovery does not support auto svcindex")
+)
+
+// IsAutoSvcIndex 是否配置为自动分配服务索引
+func IsAutoSvcIndex() bool {
+	return GetSvcIndex() == SvcIndexAuto
+}
+
+// setSvcIndex 设置自动分配的服务索引
+func setSvcIndex(index int) {
+
+	svcIndexGuard.Lock()
+	flagSvcIndex = strconv.Itoa(index)
+	svcIndexGuard.Unlock()
+}
+
+// svcIndexLockName 服务名的索引对应的锁名称
+func svcIndexLockName(svcName string, index int) string {
+	return fmt.Sprintf("svcindex/%s@%s/%d", svcName, GetSvcGroup(), index)
+}
+
+// svcIndexNames 需要持有索引的服务名，包括进程名(GetLocalSvcID使用)及列表中的服务名
+func svcIndexNames(list []*discovery.ServiceDesc) []string {
+
+	names := []string{GetProcName()}
+	for _, desc := range list {
+
+		found := false
+		for _, name := range names {
+			if name == desc.Name {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			names = append(names, desc.Name)
+		}
+	}
+
+	return names
+}
+
+// tryLockSvcIndex 为所有服务名获取同一个索引的锁，任意一个被占用时释放已获取的锁
+// 返回:
+//   - bool: 是否全部获取
+//   - error: 请求失败时返回错误
+func tryLockSvcIndex(e *election.Election, names []string, index int) (bool, error) {
+
+	for i, name := range names {
+
+		locked, err := e.TryLock(svcIndexLockName(name, index))
+		if err != nil || !locked {
+
+			for _, acquired := range names[:i] {
+				e.Unlock(svcIndexLockName(acquired, index))
+			}
+
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// allocSvcIndex 从服务发现申请最小的空闲服务索引，成功后GetSvcIndex返回申请到的索引
+// 需要在Init及连接服务发现之后、Register之前调用
+// 返回:
+//   - error: 服务发现不支持或没有空闲索引时返回错误
+func allocSvcIndex() error {
+
+	client, ok := discovery.Default.(election.Client)
+	if !ok {
+		return ErrAutoSvcIndexUnsupported
+	}
+
+	e := election.New(client, "")
+
+	index, err := lockFreeSvcIndex(e, svcIndexNames(nil))
+	if err != nil {
+		return err
+	}
+
+	setSvcIndex(index)
+	log.GetLog().Infof("Auto SvcIndex: %d", index)
+
+	svcIndexGuard.Lock()
+	svcIndexElection = e
+	svcIndexGuard.Unlock()
+
+	// 断线后在重新注册服务之前确认索引仍由本进程持有
+	if sd, ok := discovery.Default.(discovery.DiscoveryReregister); ok {
+		sd.SetReregisterHook(func(list []*discovery.ServiceDesc) []*discovery.ServiceDesc {
+			return reclaimSvcIndex(e, list)
+		})
+	}
+
+	return nil
+}
+
+// lockFreeSvcIndex 获取所有服务名都空闲的最小索引的锁
+// 参数:
+//   - e: 选举实例
+//   - names: 需要持有索引的服务名
+// 返回:
+//   - int: 获取到的索引
+//   - error: 请求失败或没有空闲索引时返回错误
+func lockFreeSvcIndex(e *election.Election, names []string) (int, error) {
+
+	for index := 0; index < MaxAutoSvcIndex; index++ {
+
+		locked, err := tryLockSvcIndex(e, names, index)
+		if err != nil {
+			return 0, err
+		}
+
+		if locked {
+			return index, nil
+		}
+	}
+
+	return 0, ErrNoFreeSvcIndex
+}
+
+// reclaimSvcIndex 重连后重新申请原来的索引，索引在断线期间被其他进程获取时申请新的索引
+// 由服务发现在重新注册本实例的服务之前调用，使用原索引的服务改为新索引的ID重新注册
+// 参数:
+//   - e: 持有索引锁的选举实例
+//   - list: 断线前注册的服务
+// 返回:
+//   - []*discovery.ServiceDesc: 要重新注册的服务，没有可用索引时返回nil，不再注册
+func reclaimSvcIndex(e *election.Election, list []*discovery.ServiceDesc) []*discovery.ServiceDesc {
+
+	oldIndex, _ := strconv.Atoi(GetSvcIndex())
+	names := svcIndexNames(list)
+
+	locked, err := tryLockSvcIndex(e, names, oldIndex)
+	if err != nil {
+		// 无法确认索引的归属，按原索引注册，已被占用时服务发现拒绝覆盖他人的服务
+		log.GetLog().Errorf("reclaim svcindex %d failed, %s", oldIndex, err.Error())
+		return list
+	}
+
+	if locked {
+		return list
+	}
+
+	for _, name := range names {
+		if owner, err := e.Owner(svcIndexLockName(name, oldIndex)); err == nil && owner != e.OwnerID() {
+			log.GetLog().Errorf("svcindex '%s' taken by '%s' while disconnected", svcIndexLockName(name, oldIndex), owner)
+		}
+	}
+
+	index, err := lockFreeSvcIndex(e, names)
+	if err != nil {
+		log.GetLog().Errorf("alloc new svcindex failed, services not reregistered, %s", err.Error())
+		return nil
+	}
+
+	setSvcIndex(index)
+	log.GetLog().Infof("Auto SvcIndex changed: %d -> %d", oldIndex, index)
+
+	ret := make([]*discovery.ServiceDesc, 0, len(list))
+	for _, desc := range list {
+
+		if desc.ID != MakeSvcID(desc.Name, oldIndex, GetSvcGroup()) {
+			ret = append(ret, desc)
+			continue
+		}
+
+		newDesc := *desc
+		newDesc.Meta = make(map[string]string, len(desc.Meta))
+		for k, v := range desc.Meta {
+			newDesc.Meta[k] = v
+		}
+
+		newDesc.ID = MakeLocalSvcID(desc.Name)
+		newDesc.SetMeta("SvcIndex", GetSvcIndex())
+		ret = append(ret, &newDesc)
+	}
+
+	return ret
+}
+
+// holdSvcIndex 自动分配索引时，为注册的服务名获取当前索引的锁，由Register调用
+// 参数:
+//   - svcName: 要注册的服务名
+// 返回:
+//   - error: 索引已被其他进程的同名服务持有或请求失败时返回错误
+func holdSvcIndex(svcName string) error {
+
+	svcIndexGuard.RLock()
+	e := svcIndexElection
+	svcIndexGuard.RUnlock()
+
+	if e == nil {
+		return nil
+	}
+
+	index, _ := strconv.Atoi(GetSvcIndex())
+
+	locked, err := e.TryLock(svcIndexLockName(svcName, index))
+	if err != nil {
+		return err
+	}
+
+	if !locked {
+		return fmt.Errorf("svcindex %d of service '%s' held by other process", index, svcName)
+	}
+
+	return nil
+}
@@ -0,0 +1,120 @@
+package service_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/bobwong89757/cellmesh/discovery"
+	"github.com/bobwong89757/cellmesh/discovery/election"
+	memsd "github.com/bobwong89757/cellmesh/discovery/memsd/api"
+	"github.com/bobwong89757/cellmesh/discovery/memsd/deps"
+	"github.com/bobwong89757/cellmesh/service"
+	"github.com/bobwong89757/cellnet"
+	"testing"
+	"time"
+)
+
+func TestAutoSvcIndex(t *testing.T) {
+
+	p := deps.ListenSvc("127.0.0.1:0")
+	addr := fmt.Sprintf("127.0.0.1:%d", p.(cellnet.TCPAcceptor).Port())
+
+	// 其他进程已占用索引0
+	config := memsd.DefaultConfig()
+	config.Address = addr
+	other := election.New(memsd.NewDiscovery(config).(election.Client), "other")
+	if ok, err := other.TryLock("svcindex/game@dev/0"); !ok || err != nil {
+		t.Fatalf("occupy index failed, %v", err)
+	}
+
+	service.InitServerConfig(map[string]string{
+		"sdaddr":   addr,
+		"svcgroup": "dev",
+		"svcindex": "auto",
+	})
+	service.Init("game")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	if err := service.ConnectDiscoveryContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if service.GetSvcIndex() != "1" {
+		t.Fatalf("expect svcindex 1, got '%s'", service.GetSvcIndex())
+	}
+
+	if id := service.GetLocalSvcID(); id != "game#1@dev" {
+		t.Fatalf("unexpected svcid '%s'", id)
+	}
+
+	// 索引由本进程持有，其他进程不能再获取
+	if ok, _ := other.TryLock("svcindex/game@dev/1"); ok {
+		t.Fatal("allocated index should be held")
+	}
+
+	sd := discovery.Default
+	if err := sd.Register(&discovery.ServiceDesc{
+		Name: "game",
+		ID:   service.GetLocalSvcID(),
+		Host: "127.0.0.1",
+		Port: 1000,
+		Meta: map[string]string{"SvcGroup": "dev", "SvcIndex": "1"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 同一进程注册的其他服务名按服务名持有同一个索引
+	if err := sd.Register(&discovery.ServiceDesc{
+		Name: "login",
+		ID:   service.MakeLocalSvcID("login"),
+		Host: "127.0.0.1",
+		Port: 1001,
+		Meta: map[string]string{"SvcGroup": "dev", "SvcIndex": "1"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 模拟断线期间login的索引被其他进程获取，客户端按默认的重连间隔重连
+	if err := sd.DeleteValue(election.KeyPrefix + "svcindex/login@dev/1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := other.TryLock("svcindex/login@dev/1"); !ok || err != nil {
+		t.Fatalf("take index failed, %v", err)
+	}
+
+	reregister := sd.RegisterNotify("reregister")
+	defer sd.DeregisterNotify("reregister", reregister)
+
+	sd.(interface{ Session() cellnet.Session }).Session().Close()
+
+	select {
+	case <-reregister:
+	case <-time.After(time.Second * 15):
+		t.Fatal("wait reregister timeout")
+	}
+
+	// 重新注册之前已申请到新的索引，服务以新的ID注册
+	if service.GetSvcIndex() != "2" {
+		t.Fatalf("expect svcindex 2 after reclaim, got '%s'", service.GetSvcIndex())
+	}
+
+	var desc discovery.ServiceDesc
+	if err := sd.(interface {
+		GetValueDirect(key string, valuePtr interface{}) error
+	}).GetValueDirect(discovery.ServiceKeyPrefix+"game#2@dev", &desc); err != nil {
+		t.Fatalf("expect service reregistered with new index, %v", err)
+	}
+
+	if desc.GetMeta("SvcIndex") != "2" {
+		t.Fatalf("expect meta SvcIndex 2, got '%s'", desc.GetMeta("SvcIndex"))
+	}
+
+	// 新索引对所有服务名都由本进程持有
+	for _, name := range []string{"svcindex/game@dev/2", "svcindex/login@dev/2"} {
+		if ok, _ := other.TryLock(name); ok {
+			t.Fatalf("index lock '%s' should be held", name)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package service
+
+import (
+	"crypto/tls"
+	"github.com/bobwong89757/cellmesh/util"
+	"github.com/bobwong89757/cellnet"
+	"github.com/bobwong89757/cellnet/util"
+	"net"
+)
+
+var (
+	tlsConfig *tls.Config // 服务互联及连接服务发现使用的TLS配置，nil时不开启
+)
+
+// GetTLSConfig 获取服务使用的TLS配置
+// 返回:
+//   - *tls.Config: 配置了tlscert或tlsca时返回TLS配置，否则返回nil
+func GetTLSConfig() *tls.Config {
+	return tlsConfig
+}
+
+// SetTLSConfig 设置服务使用的TLS配置，需要在创建Peer之前调用
+// 参数:
+//   - config: TLS配置，为nil时关闭TLS
+func SetTLSConfig(config *tls.Config) {
+	tlsConfig = config
+}
+
+type socketOpt interface {
+	MaxPacketSize() int
+	ApplySocketReadTimeout(conn net.Conn, callback func())
+	ApplySocketWriteTimeout(conn net.Conn, callback func())
+}
+
+// svcMessageTransmitter 是服务互联使用的传输器
+// 与tcp.TCPMessageTransmitter相同，Peer开启TLS时通过TLS连接收发
+type svcMessageTransmitter struct {
+}
+
+func (svcMessageTransmitter) OnRecvMessage(ses cellnet.Session) (msg interface{}, err error) {
+
+	conn := meshutil.SessionConn(ses)
+
+	// 转换错误，或者连接已经关闭时退出
+	if conn == nil {
+		return nil, nil
+	}
+
+	opt := ses.Peer().(socketOpt)
+
+	// 有读超时时，设置超时
+	opt.ApplySocketReadTimeout(conn, func() {
+
+		msg, err = util.RecvLTVPacket(conn, opt.MaxPacketSize())
+
+	})
+
+	return
+}
+
+func (svcMessageTransmitter) OnSendMessage(ses cellnet.Session, msg interface{}) (err error) {
+
+	conn := meshutil.SessionConn(ses)
+
+	// 转换错误，或者连接已经关闭时退出
+	if conn == nil {
+		return nil
+	}
+
+	opt := ses.Peer().(socketOpt)
+
+	// 有写超时时，设置超时
+	opt.ApplySocketWriteTimeout(conn, func() {
+
+		err = util.SendLTVPacket(conn, ses.(cellnet.ContextSet), msg)
+
+	})
+
+	return
+}
@@ -0,0 +1,187 @@
+package service
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"github.com/bobwong89757/cellmesh/discovery"
+	"github.com/bobwong89757/cellmesh/util"
+	"github.com/bobwong89757/cellnet"
+	"github.com/bobwong89757/cellnet/peer"
+	"github.com/bobwong89757/cellnet/proc"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert 生成证书及私钥并写入PEM文件，parent为nil时生成自签名的CA
+func writeTestCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:     []string{"localhost"},
+	}
+
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert, key
+}
+
+// dialSvc 使用tcp.svc处理器建立服务连接，返回对方是否收到了身份确认
+func dialSvc(t *testing.T, serverConfig, clientConfig *tls.Config) bool {
+	return dialSvcHost(t, "127.0.0.1", serverConfig, clientConfig)
+}
+
+// dialSvcHost 与dialSvc相同，Connector使用host连接，host为空时连接地址形如":port"
+func dialSvcHost(t *testing.T, host string, serverConfig, clientConfig *tls.Config) bool {
+
+	identified := make(chan string, 1)
+
+	queue := cellnet.NewEventQueue()
+	queue.StartLoop()
+	defer queue.StopLoop()
+
+	SetTLSConfig(serverConfig)
+	acceptor := peer.NewGenericPeer("tcp.Acceptor", "tlsserver", ":0", queue)
+	proc.BindProcessorHandler(acceptor, "tcp.svc", func(ev cellnet.Event) {
+		if msg, ok := ev.Message().(*ServiceIdentifyACK); ok {
+			identified <- msg.SvcName
+		}
+	})
+	acceptor.Start()
+	defer acceptor.Stop()
+
+	addr := fmt.Sprintf("%s:%d", host, acceptor.(cellnet.TCPAcceptor).Port())
+
+	SetTLSConfig(clientConfig)
+	connector := peer.NewGenericPeer("tcp.Connector", "tlsclient", addr, queue)
+	connector.(cellnet.ContextSet).SetContext("sd", &discovery.ServiceDesc{Name: "tlsserver", ID: "tlsserver#0"})
+	proc.BindProcessorHandler(connector, "tcp.svc", func(ev cellnet.Event) {})
+	connector.Start()
+	defer connector.Stop()
+
+	SetTLSConfig(nil)
+
+	select {
+	case <-identified:
+		return true
+	case <-time.After(time.Second):
+		return false
+	}
+}
+
+func TestServiceTLS(t *testing.T) {
+
+	dir := t.TempDir()
+
+	ca, caKey := writeTestCert(t, dir, "ca", nil, nil)
+	writeTestCert(t, dir, "server", ca, caKey)
+	writeTestCert(t, dir, "client", ca, caKey)
+
+	load := func(name string) *tls.Config {
+
+		var certFile, keyFile string
+		if name != "" {
+			certFile = filepath.Join(dir, name+".crt")
+			keyFile = filepath.Join(dir, name+".key")
+		}
+
+		config, err := meshutil.LoadTLSConfig(certFile, keyFile, filepath.Join(dir, "ca.crt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return config
+	}
+
+	if !dialSvc(t, load("server"), load("client")) {
+		t.Fatal("mutual tls connect failed")
+	}
+
+	// 没有客户端证书时，服务器拒绝连接
+	if dialSvc(t, load("server"), load("")) {
+		t.Fatal("client without certificate should be rejected")
+	}
+
+	// 明文客户端无法与TLS服务器通信
+	if dialSvc(t, load("server"), nil) {
+		t.Fatal("plaintext client should be rejected")
+	}
+
+	loadOption := func(name string, opt meshutil.TLSOption) *tls.Config {
+
+		if name != "" {
+			opt.CertFile = filepath.Join(dir, name+".crt")
+			opt.KeyFile = filepath.Join(dir, name+".key")
+		}
+
+		opt.CAFile = filepath.Join(dir, "ca.crt")
+
+		config, err := meshutil.LoadTLSConfigOption(opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return config
+	}
+
+	// 不要求客户端证书时，只校验服务器证书
+	if !dialSvc(t, loadOption("server", meshutil.TLSOption{}), load("")) {
+		t.Fatal("client without certificate should connect when client auth is off")
+	}
+
+	// 地址没有主机名时，使用localhost校验服务器证书
+	if !dialSvcHost(t, "", load("server"), load("client")) {
+		t.Fatal("connect without host should verify localhost")
+	}
+
+	// 指定的服务器名称与证书不符
+	if dialSvc(t, load("server"), loadOption("client", meshutil.TLSOption{ServerName: "other"})) {
+		t.Fatal("mismatched server name should be rejected")
+	}
+
+	if _, err := meshutil.LoadTLSConfigOption(meshutil.TLSOption{ClientAuth: true}); err != meshutil.ErrClientAuthRequireCA {
+		t.Fatalf("expect client auth require ca, got %v", err)
+	}
+}
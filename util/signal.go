@@ -0,0 +1,16 @@
+package meshutil
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// WaitExitSignal 等待退出信号
+// 阻塞当前goroutine，直到收到SIGTERM、SIGINT或SIGQUIT信号
+func WaitExitSignal() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
+
+	<-ch
+}
@@ -0,0 +1,208 @@
+package meshutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"github.com/bobwong89757/cellnet"
+	"net"
+	"os"
+	"sync"
+)
+
+var (
+	ErrInvalidCA           = errors.New("no certificate found in ca file")
+	ErrClientAuthRequireCA = errors.New("client auth requires ca file")
+)
+
+// TLSOption 是LoadTLSConfigOption的选项
+type TLSOption struct {
+	CertFile   string // 证书文件，PEM格式，为空时不使用证书
+	KeyFile    string // 私钥文件，PEM格式
+	CAFile     string // 用于校验对方证书的CA文件，为空时Connector使用系统CA
+	ServerName string // Connector校验服务器证书使用的名称，为空时使用连接地址中的主机名，主机名为空时使用localhost
+	ClientAuth bool   // Acceptor是否要求并使用CAFile校验客户端证书(双向TLS)，需要设置CAFile
+}
+
+// peerTLS 是保存在Peer上下文中的TLS配置及已包装的连接
+type peerTLS struct {
+	config *tls.Config
+	conns  sync.Map // 会话ID对应的*sessionTLSConn
+}
+
+// sessionTLSConn 是会话当前连接包装后的TLS连接
+type sessionTLSConn struct {
+	raw     net.Conn
+	tlsConn *tls.Conn
+}
+
+// LoadTLSConfig 从文件加载TLS配置，设置了CA时Acceptor要求并校验客户端证书
+// 同一份配置可同时用于Acceptor及Connector：
+// Acceptor使用证书作为服务器证书，Connector使用CA校验服务器证书，有证书时作为客户端证书
+// 不需要双向TLS时使用LoadTLSConfigOption
+// 参数:
+//   - certFile: 证书文件，PEM格式，为空时不使用证书
+//   - keyFile: 私钥文件，PEM格式
+//   - caFile: 用于校验对方证书的CA文件，为空时Connector使用系统CA，Acceptor不校验客户端
+// 返回:
+//   - *tls.Config: TLS配置
+//   - error: 读取或解析失败时返回错误
+func LoadTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+
+	return LoadTLSConfigOption(TLSOption{
+		CertFile:   certFile,
+		KeyFile:    keyFile,
+		CAFile:     caFile,
+		ClientAuth: caFile != "",
+	})
+}
+
+// LoadTLSConfigOption 按选项从文件加载TLS配置
+// 参数:
+//   - opt: 证书、CA、服务器名称及是否要求客户端证书
+// 返回:
+//   - *tls.Config: TLS配置
+//   - error: 读取或解析失败，或要求客户端证书而没有设置CA时返回错误
+func LoadTLSConfigOption(opt TLSOption) (*tls.Config, error) {
+
+	if opt.ClientAuth && opt.CAFile == "" {
+		return nil, ErrClientAuthRequireCA
+	}
+
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: opt.ServerName,
+	}
+
+	if opt.CertFile != "" {
+
+		cert, err := tls.LoadX509KeyPair(opt.CertFile, opt.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if opt.CAFile != "" {
+
+		data, err := os.ReadFile(opt.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, ErrInvalidCA
+		}
+
+		config.RootCAs = pool
+
+		if opt.ClientAuth {
+			config.ClientCAs = pool
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	return config, nil
+}
+
+// SetPeerTLS 为Peer开启TLS，需要在Peer.Start之前调用
+// 只对收发时调用SessionConn的传输器生效
+// 参数:
+//   - p: tcp.Acceptor或tcp.Connector
+//   - config: TLS配置，为nil时不开启
+func SetPeerTLS(p cellnet.Peer, config *tls.Config) {
+
+	if config == nil {
+		return
+	}
+
+	p.(cellnet.ContextSet).SetContext("tls", &peerTLS{config: config})
+}
+
+// SessionConn 获取会话用于收发的连接
+// Peer开启了TLS时，首次调用会将原始连接包装为TLS连接，握手在首次读写时进行
+// 包装后的连接按会话保存在Peer中，各会话的收发互不阻塞
+// 参数:
+//   - ses: tcp会话
+// 返回:
+//   - net.Conn: 用于收发的连接，连接已关闭时返回nil
+func SessionConn(ses cellnet.Session) net.Conn {
+
+	conn, ok := ses.Raw().(net.Conn)
+	if !ok || conn == nil {
+		return nil
+	}
+
+	var pt *peerTLS
+	if !ses.Peer().(cellnet.ContextSet).FetchContext("tls", &pt) || pt == nil {
+		return conn
+	}
+
+	// Connector重连时复用会话，需要确认包装的是当前连接
+	if v, ok := pt.conns.Load(ses.ID()); ok && v.(*sessionTLSConn).raw == conn {
+		return v.(*sessionTLSConn).tlsConn
+	}
+
+	entry := &sessionTLSConn{raw: conn}
+
+	// Connector同样实现了TCPAcceptor接口，需要按Connector区分
+	if _, isConnector := ses.Peer().(cellnet.TCPConnector); isConnector {
+
+		config := pt.config
+
+		// 未指定时，使用连接地址校验服务器证书，如":8900"没有主机名时使用localhost
+		if config.ServerName == "" {
+			config = config.Clone()
+			config.ServerName, _, _ = net.SplitHostPort(ses.Peer().(cellnet.PeerProperty).Address())
+			if config.ServerName == "" {
+				config.ServerName = "localhost"
+			}
+		}
+
+		entry.tlsConn = tls.Client(conn, config)
+	} else {
+		entry.tlsConn = tls.Server(conn, pt.config)
+	}
+
+	// 收发协程可能同时首次调用，只保留一个包装
+	for {
+
+		v, loaded := pt.conns.LoadOrStore(ses.ID(), entry)
+		if !loaded {
+			break
+		}
+
+		old := v.(*sessionTLSConn)
+		if old.raw == conn {
+			return old.tlsConn
+		}
+
+		if pt.conns.CompareAndSwap(ses.ID(), old, entry) {
+			break
+		}
+	}
+
+	pt.removeClosed(ses.Peer())
+
+	return entry.tlsConn
+}
+
+// removeClosed 移除已经从Peer中移除的会话的连接，新连接包装时调用
+func (self *peerTLS) removeClosed(p cellnet.Peer) {
+
+	accessor, ok := p.(cellnet.SessionAccessor)
+	if !ok {
+		return
+	}
+
+	self.conns.Range(func(key, value interface{}) bool {
+
+		if accessor.GetSession(key.(int64)) == nil {
+			self.conns.Delete(key)
+		}
+
+		return true
+	})
+}